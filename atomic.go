@@ -0,0 +1,134 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continuity
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	driverpkg "github.com/containerd/continuity/driver"
+)
+
+// ApplyManifestAtomic applies the manifest to a new directory next to root
+// and then swaps it into place, so that consumers of root never observe a
+// partially applied manifest. Unlike ApplyManifest, it always materializes
+// every resource from scratch, so the context options must provide the
+// content of every regular file. The previous contents of root, if any, are
+// removed once the swap is done. The mode and ownership of root are kept.
+// The apply options are passed on to ApplyManifest. Since the new directory
+// is created and swapped on the local filesystem, options.Driver must be nil
+// or the local driver.
+//
+// On Linux, an existing root is exchanged with the new directory in a
+// single rename. Elsewhere, root is briefly missing while it is replaced,
+// but is never seen half applied.
+func ApplyManifestAtomic(root string, manifest *Manifest, options ContextOptions, opts ...ApplyOpt) (err error) {
+	if options.Driver != nil && options.Driver != driverpkg.LocalDriver {
+		return fmt.Errorf("atomic apply with %T: %w", options.Driver, ErrNotSupported)
+	}
+
+	root, err = filepath.Abs(root)
+	if err != nil {
+		return err
+	}
+
+	staging, err := os.MkdirTemp(filepath.Dir(root), "."+filepath.Base(root)+".continuity-")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// Whatever is left at the staging path is either the aborted apply
+		// or the previous root.
+		if rerr := os.RemoveAll(staging); err == nil && rerr != nil {
+			err = rerr
+		}
+	}()
+
+	fi, err := os.Lstat(root)
+	switch {
+	case err == nil:
+		if !fi.IsDir() {
+			return &os.PathError{Op: "apply", Path: root, Err: errors.New("not a directory")}
+		}
+		if err := copyRootMetadata(staging, fi); err != nil {
+			return err
+		}
+	case os.IsNotExist(err):
+		if err := os.Chmod(staging, 0o755); err != nil {
+			return err
+		}
+		fi = nil
+	default:
+		return err
+	}
+
+	ctx, err := NewContextWithOptions(staging, options)
+	if err != nil {
+		return err
+	}
+
+	if err := ApplyManifest(ctx, manifest, opts...); err != nil {
+		return err
+	}
+
+	if fi == nil {
+		return os.Rename(staging, root)
+	}
+
+	if err := exchange(staging, root); err == nil {
+		return nil
+	} else if !errors.Is(err, ErrNotSupported) {
+		return fmt.Errorf("failed to swap %s into place: %w", root, err)
+	}
+
+	// Without an atomic exchange, move the old root out of the way first.
+	old := staging + ".old"
+	if err := os.Rename(root, old); err != nil {
+		return err
+	}
+	if err := os.Rename(staging, root); err != nil {
+		if rerr := os.Rename(old, root); rerr != nil {
+			return fmt.Errorf("failed to restore %s from %s after %v: %w", root, old, err, rerr)
+		}
+		return err
+	}
+
+	return os.Rename(old, staging)
+}
+
+// copyRootMetadata gives the directory dir the mode and ownership of the
+// root described by fi.
+func copyRootMetadata(dir string, fi os.FileInfo) error {
+	if err := os.Chmod(dir, fi.Mode()&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err != nil {
+		return err
+	}
+
+	if runtime.GOOS == "windows" {
+		// Ownership is not represented in the manifest on Windows.
+		return nil
+	}
+
+	base, err := newBaseResource(dir, fi)
+	if err != nil {
+		return err
+	}
+
+	return os.Lchown(dir, int(base.UID()), int(base.GID()))
+}
@@ -0,0 +1,252 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continuity
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// specialModeBits are the setuid, setgid and sticky bits of modes.
+const specialModeBits = os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+
+// SpecialMode is a path carrying the setuid, setgid or sticky bits.
+type SpecialMode struct {
+	Path string
+	Mode os.FileMode
+}
+
+// SpecialModes returns the paths of the resources of the manifest m that carry
+// the setuid, setgid or sticky bits, in order.
+func SpecialModes(m *Manifest) []SpecialMode {
+	var modes []SpecialMode
+	for _, r := range m.Resources {
+		if r.Mode()&specialModeBits == 0 {
+			continue
+		}
+		for _, p := range resourcePaths(r) {
+			modes = append(modes, SpecialMode{Path: p, Mode: r.Mode()})
+		}
+	}
+	sort.Slice(modes, func(i, j int) bool { return modes[i].Path < modes[j].Path })
+	return modes
+}
+
+// SpecialModeChange describes a path whose setuid, setgid or sticky bits
+// differ between a manifest and a context.
+type SpecialModeChange struct {
+	Path string
+
+	// Expected holds the bits of the path in the manifest, and Actual those
+	// of the path in the context. Either is zero if the path has no bits or
+	// is absent.
+	Expected os.FileMode
+	Actual   os.FileMode
+
+	// Unexpected is set for paths that are not in the manifest at all.
+	Unexpected bool
+}
+
+func (c SpecialModeChange) String() string {
+	switch {
+	case c.Unexpected:
+		return fmt.Sprintf("%s: unexpected %s", c.Path, specialModeString(c.Actual))
+	case c.Actual == 0:
+		return fmt.Sprintf("%s: lost %s", c.Path, specialModeString(c.Expected))
+	}
+	return fmt.Sprintf("%s: %s→%s", c.Path, specialModeString(c.Expected), specialModeString(c.Actual))
+}
+
+func specialModeString(mode os.FileMode) string {
+	var s string
+	for _, bit := range []struct {
+		mode os.FileMode
+		name string
+	}{
+		{os.ModeSetuid, "setuid"},
+		{os.ModeSetgid, "setgid"},
+		{os.ModeSticky, "sticky"},
+	} {
+		if mode&bit.mode != 0 {
+			if s != "" {
+				s += ","
+			}
+			s += bit.name
+		}
+	}
+	if s == "" {
+		return "none"
+	}
+	return s
+}
+
+// AuditSpecialModes walks the context and returns the paths whose setuid,
+// setgid or sticky bits differ from those in the manifest m, in order. Unlike
+// verification, it also looks at paths that are not in the manifest, as new
+// setuid and setgid files are a primary sign of compromise.
+func AuditSpecialModes(ctx Context, m *Manifest) ([]SpecialModeChange, error) {
+	expected := map[string]os.FileMode{}
+	for _, r := range m.Resources {
+		for _, p := range resourcePaths(r) {
+			expected[p] = r.Mode() & specialModeBits
+		}
+	}
+
+	var (
+		changes []SpecialModeChange
+		seen    = map[string]bool{}
+	)
+	if err := ctx.Walk(func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return fmt.Errorf("error walking %s: %w", p, err)
+		}
+		if p == string(os.PathSeparator) {
+			return nil
+		}
+		seen[p] = true
+
+		actual := fi.Mode() & specialModeBits
+		mode, ok := expected[p]
+		if (ok && mode != actual) || (!ok && actual != 0) {
+			changes = append(changes, SpecialModeChange{Path: p, Expected: mode, Actual: actual, Unexpected: !ok})
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	for p, mode := range expected {
+		if mode != 0 && !seen[p] {
+			changes = append(changes, SpecialModeChange{Path: p, Expected: mode})
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+	return changes, nil
+}
+
+// Finding is a problem found in a manifest by a Rule.
+type Finding struct {
+	// Rule is the name of the rule that found the problem.
+	Rule    string
+	Path    string
+	Message string
+}
+
+func (f Finding) String() string {
+	return fmt.Sprintf("%s %s: %s", f.Rule, f.Path, f.Message)
+}
+
+// Rule is a policy that resources of manifests are checked against by Audit.
+type Rule struct {
+	Name string
+
+	// Check returns the problems found with the resource, with the Rule of
+	// the findings left for Audit to fill in.
+	Check func(Resource) []Finding
+}
+
+// Audit checks the resources of the manifest m against the rules, turning
+// the manifest into a lightweight hardening scan, and returns the problems
+// found, in the order of the resources and of the rules.
+func Audit(m *Manifest, rules ...Rule) []Finding {
+	var findings []Finding
+	for _, r := range m.Resources {
+		for _, rule := range rules {
+			for _, f := range rule.Check(r) {
+				f.Rule = rule.Name
+				findings = append(findings, f)
+			}
+		}
+	}
+	return findings
+}
+
+// DefaultRules returns the rules that apply to most root filesystems:
+// WorldWritable and ExecutablesIn the usual temporary directories.
+func DefaultRules() []Rule {
+	return []Rule{WorldWritable(), ExecutablesIn()}
+}
+
+// WorldWritable returns a Rule finding files and directories that anyone may
+// write to. Directories with the sticky bit, such as /tmp, are allowed, and
+// symlinks, whose permissions are meaningless, are ignored.
+func WorldWritable() Rule {
+	return Rule{
+		Name: "world-writable",
+		Check: func(r Resource) []Finding {
+			mode := r.Mode()
+			switch {
+			case mode&0o002 == 0, mode&os.ModeSymlink != 0:
+				return nil
+			case mode.IsDir() && mode&os.ModeSticky != 0:
+				return nil
+			}
+			return []Finding{{Path: r.Path(), Message: fmt.Sprintf("%v is writable by anyone", mode)}}
+		},
+	}
+}
+
+// AllowedOwners returns a Rule finding resources owned by a uid other than
+// the given ones.
+func AllowedOwners(uids ...int64) Rule {
+	allowed := map[int64]bool{}
+	for _, uid := range uids {
+		allowed[uid] = true
+	}
+	return Rule{
+		Name: "owner",
+		Check: func(r Resource) []Finding {
+			if allowed[r.UID()] {
+				return nil
+			}
+			return []Finding{{Path: r.Path(), Message: fmt.Sprintf("owned by unexpected uid %d", r.UID())}}
+		},
+	}
+}
+
+// ExecutablesIn returns a Rule finding executable files below the given
+// directories, which default to the usual temporary directories: /tmp,
+// /var/tmp and /dev/shm.
+func ExecutablesIn(dirs ...string) Rule {
+	if len(dirs) == 0 {
+		dirs = []string{"/tmp", "/var/tmp", "/dev/shm"}
+	}
+	roots := make([]string, len(dirs))
+	for i, dir := range dirs {
+		roots[i] = filepath.Join(string(os.PathSeparator), dir)
+	}
+	return Rule{
+		Name: "executable",
+		Check: func(r Resource) []Finding {
+			if !r.Mode().IsRegular() || r.Mode()&0o111 == 0 {
+				return nil
+			}
+			var findings []Finding
+			for _, p := range resourcePaths(r) {
+				for _, dir := range roots {
+					if _, ok := below(dir, p); ok {
+						findings = append(findings, Finding{Path: p, Message: fmt.Sprintf("executable in %s", dir)})
+					}
+				}
+			}
+			return findings
+		},
+	}
+}
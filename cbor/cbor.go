@@ -0,0 +1,301 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package cbor encodes manifests in CBOR. It is a module of its own, so that
+// the core module does not depend on a CBOR library.
+package cbor
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+
+	"github.com/containerd/continuity"
+	pb "github.com/containerd/continuity/proto"
+	"github.com/fxamacker/cbor/v2"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+var (
+	// cborEnc follows the core deterministic encoding of RFC 8949, so that
+	// the same manifest is always encoded the same way.
+	cborEnc, _ = cbor.CoreDetEncOptions().EncMode()
+
+	cborDec, _ = cbor.DecOptions{
+		DupMapKey:      cbor.DupMapKeyEnforcedAPF,
+		DefaultMapType: reflect.TypeOf(map[uint64]interface{}(nil)),
+	}.DecMode()
+)
+
+// Marshal encodes the manifest in CBOR, as a compact alternative to
+// protobuf for consumers without a protobuf toolchain. The encoding mirrors
+// the protobuf message: messages are maps from the numbers of their
+// populated fields, in manifest.proto, to their values. Repeated fields are
+// arrays, enums are integers, and bytes are byte strings. Maps are arrays of
+// their entries, sorted by key, as protobuf encodes them: maps from 1 to the
+// key and 2 to the value.
+func Marshal(m *continuity.Manifest) ([]byte, error) {
+	v, err := cborMessage(continuity.ToProto(m).ProtoReflect())
+	if err != nil {
+		return nil, err
+	}
+	return cborEnc.Marshal(v)
+}
+
+// Unmarshal decodes a manifest encoded by Marshal. Unknown fields are
+// rejected rather than dropped.
+func Unmarshal(p []byte, opts ...continuity.UnmarshalOpt) (*continuity.Manifest, error) {
+	var v map[uint64]interface{}
+	if err := cborDec.Unmarshal(p, &v); err != nil {
+		return nil, err
+	}
+
+	var bm pb.Manifest
+	if err := fromCBOR(bm.ProtoReflect(), v); err != nil {
+		return nil, err
+	}
+
+	return continuity.FromProto(&bm, opts...)
+}
+
+func cborMessage(m protoreflect.Message) (map[uint64]interface{}, error) {
+	v := map[uint64]interface{}{}
+
+	var err error
+	m.Range(func(fd protoreflect.FieldDescriptor, fv protoreflect.Value) bool {
+		if fd.IsMap() {
+			v[uint64(fd.Number())], err = cborMap(fd, fv.Map())
+			return err == nil
+		}
+
+		if !fd.IsList() {
+			v[uint64(fd.Number())], err = cborValue(fd, fv)
+			return err == nil
+		}
+
+		l := fv.List()
+		items := make([]interface{}, l.Len())
+		for i := range items {
+			if items[i], err = cborValue(fd, l.Get(i)); err != nil {
+				return false
+			}
+		}
+		v[uint64(fd.Number())] = items
+		return true
+	})
+	return v, err
+}
+
+func cborMap(fd protoreflect.FieldDescriptor, m protoreflect.Map) ([]interface{}, error) {
+	var keys []protoreflect.MapKey
+	m.Range(func(k protoreflect.MapKey, _ protoreflect.Value) bool {
+		keys = append(keys, k)
+		return true
+	})
+	sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+
+	entries := make([]interface{}, len(keys))
+	for i, k := range keys {
+		key, err := cborValue(fd.MapKey(), k.Value())
+		if err != nil {
+			return nil, err
+		}
+		value, err := cborValue(fd.MapValue(), m.Get(k))
+		if err != nil {
+			return nil, err
+		}
+		entries[i] = map[uint64]interface{}{1: key, 2: value}
+	}
+	return entries, nil
+}
+
+func cborValue(fd protoreflect.FieldDescriptor, v protoreflect.Value) (interface{}, error) {
+	switch fd.Kind() {
+	case protoreflect.MessageKind:
+		return cborMessage(v.Message())
+	case protoreflect.EnumKind:
+		return int64(v.Enum()), nil
+	}
+	return v.Interface(), nil
+}
+
+// fromCBOR sets the fields of the message m from their CBOR values in v.
+func fromCBOR(m protoreflect.Message, v map[uint64]interface{}) error {
+	fields := m.Descriptor().Fields()
+	for num, fv := range v {
+		fd := fields.ByNumber(protoreflect.FieldNumber(num))
+		if fd == nil {
+			return fmt.Errorf("unknown field %d of %s in CBOR", num, m.Descriptor().FullName())
+		}
+
+		if fd.IsMap() {
+			if err := fromCBORMap(fd, m.Mutable(fd).Map(), fv); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if !fd.IsList() {
+			if fd.Kind() == protoreflect.MessageKind {
+				mv, ok := fv.(map[uint64]interface{})
+				if !ok {
+					return fmt.Errorf("invalid CBOR value for %s: %T", fd.FullName(), fv)
+				}
+				if err := fromCBOR(m.Mutable(fd).Message(), mv); err != nil {
+					return err
+				}
+				continue
+			}
+
+			val, err := cborScalar(fd, fv)
+			if err != nil {
+				return err
+			}
+			m.Set(fd, val)
+			continue
+		}
+
+		items, ok := fv.([]interface{})
+		if !ok {
+			return fmt.Errorf("invalid CBOR value for %s: %T", fd.FullName(), fv)
+		}
+		l := m.Mutable(fd).List()
+		for _, item := range items {
+			if fd.Kind() == protoreflect.MessageKind {
+				mv, ok := item.(map[uint64]interface{})
+				if !ok {
+					return fmt.Errorf("invalid CBOR value for %s: %T", fd.FullName(), item)
+				}
+				elem := l.NewElement()
+				if err := fromCBOR(elem.Message(), mv); err != nil {
+					return err
+				}
+				l.Append(elem)
+				continue
+			}
+
+			val, err := cborScalar(fd, item)
+			if err != nil {
+				return err
+			}
+			l.Append(val)
+		}
+	}
+	return nil
+}
+
+// fromCBORMap sets the entries of the map field fd from their CBOR value v.
+func fromCBORMap(fd protoreflect.FieldDescriptor, m protoreflect.Map, v interface{}) error {
+	entries, ok := v.([]interface{})
+	if !ok {
+		return fmt.Errorf("invalid CBOR value for %s: %T", fd.FullName(), v)
+	}
+	for _, entry := range entries {
+		ev, ok := entry.(map[uint64]interface{})
+		if !ok {
+			return fmt.Errorf("invalid CBOR value for %s: %T", fd.FullName(), entry)
+		}
+		for num := range ev {
+			if num != 1 && num != 2 {
+				return fmt.Errorf("unknown field %d of %s entry in CBOR", num, fd.FullName())
+			}
+		}
+
+		key := fd.MapKey().Default()
+		if kv, ok := ev[1]; ok {
+			var err error
+			if key, err = cborScalar(fd.MapKey(), kv); err != nil {
+				return err
+			}
+		}
+
+		value := m.NewValue()
+		if vv, ok := ev[2]; ok {
+			if fd.MapValue().Kind() == protoreflect.MessageKind {
+				mv, ok := vv.(map[uint64]interface{})
+				if !ok {
+					return fmt.Errorf("invalid CBOR value for %s: %T", fd.FullName(), vv)
+				}
+				if err := fromCBOR(value.Message(), mv); err != nil {
+					return err
+				}
+			} else {
+				var err error
+				if value, err = cborScalar(fd.MapValue(), vv); err != nil {
+					return err
+				}
+			}
+		}
+		m.Set(key.MapKey(), value)
+	}
+	return nil
+}
+
+// cborScalar converts the CBOR value v of a field that is not a message.
+func cborScalar(fd protoreflect.FieldDescriptor, v interface{}) (protoreflect.Value, error) {
+	invalid := fmt.Errorf("invalid CBOR value for %s: %v", fd.FullName(), v)
+
+	switch fd.Kind() {
+	case protoreflect.BoolKind:
+		if b, ok := v.(bool); ok {
+			return protoreflect.ValueOfBool(b), nil
+		}
+	case protoreflect.StringKind:
+		if s, ok := v.(string); ok {
+			return protoreflect.ValueOfString(s), nil
+		}
+	case protoreflect.BytesKind:
+		if b, ok := v.([]byte); ok {
+			return protoreflect.ValueOfBytes(b), nil
+		}
+	case protoreflect.Uint32Kind:
+		if u, ok := v.(uint64); ok && u <= math.MaxUint32 {
+			return protoreflect.ValueOfUint32(uint32(u)), nil
+		}
+	case protoreflect.Uint64Kind:
+		if u, ok := v.(uint64); ok {
+			return protoreflect.ValueOfUint64(u), nil
+		}
+	case protoreflect.Int64Kind, protoreflect.Int32Kind, protoreflect.EnumKind:
+		var i int64
+		switch n := v.(type) {
+		case uint64:
+			if n > math.MaxInt64 {
+				return protoreflect.Value{}, invalid
+			}
+			i = int64(n)
+		case int64:
+			i = n
+		default:
+			return protoreflect.Value{}, invalid
+		}
+
+		switch fd.Kind() {
+		case protoreflect.Int64Kind:
+			return protoreflect.ValueOfInt64(i), nil
+		case protoreflect.Int32Kind:
+			if i >= math.MinInt32 && i <= math.MaxInt32 {
+				return protoreflect.ValueOfInt32(int32(i)), nil
+			}
+		default:
+			if i >= math.MinInt32 && i <= math.MaxInt32 {
+				return protoreflect.ValueOfEnum(protoreflect.EnumNumber(i)), nil
+			}
+		}
+	}
+	return protoreflect.Value{}, invalid
+}
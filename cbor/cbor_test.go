@@ -0,0 +1,79 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cbor
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/containerd/continuity"
+	"github.com/opencontainers/go-digest"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestRoundTrip(t *testing.T) {
+	attrs := continuity.Attributes{
+		Mode:           os.ModeSetgid | 0o640,
+		UID:            1000,
+		GID:            100,
+		XAttrs:         map[string][]byte{"user.a": {0, 1, 0xff}, "user.b": nil},
+		BirthTime:      time.Unix(1700000000, 42),
+		FileAttributes: continuity.FileAttributeHidden,
+		Annotations:    map[string]string{"org.example.package": "example", "org.example.b": "b"},
+	}
+	must := func(r continuity.Resource, err error) continuity.Resource {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+	resources := []continuity.Resource{
+		must(continuity.NewRegularFile([]string{"/a", "/b"}, attrs, 1<<40, digest.FromString("a"))),
+		must(continuity.NewDirectory("/dir", continuity.Attributes{Mode: os.ModeSticky | 0o1777})),
+		must(continuity.NewSymLink("/link", continuity.Attributes{Mode: 0o777}, "a")),
+		must(continuity.NewDevice([]string{"/null"}, continuity.Attributes{Mode: 0o666}, true, 1, 3)),
+		must(continuity.NewNamedPipe([]string{"/fifo"}, continuity.Attributes{Mode: 0o600})),
+	}
+	m := &continuity.Manifest{Resources: resources}
+
+	p, err := Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, err := Marshal(m); err != nil || !bytes.Equal(p, again) {
+		t.Fatalf("expected a stable CBOR encoding: %v", err)
+	}
+	decoded, err := Unmarshal(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !proto.Equal(continuity.ToProto(m), continuity.ToProto(decoded)) {
+		t.Fatal("manifest differs after a round trip")
+	}
+	for i, r := range decoded.Resources {
+		if r.Mode() != resources[i].Mode() {
+			t.Fatalf("%s: mode %v != %v", r.Path(), r.Mode(), resources[i].Mode())
+		}
+	}
+
+	if _, err := Unmarshal([]byte{0xa1, 0x18, 0x63, 0x01}); err == nil { // {99: 1}
+		t.Fatal("expected unknown fields to be rejected")
+	}
+}
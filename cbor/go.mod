@@ -0,0 +1,20 @@
+module github.com/containerd/continuity/cbor
+
+go 1.19
+
+require (
+	github.com/containerd/continuity v0.0.0-00010101000000-000000000000 // see replace
+	github.com/fxamacker/cbor/v2 v2.5.0
+	github.com/opencontainers/go-digest v1.0.0
+	google.golang.org/protobuf v1.33.0
+)
+
+require (
+	github.com/Microsoft/go-winio v0.5.2 // indirect
+	github.com/google/go-cmp v0.6.0 // indirect
+	github.com/x448/float16 v0.8.4 // indirect
+	golang.org/x/sys v0.18.0 // indirect
+)
+
+// use local source for the main module
+replace github.com/containerd/continuity => ../
@@ -0,0 +1,107 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continuity
+
+import (
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// MarshalChecksums writes the regular files of the manifest to w in the
+// format of sha256sum and related tools, with the digest of each file of the
+// algorithm alg, so that the files can be checked with "sha256sum -c". One
+// line is written for each path of each file. The manifest paths are joined
+// to root, so that a root of "." checks the files from the manifest's root.
+// Names holding a backslash or a newline are escaped as GNU coreutils do.
+//
+// An error is returned if a file has no digest of the algorithm.
+func MarshalChecksums(w io.Writer, m *Manifest, alg digest.Algorithm, root string) error {
+	for _, resource := range m.Resources {
+		rf, ok := resource.(RegularFile)
+		if !ok {
+			continue
+		}
+
+		dgst, err := digestOf(rf, alg)
+		if err != nil {
+			return err
+		}
+
+		for _, fp := range rf.Paths() {
+			name, prefix := path.Join(root, fp), ""
+			if strings.ContainsAny(name, "\\\n") {
+				name = strings.NewReplacer("\\", "\\\\", "\n", "\\n").Replace(name)
+				prefix = "\\"
+			}
+			if _, err := fmt.Fprintf(w, "%s%s  %s\n", prefix, dgst.Encoded(), name); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// MarshalHashdeep writes the regular files of the manifest to w in the
+// format of hashdeep, with their size and SHA-256 digest, so that they can be
+// audited with "hashdeep -a -k". One record is written for each path of each
+// file. The manifest paths are joined to root, which should be the location
+// of the manifest's root as given to hashdeep.
+//
+// An error is returned if a file has no SHA-256 digest.
+func MarshalHashdeep(w io.Writer, m *Manifest, root string) error {
+	if _, err := io.WriteString(w, "%%%% HASHDEEP-1.0\n%%%% size,sha256,filename\n## Written by continuity\n##\n"); err != nil {
+		return err
+	}
+
+	for _, resource := range m.Resources {
+		rf, ok := resource.(RegularFile)
+		if !ok {
+			continue
+		}
+
+		dgst, err := digestOf(rf, digest.SHA256)
+		if err != nil {
+			return err
+		}
+
+		for _, fp := range rf.Paths() {
+			if _, err := fmt.Fprintf(w, "%d,%s,%s\n", rf.Size(), dgst.Encoded(), path.Join(root, fp)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// digestOf returns the digest of the algorithm alg of the regular file rf.
+func digestOf(rf RegularFile, alg digest.Algorithm) (digest.Digest, error) {
+	for _, dgst := range rf.Digests() {
+		if dgst.Algorithm() == alg {
+			if err := dgst.Validate(); err != nil {
+				return "", fmt.Errorf("invalid digest for resource %q: %w", rf.Path(), err)
+			}
+			return dgst, nil
+		}
+	}
+	return "", fmt.Errorf("no %s digest for resource %q", alg, rf.Path())
+}
@@ -19,34 +19,145 @@ package commands
 import (
 	"log"
 	"os"
+	"strconv"
+	"strings"
 
 	"github.com/containerd/continuity"
+	"github.com/containerd/continuity/content"
 	"github.com/spf13/cobra"
 )
 
+var applyCmdConfig struct {
+	progress    bool
+	dryRun      bool
+	atomic      bool
+	rollback    bool
+	format      string
+	content     string
+	umask       string
+	concurrency int
+}
+
 var ApplyCmd = &cobra.Command{
 	Use:   "apply <root> [<manifest>]",
 	Short: "Apply the manifest to the provided root",
 	Run: func(cmd *cobra.Command, args []string) {
 		root, path := args[0], args[1]
 
-		p, err := os.ReadFile(path)
+		p, err := readManifest(path)
 		if err != nil {
 			log.Fatalf("error reading manifest: %v", err)
 		}
 
-		m, err := continuity.Unmarshal(p)
+		// Manifests may come from anywhere, so paths leading outside of
+		// the root are refused before anything is applied.
+		m, err := continuity.Unmarshal(p, continuity.WithSafePaths())
 		if err != nil {
 			log.Fatalf("error unmarshaling manifest: %v", err)
 		}
 
-		ctx, err := continuity.NewContext(root)
+		options := continuity.ContextOptions{Logger: logrusLogger{}}
+		if applyCmdConfig.umask != "" {
+			mask, err := strconv.ParseUint(applyCmdConfig.umask, 8, 32)
+			if err != nil || os.FileMode(mask)&^os.ModePerm != 0 {
+				log.Fatalf("invalid umask %q", applyCmdConfig.umask)
+			}
+			options.ModeMask = os.FileMode(mask)
+		}
+		if applyCmdConfig.content != "" {
+			provider, cleanup, err := openContent(applyCmdConfig.content)
+			if err != nil {
+				log.Fatalf("error opening content: %v", err)
+			}
+			defer cleanup()
+			options.Provider = provider
+		}
+		done := withProgress(&options, applyCmdConfig.progress)
+		ctx, err := continuity.NewContextWithOptions(root, options)
 		if err != nil {
 			log.Fatalf("error getting context: %v", err)
 		}
 
-		if err := continuity.ApplyManifest(ctx, m); err != nil {
+		if applyCmdConfig.dryRun {
+			changes, err := continuity.Plan(ctx, m)
+			done()
+			if err != nil {
+				log.Fatalf("error planning manifest: %v", err)
+			}
+
+			enc, err := continuity.NewChangeEncoder(os.Stdout, continuity.Format(applyCmdConfig.format))
+			if err != nil {
+				log.Fatal(err)
+			}
+			for _, change := range changes {
+				if err := enc.Encode(change); err != nil {
+					log.Fatalf("error writing changes: %v", err)
+				}
+			}
+			return
+		}
+
+		applyOpts := []continuity.ApplyOpt{continuity.WithApplyConcurrency(applyCmdConfig.concurrency)}
+		if applyCmdConfig.atomic {
+			err = continuity.ApplyManifestAtomic(root, m, options, applyOpts...)
+		} else {
+			if applyCmdConfig.rollback {
+				applyOpts = append(applyOpts, continuity.WithRollback())
+			}
+			err = continuity.ApplyManifest(ctx, m, applyOpts...)
+		}
+		done()
+		if err != nil {
 			log.Fatalf("error applying manifest: %v", err)
 		}
 	},
 }
+
+func init() {
+	ApplyCmd.Flags().BoolVar(&applyCmdConfig.progress, "progress", false, "print progress to stderr")
+	ApplyCmd.Flags().BoolVar(&applyCmdConfig.atomic, "atomic", false, "apply to a new directory and swap it into place")
+	ApplyCmd.Flags().BoolVar(&applyCmdConfig.rollback, "rollback", false, "restore the root if the apply fails")
+	ApplyCmd.Flags().BoolVarP(&applyCmdConfig.dryRun, "dry-run", "n", false, "print the changes to make instead of making them")
+	ApplyCmd.Flags().StringVar(&applyCmdConfig.content, "content", "", "provide file content from a directory stored by build --store, an HTTP blob store URL, or a tar archive")
+	ApplyCmd.Flags().IntVarP(&applyCmdConfig.concurrency, "concurrency", "j", 1, "number of files to write at once")
+	ApplyCmd.Flags().StringVar(&applyCmdConfig.umask, "umask", "", "clear the permission bits of the octal mask from the recorded modes, rather than apply them exactly")
+	ApplyCmd.Flags().StringVar(&applyCmdConfig.format, "format", string(continuity.FormatText), "format of the changes printed by --dry-run: text, json or proto")
+}
+
+// openContent returns the provider of the content at source: an HTTP blob
+// store if it is an http or https URL, the content of a tar archive if it is
+// a file, and a content directory otherwise. Tar archives are imported into
+// a temporary directory, removed by cleanup.
+func openContent(source string) (_ continuity.ContentProvider, cleanup func(), err error) {
+	cleanup = func() {}
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		return content.NewHTTP(source, nil), cleanup, nil
+	}
+
+	fi, err := os.Stat(source)
+	if err != nil {
+		return nil, nil, err
+	}
+	if fi.IsDir() {
+		return content.NewDir(source), cleanup, nil
+	}
+
+	f, err := os.Open(source)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	dir, err := os.MkdirTemp("", "continuity-content-")
+	if err != nil {
+		return nil, nil, err
+	}
+	cleanup = func() { os.RemoveAll(dir) }
+
+	d := content.NewDir(dir)
+	if err := content.ImportTar(d, f); err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	return d, cleanup, nil
+}
@@ -0,0 +1,99 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/containerd/continuity"
+	"github.com/spf13/cobra"
+)
+
+var auditCmdConfig struct {
+	policy bool
+	uids   []int64
+	execIn []string
+}
+
+var AuditCmd = &cobra.Command{
+	Use:   "audit <manifest> [<root>]",
+	Short: "List the setuid, setgid and sticky entries of the manifest, or those of the root that differ from it",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) < 1 || len(args) > 2 {
+			log.Fatalln("please specify a manifest and optionally a root")
+		}
+
+		p, err := readManifest(args[0])
+		if err != nil {
+			log.Fatalf("error reading manifest: %v", err)
+		}
+
+		m, err := continuity.Unmarshal(p)
+		if err != nil {
+			log.Fatalf("error unmarshaling manifest: %v", err)
+		}
+
+		if auditCmdConfig.policy {
+			rules := []continuity.Rule{continuity.WorldWritable(), continuity.ExecutablesIn(auditCmdConfig.execIn...)}
+			if len(auditCmdConfig.uids) > 0 {
+				rules = append(rules, continuity.AllowedOwners(auditCmdConfig.uids...))
+			}
+			findings := continuity.Audit(m, rules...)
+			for _, f := range findings {
+				fmt.Println(f)
+			}
+			if len(findings) > 0 {
+				os.Exit(1)
+			}
+			return
+		}
+
+		if len(args) == 1 {
+			w := newTabwriter(os.Stdout)
+			defer w.Flush()
+
+			for _, s := range continuity.SpecialModes(m) {
+				fmt.Fprintf(w, "%v\t%s\n", s.Mode, s.Path)
+			}
+			return
+		}
+
+		ctx, err := continuity.NewContextWithOptions(args[1], continuity.ContextOptions{Logger: logrusLogger{}})
+		if err != nil {
+			log.Fatalf("error getting context: %v", err)
+		}
+
+		changes, err := continuity.AuditSpecialModes(ctx, m)
+		if err != nil {
+			log.Fatalf("error auditing root: %v", err)
+		}
+		for _, change := range changes {
+			fmt.Println(change)
+		}
+		if len(changes) > 0 {
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	AuditCmd.Flags().BoolVar(&auditCmdConfig.policy, "policy", false, "check the manifest against hardening rules instead")
+	AuditCmd.Flags().Int64SliceVar(&auditCmdConfig.uids, "allowed-uid", nil, "with --policy, uids allowed to own files")
+	AuditCmd.Flags().StringSliceVar(&auditCmdConfig.execIn, "no-exec", nil, "with --policy, directories not to hold executables (default /tmp,/var/tmp,/dev/shm)")
+}
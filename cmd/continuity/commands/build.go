@@ -19,14 +19,36 @@ package commands
 import (
 	"log"
 	"os"
+	"time"
 
 	"github.com/containerd/continuity"
+	"github.com/containerd/continuity/compression"
+	"github.com/containerd/continuity/content"
 	"github.com/spf13/cobra"
 )
 
 var (
 	buildCmdConfig struct {
-		format string
+		format        string
+		appleMetadata bool
+		oneFileSystem bool
+		skipVirtual   bool
+		subvolumes    bool
+		projectIDs    bool
+		birthTimes    bool
+		exclude       []string
+		limits        continuity.Limits
+		follow        bool
+		escape        string
+		retry         continuity.RetryPolicy
+		progress      bool
+		rateLimit     rateLimitFlags
+		journal       string
+		ssh           sshFlags
+		compress      string
+		store         string
+		provenance    bool
+		labels        map[string]string
 	}
 
 	BuildCmd = &cobra.Command{
@@ -37,28 +59,142 @@ var (
 				log.Fatalln("please specify a root")
 			}
 
-			ctx, err := continuity.NewContext(args[0])
+			options := continuity.ContextOptions{
+				AppleMetadata: buildCmdConfig.appleMetadata,
+				OneFileSystem: buildCmdConfig.oneFileSystem,
+				Subvolumes:    buildCmdConfig.subvolumes,
+				ProjectIDs:    buildCmdConfig.projectIDs,
+				BirthTimes:    buildCmdConfig.birthTimes,
+				Exclude:       buildCmdConfig.exclude,
+				Retry:         buildCmdConfig.retry,
+				Logger:        logrusLogger{},
+			}
+			if buildCmdConfig.follow {
+				options.FollowSymlinks = true
+				switch buildCmdConfig.escape {
+				case "scope":
+					options.SymlinkEscape = continuity.EscapeScope
+				case "keep":
+					options.SymlinkEscape = continuity.EscapeKeep
+				case "reject":
+					options.SymlinkEscape = continuity.EscapeReject
+				default:
+					log.Fatalf("unknown symlink escape policy %q", buildCmdConfig.escape)
+				}
+			}
+			// Reproducible builds clamp the times they record.
+			epoch, ok, err := continuity.SourceDateEpoch()
+			if err != nil {
+				log.Fatal(err)
+			}
+			if ok {
+				options.ClampTime = epoch
+			}
+			if buildCmdConfig.store != "" {
+				options.Sink = content.NewDir(buildCmdConfig.store)
+			}
+			if buildCmdConfig.skipVirtual {
+				options.SkipFilesystems = continuity.VirtualFilesystems
+			}
+
+			if err := buildCmdConfig.rateLimit.apply(&options); err != nil {
+				log.Fatal(err)
+			}
+
+			disconnect, err := buildCmdConfig.ssh.apply(&options)
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer disconnect()
+
+			done := withProgress(&options, buildCmdConfig.progress)
+			ctx, err := continuity.NewContextWithOptions(args[0], options)
 			if err != nil {
 				log.Fatalf("error creating path context: %v", err)
 			}
 
-			m, err := continuity.BuildManifest(ctx)
+			// Provenance differs between builds of the same tree, so it is
+			// only recorded on request. Labels alone are recorded as given.
+			var provenance *continuity.Provenance
+			if buildCmdConfig.provenance {
+				if provenance, err = continuity.NewProvenance(args[0]); err != nil {
+					log.Fatal(err)
+				}
+			}
+			if len(buildCmdConfig.labels) > 0 {
+				if provenance == nil {
+					provenance = &continuity.Provenance{}
+				}
+				provenance.Labels = buildCmdConfig.labels
+			}
+
+			var buildOpts []continuity.BuildOpt
+			if buildCmdConfig.journal != "" {
+				buildOpts = append(buildOpts, continuity.WithJournal(buildCmdConfig.journal))
+			}
+			if limits := buildCmdConfig.limits; limits.MaxDepth > 0 || limits.MaxEntries > 0 || limits.MaxFileSize > 0 {
+				buildOpts = append(buildOpts, continuity.WithLimits(limits))
+			}
+
+			if buildCmdConfig.format == "ndjson" {
+				if provenance != nil {
+					log.Fatalln("ndjson manifests have no header to record provenance in")
+				}
+				truncated, err := continuity.BuildNDJSON(ctx, os.Stdout, buildOpts...)
+				done()
+				if err != nil {
+					log.Fatalf("error generating manifest: %v", err)
+				}
+				if truncated {
+					log.Println("manifest truncated at the limits")
+				}
+				return
+			}
+
+			m, err := continuity.BuildManifest(ctx, buildOpts...)
+			done()
 			if err != nil {
 				log.Fatalf("error generating manifest: %v", err)
 			}
+			m.Provenance = provenance
 
-			p, err := continuity.Marshal(m)
-			if err != nil {
-				log.Fatalf("error marshaling manifest: %v", err)
+			if m.Header.Truncated {
+				log.Println("manifest truncated at the limits")
+			}
+			if n := continuity.Stats(m).Unstable; n > 0 {
+				log.Printf("%d files changed while they were read and are flagged as unstable", n)
 			}
 
-			if _, err := os.Stdout.Write(p); err != nil {
-				log.Fatalf("error writing to stdout: %v", err)
+			if err := compression.WriteManifest(os.Stdout, m, compression.Compression(buildCmdConfig.compress)); err != nil {
+				log.Fatalf("error writing manifest: %v", err)
 			}
 		},
 	}
 )
 
 func init() {
-	BuildCmd.Flags().StringVar(&buildCmdConfig.format, "format", "pb", "specify the output format of the manifest")
+	BuildCmd.Flags().StringVar(&buildCmdConfig.format, "format", "pb", "specify the output format of the manifest: pb, or ndjson to write a line of JSON for each resource as it is walked")
+	BuildCmd.Flags().BoolVar(&buildCmdConfig.appleMetadata, "apple-metadata", false, "capture resource forks and Finder metadata on darwin")
+	BuildCmd.Flags().BoolVarP(&buildCmdConfig.oneFileSystem, "one-file-system", "x", false, "do not cross filesystem boundaries")
+	BuildCmd.Flags().BoolVar(&buildCmdConfig.skipVirtual, "skip-virtual", false, "do not descend into procfs, sysfs and other virtual filesystems")
+	BuildCmd.Flags().BoolVar(&buildCmdConfig.subvolumes, "subvolumes", false, "record btrfs subvolume boundaries")
+	BuildCmd.Flags().BoolVar(&buildCmdConfig.projectIDs, "project-ids", false, "record project quota ids")
+	BuildCmd.Flags().BoolVar(&buildCmdConfig.birthTimes, "birth-times", false, "record file creation times where the filesystem provides them, clamped to SOURCE_DATE_EPOCH if set")
+	BuildCmd.Flags().StringSliceVar(&buildCmdConfig.exclude, "exclude", nil, "leave out paths matching the patterns, and directories matching those ending in a slash")
+	BuildCmd.Flags().BoolVarP(&buildCmdConfig.follow, "follow-symlinks", "L", false, "record what symbolic links lead to rather than the links")
+	BuildCmd.Flags().StringVar(&buildCmdConfig.escape, "symlink-escape", "scope", "with -L, how to handle links leading out of the root, one of scope, keep or reject")
+	BuildCmd.Flags().IntVar(&buildCmdConfig.retry.Attempts, "retries", 0, "read files that are busy or change while they are read again, up to the given number of times")
+	BuildCmd.Flags().DurationVar(&buildCmdConfig.retry.Backoff, "retry-backoff", 100*time.Millisecond, "delay before the first retry, doubled for each of the next ones")
+	BuildCmd.Flags().IntVar(&buildCmdConfig.limits.MaxDepth, "max-depth", 0, "fail on paths deeper than the limit, if set")
+	BuildCmd.Flags().IntVar(&buildCmdConfig.limits.MaxEntries, "max-entries", 0, "fail on trees with more entries than the limit, if set")
+	BuildCmd.Flags().Int64Var(&buildCmdConfig.limits.MaxFileSize, "max-file-size", 0, "fail on files larger than the limit in bytes, if set")
+	BuildCmd.Flags().BoolVar(&buildCmdConfig.limits.Truncate, "truncate", false, "leave out entries beyond the limits rather than fail")
+	BuildCmd.Flags().BoolVar(&buildCmdConfig.progress, "progress", false, "print progress to stderr")
+	buildCmdConfig.rateLimit.register(BuildCmd)
+	buildCmdConfig.ssh.register(BuildCmd)
+	BuildCmd.Flags().StringVar(&buildCmdConfig.journal, "journal", "", "record progress in a journal file to resume an interrupted build")
+	BuildCmd.Flags().StringVar(&buildCmdConfig.store, "store", "", "store the content of regular files in a directory by digest, for apply --content")
+	BuildCmd.Flags().BoolVar(&buildCmdConfig.provenance, "provenance", false, "record the builder, host, build time and root in the manifest, which makes builds irreproducible")
+	BuildCmd.Flags().StringToStringVar(&buildCmdConfig.labels, "label", nil, "attach a key=value label to the manifest")
+	BuildCmd.Flags().StringVar(&buildCmdConfig.compress, "compress", "", "compress the manifest with gzip or zstd")
 }
@@ -0,0 +1,56 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"bufio"
+	"log"
+	"os"
+	"time"
+
+	"github.com/containerd/continuity"
+	"github.com/containerd/continuity/cpio"
+	"github.com/spf13/cobra"
+)
+
+var cpioCmdConfig struct {
+	content string
+}
+
+var CPIOCmd = &cobra.Command{
+	Use:   "cpio <manifest> <archive>",
+	Short: "Write a cpio archive of the manifest, for initramfs, with file content from --content",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 2 {
+			log.Fatalln("please specify a manifest and an archive")
+		}
+
+		writeImage(args[0], cpioCmdConfig.content, args[1], "archive", func(out *os.File, m *continuity.Manifest, provider continuity.ContentProvider, modTime time.Time) error {
+			w := bufio.NewWriter(out)
+			if err := cpio.Write(w, m, provider, cpio.Options{
+				ModTime: modTime,
+			}); err != nil {
+				return err
+			}
+			return w.Flush()
+		})
+	},
+}
+
+func init() {
+	CPIOCmd.Flags().StringVar(&cpioCmdConfig.content, "content", "", "provide file content from a directory stored by build --store, an HTTP blob store URL, or a tar archive")
+}
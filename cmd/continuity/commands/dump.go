@@ -17,34 +17,174 @@
 package commands
 
 import (
+	"encoding/json"
 	"io"
 	"log"
 	"os"
+	"path/filepath"
 
+	"github.com/containerd/continuity"
+	"github.com/containerd/continuity/compression"
 	pb "github.com/containerd/continuity/proto"
 	"github.com/golang/protobuf/proto"
+	"github.com/opencontainers/go-digest"
 	"github.com/spf13/cobra"
 )
 
+var dumpCmdConfig struct {
+	format string
+	root   string
+	filter string
+}
+
 var DumpCmd = &cobra.Command{
 	Use:   "dump <manifest>",
 	Short: "Dump the contents of the manifest in protobuf text format",
+	Long: `Dump the contents of the manifest in protobuf text format. With --format
+ima, regular files are written as IMA measurement list records instead. With
+--format intoto, an in-toto statement for the manifest and its regular files is
+written as JSON. With --format spdx, an SPDX document listing the regular files
+and their checksums is written as JSON. With --format ndjson, each resource is
+written as JSON on a line of its own. With --format sha256sum or sha512sum,
+regular files are listed as those tools do, to be checked with -c from the
+manifest root. With --format hashdeep, regular files are listed as hashdeep
+does, to be audited with hashdeep -a -k.
+
+A format holding {{ is a Go template, executed for each path of the manifest,
+with the fields Path, Paths, Type, Mode, UID, GID, Size, Digest, Digests,
+Target, Major, Minor, XAttrs and Annotations, and the functions join,
+trimPrefix and bytes.
+For example, '{{.Digest.Encoded}}  {{trimPrefix .Path "/"}}' with a filter of
+type==regular lists the regular files as sha256sum does.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		var p []byte
 		var err error
 
+		name := "manifest"
 		if len(args) < 1 {
-			p, err = io.ReadAll(os.Stdin)
+			r, err := compression.Decompress(os.Stdin)
+			if err != nil {
+				log.Fatalf("error reading manifest: %v", err)
+			}
+			p, err = io.ReadAll(r)
 			if err != nil {
 				log.Fatalf("error reading manifest: %v", err)
 			}
 		} else {
-			p, err = os.ReadFile(args[0])
+			name = filepath.Base(args[0])
+			p, err = readManifest(args[0])
 			if err != nil {
 				log.Fatalf("error reading manifest: %v", err)
 			}
 		}
 
+		if dumpCmdConfig.filter != "" {
+			m, err := continuity.Unmarshal(p)
+			if err != nil {
+				log.Fatalf("error unmarshaling manifest: %v", err)
+			}
+			if m, err = filterManifest(m, dumpCmdConfig.filter); err != nil {
+				log.Fatalf("error filtering manifest: %v", err)
+			}
+			if p, err = continuity.Marshal(m); err != nil {
+				log.Fatalf("error marshaling manifest: %v", err)
+			}
+		}
+
+		if isTemplate(dumpCmdConfig.format) {
+			m, err := continuity.Unmarshal(p)
+			if err != nil {
+				log.Fatalf("error unmarshaling manifest: %v", err)
+			}
+
+			if err := executeTemplate(os.Stdout, dumpCmdConfig.format, m); err != nil {
+				log.Fatalf("error dumping manifest: %v", err)
+			}
+			return
+		}
+
+		switch dumpCmdConfig.format {
+		case "text":
+		case "ima":
+			m, err := continuity.Unmarshal(p)
+			if err != nil {
+				log.Fatalf("error unmarshaling manifest: %v", err)
+			}
+
+			if err := continuity.MarshalIMA(os.Stdout, m, dumpCmdConfig.root); err != nil {
+				log.Fatalf("error dumping manifest: %v", err)
+			}
+			return
+		case "intoto":
+			m, err := continuity.Unmarshal(p)
+			if err != nil {
+				log.Fatalf("error unmarshaling manifest: %v", err)
+			}
+
+			statement, err := continuity.NewInTotoStatement(m, name)
+			if err != nil {
+				log.Fatalf("error creating statement: %v", err)
+			}
+
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			if err := enc.Encode(statement); err != nil {
+				log.Fatalf("error dumping manifest: %v", err)
+			}
+			return
+		case "spdx":
+			m, err := continuity.Unmarshal(p)
+			if err != nil {
+				log.Fatalf("error unmarshaling manifest: %v", err)
+			}
+
+			doc, err := continuity.NewSPDXDocument(m, name)
+			if err != nil {
+				log.Fatalf("error creating document: %v", err)
+			}
+
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			if err := enc.Encode(doc); err != nil {
+				log.Fatalf("error dumping manifest: %v", err)
+			}
+			return
+		case "sha256sum", "sha512sum", "hashdeep":
+			m, err := continuity.Unmarshal(p)
+			if err != nil {
+				log.Fatalf("error unmarshaling manifest: %v", err)
+			}
+
+			root := dumpCmdConfig.root
+			if !cmd.Flags().Changed("root") {
+				root = "."
+			}
+			switch dumpCmdConfig.format {
+			case "sha256sum":
+				err = continuity.MarshalChecksums(os.Stdout, m, digest.SHA256, root)
+			case "sha512sum":
+				err = continuity.MarshalChecksums(os.Stdout, m, digest.SHA512, root)
+			default:
+				err = continuity.MarshalHashdeep(os.Stdout, m, root)
+			}
+			if err != nil {
+				log.Fatalf("error dumping manifest: %v", err)
+			}
+			return
+		case "ndjson":
+			m, err := continuity.Unmarshal(p)
+			if err != nil {
+				log.Fatalf("error unmarshaling manifest: %v", err)
+			}
+
+			if err := continuity.MarshalNDJSON(os.Stdout, m); err != nil {
+				log.Fatalf("error dumping manifest: %v", err)
+			}
+			return
+		default:
+			log.Fatalf("unknown format %q", dumpCmdConfig.format)
+		}
+
 		var bm pb.Manifest
 
 		if err := proto.Unmarshal(p, &bm); err != nil {
@@ -58,3 +198,9 @@ var DumpCmd = &cobra.Command{
 		}
 	},
 }
+
+func init() {
+	DumpCmd.Flags().StringVar(&dumpCmdConfig.format, "format", "text", "output format, one of text, ima, intoto, spdx, ndjson, sha256sum, sha512sum or hashdeep, or a Go template")
+	DumpCmd.Flags().StringVar(&dumpCmdConfig.root, "root", "/", "location of the manifest root on the measured system, for ima output, or of the files listed by checksum formats, relative by default")
+	DumpCmd.Flags().StringVar(&dumpCmdConfig.filter, "filter", "", "only dump resources matching the filter expression, such as 'type==regular && size>10MB'")
+}
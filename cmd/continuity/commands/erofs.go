@@ -0,0 +1,56 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"bufio"
+	"log"
+	"os"
+	"time"
+
+	"github.com/containerd/continuity"
+	"github.com/containerd/continuity/erofs"
+	"github.com/spf13/cobra"
+)
+
+var erofsCmdConfig struct {
+	content string
+}
+
+var EROFSCmd = &cobra.Command{
+	Use:   "erofs <manifest> <image>",
+	Short: "Write an EROFS image of the manifest, with file content from --content",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 2 {
+			log.Fatalln("please specify a manifest and an image")
+		}
+
+		writeImage(args[0], erofsCmdConfig.content, args[1], "image", func(out *os.File, m *continuity.Manifest, provider continuity.ContentProvider, modTime time.Time) error {
+			w := bufio.NewWriter(out)
+			if err := erofs.Write(w, m, provider, erofs.Options{
+				ModTime: modTime,
+			}); err != nil {
+				return err
+			}
+			return w.Flush()
+		})
+	},
+}
+
+func init() {
+	EROFSCmd.Flags().StringVar(&erofsCmdConfig.content, "content", "", "provide file content from a directory stored by build --store, an HTTP blob store URL, or a tar archive")
+}
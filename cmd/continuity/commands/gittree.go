@@ -0,0 +1,61 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"log"
+	"os"
+
+	"github.com/containerd/continuity/compression"
+	"github.com/containerd/continuity/gittree"
+	"github.com/spf13/cobra"
+)
+
+var gitTreeCmdConfig struct {
+	compress string
+}
+
+var GitTreeCmd = &cobra.Command{
+	Use:   "git-tree <repository> <revision>",
+	Short: "Build a manifest of the git tree of the revision, to verify a deployed directory against",
+	Long: `Build a manifest of the git tree of the revision. Git trees do not record
+ownership or extended attributes, so directories deployed from the tree are
+verified against the manifest with verify --skip owner,group,xattrs.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 2 {
+			log.Fatalln("please specify a repository and a revision")
+		}
+
+		repo, err := gittree.OpenRepository(args[0])
+		if err != nil {
+			log.Fatalf("error opening repository: %v", err)
+		}
+		defer repo.Close()
+
+		m, err := gittree.ToManifest(repo, args[1]+"^{tree}")
+		if err != nil {
+			log.Fatalf("error reading tree: %v", err)
+		}
+		if err := compression.WriteManifest(os.Stdout, m, compression.Compression(gitTreeCmdConfig.compress)); err != nil {
+			log.Fatalf("error writing manifest: %v", err)
+		}
+	},
+}
+
+func init() {
+	GitTreeCmd.Flags().StringVar(&gitTreeCmdConfig.compress, "compress", "", "compress the manifest with gzip or zstd")
+}
@@ -0,0 +1,70 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"log"
+	"os"
+	"time"
+
+	"github.com/containerd/continuity"
+)
+
+// writeImage writes the image or archive of the manifest at manifestPath to
+// path with write, which is passed the manifest, the provider of the content
+// at source and the time to give every file. Manifests do not record times,
+// so for reproducible output, files get the time of SOURCE_DATE_EPOCH, or
+// the zero time, for write to pick its default. The file at path is removed
+// if write fails.
+func writeImage(manifestPath, source, path, kind string, write func(out *os.File, m *continuity.Manifest, provider continuity.ContentProvider, modTime time.Time) error) {
+	if source == "" {
+		log.Fatalln("please specify the content with --content")
+	}
+
+	p, err := readManifest(manifestPath)
+	if err != nil {
+		log.Fatalf("error reading manifest: %v", err)
+	}
+	m, err := continuity.Unmarshal(p, continuity.WithSafePaths())
+	if err != nil {
+		log.Fatalf("error unmarshaling manifest: %v", err)
+	}
+
+	provider, cleanup, err := openContent(source)
+	if err != nil {
+		log.Fatalf("error opening content: %v", err)
+	}
+	defer cleanup()
+
+	modTime, _, err := continuity.SourceDateEpoch()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	out, err := os.Create(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := write(out, m, provider, modTime); err != nil {
+		out.Close()
+		os.Remove(path)
+		log.Fatalf("error writing %s: %v", kind, err)
+	}
+	if err := out.Close(); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,45 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"github.com/containerd/continuity"
+	"github.com/sirupsen/logrus"
+)
+
+// logrusLogger passes the log messages of the continuity library to logrus.
+type logrusLogger struct{}
+
+func (logrusLogger) Log(level continuity.LogLevel, msg string, fields ...interface{}) {
+	entry := logrus.NewEntry(logrus.StandardLogger())
+	for i := 0; i+1 < len(fields); i += 2 {
+		if key, ok := fields[i].(string); ok {
+			entry = entry.WithField(key, fields[i+1])
+		}
+	}
+
+	switch level {
+	case continuity.LogLevelDebug:
+		entry.Debug(msg)
+	case continuity.LogLevelInfo:
+		entry.Info(msg)
+	case continuity.LogLevelWarn:
+		entry.Warn(msg)
+	default:
+		entry.Error(msg)
+	}
+}
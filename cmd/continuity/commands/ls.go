@@ -22,10 +22,23 @@ import (
 	"os"
 	"text/tabwriter"
 
+	"github.com/containerd/continuity"
+	pb "github.com/containerd/continuity/proto"
 	"github.com/dustin/go-humanize"
+	"github.com/golang/protobuf/proto"
 	"github.com/spf13/cobra"
 )
 
+var lsCmdConfig struct {
+	match   []string
+	kinds   []string
+	minSize string
+	owner   int64
+	largest int
+	newest  int
+	filter  string
+}
+
 var LSCmd = &cobra.Command{
 	Use:   "ls <manifest>",
 	Short: "List the contents of the manifest.",
@@ -34,25 +47,109 @@ var LSCmd = &cobra.Command{
 			log.Fatalln("please specify a manifest")
 		}
 
-		bm, err := readManifestFile(args[0])
+		p, err := readManifest(args[0])
 		if err != nil {
 			log.Fatalf("error reading manifest: %v", err)
 		}
 
-		w := tabwriter.NewWriter(os.Stdout, 0, 2, 2, ' ', 0)
+		var bm pb.Manifest
+		if err := proto.Unmarshal(p, &bm); err != nil {
+			log.Fatalf("error reading manifest: %v", err)
+		}
 
+		paths, err := lsQuery(p)
+		if err != nil {
+			log.Fatalf("error querying manifest: %v", err)
+		}
+
+		entries := map[string]*pb.Resource{}
+		var all []string
 		for _, entry := range bm.Resource {
 			for _, path := range entry.Path {
-				if os.FileMode(entry.Mode)&os.ModeSymlink != 0 {
-					//nolint:unconvert
-					fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v -> %v\n", os.FileMode(entry.Mode), entry.User, entry.Group, humanize.Bytes(uint64(entry.Size)), path, entry.Target)
-				} else {
-					//nolint:unconvert
-					fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\n", os.FileMode(entry.Mode), entry.User, entry.Group, humanize.Bytes(uint64(entry.Size)), path)
-				}
+				entries[path] = entry
+				all = append(all, path)
+			}
+		}
+		if paths == nil {
+			paths = all
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 2, 2, ' ', 0)
+
+		for _, path := range paths {
+			entry := entries[path]
+			if os.FileMode(entry.Mode)&os.ModeSymlink != 0 {
+				//nolint:unconvert
+				fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v -> %v\n", os.FileMode(entry.Mode), entry.User, entry.Group, humanize.Bytes(uint64(entry.Size)), path, entry.Target)
+			} else {
+				//nolint:unconvert
+				fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\n", os.FileMode(entry.Mode), entry.User, entry.Group, humanize.Bytes(uint64(entry.Size)), path)
 			}
 		}
 
 		w.Flush()
 	},
 }
+
+func init() {
+	LSCmd.Flags().StringSliceVar(&lsCmdConfig.match, "match", nil, "only list paths matching the patterns, or below a directory that does")
+	LSCmd.Flags().StringSliceVar(&lsCmdConfig.kinds, "type", nil, "only list resources of the types: regular, directory, symlink, pipe or device")
+	LSCmd.Flags().StringVar(&lsCmdConfig.minSize, "min-size", "", "only list regular files larger than the size, such as 10MB")
+	LSCmd.Flags().Int64Var(&lsCmdConfig.owner, "uid", -1, "only list resources owned by the uid")
+	LSCmd.Flags().IntVar(&lsCmdConfig.largest, "largest", 0, "list the largest regular files, largest first")
+	LSCmd.Flags().IntVar(&lsCmdConfig.newest, "newest", 0, "list the most recently created resources, newest first")
+	LSCmd.Flags().StringVar(&lsCmdConfig.filter, "filter", "", "only list resources matching the filter expression, such as 'type==regular && size>10MB'")
+}
+
+// lsQuery returns the paths of the manifest p selected by the flags of the
+// ls command, or nil if no flag selects paths.
+func lsQuery(p []byte) ([]string, error) {
+	var preds []continuity.Predicate
+	if len(lsCmdConfig.match) > 0 {
+		pred, err := continuity.MatchPaths(lsCmdConfig.match...)
+		if err != nil {
+			return nil, err
+		}
+		preds = append(preds, pred)
+	}
+	if len(lsCmdConfig.kinds) > 0 {
+		preds = append(preds, continuity.OfKind(lsCmdConfig.kinds...))
+	}
+	if lsCmdConfig.minSize != "" {
+		size, err := humanize.ParseBytes(lsCmdConfig.minSize)
+		if err != nil {
+			return nil, err
+		}
+		preds = append(preds, continuity.LargerThan(int64(size)))
+	}
+	if lsCmdConfig.owner >= 0 {
+		preds = append(preds, continuity.OwnedBy(lsCmdConfig.owner))
+	}
+	if lsCmdConfig.filter != "" {
+		pred, err := continuity.ParseFilter(lsCmdConfig.filter)
+		if err != nil {
+			return nil, err
+		}
+		preds = append(preds, pred)
+	}
+	if len(preds) == 0 && lsCmdConfig.largest == 0 && lsCmdConfig.newest == 0 {
+		return nil, nil
+	}
+
+	m, err := continuity.Unmarshal(p)
+	if err != nil {
+		return nil, err
+	}
+	idx := continuity.NewIndex(m)
+
+	paths := []string{}
+	switch {
+	case lsCmdConfig.largest > 0:
+		paths = append(paths, idx.Largest(lsCmdConfig.largest, preds...)...)
+	case lsCmdConfig.newest > 0:
+		paths = append(paths, idx.Newest(lsCmdConfig.newest, preds...)...)
+	default:
+		paths = append(paths, idx.Select(preds...)...)
+	}
+	return paths, nil
+}
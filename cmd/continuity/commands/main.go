@@ -21,15 +21,25 @@ import (
 	"os"
 	"text/tabwriter"
 
+	"github.com/containerd/continuity"
+	"github.com/containerd/continuity/compression"
 	pb "github.com/containerd/continuity/proto"
 	"github.com/golang/protobuf/proto"
+	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 )
 
 var (
+	debug bool
+
 	MainCmd = &cobra.Command{
 		Use:   "continuity <command>",
 		Short: "A transport-agnostic filesytem metadata tool.",
+		PersistentPreRun: func(cmd *cobra.Command, args []string) {
+			if debug {
+				logrus.SetLevel(logrus.DebugLevel)
+			}
+		},
 	}
 
 	// usageTemplate is nearly identical to the default template without the
@@ -65,19 +75,61 @@ func init() {
 	MainCmd.AddCommand(BuildCmd)
 	MainCmd.AddCommand(VerifyCmd)
 	MainCmd.AddCommand(ApplyCmd)
+	MainCmd.AddCommand(RepairCmd)
+	MainCmd.AddCommand(WatchVerifyCmd)
+	MainCmd.AddCommand(ServeCmd)
 	MainCmd.AddCommand(LSCmd)
 	MainCmd.AddCommand(StatsCmd)
 	MainCmd.AddCommand(DumpCmd)
+	MainCmd.AddCommand(AuditCmd)
+	MainCmd.AddCommand(VerityCmd)
+	MainCmd.AddCommand(SquashfsCmd)
+	MainCmd.AddCommand(EROFSCmd)
+	MainCmd.AddCommand(CPIOCmd)
+	MainCmd.AddCommand(ZipCmd)
+	MainCmd.AddCommand(GitTreeCmd)
 	if MountCmd != nil {
 		MainCmd.AddCommand(MountCmd)
 	}
+	MainCmd.PersistentFlags().BoolVar(&debug, "debug", false, "enable debug logging")
 	MainCmd.SetUsageTemplate(usageTemplate)
 }
 
+// readManifest reads the encoded manifest at the given path, decompressing
+// it if it was compressed.
+func readManifest(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r, err := compression.Decompress(f)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return io.ReadAll(r)
+}
+
+// filterManifest returns the manifest m with only the resources matching
+// the filter expression, or m itself if the expression is empty.
+func filterManifest(m *continuity.Manifest, expr string) (*continuity.Manifest, error) {
+	if expr == "" {
+		return m, nil
+	}
+	pred, err := continuity.ParseFilter(expr)
+	if err != nil {
+		return nil, err
+	}
+	return continuity.Filter(m, pred)
+}
+
 // readManifestFile reads the manifest from the given path. This should
 // probably be provided by the continuity library.
 func readManifestFile(path string) (*pb.Manifest, error) {
-	p, err := os.ReadFile(path)
+	p, err := readManifest(path)
 	if err != nil {
 		return nil, err
 	}
@@ -37,19 +37,26 @@ import (
 	"github.com/spf13/cobra"
 )
 
+var mountCmdConfig struct {
+	content string
+}
+
 var MountCmd = &cobra.Command{
 	Use:   "mount <mountpoint> [<manifest>] [<source directory>]",
-	Short: "Mount the manifest to the provided mountpoint using content from a source directory",
+	Short: "Mount the manifest to the provided mountpoint using content from a source directory or a content store",
 	Run: func(cmd *cobra.Command, args []string) {
-		if len(args) != 3 {
+		if mountCmdConfig.content != "" {
+			if len(args) != 2 {
+				log.Fatal("Must specify mountpoint and manifest")
+			}
+		} else if len(args) != 3 {
 			log.Fatal("Must specify mountpoint, manifest, and source directory")
 		}
-		mountpoint := args[0]
-		manifest, source := args[1], args[2]
+		mountpoint, manifest := args[0], args[1]
 
 		manifestName := filepath.Base(manifest)
 
-		p, err := os.ReadFile(manifest)
+		p, err := readManifest(manifest)
 		if err != nil {
 			log.Fatalf("error reading manifest: %v", err)
 		}
@@ -59,13 +66,22 @@ var MountCmd = &cobra.Command{
 			log.Fatalf("error unmarshaling manifest: %v", err)
 		}
 
-		driver, err := driver.NewSystemDriver()
-		if err != nil {
-			logrus.Fatal(err)
+		var provider continuityfs.FileContentProvider
+		if mountCmdConfig.content != "" {
+			content, cleanup, err := openContent(mountCmdConfig.content)
+			if err != nil {
+				log.Fatalf("error opening content: %v", err)
+			}
+			defer cleanup()
+			provider = continuityfs.NewContentProvider(content)
+		} else {
+			driver, err := driver.NewSystemDriver()
+			if err != nil {
+				logrus.Fatal(err)
+			}
+			provider = continuityfs.NewFSFileContentProvider(args[2], driver)
 		}
 
-		provider := continuityfs.NewFSFileContentProvider(source, driver)
-
 		contfs, err := continuityfs.NewFSFromManifest(m, mountpoint, provider)
 		if err != nil {
 			logrus.Fatal(err)
@@ -129,3 +145,7 @@ var MountCmd = &cobra.Command{
 		}
 	},
 }
+
+func init() {
+	MountCmd.Flags().StringVar(&mountCmdConfig.content, "content", "", "provide file content from a directory stored by build --store, an HTTP blob store URL, or a tar archive instead of a source directory")
+}
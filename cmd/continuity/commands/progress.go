@@ -0,0 +1,60 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/containerd/continuity"
+	"github.com/dustin/go-humanize"
+)
+
+// progressInterval is how often progress is redrawn.
+const progressInterval = 100 * time.Millisecond
+
+// progressPrinter renders progress updates on a single line of stderr.
+type progressPrinter struct{}
+
+func (progressPrinter) Update(update continuity.ProgressUpdate) {
+	status := fmt.Sprintf("%d entries, %s read", update.Entries, humanize.Bytes(uint64(update.Bytes)))
+	if update.TotalEntries > 0 {
+		status = fmt.Sprintf("%d/%d entries, %s read", update.Entries, update.TotalEntries, humanize.Bytes(uint64(update.Bytes)))
+	}
+	if update.Written > 0 {
+		status += fmt.Sprintf(", %s written", humanize.Bytes(uint64(update.Written)))
+	}
+	if remaining, ok := update.Remaining(); ok {
+		status += fmt.Sprintf(", %s left", remaining.Round(time.Second))
+	}
+	fmt.Fprintf(os.Stderr, "\r\x1b[K%s: %s", status, update.Path)
+}
+
+// withProgress sets up options to print progress if enabled. The returned
+// function ends the progress line and must be called when done.
+func withProgress(options *continuity.ContextOptions, enabled bool) func() {
+	if !enabled {
+		return func() {}
+	}
+
+	options.Progress = progressPrinter{}
+	options.ProgressInterval = progressInterval
+	return func() {
+		fmt.Fprintln(os.Stderr)
+	}
+}
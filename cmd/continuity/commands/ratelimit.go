@@ -0,0 +1,49 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"fmt"
+
+	"github.com/containerd/continuity"
+	"github.com/dustin/go-humanize"
+	"github.com/spf13/cobra"
+)
+
+// rateLimitFlags holds the throttling flags shared by commands that scan a
+// root.
+type rateLimitFlags struct {
+	bytesPerSecond string
+	opsPerSecond   int64
+}
+
+func (f *rateLimitFlags) register(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&f.bytesPerSecond, "bytes-per-second", "", "limit the rate at which file content is read, such as 10MB")
+	cmd.Flags().Int64Var(&f.opsPerSecond, "ops-per-second", 0, "limit the number of files processed per second")
+}
+
+func (f *rateLimitFlags) apply(options *continuity.ContextOptions) error {
+	if f.bytesPerSecond != "" {
+		n, err := humanize.ParseBytes(f.bytesPerSecond)
+		if err != nil {
+			return fmt.Errorf("invalid --bytes-per-second: %w", err)
+		}
+		options.BytesPerSecond = int64(n)
+	}
+	options.OpsPerSecond = f.opsPerSecond
+	return nil
+}
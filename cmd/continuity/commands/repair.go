@@ -0,0 +1,76 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"log"
+	"os"
+
+	"github.com/containerd/continuity"
+	"github.com/spf13/cobra"
+)
+
+var repairCmdConfig struct {
+	format string
+}
+
+var RepairCmd = &cobra.Command{
+	Use:   "repair <root> <manifest>",
+	Short: "Repair the resources of the root that drifted from the manifest",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 2 {
+			log.Fatalln("please specify a root and manifest")
+		}
+
+		root, path := args[0], args[1]
+
+		p, err := readManifest(path)
+		if err != nil {
+			log.Fatalf("error reading manifest: %v", err)
+		}
+
+		m, err := continuity.Unmarshal(p)
+		if err != nil {
+			log.Fatalf("error unmarshaling manifest: %v", err)
+		}
+
+		enc, err := continuity.NewChangeEncoder(os.Stdout, continuity.Format(repairCmdConfig.format))
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		ctx, err := continuity.NewContextWithOptions(root, continuity.ContextOptions{Logger: logrusLogger{}})
+		if err != nil {
+			log.Fatalf("error getting context: %v", err)
+		}
+
+		changes, err := continuity.Repair(ctx, m)
+		if err != nil {
+			log.Fatalf("error repairing root: %v", err)
+		}
+
+		for _, change := range changes {
+			if err := enc.Encode(change); err != nil {
+				log.Fatalf("error writing changes: %v", err)
+			}
+		}
+	},
+}
+
+func init() {
+	RepairCmd.Flags().StringVar(&repairCmdConfig.format, "format", string(continuity.FormatText), "format of the changes: text, json or proto")
+}
@@ -0,0 +1,101 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+
+	"github.com/containerd/continuity"
+	"github.com/containerd/continuity/remote"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"google.golang.org/grpc"
+)
+
+var serveCmdConfig struct {
+	address     string
+	httpAddress string
+}
+
+var ServeCmd = &cobra.Command{
+	Use:   "serve <root>",
+	Short: "Serve manifest operations on the root over gRPC or HTTP",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 1 {
+			log.Fatalln("please specify a root")
+		}
+
+		server, err := remote.NewServer(args[0], continuity.ContextOptions{
+			Logger: logrusLogger{},
+		})
+		if err != nil {
+			log.Fatalf("error getting context: %v", err)
+		}
+
+		if serveCmdConfig.httpAddress != "" {
+			hlis, err := listen(serveCmdConfig.httpAddress)
+			if err != nil {
+				log.Fatalf("error listening: %v", err)
+			}
+
+			logrus.WithField("address", hlis.Addr()).Info("serving manifest operations over HTTP")
+			go func() {
+				if err := http.Serve(hlis, server.HTTPHandler()); err != nil {
+					log.Fatalf("error serving HTTP: %v", err)
+				}
+			}()
+		}
+
+		lis, err := listen(serveCmdConfig.address)
+		if err != nil {
+			log.Fatalf("error listening: %v", err)
+		}
+
+		gs := grpc.NewServer()
+		server.Register(gs)
+
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, os.Interrupt)
+		go func() {
+			<-sigs
+			gs.GracefulStop()
+		}()
+
+		logrus.WithField("address", lis.Addr()).Info("serving manifest operations")
+		if err := gs.Serve(lis); err != nil {
+			log.Fatalf("error serving: %v", err)
+		}
+	},
+}
+
+// listen listens on a TCP address, or on a unix socket for unix://<path>.
+func listen(address string) (net.Listener, error) {
+	if strings.HasPrefix(address, "unix://") {
+		return net.Listen("unix", strings.TrimPrefix(address, "unix://"))
+	}
+	return net.Listen("tcp", address)
+}
+
+func init() {
+	ServeCmd.Flags().StringVar(&serveCmdConfig.address, "address", "127.0.0.1:7788", "address to listen on, or unix://<path> for a unix socket")
+	ServeCmd.Flags().StringVar(&serveCmdConfig.httpAddress, "http-address", "", "address to also serve the HTTP API on")
+}
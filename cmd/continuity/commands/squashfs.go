@@ -0,0 +1,54 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"log"
+	"os"
+	"time"
+
+	"github.com/containerd/continuity"
+	"github.com/containerd/continuity/squashfs"
+	"github.com/spf13/cobra"
+)
+
+var squashfsCmdConfig struct {
+	content   string
+	blockSize int
+}
+
+var SquashfsCmd = &cobra.Command{
+	Use:   "squashfs <manifest> <image>",
+	Short: "Write a SquashFS image of the manifest, with file content from --content",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 2 {
+			log.Fatalln("please specify a manifest and an image")
+		}
+
+		writeImage(args[0], squashfsCmdConfig.content, args[1], "image", func(out *os.File, m *continuity.Manifest, provider continuity.ContentProvider, modTime time.Time) error {
+			return squashfs.Write(out, m, provider, squashfs.Options{
+				BlockSize: squashfsCmdConfig.blockSize,
+				ModTime:   modTime,
+			})
+		})
+	},
+}
+
+func init() {
+	SquashfsCmd.Flags().StringVar(&squashfsCmdConfig.content, "content", "", "provide file content from a directory stored by build --store, an HTTP blob store URL, or a tar archive")
+	SquashfsCmd.Flags().IntVar(&squashfsCmdConfig.blockSize, "block-size", 128<<10, "size of the data blocks of files")
+}
@@ -0,0 +1,110 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+
+	"github.com/containerd/continuity"
+	"github.com/containerd/continuity/driver/sftp"
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// sshFlags holds the flags of commands that can scan a root on a remote
+// host, over SFTP.
+type sshFlags struct {
+	target string
+}
+
+func (f *sshFlags) register(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&f.target, "ssh", "", "read the root from a remote host over SFTP, given as [user@]host[:port]")
+}
+
+// apply connects to the remote host, if one was given, and makes the options
+// use its filesystem. The returned function closes the connection.
+func (f *sshFlags) apply(options *continuity.ContextOptions) (func(), error) {
+	if f.target == "" {
+		return func() {}, nil
+	}
+
+	username, address := "", f.target
+	if i := strings.LastIndex(address, "@"); i >= 0 {
+		username, address = address[:i], address[i+1:]
+	}
+	if username == "" {
+		u, err := user.Current()
+		if err != nil {
+			return nil, err
+		}
+		username = u.Username
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, "22")
+	}
+
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	if sock == "" {
+		return nil, errors.New("--ssh authenticates with ssh-agent, but SSH_AUTH_SOCK is not set")
+	}
+	agentConn, err := net.Dial("unix", sock)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to ssh-agent: %w", err)
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		agentConn.Close()
+		return nil, err
+	}
+	hostKeyCallback, err := knownhosts.New(filepath.Join(home, ".ssh", "known_hosts"))
+	if err != nil {
+		agentConn.Close()
+		return nil, fmt.Errorf("error reading known hosts: %w", err)
+	}
+
+	conn, err := ssh.Dial("tcp", address, &ssh.ClientConfig{
+		User:            username,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeysCallback(agent.NewClient(agentConn).Signers)},
+		HostKeyCallback: hostKeyCallback,
+	})
+	agentConn.Close()
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to %s: %w", f.target, err)
+	}
+
+	d, err := sftp.Dial(conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("error starting sftp on %s: %w", f.target, err)
+	}
+
+	options.Driver = d
+	options.PathDriver = d.PathDriver()
+	return func() {
+		d.Close()
+		conn.Close()
+	}, nil
+}
@@ -20,11 +20,19 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strings"
 
+	"github.com/containerd/continuity"
 	"github.com/dustin/go-humanize"
 	"github.com/spf13/cobra"
 )
 
+var statsCmdConfig struct {
+	duplicates bool
+	usage      string
+	filter     string
+}
+
 var StatsCmd = &cobra.Command{
 	Use:   "stats <manifest>",
 	Short: "display statistics about the specified manifest",
@@ -33,40 +41,89 @@ var StatsCmd = &cobra.Command{
 			log.Fatalln("please specify a manifest")
 		}
 
-		bm, err := readManifestFile(args[0])
+		p, err := readManifest(args[0])
 		if err != nil {
 			log.Fatalf("error reading manifest: %v", err)
 		}
 
-		var stats struct {
-			resources   int
-			files       int
-			directories int
-			totalSize   int64
-			symlinks    int
+		m, err := continuity.Unmarshal(p)
+		if err != nil {
+			log.Fatalf("error unmarshaling manifest: %v", err)
 		}
 
-		for _, entry := range bm.Resource {
-			stats.resources++
-			stats.totalSize += int64(entry.Size)
-
-			mode := os.FileMode(entry.Mode)
-			if mode.IsRegular() {
-				stats.files += len(entry.Path) // count hardlinks!
-			} else if mode.IsDir() {
-				stats.directories++
-			} else if mode&os.ModeSymlink != 0 {
-				stats.symlinks++
-			}
+		if m, err = filterManifest(m, statsCmdConfig.filter); err != nil {
+			log.Fatalf("error filtering manifest: %v", err)
 		}
 
 		w := newTabwriter(os.Stdout)
 		defer w.Flush()
 
-		fmt.Fprintf(w, "resources\t%v\n", stats.resources)
-		fmt.Fprintf(w, "directories\t%v\n", stats.directories)
-		fmt.Fprintf(w, "files\t%v\n", stats.files)
-		fmt.Fprintf(w, "symlinks\t%v\n", stats.symlinks)
-		fmt.Fprintf(w, "size\t%v\n", humanize.Bytes(uint64(stats.totalSize)))
+		if statsCmdConfig.duplicates {
+			report := continuity.FindDuplicates(m)
+			fmt.Fprintf(w, "size\t%v\n", humanize.Bytes(uint64(report.TotalSize)))
+			fmt.Fprintf(w, "unique size\t%v\n", humanize.Bytes(uint64(report.UniqueSize)))
+			fmt.Fprintf(w, "savings\t%v\n", humanize.Bytes(uint64(report.Savings)))
+			fmt.Fprintf(w, "hardlink savings\t%v\n", humanize.Bytes(uint64(report.HardlinkSavings)))
+			for _, d := range report.Duplicates {
+				fmt.Fprintf(w, "duplicate\t%v\t%v\t%s\n", humanize.Bytes(uint64(d.Savings())), d.Digest, joinFiles(d.Files))
+			}
+			return
+		}
+
+		if statsCmdConfig.usage != "" {
+			by, ok := map[string]continuity.UsageBy{
+				"dir":   continuity.UsageByDirectory,
+				"owner": continuity.UsageByOwner,
+				"type":  continuity.UsageByType,
+			}[statsCmdConfig.usage]
+			if !ok {
+				log.Fatalf("unknown usage grouping %q", statsCmdConfig.usage)
+			}
+			usage, err := continuity.DiskUsage(m, by)
+			if err != nil {
+				log.Fatalf("error computing usage: %v", err)
+			}
+			for _, u := range usage {
+				fmt.Fprintf(w, "%v\t%v\t%s\n", humanize.Bytes(uint64(u.Size)), u.Resources, u.Key)
+			}
+			return
+		}
+
+		stats := continuity.Stats(m)
+
+		fmt.Fprintf(w, "resources\t%v\n", stats.Resources)
+		fmt.Fprintf(w, "directories\t%v\n", stats.Directories)
+		fmt.Fprintf(w, "files\t%v\n", stats.Files)
+		fmt.Fprintf(w, "symlinks\t%v\n", stats.SymLinks)
+		fmt.Fprintf(w, "pipes\t%v\n", stats.NamedPipes)
+		fmt.Fprintf(w, "devices\t%v\n", stats.Devices)
+		fmt.Fprintf(w, "hardlink groups\t%v\n", stats.HardlinkGroups)
+		fmt.Fprintf(w, "unstable files\t%v\n", stats.Unstable)
+		fmt.Fprintf(w, "size\t%v\n", humanize.Bytes(uint64(stats.TotalSize)))
+		fmt.Fprintf(w, "unique size\t%v\n", humanize.Bytes(uint64(stats.UniqueSize)))
+
+		for depth, n := range stats.Depths {
+			if n > 0 {
+				fmt.Fprintf(w, "depth %d\t%v\n", depth, n)
+			}
+		}
+		for _, f := range stats.Largest {
+			fmt.Fprintf(w, "largest\t%v\t%s\n", humanize.Bytes(uint64(f.Size)), f.Path)
+		}
 	},
 }
+
+func init() {
+	StatsCmd.Flags().BoolVar(&statsCmdConfig.duplicates, "duplicates", false, "report files with the same content and the space linking them would save")
+	StatsCmd.Flags().StringVar(&statsCmdConfig.usage, "usage", "", "print the space used by top-level directory, uid or type: dir, owner or type")
+	StatsCmd.Flags().StringVar(&statsCmdConfig.filter, "filter", "", "only count resources matching the filter expression, such as 'type==regular && size>10MB'")
+}
+
+// joinFiles joins the paths of files, hardlinked paths with "=".
+func joinFiles(files [][]string) string {
+	joined := make([]string, len(files))
+	for i, paths := range files {
+		joined[i] = strings.Join(paths, "=")
+	}
+	return strings.Join(joined, " ")
+}
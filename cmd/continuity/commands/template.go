@@ -0,0 +1,123 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"strings"
+	"text/template"
+
+	"github.com/containerd/continuity"
+	"github.com/dustin/go-humanize"
+	"github.com/opencontainers/go-digest"
+)
+
+// templateEntry is a path of a resource, as rendered by dump templates.
+type templateEntry struct {
+	Path  string
+	Paths []string
+	Type  string
+	Mode  os.FileMode
+	UID   int64
+	GID   int64
+	Size  int64
+
+	// Digest is the first digest of regular files, and Digests all of them.
+	Digest  digest.Digest
+	Digests []digest.Digest
+
+	Target       string
+	Major, Minor uint64
+	XAttrs       map[string][]byte
+	Annotations  map[string]string
+}
+
+var templateFuncs = template.FuncMap{
+	"join":       strings.Join,
+	"trimPrefix": strings.TrimPrefix,
+	"bytes": func(n int64) string {
+		return humanize.Bytes(uint64(n))
+	},
+}
+
+// isTemplate returns whether the output format is a template.
+func isTemplate(format string) bool {
+	return strings.Contains(format, "{{")
+}
+
+// executeTemplate renders each path of the resources of m through the
+// template text, followed by a newline. The escapes \t and \n in text
+// stand for a tab and a newline, so that they can be given on the command
+// line.
+func executeTemplate(w io.Writer, text string, m *continuity.Manifest) error {
+	text = strings.NewReplacer(`\t`, "\t", `\n`, "\n").Replace(text)
+	tmpl, err := template.New("dump").Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(w)
+	for _, r := range m.Resources {
+		entry := templateEntry{
+			Paths: []string{r.Path()},
+			Mode:  r.Mode(),
+			UID:   r.UID(),
+			GID:   r.GID(),
+		}
+		if h, ok := r.(continuity.Hardlinkable); ok {
+			entry.Paths = h.Paths()
+		}
+		if x, ok := r.(continuity.XAttrer); ok {
+			entry.XAttrs = x.XAttrs()
+		}
+		if a, ok := r.(continuity.Annotator); ok {
+			entry.Annotations = a.Annotations()
+		}
+		switch r := r.(type) {
+		case continuity.RegularFile:
+			entry.Type = "regular"
+			entry.Size = r.Size()
+			entry.Digests = r.Digests()
+			if len(entry.Digests) > 0 {
+				entry.Digest = entry.Digests[0]
+			}
+		case continuity.Directory:
+			entry.Type = "directory"
+		case continuity.SymLink:
+			entry.Type = "symlink"
+			entry.Target = r.Target()
+		case continuity.NamedPipe:
+			entry.Type = "pipe"
+		case continuity.Device:
+			entry.Type = "device"
+			entry.Major, entry.Minor = r.Major(), r.Minor()
+		}
+
+		for _, p := range entry.Paths {
+			entry.Path = p
+			if err := tmpl.Execute(bw, entry); err != nil {
+				return err
+			}
+			if err := bw.WriteByte('\n'); err != nil {
+				return err
+			}
+		}
+	}
+	return bw.Flush()
+}
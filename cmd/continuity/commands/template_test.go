@@ -0,0 +1,96 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/containerd/continuity"
+	"github.com/opencontainers/go-digest"
+)
+
+func TestExecuteTemplate(t *testing.T) {
+	attrs := continuity.Attributes{Mode: 0o644, UID: 1000, GID: 100}
+	file, err := continuity.NewRegularFile([]string{"/a", "/b"}, attrs, 2048, digest.FromString("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	link, err := continuity.NewSymLink("/l", continuity.Attributes{
+		Mode:        0o777,
+		Annotations: map[string]string{"org.example.package": "example"},
+	}, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &continuity.Manifest{Resources: []continuity.Resource{file, link}}
+
+	for _, tc := range []struct {
+		name     string
+		text     string
+		expected string
+		err      string
+	}{
+		{
+			name:     "fields",
+			text:     `{{.Path}}\t{{.Type}}\t{{.UID}}:{{.GID}}`,
+			expected: "/a\tregular\t1000:100\n/b\tregular\t1000:100\n/l\tsymlink\t0:0\n",
+		},
+		{
+			name:     "functions",
+			text:     `{{trimPrefix .Path "/"}} {{join .Paths ","}} {{bytes .Size}}`,
+			expected: "a /a,/b 2.0 kB\nb /a,/b 2.0 kB\nl /l 0 B\n",
+		},
+		{
+			name:     "digest and target",
+			text:     `{{if eq .Type "regular"}}{{.Digest.Encoded}}{{else}}{{.Target}}{{end}}`,
+			expected: digest.FromString("a").Encoded() + "\n" + digest.FromString("a").Encoded() + "\na\n",
+		},
+		{
+			name:     "annotations",
+			text:     `{{.Path}} {{index .Annotations "org.example.package"}}`,
+			expected: "/a \n/b \n/l example\n",
+		},
+		{
+			name: "bad template",
+			text: `{{.Path`,
+			err:  "unclosed action",
+		},
+		{
+			name: "missing field",
+			text: `{{.Missing}}`,
+			err:  "can't evaluate field Missing",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var sb strings.Builder
+			err := executeTemplate(&sb, tc.text, m)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("expected error %q, got %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sb.String() != tc.expected {
+				t.Fatalf("expected %q, got %q", tc.expected, sb.String())
+			}
+		})
+	}
+}
@@ -17,13 +17,32 @@
 package commands
 
 import (
+	"fmt"
 	"log"
 	"os"
+	"runtime"
 
 	"github.com/containerd/continuity"
 	"github.com/spf13/cobra"
 )
 
+var verifyCmdConfig struct {
+	trustVerity bool
+	progress    bool
+	rateLimit   rateLimitFlags
+	sample      float64
+	seed        int64
+	concurrency int
+	all         bool
+	report      string
+	drift       bool
+	color       bool
+	ignore      []string
+	ignoreFile  string
+	skip        []string
+	ssh         sshFlags
+}
+
 var VerifyCmd = &cobra.Command{
 	Use:   "verify <root> [<manifest>]",
 	Short: "Verify the root against the provided manifest",
@@ -34,7 +53,7 @@ var VerifyCmd = &cobra.Command{
 
 		root, path := args[0], args[1]
 
-		p, err := os.ReadFile(path)
+		p, err := readManifest(path)
 		if err != nil {
 			log.Fatalf("error reading manifest: %v", err)
 		}
@@ -44,14 +63,97 @@ var VerifyCmd = &cobra.Command{
 			log.Fatalf("error unmarshaling manifest: %v", err)
 		}
 
-		ctx, err := continuity.NewContext(root)
+		options := continuity.ContextOptions{
+			TrustVerity: verifyCmdConfig.trustVerity,
+			Logger:      logrusLogger{},
+		}
+		if err := verifyCmdConfig.rateLimit.apply(&options); err != nil {
+			log.Fatal(err)
+		}
+
+		disconnect, err := verifyCmdConfig.ssh.apply(&options)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer disconnect()
+
+		done := withProgress(&options, verifyCmdConfig.progress)
+		ctx, err := continuity.NewContextWithOptions(root, options)
 		if err != nil {
 			log.Fatalf("error getting context: %v", err)
 		}
 
-		if err := continuity.VerifyManifest(ctx, m); err != nil {
+		var report continuity.VerifyReport
+		verifyOpts := []continuity.VerifyOpt{
+			continuity.WithVerifyReport(&report),
+			continuity.WithConcurrency(verifyCmdConfig.concurrency),
+		}
+		if cmd.Flags().Changed("sample") {
+			verifyOpts = append(verifyOpts, continuity.WithSampling(verifyCmdConfig.sample, verifyCmdConfig.seed))
+		}
+		if verifyCmdConfig.all {
+			verifyOpts = append(verifyOpts, continuity.WithAllFailures())
+		}
+		ignore := verifyCmdConfig.ignore
+		if verifyCmdConfig.ignoreFile != "" {
+			f, err := os.Open(verifyCmdConfig.ignoreFile)
+			if err != nil {
+				log.Fatalf("error opening ignore file: %v", err)
+			}
+			patterns, err := continuity.ReadIgnoreFile(f)
+			f.Close()
+			if err != nil {
+				log.Fatalf("error reading ignore file: %v", err)
+			}
+			ignore = append(ignore, patterns...)
+		}
+		if len(ignore) > 0 {
+			verifyOpts = append(verifyOpts, continuity.WithIgnore(ignore...))
+		}
+		if len(verifyCmdConfig.skip) > 0 {
+			var fields []continuity.VerifyField
+			for _, field := range verifyCmdConfig.skip {
+				fields = append(fields, continuity.VerifyField(field))
+			}
+			verifyOpts = append(verifyOpts, continuity.WithoutFields(fields...))
+		}
+
+		err = continuity.VerifyManifest(ctx, m, verifyOpts...)
+		done()
+		if verifyCmdConfig.report != "" {
+			if err := continuity.EncodeVerifyReport(os.Stdout, &report, continuity.Format(verifyCmdConfig.report)); err != nil {
+				log.Fatalf("error writing report: %v", err)
+			}
+		}
+		if verifyCmdConfig.drift {
+			renderer := continuity.DriftRenderer{Color: verifyCmdConfig.color, Names: true}
+			for _, f := range report.Failures {
+				fmt.Println(renderer.Render(f))
+			}
+		}
+		if report.Sampling != nil {
+			log.Printf("verified the content of %d files, sampling %v%% with seed %d", report.ContentVerified, report.Sampling.Percent, report.Sampling.Seed)
+		}
+		if err != nil {
 			// TODO(stevvooe): Support more interesting error reporting.
 			log.Fatalf("error verifying manifest: %v", err)
 		}
 	},
 }
+
+func init() {
+	VerifyCmd.Flags().BoolVar(&verifyCmdConfig.trustVerity, "trust-verity", false, "trust fs-verity measurements instead of reading file content")
+	VerifyCmd.Flags().BoolVar(&verifyCmdConfig.progress, "progress", false, "print progress to stderr")
+	verifyCmdConfig.rateLimit.register(VerifyCmd)
+	verifyCmdConfig.ssh.register(VerifyCmd)
+	VerifyCmd.Flags().IntVarP(&verifyCmdConfig.concurrency, "concurrency", "j", runtime.NumCPU(), "number of files to verify at once")
+	VerifyCmd.Flags().Float64Var(&verifyCmdConfig.sample, "sample", 100, "percentage of files whose content is verified")
+	VerifyCmd.Flags().Int64Var(&verifyCmdConfig.seed, "seed", 0, "seed picking the files whose content is verified with --sample")
+	VerifyCmd.Flags().BoolVar(&verifyCmdConfig.all, "all", false, "verify every resource rather than stop at the first failure")
+	VerifyCmd.Flags().StringVar(&verifyCmdConfig.report, "report", "", "print a report to stdout in the given format: text, json or proto")
+	VerifyCmd.Flags().BoolVar(&verifyCmdConfig.drift, "drift", false, "print how each failing resource drifted from the manifest")
+	VerifyCmd.Flags().BoolVar(&verifyCmdConfig.color, "color", false, "highlight the output of --drift with colors")
+	VerifyCmd.Flags().StringArrayVar(&verifyCmdConfig.ignore, "ignore", nil, "skip the paths matching the pattern, such as *.log")
+	VerifyCmd.Flags().StringVar(&verifyCmdConfig.ignoreFile, "ignore-file", "", "skip the paths matching the patterns listed in the file")
+	VerifyCmd.Flags().StringSliceVar(&verifyCmdConfig.skip, "skip", nil, "fields not to verify: mode, owner, group or xattrs")
+}
@@ -0,0 +1,94 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/containerd/continuity/verity"
+	"github.com/opencontainers/go-digest"
+	"github.com/spf13/cobra"
+)
+
+var verityCmdConfig struct {
+	salt         string
+	algorithm    string
+	noSuperblock bool
+}
+
+var VerityCmd = &cobra.Command{
+	Use:   "verity <image> <hash-file>",
+	Short: "Write the dm-verity hash tree of an image and print its root hash",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 2 {
+			log.Fatalln("please specify an image and a hash file")
+		}
+
+		salt, err := hex.DecodeString(verityCmdConfig.salt)
+		if err != nil {
+			log.Fatalf("invalid salt: %v", err)
+		}
+
+		image, err := os.Open(args[0])
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer image.Close()
+		fi, err := image.Stat()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		out, err := os.Create(args[1])
+		if err != nil {
+			log.Fatal(err)
+		}
+		w := bufio.NewWriter(out)
+
+		tree, err := verity.Build(w, bufio.NewReader(image), fi.Size(), verity.Params{
+			Algorithm:    digest.Algorithm(verityCmdConfig.algorithm),
+			Salt:         salt,
+			NoSuperblock: verityCmdConfig.noSuperblock,
+		})
+		if err != nil {
+			log.Fatalf("error building hash tree: %v", err)
+		}
+		if err := w.Flush(); err != nil {
+			log.Fatal(err)
+		}
+		if err := out.Close(); err != nil {
+			log.Fatal(err)
+		}
+
+		fmt.Printf("Data blocks:\t%d\n", tree.DataBlocks)
+		fmt.Printf("Data block size:\t%d\n", tree.Params.DataBlockSize)
+		fmt.Printf("Hash block size:\t%d\n", tree.Params.HashBlockSize)
+		fmt.Printf("Hash algorithm:\t%s\n", tree.Params.Algorithm)
+		fmt.Printf("Salt:\t%x\n", tree.Params.Salt)
+		fmt.Printf("Root hash:\t%x\n", tree.RootHash)
+	},
+}
+
+func init() {
+	VerityCmd.Flags().StringVar(&verityCmdConfig.salt, "salt", "", "hex-encoded salt hashed before every block")
+	VerityCmd.Flags().StringVar(&verityCmdConfig.algorithm, "hash", "sha256", "hash algorithm of the tree")
+	VerityCmd.Flags().BoolVar(&verityCmdConfig.noSuperblock, "no-superblock", false, "leave out the superblock, as with veritysetup --no-superblock")
+}
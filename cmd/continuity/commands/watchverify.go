@@ -0,0 +1,133 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/containerd/continuity"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var watchVerifyCmdConfig struct {
+	interval time.Duration
+	webhook  string
+}
+
+var WatchVerifyCmd = &cobra.Command{
+	Use:   "watch-verify <root> <manifest>",
+	Short: "Verify the root against the provided manifest continuously",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 2 {
+			log.Fatalln("please specify a root and manifest")
+		}
+
+		root, path := args[0], args[1]
+
+		p, err := readManifest(path)
+		if err != nil {
+			log.Fatalf("error reading manifest: %v", err)
+		}
+
+		m, err := continuity.Unmarshal(p)
+		if err != nil {
+			log.Fatalf("error unmarshaling manifest: %v", err)
+		}
+
+		ctx, err := continuity.NewContextWithOptions(root, continuity.ContextOptions{
+			Logger: logrusLogger{},
+		})
+		if err != nil {
+			log.Fatalf("error getting context: %v", err)
+		}
+
+		watcher := &continuity.Watcher{
+			Context:  ctx,
+			Manifest: m,
+			Interval: watchVerifyCmdConfig.interval,
+			OnDrift: func(event continuity.DriftEvent) {
+				if event.Resolved {
+					logrus.WithField("path", event.Path).Info("resource matches the manifest again")
+				} else {
+					logrus.WithField("path", event.Path).WithError(event.Err).Warn("resource drifted from the manifest")
+				}
+
+				if watchVerifyCmdConfig.webhook != "" {
+					if err := postDriftEvent(watchVerifyCmdConfig.webhook, event); err != nil {
+						logrus.WithError(err).Error("error posting drift event")
+					}
+				}
+			},
+		}
+
+		sctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer stop()
+		if err := watcher.Run(sctx); err != nil && err != context.Canceled {
+			log.Fatalf("error watching root: %v", err)
+		}
+	},
+}
+
+// driftEventJSON is the body posted to the webhook for every drift event.
+type driftEventJSON struct {
+	Path     string    `json:"path"`
+	Error    string    `json:"error,omitempty"`
+	Resolved bool      `json:"resolved"`
+	Time     time.Time `json:"time"`
+}
+
+func postDriftEvent(url string, event continuity.DriftEvent) error {
+	body := driftEventJSON{
+		Path:     event.Path,
+		Resolved: event.Resolved,
+		Time:     event.Time,
+	}
+	if event.Err != nil {
+		body.Error = event.Err.Error()
+	}
+
+	p, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(p))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status from webhook: %s", resp.Status)
+	}
+	return nil
+}
+
+func init() {
+	WatchVerifyCmd.Flags().DurationVar(&watchVerifyCmdConfig.interval, "interval", time.Minute, "time between verifications of the whole root, or 0 to only watch for changes")
+	WatchVerifyCmd.Flags().StringVar(&watchVerifyCmdConfig.webhook, "webhook", "", "URL to POST drift events to as JSON")
+}
@@ -0,0 +1,66 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"bufio"
+	"log"
+	"os"
+	"time"
+
+	"github.com/containerd/continuity"
+	"github.com/containerd/continuity/ziparchive"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var zipCmdConfig struct {
+	content string
+	strict  bool
+}
+
+var ZipCmd = &cobra.Command{
+	Use:   "zip <manifest> <archive>",
+	Short: "Write a zip archive of the manifest, with file content from --content",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 2 {
+			log.Fatalln("please specify a manifest and an archive")
+		}
+
+		var dropped []ziparchive.Dropped
+		writeImage(args[0], zipCmdConfig.content, args[1], "archive", func(out *os.File, m *continuity.Manifest, provider continuity.ContentProvider, modTime time.Time) error {
+			w := bufio.NewWriter(out)
+			var err error
+			dropped, err = ziparchive.Write(w, m, provider, ziparchive.Options{
+				ModTime: modTime,
+				Strict:  zipCmdConfig.strict,
+			})
+			if err != nil {
+				return err
+			}
+			return w.Flush()
+		})
+		for _, d := range dropped {
+			logrus.WithField("path", d.Path).Warnf("zip archive cannot carry %s", d.Metadata)
+		}
+	},
+}
+
+func init() {
+	ZipCmd.Flags().StringVar(&zipCmdConfig.content, "content", "", "provide file content from a directory stored by build --store, an HTTP blob store URL, or a tar archive")
+	ZipCmd.Flags().BoolVar(&zipCmdConfig.strict, "strict", false, "fail rather than drop metadata zip archives cannot carry")
+}
@@ -123,12 +123,31 @@ func (f *File) getDirent(name string) (fuse.Dirent, error) {
 	}, nil
 }
 
+// Readlink returns the target of the file, if it is a symlink
+func (f *File) Readlink(ctx context.Context, req *fuse.ReadlinkRequest) (string, error) {
+	sl, ok := f.resource.(continuity.SymLink)
+	if !ok {
+		return "", fuse.Errno(syscall.EINVAL)
+	}
+	return sl.Target(), nil
+}
+
 type fileHandler struct {
 	offset int64
 	reader io.ReadCloser
 }
 
 func (h *fileHandler) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	if ra, ok := h.reader.(io.ReaderAt); ok {
+		n, err := ra.ReadAt(resp.Data[:req.Size], req.Offset)
+		if err != nil && err != io.EOF {
+			logrus.Debugf("Read error: %v", err)
+			return err
+		}
+		resp.Data = resp.Data[:n]
+		return nil
+	}
+
 	if h.offset != req.Offset {
 		if seeker, ok := h.reader.(io.Seeker); ok {
 			if _, err := seeker.Seek(req.Offset, io.SeekStart); err != nil {
@@ -142,7 +161,7 @@ func (h *fileHandler) Read(ctx context.Context, req *fuse.ReadRequest, resp *fus
 	}
 
 	n, err := h.reader.Read(resp.Data[:req.Size])
-	if err != nil {
+	if err != nil && err != io.EOF {
 		logrus.Debugf("Read error: %v", err)
 		return err
 	}
@@ -17,9 +17,11 @@
 package continuityfs
 
 import (
+	"fmt"
 	"io"
 	"path/filepath"
 
+	"github.com/containerd/continuity"
 	"github.com/containerd/continuity/driver"
 	"github.com/opencontainers/go-digest"
 )
@@ -55,3 +57,75 @@ func (p *fsContentProvider) Path(path string, dgst digest.Digest) (string, error
 func (p *fsContentProvider) Open(path string, dgst digest.Digest) (io.ReadCloser, error) {
 	return p.driver.Open(filepath.Join(p.root, path))
 }
+
+type contentProvider struct {
+	provider continuity.ContentProvider
+}
+
+// NewContentProvider creates a new content provider which gets
+// content by digest from a content store, such as a directory
+// written by build --store or an HTTP blob store. Content is read
+// at random offsets when the store supports it.
+//
+// Content read sequentially is checked against its digest, and the
+// read reaching its end fails if it does not match. Content read at
+// random offsets cannot be checked without reading all of it, so it
+// is served as the store returns it; only mount stores that are
+// trusted, or that check content themselves.
+func NewContentProvider(provider continuity.ContentProvider) FileContentProvider {
+	return &contentProvider{
+		provider: provider,
+	}
+}
+
+func (p *contentProvider) Path(path string, dgst digest.Digest) (string, error) {
+	return "", fmt.Errorf("content of %q is not stored at a path: %w", path, continuity.ErrNotSupported)
+}
+
+func (p *contentProvider) Open(path string, dgst digest.Digest) (io.ReadCloser, error) {
+	if dgst == "" {
+		return nil, fmt.Errorf("no digest for %q: %w", path, continuity.ErrNotFound)
+	}
+	if rap, ok := p.provider.(continuity.ReaderAtProvider); ok {
+		ra, err := rap.ReaderAt(dgst)
+		if err != nil {
+			return nil, err
+		}
+		return &sectionReadCloser{
+			SectionReader: io.NewSectionReader(ra, 0, ra.Size()),
+			Closer:        ra,
+		}, nil
+	}
+	r, err := p.provider.Reader(dgst)
+	if err != nil {
+		return nil, err
+	}
+	if !dgst.Algorithm().Available() {
+		return r, nil
+	}
+	return &verifiedReadCloser{ReadCloser: r, path: path, dgst: dgst, verifier: dgst.Verifier()}, nil
+}
+
+// verifiedReadCloser fails the read reaching the end of the content if the
+// content does not match its digest.
+type verifiedReadCloser struct {
+	io.ReadCloser
+	path     string
+	dgst     digest.Digest
+	verifier digest.Verifier
+}
+
+func (r *verifiedReadCloser) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.verifier.Write(p[:n])
+	if err == io.EOF && !r.verifier.Verified() {
+		return n, fmt.Errorf("content of %q does not match %s", r.path, r.dgst)
+	}
+	return n, err
+}
+
+// sectionReadCloser reads, seeks and reads at offsets of content.
+type sectionReadCloser struct {
+	*io.SectionReader
+	io.Closer
+}
@@ -0,0 +1,156 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continuityfs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/containerd/continuity"
+	"github.com/containerd/continuity/testutil"
+	"github.com/opencontainers/go-digest"
+)
+
+// readerAtProvider is a MapProvider that also reads content at offsets.
+type readerAtProvider struct {
+	testutil.MapProvider
+}
+
+func (p readerAtProvider) ReaderAt(dgst digest.Digest) (continuity.ContentReaderAt, error) {
+	b, ok := p.MapProvider[dgst]
+	if !ok {
+		return nil, continuity.ErrNotFound
+	}
+	return bytesReaderAt{bytes.NewReader(b)}, nil
+}
+
+type bytesReaderAt struct {
+	*bytes.Reader
+}
+
+func (bytesReaderAt) Close() error { return nil }
+
+// readFile reads the file at name in the root of the filesystem, in chunks
+// of n bytes at increasing offsets, as the kernel does.
+func readFile(t *testing.T, filesystem fs.FS, name string, n int) (string, error) {
+	t.Helper()
+	ctx := context.Background()
+
+	root, err := filesystem.Root()
+	if err != nil {
+		t.Fatal(err)
+	}
+	node, err := root.(*Dir).Lookup(ctx, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := node.(*File).Open(ctx, &fuse.OpenRequest{}, &fuse.OpenResponse{})
+	if err != nil {
+		return "", err
+	}
+	handler := h.(*fileHandler)
+	defer handler.Release(ctx, &fuse.ReleaseRequest{})
+
+	var sb strings.Builder
+	for {
+		resp := &fuse.ReadResponse{Data: make([]byte, n)}
+		if err := handler.Read(ctx, &fuse.ReadRequest{Offset: int64(sb.Len()), Size: n}, resp); err != nil {
+			return sb.String(), err
+		}
+		if len(resp.Data) == 0 {
+			return sb.String(), nil
+		}
+		sb.Write(resp.Data)
+	}
+}
+
+func TestContentProvider(t *testing.T) {
+	attrs := continuity.Attributes{Mode: 0o644}
+	var resources []continuity.Resource
+	for name, content := range map[string]string{"a": "content of a", "b": "content of b"} {
+		r, err := continuity.NewRegularFile([]string{"/" + name}, attrs, int64(len(content)), digest.FromString(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resources = append(resources, r)
+	}
+	m := &continuity.Manifest{Resources: resources}
+
+	store := testutil.MapProvider{
+		digest.FromString("content of a"): []byte("content of a"),
+		digest.FromString("content of b"): []byte("tampered"),
+	}
+
+	for _, tc := range []struct {
+		name     string
+		provider continuity.ContentProvider
+		// tampered is whether the tampered content of b is noticed.
+		tampered bool
+	}{
+		{name: "sequential", provider: store, tampered: true},
+		{name: "random access", provider: readerAtProvider{store}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			filesystem, err := NewFSFromManifest(m, t.TempDir(), NewContentProvider(tc.provider))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			content, err := readFile(t, filesystem, "a", 5)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if content != "content of a" {
+				t.Fatalf("unexpected content %q", content)
+			}
+
+			_, err = readFile(t, filesystem, "b", 5)
+			if tampered := err != nil; tampered != tc.tampered {
+				t.Fatalf("expected tampered content to be noticed: %v, got %v", tc.tampered, err)
+			}
+		})
+	}
+}
+
+func TestContentProviderOpen(t *testing.T) {
+	provider := NewContentProvider(testutil.MapProvider{})
+
+	if _, err := provider.Path("/a", digest.FromString("a")); !errors.Is(err, continuity.ErrNotSupported) {
+		t.Fatalf("expected content not to be stored at a path, got %v", err)
+	}
+	if _, err := provider.Open("/a", ""); !errors.Is(err, continuity.ErrNotFound) {
+		t.Fatalf("expected a file without a digest not to be found, got %v", err)
+	}
+	if _, err := provider.Open("/a", digest.FromString("a")); err == nil {
+		t.Fatal("expected missing content to fail")
+	}
+
+	r, err := NewContentProvider(testutil.MapProvider{digest.FromString("a"): []byte("a")}).Open("/a", digest.FromString("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if p, err := io.ReadAll(r); err != nil || string(p) != "a" {
+		t.Fatalf("expected content %q, got %q, %v", "a", p, err)
+	}
+}
@@ -1,23 +1,40 @@
 module github.com/containerd/continuity/cmd/continuity
 
-go 1.17
+go 1.22
 
 require (
 	bazil.org/fuse v0.0.0-20200524192727-fb710f7dfd05
 	github.com/containerd/continuity v0.0.0-00010101000000-000000000000 // see replace
+	github.com/containerd/continuity/compression v0.0.0-00010101000000-000000000000 // see replace
+	github.com/containerd/continuity/driver/sftp v0.0.0-00010101000000-000000000000 // see replace
+	github.com/containerd/continuity/remote v0.0.0-00010101000000-000000000000 // see replace
 	github.com/dustin/go-humanize v1.0.0
-	github.com/golang/protobuf v1.5.2
+	github.com/golang/protobuf v1.5.4
 	github.com/opencontainers/go-digest v1.0.0
 	github.com/sirupsen/logrus v1.8.1
 	github.com/spf13/cobra v1.4.0
+	golang.org/x/crypto v0.21.0
+	google.golang.org/grpc v1.64.0
 )
 
 require (
+	github.com/Microsoft/go-winio v0.5.2 // indirect
 	github.com/inconshreveable/mousetrap v1.0.0 // indirect
+	github.com/klauspost/compress v1.18.0 // indirect
 	github.com/spf13/pflag v1.0.5 // indirect
-	golang.org/x/sys v0.0.0-20220405210540-1e041c57c461 // indirect
-	google.golang.org/protobuf v1.26.0 // indirect
+	golang.org/x/net v0.22.0 // indirect
+	golang.org/x/sync v0.6.0 // indirect
+	golang.org/x/sys v0.18.0 // indirect
+	golang.org/x/text v0.14.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20240318140521-94a12d6c2237 // indirect
+	google.golang.org/protobuf v1.33.0 // indirect
 )
 
 // use local source for the main module
 replace github.com/containerd/continuity => ../../
+
+replace github.com/containerd/continuity/compression => ../../compression
+
+replace github.com/containerd/continuity/driver/sftp => ../../driver/sftp
+
+replace github.com/containerd/continuity/remote => ../../remote
@@ -0,0 +1,119 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package compression writes and reads compressed manifests. It is a module
+// of its own, so that the core module does not depend on zstd.
+package compression
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/containerd/continuity"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression selects the compression of a manifest written by
+// WriteManifest.
+type Compression string
+
+const (
+	// Uncompressed writes manifests uncompressed.
+	Uncompressed Compression = ""
+	// Gzip compresses manifests with gzip.
+	Gzip Compression = "gzip"
+	// Zstd compresses manifests with zstd.
+	Zstd Compression = "zstd"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// WriteManifest writes the manifest to w in the protobuf encoding of
+// continuity.Marshal, compressed with c.
+func WriteManifest(w io.Writer, m *continuity.Manifest, c Compression) error {
+	p, err := continuity.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	var cw io.WriteCloser
+	switch c {
+	case Uncompressed:
+		_, err := w.Write(p)
+		return err
+	case Gzip:
+		cw = gzip.NewWriter(w)
+	case Zstd:
+		cw, err = zstd.NewWriter(w)
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("compression %q is not supported: %w", c, continuity.ErrNotSupported)
+	}
+
+	if _, err := cw.Write(p); err != nil {
+		cw.Close()
+		return err
+	}
+	return cw.Close()
+}
+
+// ReadManifest reads a manifest written by WriteManifest, or by
+// continuity.Marshal, from r. The compression is detected from the content.
+func ReadManifest(r io.Reader, opts ...continuity.UnmarshalOpt) (*continuity.Manifest, error) {
+	dr, err := Decompress(r)
+	if err != nil {
+		return nil, err
+	}
+	defer dr.Close()
+
+	p, err := io.ReadAll(dr)
+	if err != nil {
+		return nil, err
+	}
+	return continuity.Unmarshal(p, opts...)
+}
+
+// Decompress returns a reader of the content of r, decompressed if it was
+// compressed with one of the supported compressions. Content that is not
+// compressed is returned as is, so that manifests in any encoding can be
+// read from files that may or may not have been compressed.
+func Decompress(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(len(zstdMagic))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		return gzip.NewReader(br)
+	case bytes.HasPrefix(magic, zstdMagic):
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	}
+	return io.NopCloser(br), nil
+}
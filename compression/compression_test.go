@@ -0,0 +1,62 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package compression
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/containerd/continuity"
+	"github.com/opencontainers/go-digest"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestCompression(t *testing.T) {
+	var resources []continuity.Resource
+	for i := 0; i < 100; i++ {
+		r, err := continuity.NewRegularFile([]string{fmt.Sprintf("/file%03d", i)}, continuity.Attributes{Mode: 0o644}, 1, digest.FromString(fmt.Sprint(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resources = append(resources, r)
+	}
+	m := &continuity.Manifest{Resources: resources}
+
+	for _, c := range []Compression{Uncompressed, Gzip, Zstd} {
+		var buf bytes.Buffer
+		if err := WriteManifest(&buf, m, c); err != nil {
+			t.Fatalf("%q: %v", c, err)
+		}
+		decoded, err := ReadManifest(&buf)
+		if err != nil {
+			t.Fatalf("%q: %v", c, err)
+		}
+		if !proto.Equal(continuity.ToProto(m), continuity.ToProto(decoded)) {
+			t.Fatalf("%q: manifest differs after a round trip", c)
+		}
+	}
+
+	if err := WriteManifest(io.Discard, m, "lz4"); !errors.Is(err, continuity.ErrNotSupported) {
+		t.Fatalf("expected an unknown compression to be rejected, got %v", err)
+	}
+	if m, err := ReadManifest(bytes.NewReader(nil)); err != nil || len(m.Resources) != 0 {
+		t.Fatalf("expected an empty manifest, got %v", err)
+	}
+}
@@ -0,0 +1,152 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package content
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containerd/continuity"
+	"github.com/opencontainers/go-digest"
+)
+
+// buildStored builds the manifest of a tree, storing its content in d.
+func buildStored(t *testing.T, d *Dir) *continuity.Manifest {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "a"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []string{"a/b", "c"} {
+		if err := os.WriteFile(filepath.Join(root, file), []byte("content of "+file), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, err := continuity.NewContextWithOptions(root, continuity.ContextOptions{Sink: d})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := continuity.BuildManifest(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// applyFrom applies the manifest to a new root with the provider, and
+// verifies the result.
+func applyFrom(t *testing.T, m *continuity.Manifest, provider continuity.ContentProvider) error {
+	root := t.TempDir()
+	ctx, err := continuity.NewContextWithOptions(root, continuity.ContextOptions{Provider: provider})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := continuity.ApplyManifest(ctx, m); err != nil {
+		return err
+	}
+	return continuity.VerifyManifest(ctx, m)
+}
+
+func TestDir(t *testing.T) {
+	d := NewDir(t.TempDir())
+	m := buildStored(t, d)
+	if err := applyFrom(t, m, d); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := d.Reader(digest.FromString("missing")); !errors.Is(err, continuity.ErrNotFound) {
+		t.Fatalf("expected missing content not to be found, got %v", err)
+	}
+	if _, err := d.Reader(digest.Digest("sha256:../../etc/passwd")); err == nil {
+		t.Fatal("expected an invalid digest to be rejected")
+	}
+
+	// Content that does not match its digest is not applied.
+	p, err := d.Path(digest.FromString("content of c"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(p, []byte("content of x"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := applyFrom(t, m, d); err == nil {
+		t.Fatal("expected corrupted content to be rejected")
+	}
+}
+
+func TestImportTar(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, file := range []string{"a/b", "c"} {
+		content := "content of " + file
+		if err := tw.WriteHeader(&tar.Header{Name: file, Mode: 0o644, Size: int64(len(content)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(tw, content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: "a/", Mode: 0o755, Typeflag: tar.TypeDir}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	m := buildStored(t, NewDir(t.TempDir()))
+	d := NewDir(t.TempDir())
+	if err := ImportTar(d, &buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := applyFrom(t, m, d); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHTTP(t *testing.T) {
+	dir := t.TempDir()
+	m := buildStored(t, NewDir(dir))
+
+	srv := httptest.NewServer(http.FileServer(http.Dir(dir)))
+	defer srv.Close()
+
+	h := NewHTTP(srv.URL+"/", nil)
+	if err := applyFrom(t, m, h); err != nil {
+		t.Fatal(err)
+	}
+
+	ra, err := h.ReaderAt(digest.FromString("content of a/b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ra.Close()
+	p := make([]byte, 8)
+	if n, err := ra.ReadAt(p, 11); n != 3 || err != io.EOF || string(p[:n]) != "a/b" {
+		t.Fatalf("expected a short read at the end, got %q, %v", p[:n], err)
+	}
+
+	if _, err := h.Reader(digest.FromString("missing")); !errors.Is(err, continuity.ErrNotFound) {
+		t.Fatalf("expected missing content not to be found, got %v", err)
+	}
+}
@@ -0,0 +1,148 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package content provides stores of file content addressed by digest, to
+// provide content to continuity.ApplyManifest through
+// continuity.ContextOptions.Provider, and to store it as manifests are built
+// through continuity.ContextOptions.Sink.
+package content
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/containerd/continuity"
+	"github.com/opencontainers/go-digest"
+)
+
+// Dir stores content in a local directory, in a file per digest named by its
+// encoded part, in a directory named by its algorithm, as in the blobs
+// directory of an OCI image layout:
+//
+//	<dir>/sha256/<hex>
+type Dir struct {
+	dir string
+}
+
+var (
+	_ continuity.ContentProvider  = &Dir{}
+	_ continuity.ReaderAtProvider = &Dir{}
+	_ continuity.ContentSink      = &Dir{}
+)
+
+// NewDir returns the store in the directory dir, which is created when
+// content is first stored.
+func NewDir(dir string) *Dir {
+	return &Dir{dir: dir}
+}
+
+// Path returns the path of the file holding the content of the digest dgst.
+func (d *Dir) Path(dgst digest.Digest) (string, error) {
+	if err := dgst.Validate(); err != nil {
+		return "", err
+	}
+	return filepath.Join(d.dir, string(dgst.Algorithm()), dgst.Encoded()), nil
+}
+
+// Reader implements continuity.ContentProvider.
+func (d *Dir) Reader(dgst digest.Digest) (io.ReadCloser, error) {
+	return d.open(dgst)
+}
+
+// ReaderAt implements continuity.ReaderAtProvider.
+func (d *Dir) ReaderAt(dgst digest.Digest) (continuity.ContentReaderAt, error) {
+	f, err := d.open(dgst)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &sizedReaderAt{ReaderAt: f, Closer: f, size: fi.Size()}, nil
+}
+
+func (d *Dir) open(dgst digest.Digest) (*os.File, error) {
+	p, err := d.Path(dgst)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("content %s: %w", dgst, continuity.ErrNotFound)
+	}
+	return f, err
+}
+
+// Writer implements continuity.ContentSink. The content is written to a
+// temporary file in the directory, which is moved into place when it is
+// committed.
+func (d *Dir) Writer(p string) (continuity.ContentWriter, error) {
+	if err := os.MkdirAll(d.dir, 0o755); err != nil {
+		return nil, err
+	}
+	f, err := os.CreateTemp(d.dir, ".ingest-")
+	if err != nil {
+		return nil, err
+	}
+	return &dirWriter{File: f, dir: d}, nil
+}
+
+type dirWriter struct {
+	*os.File
+	dir       *Dir
+	committed bool
+}
+
+func (w *dirWriter) Commit(dgst digest.Digest, size int64) error {
+	target, err := w.dir.Path(dgst)
+	if err != nil {
+		return err
+	}
+	if err := w.File.Sync(); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return err
+	}
+	if err := os.Rename(w.Name(), target); err != nil {
+		return err
+	}
+	w.committed = true
+	return nil
+}
+
+func (w *dirWriter) Close() error {
+	err := w.File.Close()
+	if !w.committed {
+		os.Remove(w.Name())
+	}
+	return err
+}
+
+// sizedReaderAt implements continuity.ContentReaderAt.
+type sizedReaderAt struct {
+	io.ReaderAt
+	io.Closer
+	size int64
+}
+
+func (r *sizedReaderAt) Size() int64 {
+	return r.size
+}
@@ -0,0 +1,152 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package content
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/containerd/continuity"
+	"github.com/opencontainers/go-digest"
+)
+
+// HTTP provides content from a blob store served over HTTP, at the same
+// paths relative to its base URL as in a Dir, so that a Dir served by a
+// static file server can be used:
+//
+//	<base>/sha256/<hex>
+//
+// Random access is done with range requests.
+type HTTP struct {
+	base   string
+	client *http.Client
+}
+
+var (
+	_ continuity.ContentProvider  = &HTTP{}
+	_ continuity.ReaderAtProvider = &HTTP{}
+)
+
+// NewHTTP returns the store at the base URL, requested with client, or with
+// http.DefaultClient if client is nil.
+func NewHTTP(base string, client *http.Client) *HTTP {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &HTTP{base: strings.TrimSuffix(base, "/"), client: client}
+}
+
+func (h *HTTP) url(dgst digest.Digest) (string, error) {
+	if err := dgst.Validate(); err != nil {
+		return "", err
+	}
+	return h.base + "/" + string(dgst.Algorithm()) + "/" + dgst.Encoded(), nil
+}
+
+// do sends a request for the content of dgst, checking that it succeeded
+// with the status expected.
+func (h *HTTP) do(method string, dgst digest.Digest, header http.Header, expected int) (*http.Response, error) {
+	u, err := h.url(dgst)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(method, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != expected {
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, fmt.Errorf("content %s: %w", dgst, continuity.ErrNotFound)
+		}
+		return nil, fmt.Errorf("unexpected status %s for %s %s", resp.Status, method, u)
+	}
+	return resp, nil
+}
+
+// Reader implements continuity.ContentProvider.
+func (h *HTTP) Reader(dgst digest.Digest) (io.ReadCloser, error) {
+	resp, err := h.do(http.MethodGet, dgst, nil, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// ReaderAt implements continuity.ReaderAtProvider. The size of the content
+// is requested first, and each read at an offset is a request of its own.
+func (h *HTTP) ReaderAt(dgst digest.Digest) (continuity.ContentReaderAt, error) {
+	resp, err := h.do(http.MethodHead, dgst, nil, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.ContentLength < 0 {
+		return nil, fmt.Errorf("size of content %s is unknown", dgst)
+	}
+	return &httpReaderAt{http: h, dgst: dgst, size: resp.ContentLength}, nil
+}
+
+type httpReaderAt struct {
+	http *HTTP
+	dgst digest.Digest
+	size int64
+}
+
+func (r *httpReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off >= r.size {
+		return 0, io.EOF
+	}
+	end := off + int64(len(p))
+	if end > r.size {
+		end = r.size
+	}
+	if end == off {
+		return 0, nil
+	}
+
+	header := http.Header{"Range": {fmt.Sprintf("bytes=%d-%d", off, end-1)}}
+	resp, err := r.http.do(http.MethodGet, r.dgst, header, http.StatusPartialContent)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	n, err := io.ReadFull(resp.Body, p[:end-off])
+	if err == nil && end < off+int64(len(p)) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (r *httpReaderAt) Size() int64 {
+	return r.size
+}
+
+func (r *httpReaderAt) Close() error {
+	return nil
+}
@@ -0,0 +1,63 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package content
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// ImportTar reads the tar stream r, storing the content of its regular files
+// in d by their canonical digest, so that the files of a manifest of the
+// unpacked archive can be provided from it. Other entries are skipped.
+func ImportTar(d *Dir, r io.Reader) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		if err := importFile(d, hdr.Name, tr); err != nil {
+			return fmt.Errorf("failed to import %s: %w", hdr.Name, err)
+		}
+	}
+}
+
+func importFile(d *Dir, name string, r io.Reader) error {
+	w, err := d.Writer(name)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	digester := digest.Canonical.Digester()
+	n, err := io.Copy(w, io.TeeReader(r, digester.Hash()))
+	if err != nil {
+		return err
+	}
+	return w.Commit(digester.Digest(), n)
+}
@@ -18,12 +18,15 @@ package continuity
 
 import (
 	"bytes"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/containerd/continuity/devices"
 	driverpkg "github.com/containerd/continuity/driver"
@@ -55,23 +58,205 @@ type Context interface {
 // not under the given root.
 type SymlinkPath func(root, linkname, target string) (string, error)
 
+// appleMetadataXAttrs are the extended attributes through which darwin
+// exposes resource forks and Finder metadata.
+var appleMetadataXAttrs = []string{
+	"com.apple.ResourceFork",
+	"com.apple.FinderInfo",
+}
+
 // ContextOptions represents options to create a new context.
 type ContextOptions struct {
-	Digester   Digester
-	Driver     driverpkg.Driver
+	Digester Digester
+
+	// Driver performs all filesystem operations of the context, so that
+	// alternate backends, such as remote, chrooted or fake filesystems, can
+	// be used. Optional interfaces of the driver package, such as
+	// driver.XAttrDriver, enable the features that need them. If nil, the
+	// local filesystem is used.
+	Driver driverpkg.Driver
+
+	// PathDriver manipulates the paths of the driver and walks the tree. It
+	// must be set along with drivers whose paths are not local ones.
 	PathDriver pathdriver.PathDriver
-	Provider   ContentProvider
+
+	Provider ContentProvider
+
+	// Sink, if set, receives the content of regular files as it is read to
+	// digest them when resources are built, so that it can be stored in the
+	// same pass. Files reused from the journal of a build are not read, so
+	// their content is not written to the sink again.
+	Sink ContentSink
+
+	// AppleMetadata enables capturing the com.apple.ResourceFork and
+	// com.apple.FinderInfo extended attributes on darwin. They are omitted
+	// by default, since the Finder rewrites them freely, but application
+	// bundles are not faithfully reproduced without them. Once recorded in
+	// a manifest, they are always restored by Apply.
+	AppleMetadata bool
+
+	// OneFileSystem prevents Walk from crossing filesystem boundaries, by
+	// comparing the device of each resource with that of the root. Mount
+	// points are still visited, so that they appear as empty directories,
+	// but their contents are skipped. Btrfs subvolumes have their own device
+	// ids and are treated as boundaries just like mounts. This has no effect
+	// on platforms without device numbers.
+	OneFileSystem bool
+
+	// Subvolumes records the roots of btrfs subvolumes as mount points,
+	// marked as subvolumes. Otherwise, only separate mounts are recorded and
+	// subvolumes appear as regular directories.
+	Subvolumes bool
+
+	// ProjectIDs enables capturing and verifying the project quota ids of
+	// regular files and directories, where the driver and filesystem support
+	// them. Once recorded in a manifest, they are always restored by Apply.
+	ProjectIDs bool
+
+	// BirthTimes enables capturing the creation times of resources, where the
+	// driver and filesystem record them, such as with statx(2) on Linux.
+	// Birth times cannot be set, so they are neither verified nor restored.
+	BirthTimes bool
+
+	// ClampTime, if not zero, clamps the birth times captured with
+	// BirthTimes, so that no resource is recorded as created after it, for
+	// manifests to be reproducible. See SourceDateEpoch.
+	ClampTime time.Time
+
+	// ModeMask holds permission bits that Apply clears from the modes
+	// recorded for resources, as a umask does, and that Verify then expects
+	// to be clear. When it is zero, recorded modes are applied exactly:
+	// Apply sets the mode of each resource explicitly once it is created,
+	// which has the effect of a zero umask without changing the umask of the
+	// process, which all of its threads share. Bits other than permission
+	// bits are ignored.
+	ModeMask os.FileMode
+
+	// TrustVerity makes Verify rely on the kernel's fs-verity measurement of
+	// regular files, rather than reading their content, when it matches the
+	// fs-verity digest recorded in the manifest. Files without fs-verity
+	// enabled are still verified by content.
+	TrustVerity bool
+
+	// SkipFilesystems lists the types of filesystems, such as "proc" or
+	// "tmpfs", that Walk will not descend into when they are mounted within
+	// the root. As with OneFileSystem, the mount points themselves are still
+	// visited. Filesystem types are only detected on Linux.
+	SkipFilesystems []string
+
+	// Exclude lists patterns of resources that Walk leaves out, along with
+	// the contents of matching directories. Patterns are matched as by
+	// Prune, and those ending in a separator only match directories. When
+	// the local filesystem is walked on Linux, entries are matched on the
+	// type recorded in their directory, so excluded ones are never stated.
+	Exclude []string
+
+	// FollowSymlinks makes the context describe what symbolic links lead to
+	// rather than the links themselves, as find -L does, so that manifests
+	// record the resolved view of the tree. Links to directories are walked
+	// into, except those leading to a directory above them, which would walk
+	// forever and are recorded as empty directories. Targets are resolved
+	// within the root, absolute ones relative to it, and links that dangle
+	// are recorded as links. Apply is not affected.
+	FollowSymlinks bool
+
+	// SymlinkEscape selects how links followed with FollowSymlinks that lead
+	// out of the root through ".." are handled.
+	SymlinkEscape EscapePolicy
+
+	// Retry selects how reads of the content of regular files are retried
+	// when they fail transiently or the files change while they are read.
+	Retry RetryPolicy
+
+	// Progress, if set, is updated as resources are built, verified or
+	// applied through the context and as file content is read.
+	Progress Progress
+
+	// ProgressInterval is the minimum time between two updates of Progress.
+	// If zero, Progress is updated for every resource and every read.
+	ProgressInterval time.Duration
+
+	// Metrics, if set, receives counts and timings of the operations done
+	// through the context.
+	Metrics Metrics
+
+	// Logger receives the log messages of the context. If nil, they are
+	// discarded.
+	Logger Logger
+
+	// BytesPerSecond limits the rate at which file content is read, to
+	// digest or to copy it, so that scans of busy hosts leave bandwidth to
+	// their workloads. Zero means no limit.
+	BytesPerSecond int64
+
+	// OpsPerSecond limits the rate of calls to Resource, Verify and Apply.
+	// Zero means no limit.
+	OpsPerSecond int64
+}
+
+// EscapePolicy selects how symbolic links leading out of the root are
+// handled when they are followed.
+type EscapePolicy int
+
+const (
+	// EscapeScope resolves links as if the root were the root of the
+	// filesystem, so that ".." at the root stays at the root.
+	EscapeScope EscapePolicy = iota
+
+	// EscapeKeep records links leading out of the root as links.
+	EscapeKeep
+
+	// EscapeReject fails on links leading out of the root.
+	EscapeReject
+)
+
+// maxSymlinks is the number of symbolic links followed to resolve a path
+// before giving up, as with the ELOOP limit of Linux.
+const maxSymlinks = 40
+
+// VirtualFilesystems lists the types of pseudo filesystems whose contents
+// are meaningless to record in a manifest and may block when read. Use it as
+// ContextOptions.SkipFilesystems to leave them out of a manifest of a live
+// system. Note that devtmpfs mounts are detected as tmpfs.
+var VirtualFilesystems = []string{
+	"proc",
+	"sysfs",
+	"devtmpfs",
+	"cgroup",
+	"cgroup2",
+	"tmpfs",
 }
 
 // context represents a file system context for accessing resources.
 // Generally, all path qualified access and system considerations should land
 // here.
 type context struct {
-	driver     driverpkg.Driver
-	pathDriver pathdriver.PathDriver
-	root       string
-	digester   Digester
-	provider   ContentProvider
+	driver        driverpkg.Driver
+	pathDriver    pathdriver.PathDriver
+	root          string
+	digester      Digester
+	provider      ContentProvider
+	sink          ContentSink
+	lazy          *LazyTree
+	appleMetadata bool
+	oneFileSystem bool
+	subvolumes    bool
+	projectIDs    bool
+	birthTimes    bool
+	clampTime     time.Time
+	modeMask      os.FileMode
+	trustVerity   bool
+	skipFS        []string
+	exclude       []string
+	excludeDirs   []string
+	follow        bool
+	escape        EscapePolicy
+	retry         RetryPolicy
+	progress      *progressTracker
+	metrics       Metrics
+	logger        Logger
+	bytesLimit    *limiter
+	opsLimit      *limiter
 }
 
 // NewContext returns a Context associated with root. The default driver will
@@ -102,11 +287,31 @@ func NewContextWithOptions(root string, options ContextOptions) (Context, error)
 		}
 	}
 
+	var exclude, excludeDirs []string
+	for _, pattern := range options.Exclude {
+		if trimmed := strings.TrimRight(pattern, string(os.PathSeparator)); trimmed != pattern {
+			excludeDirs = append(excludeDirs, trimmed)
+		} else {
+			exclude = append(exclude, pattern)
+		}
+	}
+	if exclude, err = compilePatterns(exclude); err != nil {
+		return nil, err
+	}
+	if excludeDirs, err = compilePatterns(excludeDirs); err != nil {
+		return nil, err
+	}
+
 	digester := options.Digester
 	if digester == nil {
 		digester = simpleDigester{digest.Canonical}
 	}
 
+	logger := options.Logger
+	if logger == nil {
+		logger = discardLogger{}
+	}
+
 	// Check the root directory. Need to be a little careful here. We are
 	// allowing a link for now, but this may have odd behavior when
 	// canonicalizing paths. As long as all files are opened through the link
@@ -121,11 +326,31 @@ func NewContextWithOptions(root string, options ContextOptions) (Context, error)
 	}
 
 	return &context{
-		root:       root,
-		driver:     driver,
-		pathDriver: pathDriver,
-		digester:   digester,
-		provider:   options.Provider,
+		root:          root,
+		driver:        driver,
+		pathDriver:    pathDriver,
+		digester:      digester,
+		provider:      options.Provider,
+		sink:          options.Sink,
+		appleMetadata: options.AppleMetadata,
+		oneFileSystem: options.OneFileSystem,
+		subvolumes:    options.Subvolumes,
+		projectIDs:    options.ProjectIDs,
+		birthTimes:    options.BirthTimes,
+		clampTime:     options.ClampTime,
+		modeMask:      options.ModeMask & os.ModePerm,
+		trustVerity:   options.TrustVerity,
+		skipFS:        options.SkipFilesystems,
+		exclude:       exclude,
+		excludeDirs:   excludeDirs,
+		follow:        options.FollowSymlinks,
+		escape:        options.SymlinkEscape,
+		retry:         options.Retry,
+		progress:      newProgressTracker(options.Progress, options.ProgressInterval),
+		metrics:       options.Metrics,
+		logger:        logger,
+		bytesLimit:    newLimiter(options.BytesPerSecond),
+		opsLimit:      newLimiter(options.OpsPerSecond),
 	}, nil
 }
 
@@ -133,13 +358,62 @@ func NewContextWithOptions(root string, options ContextOptions) (Context, error)
 // from fi. The path p should be the path of the resource in the context,
 // typically obtained through Walk or from the value of Resource.Path(). If fi
 // is nil, it will be resolved.
-func (c *context) Resource(p string, fi os.FileInfo) (Resource, error) {
-	fp, err := c.fullpath(p)
+func (c *context) Resource(p string, fi os.FileInfo) (_ Resource, err error) {
+	c.opsLimit.wait(1)
+	c.progress.entry(p)
+	defer c.observe("resource", time.Now(), &err)
+
+	return c.resource(p, fi, contentStore)
+}
+
+// contentCheck selects how the content of regular files is checked when
+// resolving a resource.
+type contentCheck int
+
+const (
+	// contentDigest digests the content.
+	contentDigest contentCheck = iota
+	// contentTrustVerity digests the content unless fs-verity is enabled.
+	contentTrustVerity
+	// contentSkip leaves the content alone.
+	contentSkip
+	// contentStore digests the content, writing it to the sink of the
+	// context as it is read, as when building.
+	contentStore
+)
+
+// resource implements Resource, checking the content of regular files as
+// selected by check. Regular files whose content is not digested have no
+// digests.
+func (c *context) resource(p string, fi os.FileInfo, check contentCheck) (Resource, error) {
+	// When following symbolic links, the resource is read from where the
+	// links lead, but keeps its path.
+	src := p
+	if c.follow {
+		target, err := c.resolveSymlinks(p)
+		if err != nil {
+			return nil, err
+		}
+		if target != p {
+			src, fi = target, nil
+		}
+	}
+
+	fp, err := c.fullpath(src)
 	if err != nil {
 		return nil, err
 	}
 
-	if fi == nil {
+	// Where the driver provides extended metadata, the resource is stated
+	// again, so that the details that would otherwise take calls of their
+	// own come along in a single one.
+	var stx *driverpkg.Statx
+	if statxDriver, ok := c.driver.(driverpkg.StatxDriver); ok {
+		fi, stx, err = statxDriver.Lstatx(fp)
+		if err != nil {
+			return nil, err
+		}
+	} else if fi == nil {
 		fi, err = c.driver.Lstat(fp)
 		if err != nil {
 			return nil, err
@@ -152,14 +426,70 @@ func (c *context) Resource(p string, fi os.FileInfo) (Resource, error) {
 	}
 
 	base.xattrs, err = c.resolveXAttrs(fp, fi, base)
-	if err != nil && !errors.Is(err, ErrNotSupported) {
+	if err != nil {
+		if !errors.Is(err, ErrNotSupported) {
+			return nil, err
+		}
+		c.logger.Log(LogLevelDebug, "skipping extended attributes", "path", p, "error", err)
+	}
+
+	base.reparseTag, base.reparseData, err = c.resolveReparsePoint(fp, fi)
+	if err != nil {
 		return nil, err
 	}
 
+	if c.projectIDs && (fi.Mode().IsRegular() || fi.Mode().IsDir()) {
+		base.projectID, err = c.resolveProjectID(fp)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if c.birthTimes {
+		if stx != nil {
+			base.birthTime = stx.BirthTime
+		} else {
+			base.birthTime, err = c.resolveBirthTime(fp)
+			if err != nil {
+				return nil, err
+			}
+		}
+		base.birthTime = clampTime(base.birthTime, c.clampTime)
+	}
+
+	switch base.reparseTag {
+	case 0:
+	case ReparseTagSymlink, ReparseTagMountPoint:
+		// Junctions are recorded as links to their target, regardless of how
+		// the runtime reports their mode. The tag tells them apart.
+		base.mode = os.ModeSymlink | base.mode.Perm()
+	default:
+		// Other reparse points keep the type of the underlying file or
+		// directory and carry their reparse data alongside.
+		base.mode &^= os.ModeIrregular | os.ModeSymlink
+	}
+
 	// TODO(stevvooe): Handle windows alternate data streams.
 
-	if fi.Mode().IsRegular() {
-		dgst, err := c.digest(p)
+	if base.Mode().IsRegular() {
+		// Files known not to have fs-verity enabled need not be measured.
+		if set, known := statxAttribute(stx, driverpkg.StatxAttrVerity); set || !known {
+			base.verityDigest, err = c.resolveVerity(fp)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if check == contentSkip || (check == contentTrustVerity && base.verityDigest != "") {
+			return newRegularFile(*base, base.paths, fi.Size())
+		}
+
+		var dgst digest.Digest
+		var sink ContentSink
+		if check == contentStore {
+			sink = c.sink
+		}
+		dgst, fi, base.unstable, err = c.stableDigest(p, src, fp, fi, sink)
 		if err != nil {
 			return nil, err
 		}
@@ -167,11 +497,16 @@ func (c *context) Resource(p string, fi os.FileInfo) (Resource, error) {
 		return newRegularFile(*base, base.paths, fi.Size(), dgst)
 	}
 
-	if fi.Mode().IsDir() {
+	if base.Mode().IsDir() {
+		base.mount, err = c.resolveMountPoint(fp, fi, stx)
+		if err != nil {
+			return nil, err
+		}
+
 		return newDirectory(*base)
 	}
 
-	if fi.Mode()&os.ModeSymlink != 0 {
+	if base.Mode()&os.ModeSymlink != 0 {
 		// We handle relative links vs absolute links by including a
 		// beginning slash for absolute links. Effectively, the bundle's
 		// root is treated as the absolute link anchor.
@@ -180,14 +515,14 @@ func (c *context) Resource(p string, fi os.FileInfo) (Resource, error) {
 			return nil, err
 		}
 
-		return newSymLink(*base, target)
+		return newSymLink(*base, target, symlinkType(fi))
 	}
 
-	if fi.Mode()&os.ModeNamedPipe != 0 {
+	if base.Mode()&os.ModeNamedPipe != 0 {
 		return newNamedPipe(*base, base.paths)
 	}
 
-	if fi.Mode()&os.ModeDevice != 0 {
+	if base.Mode()&os.ModeDevice != 0 {
 		deviceDriver, ok := c.driver.(driverpkg.DeviceInfoDriver)
 		if !ok {
 			return nil, fmt.Errorf("device extraction is not supported for %s: %w", fp, ErrNotSupported)
@@ -206,23 +541,74 @@ func (c *context) Resource(p string, fi os.FileInfo) (Resource, error) {
 	return nil, fmt.Errorf("%q (%v) is not supported: %w", fp, fi.Mode(), ErrNotFound)
 }
 
-func (c *context) verifyMetadata(resource, target Resource) error {
-	if target.Mode() != resource.Mode() {
-		return fmt.Errorf("resource %q has incorrect mode: %v != %v", target.Path(), target.Mode(), resource.Mode())
+func (c *context) verifyMetadata(resource, target Resource, skip map[VerifyField]bool) error {
+	// A change in what is mounted at a directory explains any other
+	// difference in it, or below it, so it is reported first.
+	if m, ok := resource.(Mounted); ok {
+		if tm, tok := target.(Mounted); tok {
+			expected, actual := m.MountPoint(), tm.MountPoint()
+			switch {
+			case expected == nil && actual != nil:
+				return mismatch(resource.Path(), FailureMount, &FieldMismatch{Name: "mount", Actual: describeMount(actual)}, "resource %q differs because it is now the root of %s", resource.Path(), describeMount(actual))
+			case expected != nil && actual == nil:
+				return mismatch(resource.Path(), FailureMount, &FieldMismatch{Name: "mount", Expected: describeMount(expected)}, "resource %q differs because it was the root of %s when the manifest was built", resource.Path(), describeMount(expected))
+			case expected != nil && expected.FSID != "" && actual.FSID != "" && expected.FSID != actual.FSID:
+				return mismatch(resource.Path(), FailureMount, &FieldMismatch{Name: "mount.fsid", Expected: expected.FSID, Actual: actual.FSID}, "resource %q differs because a different filesystem is mounted there: %s != %s", resource.Path(), actual.FSID, expected.FSID)
+			}
+		}
 	}
 
-	if target.UID() != resource.UID() {
-		return fmt.Errorf("unexpected uid for %q: %v != %v", target.Path(), target.UID(), resource.GID())
+	modeMask := ^os.FileMode(0)
+	if skip[FieldMode] {
+		modeMask = os.ModeType
+	}
+	if target.Mode()&modeMask != resource.Mode()&modeMask {
+		class := FailureMetadata
+		if target.Mode()&os.ModeType != resource.Mode()&os.ModeType {
+			class = FailureType
+		}
+		return mismatch(resource.Path(), class, &FieldMismatch{Name: "mode", Expected: formatMode(resource.Mode()), Actual: formatMode(target.Mode())}, "resource %q has incorrect mode: %v != %v", target.Path(), target.Mode(), resource.Mode())
 	}
 
-	if target.GID() != resource.GID() {
-		return fmt.Errorf("unexpected gid for %q: %v != %v", target.Path(), target.GID(), target.GID())
+	if c.projectIDs {
+		var expected, actual uint32
+		if pr, ok := resource.(ProjectIDer); ok {
+			expected = pr.ProjectID()
+		}
+		if tpr, ok := target.(ProjectIDer); ok {
+			actual = tpr.ProjectID()
+		}
+		if actual != expected {
+			return mismatch(resource.Path(), FailureMetadata, &FieldMismatch{Name: "project_id", Expected: fmt.Sprint(expected), Actual: fmt.Sprint(actual)}, "unexpected project id for %q: %v != %v", target.Path(), actual, expected)
+		}
 	}
 
-	if xattrer, ok := resource.(XAttrer); ok {
+	// File attributes are only captured where they can be applied.
+	if _, ok := c.driver.(driverpkg.FileAttributeDriver); ok {
+		var expected, actual uint32
+		if fa, ok := resource.(FileAttributer); ok {
+			expected = fa.FileAttributes()
+		}
+		if tfa, ok := target.(FileAttributer); ok {
+			actual = tfa.FileAttributes()
+		}
+		if actual != expected {
+			return mismatch(resource.Path(), FailureMetadata, &FieldMismatch{Name: "file_attributes", Expected: fmt.Sprintf("%#x", expected), Actual: fmt.Sprintf("%#x", actual)}, "unexpected file attributes for %q: %#x != %#x", target.Path(), actual, expected)
+		}
+	}
+
+	if !skip[FieldOwner] && target.UID() != resource.UID() {
+		return mismatch(resource.Path(), FailureMetadata, &FieldMismatch{Name: "uid", Expected: fmt.Sprint(resource.UID()), Actual: fmt.Sprint(target.UID())}, "unexpected uid for %q: %v != %v", target.Path(), target.UID(), resource.UID())
+	}
+
+	if !skip[FieldGroup] && target.GID() != resource.GID() {
+		return mismatch(resource.Path(), FailureMetadata, &FieldMismatch{Name: "gid", Expected: fmt.Sprint(resource.GID()), Actual: fmt.Sprint(target.GID())}, "unexpected gid for %q: %v != %v", target.Path(), target.GID(), resource.GID())
+	}
+
+	if xattrer, ok := resource.(XAttrer); ok && !skip[FieldXAttrs] {
 		txattrer, tok := target.(XAttrer)
 		if !tok {
-			return fmt.Errorf("resource %q has xattrs but target does not support them", resource.Path())
+			return mismatch(resource.Path(), FailureMetadata, nil, "resource %q has xattrs but target does not support them", resource.Path())
 		}
 
 		// For xattrs, only ensure that we have those defined in the resource
@@ -232,15 +618,30 @@ func (c *context) verifyMetadata(resource, target Resource) error {
 		for attr, value := range xattrer.XAttrs() {
 			tvalue, ok := txattrs[attr]
 			if !ok {
-				return fmt.Errorf("resource %q target missing xattr %q", resource.Path(), attr)
+				return mismatch(resource.Path(), FailureMetadata, &FieldMismatch{Name: "xattr." + attr, Expected: fmt.Sprintf("%q", value)}, "resource %q target missing xattr %q", resource.Path(), attr)
 			}
 
 			if !bytes.Equal(value, tvalue) {
-				return fmt.Errorf("xattr %q value differs for resource %q", attr, resource.Path())
+				return mismatch(resource.Path(), FailureMetadata, &FieldMismatch{Name: "xattr." + attr, Expected: fmt.Sprintf("%q", value), Actual: fmt.Sprintf("%q", tvalue)}, "xattr %q value differs for resource %q", attr, resource.Path())
 			}
 		}
 	}
 
+	if rp, ok := resource.(ReparsePoint); ok {
+		trp, tok := target.(ReparsePoint)
+		if !tok {
+			return mismatch(resource.Path(), FailureType, nil, "resource %q is a reparse point but target does not support them", resource.Path())
+		}
+
+		if trp.ReparseTag() != rp.ReparseTag() {
+			return mismatch(resource.Path(), FailureType, &FieldMismatch{Name: "reparse_tag", Expected: fmt.Sprintf("%#x", rp.ReparseTag()), Actual: fmt.Sprintf("%#x", trp.ReparseTag())}, "resource %q has mismatched reparse tag: %#x != %#x", resource.Path(), trp.ReparseTag(), rp.ReparseTag())
+		}
+
+		if !bytes.Equal(trp.ReparseData(), rp.ReparseData()) {
+			return mismatch(resource.Path(), FailureContent, &FieldMismatch{Name: "reparse_data", Expected: fmt.Sprintf("%x", rp.ReparseData()), Actual: fmt.Sprintf("%x", trp.ReparseData())}, "reparse data differs for resource %q", resource.Path())
+		}
+	}
+
 	switch r := resource.(type) {
 	case RegularFile:
 		// TODO(stevvooe): Another reason to use a record-based approach. We
@@ -249,39 +650,43 @@ func (c *context) verifyMetadata(resource, target Resource) error {
 		// be sure.
 		t, ok := target.(RegularFile)
 		if !ok {
-			return fmt.Errorf("resource %q target not a regular file", r.Path())
+			return mismatch(r.Path(), FailureType, nil, "resource %q target not a regular file", r.Path())
 		}
 
 		if t.Size() != r.Size() {
-			return fmt.Errorf("resource %q target has incorrect size: %v != %v", t.Path(), t.Size(), r.Size())
+			return mismatch(r.Path(), FailureContent, &FieldMismatch{Name: "size", Expected: fmt.Sprint(r.Size()), Actual: fmt.Sprint(t.Size())}, "resource %q target has incorrect size: %v != %v", t.Path(), t.Size(), r.Size())
 		}
 	case Directory:
-		t, ok := target.(Directory)
+		_, ok := target.(Directory)
 		if !ok {
-			return fmt.Errorf("resource %q target not a directory", t.Path())
+			return mismatch(r.Path(), FailureType, nil, "resource %q target not a directory", r.Path())
 		}
 	case SymLink:
 		t, ok := target.(SymLink)
 		if !ok {
-			return fmt.Errorf("resource %q target not a symlink", t.Path())
+			return mismatch(r.Path(), FailureType, nil, "resource %q target not a symlink", r.Path())
 		}
 
 		if t.Target() != r.Target() {
-			return fmt.Errorf("resource %q target has mismatched target: %q != %q", t.Path(), t.Target(), r.Target())
+			return mismatch(r.Path(), FailureContent, &FieldMismatch{Name: "target", Expected: r.Target(), Actual: t.Target()}, "resource %q target has mismatched target: %q != %q", t.Path(), t.Target(), r.Target())
+		}
+
+		if expected, actual := linkType(r), linkType(t); expected != SymlinkTypeUnknown && actual != SymlinkTypeUnknown && expected != actual {
+			return mismatch(r.Path(), FailureType, &FieldMismatch{Name: "symlink_type", Expected: fmt.Sprint(expected), Actual: fmt.Sprint(actual)}, "resource %q target has mismatched symlink type: %v != %v", t.Path(), actual, expected)
 		}
 	case Device:
 		t, ok := target.(Device)
 		if !ok {
-			return fmt.Errorf("resource %q is not a device", t.Path())
+			return mismatch(r.Path(), FailureType, nil, "resource %q is not a device", r.Path())
 		}
 
 		if t.Major() != r.Major() || t.Minor() != r.Minor() {
-			return fmt.Errorf("resource %q has mismatched major/minor numbers: %d,%d != %d,%d", t.Path(), t.Major(), t.Minor(), r.Major(), r.Minor())
+			return mismatch(r.Path(), FailureContent, &FieldMismatch{Name: "device", Expected: fmt.Sprintf("%d,%d", r.Major(), r.Minor()), Actual: fmt.Sprintf("%d,%d", t.Major(), t.Minor())}, "resource %q has mismatched major/minor numbers: %d,%d != %d,%d", t.Path(), t.Major(), t.Minor(), r.Major(), r.Minor())
 		}
 	case NamedPipe:
-		t, ok := target.(NamedPipe)
+		_, ok := target.(NamedPipe)
 		if !ok {
-			return fmt.Errorf("resource %q is not a named pipe", t.Path())
+			return mismatch(r.Path(), FailureType, nil, "resource %q is not a named pipe", r.Path())
 		}
 	default:
 		return fmt.Errorf("cannot verify resource: %v", resource)
@@ -293,6 +698,21 @@ func (c *context) verifyMetadata(resource, target Resource) error {
 // Verify the resource in the context. An error will be returned a discrepancy
 // is found.
 func (c *context) Verify(resource Resource) error {
+	return c.verify(resource, true, nil)
+}
+
+// verify implements Verify. If checkContent is not set, the content of
+// regular files is not verified, only their metadata. Fields in skip are not
+// verified.
+func (c *context) verify(resource Resource, checkContent bool, skip map[VerifyField]bool) (err error) {
+	c.opsLimit.wait(1)
+	c.progress.entry(resource.Path())
+	defer c.observe("verify", time.Now(), &err)
+
+	if resource, err = c.masked(resource); err != nil {
+		return err
+	}
+
 	fp, err := c.fullpath(resource.Path())
 	if err != nil {
 		return err
@@ -303,16 +723,39 @@ func (c *context) Verify(resource Resource) error {
 		return err
 	}
 
-	target, err := c.Resource(resource.Path(), fi)
+	// The content of regular files is only trusted to fs-verity if the
+	// manifest has a digest to compare the measurement against.
+	trustVerity := c.trustVerity && verityDigestOf(resource) != ""
+
+	check := contentDigest
+	switch {
+	case !checkContent:
+		check = contentSkip
+	case trustVerity:
+		check = contentTrustVerity
+	}
+
+	target, err := c.resource(resource.Path(), fi, check)
 	if err != nil {
 		return err
 	}
 
+	// Mismatches are reported with every field that differs, rather than
+	// only the first one checked.
+	defer func() {
+		var verr *VerifyError
+		if errors.As(err, &verr) && (verr.Class == FailureType || verr.Class == FailureMetadata || verr.Class == FailureContent) {
+			if fields := skipFields(compareResources(resource, target), skip); len(fields) > 0 {
+				verr.Fields = fields
+			}
+		}
+	}()
+
 	if target.Path() != resource.Path() {
-		return fmt.Errorf("resource paths do not match: %q != %q", target.Path(), resource.Path())
+		return mismatch(resource.Path(), FailureOther, &FieldMismatch{Name: "path", Expected: resource.Path(), Actual: target.Path()}, "resource paths do not match: %q != %q", target.Path(), resource.Path())
 	}
 
-	if err := c.verifyMetadata(resource, target); err != nil {
+	if err := c.verifyMetadata(resource, target, skip); err != nil {
 		return err
 	}
 
@@ -320,7 +763,7 @@ func (c *context) Verify(resource Resource) error {
 		hardlinkKey, err := newHardlinkKey(fi)
 		if err == errNotAHardLink {
 			if len(h.Paths()) > 1 {
-				return fmt.Errorf("%q is not a hardlink to %q", h.Paths()[1], resource.Path())
+				return mismatch(resource.Path(), FailureHardlink, &FieldMismatch{Name: "hardlink", Expected: h.Paths()[1]}, "%q is not a hardlink to %q", h.Paths()[1], resource.Path())
 			}
 		} else if err != nil {
 			return err
@@ -337,7 +780,9 @@ func (c *context) Verify(resource Resource) error {
 				return err
 			}
 
-			targetLink, err := c.Resource(path, fiLink)
+			// The content of the link is that of the resource, as long
+			// as they are the same file.
+			targetLink, err := c.resource(path, fiLink, contentSkip)
 			if err != nil {
 				return err
 			}
@@ -348,10 +793,10 @@ func (c *context) Verify(resource Resource) error {
 			}
 
 			if hardlinkKeyLink != hardlinkKey {
-				return fmt.Errorf("%q is not a hardlink to %q", path, resource.Path())
+				return mismatch(resource.Path(), FailureHardlink, &FieldMismatch{Name: "hardlink", Expected: path}, "%q is not a hardlink to %q", path, resource.Path())
 			}
 
-			if err := c.verifyMetadata(resource, targetLink); err != nil {
+			if err := c.verifyMetadata(resource, targetLink, skip); err != nil {
 				return err
 			}
 		}
@@ -361,7 +806,21 @@ func (c *context) Verify(resource Resource) error {
 	case RegularFile:
 		t, ok := target.(RegularFile)
 		if !ok {
-			return fmt.Errorf("resource %q target not a regular file", r.Path())
+			return mismatch(r.Path(), FailureType, nil, "resource %q target not a regular file", r.Path())
+		}
+
+		expected, actual := verityDigestOf(r), verityDigestOf(t)
+		if expected != "" && actual != "" && expected != actual {
+			return mismatch(r.Path(), FailureContent, &FieldMismatch{Name: "verity_digest", Expected: expected.String(), Actual: actual.String()}, "fs-verity digests for resource %q do not match: %v != %v", t.Path(), actual, expected)
+		}
+
+		if !checkContent {
+			break
+		}
+
+		if trustVerity && actual == expected {
+			// The kernel has measured the content for us.
+			break
 		}
 
 		// TODO(stevvooe): This may need to get a little more sophisticated
@@ -369,7 +828,7 @@ func (c *context) Verify(resource Resource) error {
 		// provided digests, rather than the implementations having an
 		// overlap.
 		if !digestsMatch(t.Digests(), r.Digests()) {
-			return fmt.Errorf("digests for resource %q do not match: %v != %v", t.Path(), t.Digests(), r.Digests())
+			return mismatch(r.Path(), FailureContent, &FieldMismatch{Name: "digest", Expected: formatDigests(r.Digests()), Actual: formatDigests(t.Digests())}, "digests for resource %q do not match: %v != %v", t.Path(), t.Digests(), r.Digests())
 		}
 	}
 
@@ -377,31 +836,173 @@ func (c *context) Verify(resource Resource) error {
 }
 
 func (c *context) checkoutFile(fp string, rf RegularFile) error {
+	if c.lazy != nil {
+		return c.lazy.placeholder(fp, rf)
+	}
+
+	// Plans are made without content, so the provider may be missing.
+	if planner, ok := c.driver.(*planDriver); ok {
+		planner.write(fp, rf)
+		return nil
+	}
+
+	r, err := c.readContent(rf)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	return c.writeFile(fp, r, rf.Size(), rf.Mode())
+}
+
+// readContent opens the content of the regular file rf from the provider
+// of the context, as OpenContent does.
+func (c *context) readContent(rf RegularFile) (io.ReadCloser, error) {
 	if c.provider == nil {
-		return fmt.Errorf("no file provider")
+		return nil, fmt.Errorf("no file provider")
+	}
+	r, err := OpenContent(c.provider, rf)
+	if err != nil {
+		return nil, err
 	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{c.contentReader(r), r}, nil
+}
+
+// OpenContent opens the content of the regular file rf from the provider,
+// by the first of its digests the provider has. Reading fails at the end of
+// the content if it does not match the digest and the size of the file, so
+// that content from untrusted providers can be relied on. The content is
+// read sequentially from the Reader of the provider; ReaderAtProvider is
+// left to random access, such as by filesystem overlays.
+func OpenContent(provider ContentProvider, rf RegularFile) (io.ReadCloser, error) {
 	var (
 		r   io.ReadCloser
 		err error
 	)
 	for _, dgst := range rf.Digests() {
-		r, err = c.provider.Reader(dgst)
+		r, err = provider.Reader(dgst)
+		if err == nil {
+			return struct {
+				io.Reader
+				io.Closer
+			}{verifyContent(r, dgst, rf.Size()), r}, nil
+		}
+	}
+	return nil, fmt.Errorf("file content could not be provided: %w", err)
+}
+
+// verifyContent returns a reader of r failing at its end if the content
+// read does not have the digest dgst and the given size, so that content
+// from untrusted providers is not written in place. Digests of algorithms
+// that are not available are not checked.
+func verifyContent(r io.Reader, dgst digest.Digest, size int64) io.Reader {
+	if !dgst.Algorithm().Available() {
+		return r
+	}
+	return &contentVerifier{r: r, dgst: dgst, size: size, verifier: dgst.Verifier()}
+}
+
+type contentVerifier struct {
+	r        io.Reader
+	dgst     digest.Digest
+	size     int64
+	n        int64
+	verifier digest.Verifier
+}
+
+func (v *contentVerifier) Read(p []byte) (int, error) {
+	n, err := v.r.Read(p)
+	v.verifier.Write(p[:n])
+	v.n += int64(n)
+	if err == io.EOF && (v.n != v.size || !v.verifier.Verified()) {
+		return n, fmt.Errorf("content does not match %s", v.dgst)
+	}
+	return n, err
+}
+
+// writeFile writes the content of r to the file at the full path fp through
+// the driver. Where the driver can rename files, the content is written to a
+// temporary file first, which then replaces fp.
+func (c *context) writeFile(fp string, r io.Reader, size int64, perm os.FileMode) error {
+	renamer, ok := c.driver.(driverpkg.RenameDriver)
+	if !ok {
+		return c.copyToFile(fp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, r, size, perm)
+	}
+
+	var tmp string
+	for i := 0; ; i++ {
+		tmp = c.pathDriver.Join(c.pathDriver.Dir(fp), fmt.Sprintf(".tmp-%s-%d%d", c.pathDriver.Base(fp), time.Now().UnixNano(), i))
+		err := c.copyToFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, r, size, perm)
 		if err == nil {
 			break
 		}
+		if !errors.Is(err, os.ErrExist) || i >= 10 {
+			return err
+		}
+	}
+
+	if err := renamer.Rename(tmp, fp); err != nil {
+		c.driver.Remove(tmp)
+		return err
 	}
+	return nil
+}
+
+// copyToFile copies the content of r to the file at the full path fp,
+// opened through the driver with flag, and sets its mode to perm.
+func (c *context) copyToFile(fp string, flag int, r io.Reader, size int64, perm os.FileMode) (err error) {
+	f, err := c.driver.OpenFile(fp, flag, perm)
 	if err != nil {
-		return fmt.Errorf("file content could not be provided: %w", err)
+		return err
+	}
+	defer func() {
+		if f != nil {
+			f.Close()
+		}
+		if err != nil && flag&os.O_EXCL != 0 {
+			c.driver.Remove(fp)
+		}
+	}()
+
+	n, err := io.Copy(f, c.progress.writes(r))
+	if err == nil && n < size {
+		return io.ErrShortWrite
+	}
+	if err != nil {
+		return err
+	}
+
+	if syncer, ok := f.(interface{ Sync() error }); ok {
+		if err := syncer.Sync(); err != nil {
+			return err
+		}
+	}
+
+	cf := f
+	f = nil
+	if err := cf.Close(); err != nil {
+		return err
 	}
-	defer r.Close()
 
-	return atomicWriteFile(fp, r, rf.Size(), rf.Mode())
+	// The mode given to OpenFile is subject to the umask.
+	return c.driver.Lchmod(fp, perm)
 }
 
 // Apply the resource to the contexts. An error will be returned if the
 // operation fails. Depending on the resource type, the resource may be
 // created. For resource that cannot be resolved, an error will be returned.
-func (c *context) Apply(resource Resource) error {
+func (c *context) Apply(resource Resource) (err error) {
+	c.opsLimit.wait(1)
+	c.progress.entry(resource.Path())
+	defer c.observe("apply", time.Now(), &err)
+
+	if resource, err = c.masked(resource); err != nil {
+		return err
+	}
+
 	fp, err := c.fullpath(resource.Path())
 	if err != nil {
 		return err
@@ -436,11 +1037,11 @@ func (c *context) Apply(resource Resource) error {
 				}
 			} else {
 				for _, dgst := range r.Digests() {
-					f, err := os.Open(fp)
+					f, err := c.driver.Open(fp)
 					if err != nil {
 						return fmt.Errorf("failure opening file for read %q: %w", resource.Path(), err)
 					}
-					compared, err := dgst.Algorithm().FromReader(f)
+					compared, err := dgst.Algorithm().FromReader(c.contentReader(f))
 					if err == nil && dgst != compared {
 						if err := c.checkoutFile(fp, r); err != nil {
 							return fmt.Errorf("error checking out file %q: %w", resource.Path(), err)
@@ -467,6 +1068,7 @@ func (c *context) Apply(resource Resource) error {
 
 	case SymLink:
 		var target string // only possibly set if target resource is a symlink
+		typ := SymlinkTypeUnknown
 
 		if fi != nil {
 			if fi.Mode()&os.ModeSymlink != 0 {
@@ -474,17 +1076,18 @@ func (c *context) Apply(resource Resource) error {
 				if err != nil {
 					return err
 				}
+				typ = symlinkType(fi)
 			}
 		}
 
-		if target != r.Target() {
+		if target != r.Target() || (typ != SymlinkTypeUnknown && linkType(r) != SymlinkTypeUnknown && typ != linkType(r)) {
 			if fi != nil {
 				if err := c.driver.Remove(fp); err != nil { // RemoveAll in case of directory?
 					return err
 				}
 			}
 
-			if err := c.driver.Symlink(r.Target(), fp); err != nil {
+			if err := c.symlink(r, fp); err != nil {
 				return err
 			}
 		}
@@ -522,7 +1125,21 @@ func (c *context) Apply(resource Resource) error {
 		}
 	}
 
+	if rp, ok := resource.(ReparsePoint); ok && len(rp.ReparseData()) > 0 {
+		rpDriver, ok := c.driver.(driverpkg.ReparsePointDriver)
+		if !ok {
+			return fmt.Errorf("unsupported reparse point for resource %q", resource.Path())
+		}
+		if err := rpDriver.SetReparsePoint(fp, rp.ReparseData()); err != nil {
+			return err
+		}
+	}
+
 	if h, isHardlinkable := resource.(Hardlinkable); isHardlinkable {
+		// The resource may have just been created, in which case it has no
+		// existing links.
+		fi, _ := c.driver.Lstat(fp)
+
 		for _, path := range h.Paths() {
 			if path == resource.Path() {
 				continue
@@ -533,7 +1150,11 @@ func (c *context) Apply(resource Resource) error {
 				return err
 			}
 
-			if _, fi := c.driver.Lstat(lp); fi == nil {
+			if lfi, err := c.driver.Lstat(lp); err == nil {
+				if fi != nil && os.SameFile(fi, lfi) {
+					// already linked
+					continue
+				}
 				c.driver.Remove(lp)
 			}
 			if err := c.driver.Link(fp, lp); err != nil {
@@ -542,8 +1163,9 @@ func (c *context) Apply(resource Resource) error {
 		}
 	}
 
-	// Update filemode if file was not created
-	if chmod {
+	// Update filemode if file was not created, unless it waits for its
+	// content, which sets it.
+	if chmod && !c.lazy.pending(resource.Path()) {
 		if err := c.driver.Lchmod(fp, resource.Mode()); err != nil {
 			return err
 		}
@@ -553,7 +1175,21 @@ func (c *context) Apply(resource Resource) error {
 		return err
 	}
 
-	if xattrer, ok := resource.(XAttrer); ok {
+	if err := c.applyFileAttributes(resource, fp); err != nil {
+		return err
+	}
+
+	if pr, ok := resource.(ProjectIDer); ok && pr.ProjectID() != 0 {
+		projectIDDriver, ok := c.driver.(driverpkg.ProjectIDDriver)
+		if !ok {
+			return fmt.Errorf("unsupported project id for resource %q", resource.Path())
+		}
+		if err := projectIDDriver.SetProjectID(fp, pr.ProjectID()); err != nil {
+			return err
+		}
+	}
+
+	if xattrer, ok := resource.(XAttrer); ok && len(xattrer.XAttrs()) > 0 {
 		// For xattrs, only ensure that we have those defined in the resource
 		// and their values are set. We can ignore other xattrs. In other words,
 		// we only set xattres defined by resource but never remove.
@@ -580,6 +1216,61 @@ func (c *context) Apply(resource Resource) error {
 	return nil
 }
 
+// masked returns the resource with the bits of the mode mask of the context
+// cleared from its mode.
+func (c *context) masked(resource Resource) (Resource, error) {
+	if resource.Mode()&c.modeMask == 0 {
+		return resource, nil
+	}
+	return withMode(resource, resource.Mode()&^c.modeMask)
+}
+
+// applyFileAttributes sets the Windows file attributes of the resource on
+// the file at the full path fp, where the driver supports them. Elsewhere,
+// they are skipped, since they have no meaning there.
+func (c *context) applyFileAttributes(resource Resource, fp string) error {
+	var attrs uint32
+	if fa, ok := resource.(FileAttributer); ok {
+		attrs = fa.FileAttributes()
+	}
+
+	faDriver, ok := c.driver.(driverpkg.FileAttributeDriver)
+	if !ok {
+		if attrs != 0 {
+			c.logger.Log(LogLevelDebug, "skipping file attributes", "path", resource.Path(), "attributes", fmt.Sprintf("%#x", attrs))
+		}
+		return nil
+	}
+	return faDriver.SetFileAttributes(fp, attrs)
+}
+
+// symlink creates the link described by r at the full path fp. Directory
+// junctions are recreated as junctions where the driver supports them and
+// fall back to symbolic links elsewhere.
+func (c *context) symlink(r SymLink, fp string) error {
+	if rp, ok := r.(ReparsePoint); ok && rp.ReparseTag() == ReparseTagMountPoint {
+		if rpDriver, ok := c.driver.(driverpkg.ReparsePointDriver); ok {
+			return rpDriver.Junction(r.Target(), fp)
+		}
+	}
+
+	if typ := linkType(r); typ != SymlinkTypeUnknown {
+		if stDriver, ok := c.driver.(driverpkg.SymlinkTypeDriver); ok {
+			return stDriver.CreateSymlink(r.Target(), fp, typ == SymlinkTypeDirectory)
+		}
+	}
+
+	return c.driver.Symlink(r.Target(), fp)
+}
+
+// linkType returns the type of the symlink r, if known.
+func linkType(r SymLink) SymlinkType {
+	if st, ok := r.(SymlinkTyper); ok {
+		return st.SymlinkType()
+	}
+	return SymlinkTypeUnknown
+}
+
 // Walk provides a convenience function to call filepath.Walk correctly for
 // the context. Otherwise identical to filepath.Walk, the path argument is
 // corrected to be contained within the context.
@@ -592,12 +1283,271 @@ func (c *context) Walk(fn filepath.WalkFunc) error {
 			return err
 		}
 	}
-	return c.pathDriver.Walk(root, func(p string, fi os.FileInfo, _ error) error {
-		contained, err := c.containWithRoot(p, root)
+
+	var mounts *mountChecker
+	if c.oneFileSystem || len(c.skipFS) > 0 {
+		fi, err := c.driver.Stat(root)
+		if err != nil {
+			return err
+		}
+		if dev, ok := deviceID(fi); ok {
+			mounts = &mountChecker{
+				context: c,
+				rootDev: dev,
+				devs:    map[string]uint64{root: dev},
+			}
+		}
+	}
+
+	return c.walkTree(root, string(os.PathSeparator), mounts, nil, fn)
+}
+
+// walkTree walks the directory at the full path dir, passing the paths of
+// the resources below it to fn as below the context path base. When
+// following symbolic links, parents holds the full paths of the directories
+// the links followed to get to dir are in.
+func (c *context) walkTree(dir, base string, mounts *mountChecker, parents []string, fn filepath.WalkFunc) error {
+	contain := func(p string) (string, error) {
+		contained, err := c.containWithRoot(p, dir)
+		if err != nil {
+			return "", err
+		}
+		return c.pathDriver.Join(base, contained), nil
+	}
+
+	walk := c.pathDriver.Walk
+	if c.pathDriver == pathdriver.LocalPathDriver {
+		// The local tree is walked directly, so that excluded entries can be
+		// left out before they are stated.
+		walk = func(root string, fn filepath.WalkFunc) error {
+			return walkDirents(root, func(p string, dir bool) bool {
+				contained, err := contain(p)
+				return err == nil && c.excluded(contained, dir)
+			}, fn)
+		}
+	}
+
+	return walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if p == dir && parents != nil {
+			// the directory a followed link leads to was passed to fn in
+			// place of the link.
+			return nil
+		}
+
+		contained, cerr := contain(p)
+		if err == nil {
+			err = cerr
+		}
+		if err == nil && p != dir && c.excluded(contained, fi.IsDir()) {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if mounts != nil && fi != nil {
+			skip, serr := mounts.skip(p, fi)
+			if serr != nil {
+				return serr
+			}
+			if skip {
+				if !fi.IsDir() {
+					// bind mounted file from another filesystem
+					c.logger.Log(LogLevelDebug, "skipping file on another filesystem", "path", contained)
+					return nil
+				}
+
+				// visit the mount point itself, but not its contents.
+				c.logger.Log(LogLevelDebug, "skipping contents of mount point", "path", contained)
+				if err := fn(contained, fi, err); err != nil {
+					return err
+				}
+				return filepath.SkipDir
+			}
+		}
+		if c.follow && err == nil && fi.Mode()&os.ModeSymlink != 0 {
+			return c.walkSymlink(p, contained, fi, mounts, parents, fn)
+		}
 		return fn(contained, fi, err)
 	})
 }
 
+// walkSymlink passes what the symbolic link at the full path fp, and the
+// context path p, leads to to fn in place of the link, and walks into it if
+// it is a directory.
+func (c *context) walkSymlink(fp, p string, fi os.FileInfo, mounts *mountChecker, parents []string, fn filepath.WalkFunc) error {
+	target, err := c.resolveSymlinks(p)
+	if err != nil {
+		return fn(p, fi, err)
+	}
+	if target == p {
+		return fn(p, fi, nil)
+	}
+
+	tp, err := c.fullpath(target)
+	if err != nil {
+		return fn(p, fi, err)
+	}
+	tfi, err := c.driver.Lstat(tp)
+	if err != nil {
+		return fn(p, fi, err)
+	}
+	if !tfi.IsDir() {
+		return fn(p, tfi, nil)
+	}
+
+	if err := fn(p, tfi, nil); err != nil {
+		if err == filepath.SkipDir {
+			return nil
+		}
+		return err
+	}
+
+	parents = append(parents[:len(parents):len(parents)], c.pathDriver.Dir(fp))
+	for _, parent := range parents {
+		if parent == tp || strings.HasPrefix(parent, tp+string(c.pathDriver.Separator())) {
+			c.logger.Log(LogLevelDebug, "not walking into symbolic link to a parent directory", "path", p)
+			return nil
+		}
+	}
+
+	if mounts != nil {
+		skip, err := mounts.skip(tp, tfi)
+		if err != nil {
+			return err
+		}
+		if skip {
+			c.logger.Log(LogLevelDebug, "skipping contents of mount point", "path", p)
+			return nil
+		}
+	}
+
+	return c.walkTree(tp, p, mounts, parents, fn)
+}
+
+// resolveSymlinks resolves the symbolic links along the context path p,
+// component by component, within the root, and returns the context path of
+// the resource they lead to. Absolute targets are resolved relative to the
+// root. The path p itself is returned where the last link is to be kept as a
+// link: when it dangles or loops, or leads out of the root with EscapeKeep.
+func (c *context) resolveSymlinks(p string) (string, error) {
+	sep := string(c.pathDriver.Separator())
+	resolved := sep
+	queue := strings.Split(p, sep)
+	var links int
+	var escaped bool
+	for len(queue) > 0 {
+		name := queue[0]
+		queue = queue[1:]
+
+		switch name {
+		case "", ".":
+			continue
+		case "..":
+			if resolved == sep {
+				escaped = true
+			} else {
+				resolved = c.pathDriver.Dir(resolved)
+			}
+			continue
+		}
+
+		next := c.pathDriver.Join(resolved, name)
+		fp, err := c.fullpath(next)
+		if err != nil {
+			return "", err
+		}
+		fi, err := c.driver.Lstat(fp)
+		if err != nil {
+			if os.IsNotExist(err) || errors.Is(err, syscall.ENOTDIR) {
+				return p, nil
+			}
+			return "", err
+		}
+		if fi.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+
+		if links++; links > maxSymlinks {
+			return p, nil
+		}
+		target, err := c.driver.Readlink(fp)
+		if err != nil {
+			return "", err
+		}
+		target = c.pathDriver.FromSlash(target)
+		if c.pathDriver.IsAbs(target) {
+			resolved = sep
+		}
+		queue = append(strings.Split(target, sep), queue...)
+	}
+
+	if escaped {
+		switch c.escape {
+		case EscapeKeep:
+			return p, nil
+		case EscapeReject:
+			return "", fmt.Errorf("symbolic link %s leads out of the root", p)
+		}
+	}
+
+	return resolved, nil
+}
+
+// excluded reports whether the resource at path p, a directory if dir is set,
+// is excluded from walks.
+func (c *context) excluded(p string, dir bool) bool {
+	if len(c.exclude) == 0 && len(c.excludeDirs) == 0 {
+		return false
+	}
+	return matchPatterns(c.exclude, p) || dir && matchPatterns(c.excludeDirs, p)
+}
+
+// mountChecker decides which filesystem boundaries a walk may cross.
+type mountChecker struct {
+	*context
+	rootDev uint64
+	devs    map[string]uint64 // device ids of the visited directories
+}
+
+// skip reports whether the resource at the full path fp lives on a
+// filesystem that must not be walked into.
+func (mc *mountChecker) skip(fp string, fi os.FileInfo) (bool, error) {
+	dev, ok := deviceID(fi)
+	if !ok {
+		return false, nil
+	}
+	if fi.IsDir() {
+		mc.devs[fp] = dev
+	}
+
+	if mc.oneFileSystem && dev != mc.rootDev {
+		return true, nil
+	}
+
+	if len(mc.skipFS) == 0 {
+		return false, nil
+	}
+
+	// Only look up the filesystem type where a mount is crossed.
+	if parent, ok := mc.devs[mc.pathDriver.Dir(fp)]; !ok || parent == dev {
+		return false, nil
+	}
+
+	fstype, _, err := mc.statFilesystem(fp)
+	if err != nil {
+		return false, err
+	}
+
+	for _, skip := range mc.skipFS {
+		if fstype == skip {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
 // fullpath returns the system path for the resource, joined with the context
 // root. The path p must be a part of the context.
 func (c *context) fullpath(p string) (string, error) {
@@ -624,38 +1574,289 @@ func (c *context) containWithRoot(p string, root string) (string, error) {
 	return c.pathDriver.Join("/", c.pathDriver.Clean(sanitized)), nil
 }
 
+// contentReader wraps a reader of file content for progress reporting and
+// rate limiting.
+func (c *context) contentReader(r io.Reader) io.Reader {
+	return c.progress.reader(c.bytesLimit.reader(r))
+}
+
 // digest returns the digest of the file at path p, relative to the root.
-func (c *context) digest(p string) (digest.Digest, error) {
+func (c *context) digest(p string, w io.Writer) (digest.Digest, int64, error) {
 	f, err := c.driver.Open(c.pathDriver.Join(c.root, p))
 	if err != nil {
-		return "", err
+		return "", 0, err
 	}
 	defer f.Close()
 
-	return c.digester.Digest(f)
+	r := c.contentReader(f)
+	if w != nil {
+		r = io.TeeReader(r, w)
+	}
+
+	start := time.Now()
+	cr := &countingReader{Reader: r}
+	dgst, err := c.digester.Digest(cr)
+	if err == nil && c.metrics != nil {
+		c.metrics.Hashed(cr.n, time.Since(start))
+	}
+
+	return dgst, cr.n, err
 }
 
 // resolveXAttrs attempts to resolve the extended attributes for the resource
 // at the path fp, which is the full path to the resource. If the resource
 // cannot have xattrs, nil will be returned.
 func (c *context) resolveXAttrs(fp string, fi os.FileInfo, base *resource) (map[string][]byte, error) {
+	var (
+		xattrs map[string][]byte
+		err    error
+	)
+
 	if fi.Mode().IsRegular() || fi.Mode().IsDir() {
 		xattrDriver, ok := c.driver.(driverpkg.XAttrDriver)
 		if !ok {
 			return nil, fmt.Errorf("xattr extraction is not supported: %w", ErrNotSupported)
 		}
 
-		return xattrDriver.Getxattr(fp)
-	}
-
-	if fi.Mode()&os.ModeSymlink != 0 {
+		xattrs, err = xattrDriver.Getxattr(fp)
+	} else if fi.Mode()&os.ModeSymlink != 0 {
 		lxattrDriver, ok := c.driver.(driverpkg.LXAttrDriver)
 		if !ok {
 			return nil, fmt.Errorf("xattr extraction for symlinks is not supported: %w", ErrNotSupported)
 		}
 
-		return lxattrDriver.LGetxattr(fp)
+		xattrs, err = lxattrDriver.LGetxattr(fp)
+	}
+
+	if errors.Is(err, driverpkg.ErrNotSupported) {
+		return nil, fmt.Errorf("xattr extraction is not supported: %v: %w", err, ErrNotSupported)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if !c.appleMetadata {
+		for _, attr := range appleMetadataXAttrs {
+			delete(xattrs, attr)
+		}
+	}
+
+	return xattrs, nil
+}
+
+// resolveVerity returns the fs-verity file digest of the regular file at the
+// full path fp. An empty digest is returned if fs-verity is not enabled or not
+// supported.
+func (c *context) resolveVerity(fp string) (digest.Digest, error) {
+	verityDriver, ok := c.driver.(driverpkg.VerityDriver)
+	if !ok {
+		return "", nil
+	}
+
+	dgst, err := verityDriver.MeasureVerity(fp)
+	if err != nil {
+		if errors.Is(err, driverpkg.ErrNotSupported) {
+			c.logger.Log(LogLevelDebug, "fs-verity not supported", "path", fp, "error", err)
+			return "", nil
+		}
+		return "", err
+	}
+
+	return dgst, nil
+}
+
+// verityDigestOf returns the fs-verity digest carried by r, if any.
+func verityDigestOf(r Resource) digest.Digest {
+	if vf, ok := r.(VerityFile); ok {
+		return vf.VerityDigest()
+	}
+	return ""
+}
+
+// resolveProjectID returns the project quota id of the resource at the full
+// path fp. Zero is returned where project ids are not supported.
+func (c *context) resolveProjectID(fp string) (uint32, error) {
+	projectIDDriver, ok := c.driver.(driverpkg.ProjectIDDriver)
+	if !ok {
+		return 0, nil
+	}
+
+	id, err := projectIDDriver.GetProjectID(fp)
+	if err != nil {
+		if errors.Is(err, driverpkg.ErrNotSupported) {
+			c.logger.Log(LogLevelDebug, "project ids not supported", "path", fp, "error", err)
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	return id, nil
+}
+
+// resolveBirthTime returns the creation time of the resource at the full path
+// fp. The zero time is returned where birth times are not supported.
+func (c *context) resolveBirthTime(fp string) (time.Time, error) {
+	birthTimeDriver, ok := c.driver.(driverpkg.BirthTimeDriver)
+	if !ok {
+		return time.Time{}, nil
+	}
+
+	t, err := birthTimeDriver.BirthTime(fp)
+	if err != nil {
+		if errors.Is(err, driverpkg.ErrNotSupported) {
+			c.logger.Log(LogLevelDebug, "birth times not supported", "path", fp, "error", err)
+			return time.Time{}, nil
+		}
+		return time.Time{}, err
+	}
+
+	return t, nil
+}
+
+// statxAttribute reports whether the extended metadata stx has the attribute
+// attr, and whether it is known at all. Nothing is known without metadata.
+func statxAttribute(stx *driverpkg.Statx, attr uint64) (set bool, known bool) {
+	if stx == nil {
+		return false, false
+	}
+	return stx.Attribute(attr)
+}
+
+// statFilesystem returns the name of the type and the id of the filesystem
+// containing the full path fp. Empty strings are returned where the driver
+// cannot tell.
+func (c *context) statFilesystem(fp string) (fstype string, fsid string, err error) {
+	fsDriver, ok := c.driver.(driverpkg.FilesystemDriver)
+	if !ok {
+		return "", "", nil
+	}
+
+	fstype, fsid, err = fsDriver.StatFilesystem(fp)
+	if errors.Is(err, driverpkg.ErrNotSupported) {
+		return "", "", nil
+	}
+	return fstype, fsid, err
+}
+
+// resolveMountPoint returns the filesystem mounted at the directory at the
+// full path fp, or nil if the directory is on the same filesystem as its
+// parent.
+func (c *context) resolveMountPoint(fp string, fi os.FileInfo, stx *driverpkg.Statx) (*MountPoint, error) {
+	dev, ok := deviceID(fi)
+	if !ok || fp == c.root {
+		return nil, nil
+	}
+
+	// Directories known not to be the root of a mount can only be a
+	// boundary as the root of a btrfs subvolume, which need not be
+	// compared with their parent otherwise.
+	if root, known := statxAttribute(stx, driverpkg.StatxAttrMountRoot); known && !root && !isSubvolume(fi, "btrfs") {
+		return nil, nil
+	}
+
+	var (
+		pfi  os.FileInfo
+		pstx *driverpkg.Statx
+		err  error
+	)
+	if statxDriver, ok := c.driver.(driverpkg.StatxDriver); ok {
+		pfi, pstx, err = statxDriver.Lstatx(c.pathDriver.Dir(fp))
+	} else {
+		pfi, err = c.driver.Stat(c.pathDriver.Dir(fp))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// The mount id tells mounts apart, including bind mounts of the
+	// filesystem of the parent, which share its device id, and btrfs
+	// subvolumes, which have their own device id on the same mount. The
+	// device ids are only compared where the mount ids are unknown.
+	pdev, ok := deviceID(pfi)
+	if !ok {
+		return nil, nil
+	}
+	sameMount := pdev == dev
+	mountIDs := stx != nil && pstx != nil && stx.MountID != 0 && pstx.MountID != 0
+	if mountIDs {
+		sameMount = stx.MountID == pstx.MountID
+	}
+	if sameMount && pdev == dev {
+		return nil, nil
+	}
+
+	fstype, fsid, err := c.statFilesystem(fp)
+	if err != nil {
+		return nil, err
+	}
+
+	mount := &MountPoint{Type: fstype, FSID: fsid}
+	if isSubvolume(fi, fstype) {
+		// A subvolume root on the mount of its parent is not a mount, even
+		// though it has its own device id. Without mount ids, it is told
+		// by the filesystem id, which is that of the btrfs filesystem of
+		// its parent with the id of the subvolume masked in.
+		inParent := sameMount
+		if !mountIDs {
+			ptype, pfsid, err := c.statFilesystem(c.pathDriver.Dir(fp))
+			if err != nil {
+				return nil, err
+			}
+			inParent = ptype == fstype && sameBtrfs(fsid, pfsid)
+		}
+		if inParent {
+			if !c.subvolumes {
+				return nil, nil
+			}
+			mount.Subvolume = true
+		}
+	} else if sameMount {
+		return nil, nil
+	}
+
+	return mount, nil
+}
+
+// describeMount returns a short description of the filesystem mounted at m,
+// for use in error messages.
+func describeMount(m *MountPoint) string {
+	switch {
+	case m.Subvolume:
+		return fmt.Sprintf("a %s subvolume", m.Type)
+	case m.Type == "":
+		return "a separate mount"
+	default:
+		return fmt.Sprintf("a %s mount", m.Type)
+	}
+}
+
+// resolveReparsePoint returns the reparse tag of the resource at the path fp,
+// which is the full path to the resource, along with its raw reparse data if
+// it is neither a symbolic link nor a directory junction. If the resource is
+// not a reparse point, a zero tag is returned.
+func (c *context) resolveReparsePoint(fp string, fi os.FileInfo) (uint32, []byte, error) {
+	if !isReparsePoint(fi) {
+		return 0, nil, nil
+	}
+
+	rpDriver, ok := c.driver.(driverpkg.ReparsePointDriver)
+	if !ok {
+		return 0, nil, fmt.Errorf("reparse point extraction is not supported for %s: %w", fp, ErrNotSupported)
+	}
+
+	data, err := rpDriver.GetReparsePoint(fp)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if len(data) < 4 {
+		return 0, nil, fmt.Errorf("invalid reparse data for %s", fp)
+	}
+
+	tag := binary.LittleEndian.Uint32(data)
+	if tag == ReparseTagSymlink || tag == ReparseTagMountPoint {
+		return tag, nil, nil
 	}
 
-	return nil, nil
+	return tag, data, nil
 }
@@ -0,0 +1,527 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continuity
+
+import (
+	stdcontext "context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	driverpkg "github.com/containerd/continuity/driver"
+	"github.com/containerd/continuity/testutil"
+	"golang.org/x/sys/unix"
+)
+
+func TestMountBoundaries(t *testing.T) {
+	testutil.RequiresRoot(t)
+
+	root := t.TempDir()
+	mnt := filepath.Join(root, "mnt")
+	if err := os.Mkdir(mnt, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "a"), []byte("a"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := unix.Mount("tmpfs", mnt, "tmpfs", 0, ""); err != nil {
+		t.Fatal(err)
+	}
+	defer testutil.Unmount(t, mnt)
+
+	if err := os.WriteFile(filepath.Join(mnt, "b"), []byte("b"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		options  ContextOptions
+		expected []string
+	}{
+		{
+			name:     "Default",
+			expected: []string{"/a", "/mnt", "/mnt/b"},
+		},
+		{
+			name:     "OneFileSystem",
+			options:  ContextOptions{OneFileSystem: true},
+			expected: []string{"/a", "/mnt"},
+		},
+		{
+			name:     "VirtualFilesystems",
+			options:  ContextOptions{SkipFilesystems: VirtualFilesystems},
+			expected: []string{"/a", "/mnt"},
+		},
+		{
+			name:     "OtherFilesystems",
+			options:  ContextOptions{SkipFilesystems: []string{"proc"}},
+			expected: []string{"/a", "/mnt", "/mnt/b"},
+		},
+	} {
+		ctx, err := NewContextWithOptions(root, tc.options)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		m, err := BuildManifest(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var paths []string
+		for _, r := range m.Resources {
+			paths = append(paths, r.Path())
+		}
+
+		if len(paths) != len(tc.expected) {
+			t.Fatalf("%s: expected %v, got %v", tc.name, tc.expected, paths)
+		}
+		for i := range paths {
+			if paths[i] != tc.expected[i] {
+				t.Fatalf("%s: expected %v, got %v", tc.name, tc.expected, paths)
+			}
+		}
+	}
+}
+
+func TestBuildBirthTimes(t *testing.T) {
+	root := t.TempDir()
+	before := time.Now().Add(-time.Second)
+	if err := os.WriteFile(filepath.Join(root, "a"), []byte("a"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, err := NewContextWithOptions(root, ContextOptions{BirthTimes: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := BuildManifest(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	btime := m.Resources[0].(BirthTimer).BirthTime()
+	if btime.IsZero() {
+		t.Skip("birth times are not recorded by the filesystem")
+	}
+	if btime.Before(before) || btime.After(time.Now()) {
+		t.Fatalf("unexpected birth time %v", btime)
+	}
+
+	p, err := Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err = Unmarshal(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded := m.Resources[0].(BirthTimer).BirthTime(); !decoded.Equal(btime) {
+		t.Fatalf("expected birth time %v after decoding, got %v", btime, decoded)
+	}
+
+	if err := VerifyManifest(ctx, m); err != nil {
+		t.Fatalf("birth times should not be verified: %v", err)
+	}
+}
+
+func TestWalkDirents(t *testing.T) {
+	root := t.TempDir()
+	for _, dir := range []string{"a/b/c", "a/d", "e"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, file := range []string{"a/b/c/f", "a/b/g", "a/b/h", "a/d/k", "a/l", "e/i"} {
+		if err := os.WriteFile(filepath.Join(root, file), []byte(file), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("a", filepath.Join(root, "j")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Skipping the directory "d" leaves out its contents, and skipping the
+	// file "g" the rest of its directory.
+	walk := func(walker func(string, filepath.WalkFunc) error) []string {
+		var visited []string
+		if err := walker(root, func(p string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			st := fi.Sys().(*syscall.Stat_t)
+			visited = append(visited, fmt.Sprintf("%s %v %d %d", p, fi.Mode(), fi.Size(), st.Ino))
+			if fi.Name() == "d" || fi.Name() == "g" {
+				return filepath.SkipDir
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return visited
+	}
+
+	expected := walk(filepath.Walk)
+	visited := walk(func(root string, fn filepath.WalkFunc) error {
+		return walkDirents(root, func(string, bool) bool { return false }, fn)
+	})
+	if !reflect.DeepEqual(visited, expected) {
+		t.Fatalf("expected\n%s\ngot\n%s", strings.Join(expected, "\n"), strings.Join(visited, "\n"))
+	}
+}
+
+func TestWalkDirentsDeep(t *testing.T) {
+	root := t.TempDir()
+	dir := root
+	for i := 0; i < 2*maxWalkFds+10; i++ {
+		if err := os.WriteFile(filepath.Join(dir, "f"), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		dir = filepath.Join(dir, "d")
+		if err := os.Mkdir(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fds := func() int {
+		entries, err := os.ReadDir("/proc/self/fd")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(entries)
+	}
+	open := fds()
+
+	var expected, visited []string
+	if err := filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		expected = append(expected, p)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := walkDirents(root, func(string, bool) bool { return false }, func(p string, fi os.FileInfo, err error) error {
+		if n := fds() - open; n > maxWalkFds+1 {
+			t.Fatalf("%d directories open at %s", n, p)
+		}
+		visited = append(visited, p)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(visited, expected) {
+		t.Fatalf("expected %d paths, got %d", len(expected), len(visited))
+	}
+}
+
+func TestVerifyMountPoint(t *testing.T) {
+	testutil.RequiresRoot(t)
+
+	root := t.TempDir()
+	mnt := filepath.Join(root, "mnt")
+	if err := os.Mkdir(mnt, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, err := NewContext(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unmounted, err := BuildManifest(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := unix.Mount("tmpfs", mnt, "tmpfs", 0, ""); err != nil {
+		t.Fatal(err)
+	}
+	defer testutil.Unmount(t, mnt)
+
+	mounted, err := BuildManifest(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(mounted.Resources) != 1 {
+		t.Fatalf("unexpected resources: %v", mounted.Resources)
+	}
+
+	mount := mounted.Resources[0].(Mounted).MountPoint()
+	if mount == nil || mount.Type != "tmpfs" {
+		t.Fatalf("expected a tmpfs mount point, got %#v", mount)
+	}
+
+	if err := VerifyManifest(ctx, mounted); err != nil {
+		t.Fatalf("unexpected error verifying mounted manifest: %v", err)
+	}
+
+	err = VerifyManifest(ctx, unmounted)
+	if err == nil || !strings.Contains(err.Error(), "now the root of a tmpfs mount") {
+		t.Fatalf("expected mount error, got %v", err)
+	}
+}
+
+func TestWatcherInotify(t *testing.T) {
+	root := t.TempDir()
+	if err := os.Mkdir(filepath.Join(root, "dir"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "dir", "a"), []byte("a"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, err := NewContext(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := BuildManifest(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events := make(chan DriftEvent, 10)
+	w := &Watcher{
+		Context:  ctx,
+		Manifest: m,
+		OnDrift:  func(event DriftEvent) { events <- event },
+	}
+
+	wctx, cancel := stdcontext.WithCancel(stdcontext.Background())
+	done := make(chan error, 1)
+	go func() { done <- w.Run(wctx) }()
+	defer func() {
+		cancel()
+		if err := <-done; err != stdcontext.Canceled {
+			t.Errorf("unexpected error from Run: %v", err)
+		}
+	}()
+
+	// Without an interval, changes can only be noticed through inotify.
+	// Give the watcher a moment to set up its watches.
+	time.Sleep(100 * time.Millisecond)
+
+	expect := func(resolved bool) {
+		t.Helper()
+		select {
+		case event := <-events:
+			if event.Path != "/dir/a" || event.Resolved != resolved {
+				t.Fatalf("unexpected event: %+v", event)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for a drift event")
+		}
+	}
+
+	if err := os.Chmod(filepath.Join(root, "dir", "a"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	expect(false)
+
+	if err := os.Chmod(filepath.Join(root, "dir", "a"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	expect(true)
+}
+
+func TestWatcherInotifyCreated(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "dir", "sub"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "dir", "sub", "a"), []byte("a"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, err := NewContext(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := BuildManifest(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.RemoveAll(filepath.Join(root, "dir")); err != nil {
+		t.Fatal(err)
+	}
+
+	events := make(chan DriftEvent, 10)
+	w := &Watcher{
+		Context:  ctx,
+		Manifest: m,
+		OnDrift:  func(event DriftEvent) { events <- event },
+	}
+
+	wctx, cancel := stdcontext.WithCancel(stdcontext.Background())
+	done := make(chan error, 1)
+	go func() { done <- w.Run(wctx) }()
+	defer func() {
+		cancel()
+		if err := <-done; err != stdcontext.Canceled {
+			t.Errorf("unexpected error from Run: %v", err)
+		}
+	}()
+
+	// The directories missing when the watcher starts are watched once
+	// they are created again.
+	drifted := map[string]bool{}
+	for len(drifted) < 3 {
+		select {
+		case event := <-events:
+			drifted[event.Path] = !event.Resolved
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for drift events, got %v", drifted)
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Join(root, "dir", "sub"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "dir", "sub", "a"), []byte("a"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for drifted["/dir"] || drifted["/dir/sub"] || drifted["/dir/sub/a"] {
+		select {
+		case event := <-events:
+			drifted[event.Path] = !event.Resolved
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for the resources to be resolved, got %v", drifted)
+		}
+	}
+}
+
+// fakeMount describes the filesystem mounted at a directory by mountDriver.
+type fakeMount struct {
+	dev     uint64
+	mountID uint64
+	ino     uint64
+	fstype  string
+	fsid    string
+}
+
+// mountDriver reports the directories of its table as the roots of the
+// filesystems they are mapped to, and the files below them as on those.
+type mountDriver struct {
+	driverpkg.Driver
+	mounts map[string]fakeMount // by full path
+}
+
+func (d *mountDriver) mount(p string) fakeMount {
+	for ; ; p = filepath.Dir(p) {
+		if m, ok := d.mounts[p]; ok {
+			return m
+		}
+		if p == filepath.Dir(p) {
+			return fakeMount{}
+		}
+	}
+}
+
+func (d *mountDriver) Lstatx(p string) (os.FileInfo, *driverpkg.Statx, error) {
+	fi, err := d.Driver.Lstat(p)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	m := d.mount(p)
+	sfi := &statFileInfo{name: fi.Name(), sys: *fi.Sys().(*syscall.Stat_t)}
+	// The type of Dev varies between architectures.
+	reflect.ValueOf(&sfi.sys.Dev).Elem().SetUint(m.dev)
+	if _, ok := d.mounts[p]; ok && m.ino != 0 {
+		sfi.sys.Ino = m.ino
+	}
+	return sfi, &driverpkg.Statx{MountID: m.mountID}, nil
+}
+
+func (d *mountDriver) StatFilesystem(p string) (string, string, error) {
+	m := d.mount(p)
+	return m.fstype, m.fsid, nil
+}
+
+func TestResolveMountPoint(t *testing.T) {
+	root := t.TempDir()
+	btrfs := fakeMount{dev: 1, mountID: 1, ino: 256, fstype: "btrfs", fsid: "aaaaaaaa00000005"}
+	for _, tc := range []struct {
+		name     string
+		mount    fakeMount
+		expected *MountPoint
+	}{
+		{
+			name:     "BindMount",
+			mount:    fakeMount{dev: 1, mountID: 2, fstype: "btrfs", fsid: "aaaaaaaa00000005"},
+			expected: &MountPoint{Type: "btrfs", FSID: "aaaaaaaa00000005"},
+		},
+		{
+			name:     "Mount",
+			mount:    fakeMount{dev: 2, mountID: 3, fstype: "tmpfs"},
+			expected: &MountPoint{Type: "tmpfs"},
+		},
+		{
+			name:  "SameMount",
+			mount: fakeMount{dev: 3, mountID: 1, fstype: "overlay"},
+		},
+		{
+			name:     "Subvolume",
+			mount:    fakeMount{dev: 4, mountID: 1, ino: 256, fstype: "btrfs", fsid: "aaaaaaaa00000105"},
+			expected: &MountPoint{Type: "btrfs", FSID: "aaaaaaaa00000105", Subvolume: true},
+		},
+		{
+			name:     "OtherBtrfs",
+			mount:    fakeMount{dev: 5, mountID: 4, ino: 256, fstype: "btrfs", fsid: "bbbbbbbb00000005"},
+			expected: &MountPoint{Type: "btrfs", FSID: "bbbbbbbb00000005"},
+		},
+		{
+			name:     "SubvolumeWithoutMountID",
+			mount:    fakeMount{dev: 6, ino: 256, fstype: "btrfs", fsid: "aaaaaaaa00000106"},
+			expected: &MountPoint{Type: "btrfs", FSID: "aaaaaaaa00000106", Subvolume: true},
+		},
+		{
+			name:     "OtherBtrfsWithoutMountID",
+			mount:    fakeMount{dev: 7, ino: 256, fstype: "btrfs", fsid: "cccccccc00000005"},
+			expected: &MountPoint{Type: "btrfs", FSID: "cccccccc00000005"},
+		},
+	} {
+		dir := filepath.Join(root, tc.name)
+		if err := os.Mkdir(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, err := NewContextWithOptions(root, ContextOptions{
+			Driver:     &mountDriver{Driver: driverpkg.LocalDriver, mounts: map[string]fakeMount{root: btrfs, dir: tc.mount}},
+			Subvolumes: true,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := ctx.Resource("/"+tc.name, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mount := r.(Mounted).MountPoint(); !reflect.DeepEqual(mount, tc.expected) {
+			t.Errorf("%s: expected %+v, got %+v", tc.name, tc.expected, mount)
+		}
+		if err := os.Remove(dir); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,481 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continuity
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	driverpkg "github.com/containerd/continuity/driver"
+	"github.com/opencontainers/go-digest"
+)
+
+// xattrDriver reports a fixed set of extended attributes for every regular
+// file and directory.
+type xattrDriver struct {
+	driverpkg.Driver
+	xattrs map[string][]byte
+}
+
+func (d *xattrDriver) Getxattr(path string) (map[string][]byte, error) {
+	xattrs := make(map[string][]byte, len(d.xattrs))
+	for k, v := range d.xattrs {
+		xattrs[k] = v
+	}
+	return xattrs, nil
+}
+
+func (d *xattrDriver) Setxattr(path string, attr map[string][]byte) error {
+	return nil
+}
+
+func TestAppleMetadata(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "a"), []byte("a"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	driver := &xattrDriver{
+		Driver: driverpkg.LocalDriver,
+		xattrs: map[string][]byte{
+			"com.apple.ResourceFork": []byte("fork"),
+			"com.apple.FinderInfo":   make([]byte, 32),
+			"user.other":             []byte("other"),
+		},
+	}
+
+	for _, tc := range []struct {
+		appleMetadata bool
+		expected      []string
+	}{
+		{expected: []string{"user.other"}},
+		{appleMetadata: true, expected: []string{"com.apple.FinderInfo", "com.apple.ResourceFork", "user.other"}},
+	} {
+		ctx, err := NewContextWithOptions(root, ContextOptions{
+			Driver:        driver,
+			AppleMetadata: tc.appleMetadata,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r, err := ctx.Resource("/a", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		xattrs := r.(XAttrer).XAttrs()
+		if len(xattrs) != len(tc.expected) {
+			t.Fatalf("expected xattrs %v, got %v", tc.expected, xattrs)
+		}
+		for _, attr := range tc.expected {
+			if _, ok := xattrs[attr]; !ok {
+				t.Fatalf("expected xattr %q with AppleMetadata=%v, got %v", attr, tc.appleMetadata, xattrs)
+			}
+		}
+	}
+}
+
+// verityDriver reports a fixed fs-verity digest for every regular file.
+type verityDriver struct {
+	driverpkg.Driver
+	dgst digest.Digest
+}
+
+func (d *verityDriver) MeasureVerity(path string) (digest.Digest, error) {
+	return d.dgst, nil
+}
+
+func TestTrustVerity(t *testing.T) {
+	root := t.TempDir()
+	p := filepath.Join(root, "a")
+	if err := os.WriteFile(p, []byte("a"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	measured := digest.FromString("measured")
+	driver := &verityDriver{Driver: driverpkg.LocalDriver, dgst: measured}
+
+	ctx, err := NewContextWithOptions(root, ContextOptions{Driver: driver})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := ctx.Resource("/a", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dgst := r.(VerityFile).VerityDigest(); dgst != measured {
+		t.Fatalf("expected verity digest %v, got %v", measured, dgst)
+	}
+
+	// Change the content behind the back of the fake measurement, so that
+	// only verification by content notices.
+	if err := os.WriteFile(p, []byte("b"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		trustVerity bool
+		dgst        digest.Digest
+		fails       bool
+	}{
+		{dgst: measured, fails: true},
+		{trustVerity: true, dgst: measured},
+		{trustVerity: true, dgst: digest.FromString("other"), fails: true},
+		{trustVerity: true, dgst: "", fails: true},
+	} {
+		driver.dgst = tc.dgst
+		ctx, err := NewContextWithOptions(root, ContextOptions{
+			Driver:      driver,
+			TrustVerity: tc.trustVerity,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := ctx.Verify(r); (err != nil) != tc.fails {
+			t.Fatalf("unexpected verify result with TrustVerity=%v and measurement %q: %v", tc.trustVerity, tc.dgst, err)
+		}
+	}
+}
+
+// projectIDDriver keeps the project quota ids of files in memory, by path.
+type projectIDDriver struct {
+	driverpkg.Driver
+	ids map[string]uint32
+}
+
+func (d *projectIDDriver) GetProjectID(path string) (uint32, error) {
+	return d.ids[path], nil
+}
+
+func (d *projectIDDriver) SetProjectID(path string, id uint32) error {
+	d.ids[path] = id
+	return nil
+}
+
+func TestProjectIDs(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	for _, root := range []string{src, dst} {
+		if err := os.WriteFile(filepath.Join(root, "a"), []byte("a"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	srcDriver := &projectIDDriver{Driver: driverpkg.LocalDriver, ids: map[string]uint32{
+		filepath.Join(src, "a"): 42,
+	}}
+	srcCtx, err := NewContextWithOptions(src, ContextOptions{Driver: srcDriver, ProjectIDs: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := srcCtx.Resource("/a", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := r.(ProjectIDer).ProjectID(); id != 42 {
+		t.Fatalf("expected project id 42, got %d", id)
+	}
+
+	dstDriver := &projectIDDriver{Driver: driverpkg.LocalDriver, ids: map[string]uint32{}}
+	dstCtx, err := NewContextWithOptions(dst, ContextOptions{Driver: dstDriver, ProjectIDs: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dstCtx.Verify(r); err == nil {
+		t.Fatal("expected verify to fail before the project id is applied")
+	}
+	if err := dstCtx.Apply(r); err != nil {
+		t.Fatal(err)
+	}
+	if id := dstDriver.ids[filepath.Join(dst, "a")]; id != 42 {
+		t.Fatalf("expected apply to set project id 42, got %d", id)
+	}
+	if err := dstCtx.Verify(r); err != nil {
+		t.Fatal(err)
+	}
+
+	// Project ids are only compared when asked for.
+	dstDriver.ids[filepath.Join(dst, "a")] = 7
+	if err := dstCtx.Verify(r); err == nil {
+		t.Fatal("expected verify to fail with another project id")
+	}
+	ctx, err := NewContextWithOptions(dst, ContextOptions{Driver: dstDriver})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ctx.Verify(r); err != nil {
+		t.Fatalf("expected project ids to be ignored, got %v", err)
+	}
+}
+
+type progressRecorder []ProgressUpdate
+
+func (r *progressRecorder) Update(update ProgressUpdate) {
+	*r = append(*r, update)
+}
+
+func TestProgress(t *testing.T) {
+	root := t.TempDir()
+	for _, name := range []string{"a", "b"} {
+		if err := os.WriteFile(filepath.Join(root, name), []byte("content"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var updates progressRecorder
+	ctx, err := NewContextWithOptions(root, ContextOptions{Progress: &updates})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := BuildManifest(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyManifest(ctx, m); err != nil {
+		t.Fatal(err)
+	}
+
+	last := updates[len(updates)-1]
+	last.Elapsed = 0
+	if expected := (ProgressUpdate{Entries: 4, Bytes: 28, Path: "/b"}); last != expected {
+		t.Fatalf("expected last update %+v, got %+v", expected, last)
+	}
+	if _, ok := last.Remaining(); ok {
+		t.Fatal("expected no estimate without totals")
+	}
+
+	if remaining, ok := (ProgressUpdate{Entries: 1, TotalEntries: 4, Elapsed: time.Second}).Remaining(); !ok || remaining != 3*time.Second {
+		t.Fatalf("expected 3s to remain, got %v, %v", remaining, ok)
+	}
+}
+
+type metricsRecorder struct {
+	ops    map[string]int
+	hashed int64
+	errors map[string]int
+}
+
+func (m *metricsRecorder) Observe(op string, d time.Duration) {
+	m.ops[op]++
+}
+
+func (m *metricsRecorder) Hashed(n int64, d time.Duration) {
+	m.hashed += n
+}
+
+func (m *metricsRecorder) Error(op string, class string) {
+	m.errors[op+" "+class]++
+}
+
+func TestMetrics(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "a"), []byte("content"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	metrics := &metricsRecorder{ops: map[string]int{}, errors: map[string]int{}}
+	ctx, err := NewContextWithOptions(root, ContextOptions{Metrics: metrics})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := BuildManifest(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Remove(filepath.Join(root, "a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyManifest(ctx, m); err == nil {
+		t.Fatal("expected verification of a removed file to fail")
+	}
+
+	if metrics.ops["resource"] != 1 || metrics.ops["verify"] != 1 {
+		t.Fatalf("unexpected operations: %v", metrics.ops)
+	}
+	if metrics.hashed != 7 {
+		t.Fatalf("expected 7 bytes hashed, got %d", metrics.hashed)
+	}
+	if metrics.errors["verify notexist"] != 1 || len(metrics.errors) != 1 {
+		t.Fatalf("unexpected errors: %v", metrics.errors)
+	}
+}
+
+type logRecorder []string
+
+func (l *logRecorder) Log(level LogLevel, msg string, fields ...interface{}) {
+	*l = append(*l, fmt.Sprintf("%v %s %v", level, msg, fields))
+}
+
+func TestLogger(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "a"), []byte("a"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var logs logRecorder
+	ctx, err := NewContextWithOptions(root, ContextOptions{
+		Driver: &verityDriver{Driver: driverpkg.LocalDriver},
+		Logger: &logs,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The fake driver does not support extended attributes.
+	if _, err := ctx.Resource("/a", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(logs) != 1 || !strings.HasPrefix(logs[0], "debug skipping extended attributes [path /a error ") {
+		t.Fatalf("unexpected logs: %q", logs)
+	}
+}
+
+// linkFS adds symbolic links and extended attributes to a fstest.MapFS.
+type linkFS struct {
+	fstest.MapFS
+	links  map[string]string
+	xattrs map[string][]byte
+}
+
+func (fsys linkFS) ReadLink(name string) (string, error) {
+	target, ok := fsys.links[name]
+	if !ok {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+	return target, nil
+}
+
+// Lstat describes files as listed in their directory, so that links are not
+// followed.
+func (fsys linkFS) Lstat(name string) (fs.FileInfo, error) {
+	if name == "." {
+		return fs.Stat(fsys.MapFS, name)
+	}
+
+	entries, err := fs.ReadDir(fsys.MapFS, path.Dir(name))
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if entry.Name() == path.Base(name) {
+			return entry.Info()
+		}
+	}
+	return nil, &fs.PathError{Op: "lstat", Path: name, Err: fs.ErrNotExist}
+}
+
+func (fsys linkFS) Xattrs(name string) (map[string][]byte, error) {
+	return fsys.xattrs, nil
+}
+
+func TestNewContextFS(t *testing.T) {
+	owner := &driverpkg.FileStat{UID: 1000, GID: 100}
+	fsys := linkFS{
+		MapFS: fstest.MapFS{
+			"a":     {Data: []byte("a"), Mode: 0o644, Sys: owner},
+			"dir":   {Mode: fs.ModeDir | 0o755},
+			"dir/b": {Data: []byte("b"), Mode: 0o600},
+			"link":  {Mode: fs.ModeSymlink | 0o777},
+		},
+		links:  map[string]string{"link": "dir/b"},
+		xattrs: map[string][]byte{"user.test": []byte("value")},
+	}
+
+	ctx, err := NewContextFS(fsys, ContextOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := BuildManifest(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var paths []string
+	for _, r := range m.Resources {
+		paths = append(paths, r.Path())
+	}
+	if strings.Join(paths, " ") != "/a /dir /dir/b /link" {
+		t.Fatalf("unexpected resources: %v", paths)
+	}
+
+	a := m.Resources[0].(RegularFile)
+	if a.UID() != 1000 || a.GID() != 100 || a.Digests()[0] != digest.FromString("a") {
+		t.Fatalf("unexpected resource: %v", a)
+	}
+	if string(a.(XAttrer).XAttrs()["user.test"]) != "value" {
+		t.Fatalf("expected xattrs, got %v", a.(XAttrer).XAttrs())
+	}
+	if target := m.Resources[3].(SymLink).Target(); target != "dir/b" {
+		t.Fatalf("unexpected link target %q", target)
+	}
+
+	if err := VerifyManifest(ctx, m); err != nil {
+		t.Fatal(err)
+	}
+
+	fsys.MapFS["dir/b"].Data = []byte("changed")
+	if err := VerifyManifest(ctx, m); err == nil || !strings.Contains(err.Error(), "/dir/b") {
+		t.Fatalf("expected /dir/b to have changed, got %v", err)
+	}
+}
+
+func TestContextFSReaddir(t *testing.T) {
+	d := &fsDriver{fsys: fstest.MapFS{"a": {}, "b": {}, "c": {}}}
+	f, err := d.Open("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var names []string
+	for _, expected := range []int{2, 1} {
+		fis, err := f.Readdir(2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(fis) != expected {
+			t.Fatalf("expected %d entries, got %d", expected, len(fis))
+		}
+		for _, fi := range fis {
+			names = append(names, fi.Name())
+		}
+	}
+	if strings.Join(names, " ") != "a b c" {
+		t.Fatalf("expected every entry once, got %v", names)
+	}
+	if fis, err := f.Readdir(2); len(fis) != 0 || err != io.EOF {
+		t.Fatalf("expected io.EOF once exhausted, got %v, %v", fis, err)
+	}
+	if fis, err := f.Readdir(0); len(fis) != 0 || err != nil {
+		t.Fatalf("expected no entries once exhausted, got %v, %v", fis, err)
+	}
+}
@@ -0,0 +1,201 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package cpio writes cpio archives of manifests in the "newc" format the
+// Linux kernel unpacks as initramfs, with the content of their regular files
+// from a content provider. Archives are reproducible: the same manifest and
+// content always give the same archive.
+package cpio
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/containerd/continuity"
+	"github.com/containerd/continuity/internal/imagetree"
+)
+
+// Options controls how archives are written.
+type Options struct {
+	// ModTime is recorded as the modification time of all entries, since
+	// manifests do not record them. It defaults to the Unix epoch.
+	ModTime time.Time
+}
+
+const (
+	magic   = "070701"
+	trailer = "TRAILER!!!"
+
+	// blockSize is the size archives are padded to, as cpio does.
+	blockSize = 512
+)
+
+// node is a path of the archive.
+type node = imagetree.Node[inode]
+
+type inode struct {
+	ino uint32
+	// last is the path of the last entry of the inode, which holds the
+	// content of hardlinked files.
+	last *node
+}
+
+// Write writes the cpio archive of the manifest to w, reading the content
+// of regular files from the provider. Entries are written in the order of
+// their paths, with parents first, adding the directories missing from the
+// manifest as imagetree.Build does. The root is only written, as ".", if the
+// manifest describes it. Extended attributes are not written.
+//
+// Hardlinked files share an inode number, and only their last entry holds
+// their content, as the kernel and GNU cpio expect.
+func Write(w io.Writer, m *continuity.Manifest, provider continuity.ContentProvider, opts Options) error {
+	root, err := imagetree.Build[inode](m)
+	if err != nil {
+		return err
+	}
+
+	var (
+		nodes []*node
+		count uint32
+	)
+	root.Walk(func(n *node) error {
+		if n == root && n.Resource == nil {
+			return nil
+		}
+		if n.Inode.ino == 0 {
+			count++
+			n.Inode.ino = count
+		}
+		n.Inode.last = n
+		nodes = append(nodes, n)
+		return nil
+	})
+
+	var mtime int64
+	if !opts.ModTime.IsZero() {
+		mtime = opts.ModTime.Unix()
+	}
+	cw := &countWriter{w: w}
+	for _, n := range nodes {
+		if err := writeEntry(cw, n, provider, mtime); err != nil {
+			return fmt.Errorf("failed to write %s: %w", n.Path, err)
+		}
+	}
+	if err := writeHeader(cw, trailer, header{nlink: 1}); err != nil {
+		return err
+	}
+	return cw.pad(blockSize)
+}
+
+// header holds the fields of the header of an entry.
+type header struct {
+	ino, mode, uid, gid, nlink uint32
+	mtime                      int64
+	size                       int64
+	rdevMajor, rdevMinor       uint32
+}
+
+func writeEntry(cw *countWriter, n *node, provider continuity.ContentProvider, mtime int64) error {
+	name := n.Path[1:]
+	if n.Path == "/" {
+		name = "."
+	}
+	hdr := header{
+		ino:   n.Inode.ino,
+		mode:  n.Perm(),
+		uid:   n.UID,
+		gid:   n.GID,
+		nlink: n.Links(),
+		mtime: mtime,
+	}
+
+	var data func() error
+	switch r := n.Resource.(type) {
+	case continuity.RegularFile:
+		hdr.mode |= 0o100000
+		if n.Inode.last == n && r.Size() > 0 {
+			hdr.size = r.Size()
+			data = func() error { return imagetree.CopyContent(cw, provider, r) }
+		}
+	case continuity.SymLink:
+		hdr.mode |= 0o120000
+		hdr.size = int64(len(r.Target()))
+		data = func() error {
+			_, err := io.WriteString(cw, r.Target())
+			return err
+		}
+	case continuity.Device:
+		if n.Mode&os.ModeCharDevice != 0 {
+			hdr.mode |= 0o020000
+		} else {
+			hdr.mode |= 0o060000
+		}
+		hdr.rdevMajor, hdr.rdevMinor = uint32(r.Major()), uint32(r.Minor())
+	case continuity.NamedPipe:
+		hdr.mode |= 0o010000
+	default:
+		if !n.IsDir() {
+			return fmt.Errorf("unsupported resource of mode %v", n.Mode)
+		}
+		hdr.mode |= 0o040000
+	}
+	if hdr.size > 0xffffffff {
+		return fmt.Errorf("file of %d bytes is too large", hdr.size)
+	}
+
+	if err := writeHeader(cw, name, hdr); err != nil {
+		return err
+	}
+	if data != nil {
+		if err := data(); err != nil {
+			return err
+		}
+	}
+	return cw.pad(4)
+}
+
+// writeHeader writes the header of an entry and its name.
+func writeHeader(cw *countWriter, name string, hdr header) error {
+	if _, err := fmt.Fprintf(cw, "%s%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%s\x00",
+		magic, hdr.ino, hdr.mode, hdr.uid, hdr.gid, hdr.nlink, uint32(hdr.mtime), uint32(hdr.size),
+		0, 0, hdr.rdevMajor, hdr.rdevMinor, len(name)+1, 0, name); err != nil {
+		return err
+	}
+	return cw.pad(4)
+}
+
+// countWriter counts the bytes written, to pad the archive.
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// pad pads what is written to a multiple of size.
+func (cw *countWriter) pad(size int64) error {
+	if rem := cw.n % size; rem != 0 {
+		_, err := cw.Write(make([]byte, size-rem))
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cpio
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/containerd/continuity"
+	"github.com/containerd/continuity/testutil"
+	"github.com/opencontainers/go-digest"
+)
+
+type entry struct {
+	name                 string
+	ino, mode, uid, gid  uint32
+	nlink, mtime         uint32
+	rdevMajor, rdevMinor uint32
+	data                 string
+}
+
+func TestWrite(t *testing.T) {
+	content := []byte("hello\n")
+	provider := testutil.MapProvider{digest.FromBytes(content): content}
+
+	must := func(r continuity.Resource, err error) continuity.Resource {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+	m := &continuity.Manifest{Resources: []continuity.Resource{
+		must(continuity.NewDirectory("/", continuity.Attributes{Mode: 0o700})),
+		must(continuity.NewRegularFile([]string{"/bin/sh", "/init"}, continuity.Attributes{Mode: os.ModeSetuid | 0o755, UID: 1, GID: 2}, int64(len(content)), digest.FromBytes(content))),
+		must(continuity.NewDevice([]string{"/dev/console"}, continuity.Attributes{Mode: 0o600}, true, 5, 1)),
+		must(continuity.NewSymLink("/sbin", continuity.Attributes{Mode: 0o777}, "bin")),
+	}}
+
+	modTime := time.Unix(1700000000, 0)
+	var buf bytes.Buffer
+	if err := Write(&buf, m, provider, Options{ModTime: modTime}); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len()%blockSize != 0 {
+		t.Fatalf("archive of %d bytes is not padded", buf.Len())
+	}
+
+	entries := readArchive(t, buf.Bytes())
+	mtime := uint32(modTime.Unix())
+	expected := []entry{
+		{name: ".", ino: 1, mode: 0o040700, nlink: 4, mtime: mtime},
+		{name: "bin", ino: 2, mode: 0o040755, nlink: 2, mtime: mtime},
+		{name: "bin/sh", ino: 3, mode: 0o104755, uid: 1, gid: 2, nlink: 2, mtime: mtime},
+		{name: "dev", ino: 4, mode: 0o040755, nlink: 2, mtime: mtime},
+		{name: "dev/console", ino: 5, mode: 0o020600, nlink: 1, mtime: mtime, rdevMajor: 5, rdevMinor: 1},
+		{name: "init", ino: 3, mode: 0o104755, uid: 1, gid: 2, nlink: 2, mtime: mtime, data: "hello\n"},
+		{name: "sbin", ino: 6, mode: 0o120777, nlink: 1, mtime: mtime, data: "bin"},
+		{name: trailer, nlink: 1},
+	}
+	if len(entries) != len(expected) {
+		t.Fatalf("unexpected entries: %+v", entries)
+	}
+	for i := range expected {
+		if entries[i] != expected[i] {
+			t.Errorf("unexpected entry %+v, expected %+v", entries[i], expected[i])
+		}
+	}
+
+	// Content not matching its digest fails the archive.
+	provider[digest.FromBytes(content)] = []byte("bye\n")
+	if err := Write(io.Discard, m, provider, Options{}); err == nil {
+		t.Fatal("expected an error for content not matching its digest")
+	}
+}
+
+func readArchive(t *testing.T, b []byte) []entry {
+	var (
+		entries []entry
+		off     int
+	)
+	field := func(i int) uint32 {
+		v, err := strconv.ParseUint(string(b[off+6+8*i:off+14+8*i]), 16, 32)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return uint32(v)
+	}
+	align := func(n int) int { return (n + 3) &^ 3 }
+	for {
+		if string(b[off:off+6]) != magic {
+			t.Fatalf("missing magic at %d", off)
+		}
+		e := entry{
+			ino: field(0), mode: field(1), uid: field(2), gid: field(3),
+			nlink: field(4), mtime: field(5),
+			rdevMajor: field(9), rdevMinor: field(10),
+		}
+		size, nameSize := int(field(6)), int(field(11))
+		e.name = string(b[off+110 : off+110+nameSize-1])
+		off = align(off + 110 + nameSize)
+		e.data = string(b[off : off+size])
+		off = align(off + size)
+		entries = append(entries, e)
+		if e.name == trailer {
+			return entries
+		}
+	}
+}
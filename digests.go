@@ -34,6 +34,42 @@ type ContentProvider interface {
 	Reader(digest.Digest) (io.ReadCloser, error)
 }
 
+// ReaderAtProvider is an optional interface of a ContentProvider giving
+// random access to content, along with its size.
+type ReaderAtProvider interface {
+	ReaderAt(digest.Digest) (ContentReaderAt, error)
+}
+
+// ContentReaderAt reads content of a known size at any offset.
+type ContentReaderAt interface {
+	io.ReaderAt
+	io.Closer
+
+	// Size returns the size of the content.
+	Size() int64
+}
+
+// ContentSink receives the content of regular files as it is read to digest
+// them, so that it can be stored, such as by a backup tool, without reading
+// the files again.
+type ContentSink interface {
+	// Writer returns a writer receiving the content of the regular file at
+	// path p from its start. Once the content has been written in full, it
+	// is committed with its digest. Otherwise, such as when reading fails or
+	// the file changed and is read again, the writer is closed without
+	// committing, and the content written should be discarded.
+	Writer(p string) (ContentWriter, error)
+}
+
+// ContentWriter writes the content of a file to a ContentSink.
+type ContentWriter interface {
+	io.WriteCloser
+
+	// Commit completes the content, of the given digest and size. Close is
+	// called after it.
+	Commit(dgst digest.Digest, size int64) error
+}
+
 type simpleDigester struct {
 	algorithm digest.Algorithm
 }
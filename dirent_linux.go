@@ -0,0 +1,285 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continuity
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// dirent is an entry of a directory, with the type recorded in the
+// directory itself, one of the unix.DT_ constants.
+type dirent struct {
+	name string
+	typ  uint8
+}
+
+// The offsets of the fields of struct linux_dirent64.
+const (
+	direntReclen = 16
+	direntType   = 18
+	direntName   = 19
+)
+
+// readDirents returns the entries of the directory open as fd, at path,
+// sorted by name, as read with getdents64(2).
+func readDirents(fd int, path string) ([]dirent, error) {
+	var entries []dirent
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := unix.Getdents(fd, buf)
+		if err != nil {
+			if errors.Is(err, unix.EINTR) {
+				continue
+			}
+			return nil, &os.PathError{Op: "getdents", Path: path, Err: err}
+		}
+		if n <= 0 {
+			break
+		}
+
+		for off := 0; off < n; {
+			rec := buf[off:n]
+			if len(rec) < direntName {
+				break
+			}
+			reclen := int(*(*uint16)(unsafe.Pointer(&rec[direntReclen])))
+			if reclen < direntName || reclen > len(rec) {
+				break
+			}
+			off += reclen
+
+			name := rec[direntName:reclen]
+			if i := bytes.IndexByte(name, 0); i >= 0 {
+				name = name[:i]
+			}
+			if string(name) == "." || string(name) == ".." {
+				continue
+			}
+			entries = append(entries, dirent{name: string(name), typ: rec[direntType]})
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].name < entries[j].name })
+	return entries, nil
+}
+
+// statFileInfo is the os.FileInfo of an entry stated with fstatat(2).
+type statFileInfo struct {
+	name string
+	sys  syscall.Stat_t
+}
+
+func (fi *statFileInfo) Name() string       { return fi.name }
+func (fi *statFileInfo) Size() int64        { return fi.sys.Size }
+func (fi *statFileInfo) Mode() os.FileMode  { return fileMode(fi.sys.Mode) }
+func (fi *statFileInfo) ModTime() time.Time { return time.Unix(fi.sys.Mtim.Unix()) }
+func (fi *statFileInfo) IsDir() bool        { return fi.Mode().IsDir() }
+func (fi *statFileInfo) Sys() interface{}   { return &fi.sys }
+
+// fstatat returns the os.FileInfo of the entry name of the directory open as
+// dirfd, at path, without following symbolic links.
+func fstatat(dirfd int, path, name string) (os.FileInfo, error) {
+	fi := &statFileInfo{name: name}
+	// syscall.Stat_t and unix.Stat_t both mirror struct stat.
+	if err := unix.Fstatat(dirfd, name, (*unix.Stat_t)(unsafe.Pointer(&fi.sys)), unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return nil, &os.PathError{Op: "fstatat", Path: path, Err: err}
+	}
+	return fi, nil
+}
+
+// maxWalkFds is the number of directories that walkDirents keeps open.
+// Directories further up the tree are closed and opened again by path when
+// the walk gets back to them.
+const maxWalkFds = 64
+
+// walkFrame is a directory being walked by walkDirents. Its fd is -1 while
+// it is closed.
+type walkFrame struct {
+	fd      int
+	path    string
+	fi      os.FileInfo
+	entries []dirent
+	next    int
+}
+
+// reopen opens the directory of the frame again by its path. The directory
+// must still be the one that was stated while walking.
+func (f *walkFrame) reopen() error {
+	fd, err := unix.Open(f.path, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return &os.PathError{Op: "open", Path: f.path, Err: err}
+	}
+
+	var st unix.Stat_t
+	if err := unix.Fstat(fd, &st); err != nil {
+		unix.Close(fd)
+		return &os.PathError{Op: "fstat", Path: f.path, Err: err}
+	}
+	if sys, ok := f.fi.Sys().(*syscall.Stat_t); ok && (uint64(sys.Dev) != uint64(st.Dev) || sys.Ino != st.Ino) {
+		unix.Close(fd)
+		return &os.PathError{Op: "open", Path: f.path, Err: errors.New("directory changed while walking")}
+	}
+
+	f.fd = fd
+	return nil
+}
+
+// walkDirents walks the tree at root like filepath.Walk, except that entries
+// for which skip returns true are left out without being stated, as far as
+// their type is recorded in their directory. The full path of the entry and
+// whether it is a directory are passed to skip.
+//
+// Rather than recursing on paths, the walk keeps the directories above the
+// current one open, and states and opens entries relative to their parent
+// with fstatat(2) and openat(2). Paths are not resolved again from the root
+// at every level, and directories are opened without following symbolic
+// links, so that one swapped for a link while walking is not walked through.
+// At most maxWalkFds directories are kept open, however deep the tree.
+func walkDirents(root string, skip func(p string, dir bool) bool, walkFn filepath.WalkFunc) error {
+	err := walkTree(root, skip, walkFn)
+	if err == filepath.SkipDir {
+		return nil
+	}
+	return err
+}
+
+func walkTree(root string, skip func(p string, dir bool) bool, walkFn filepath.WalkFunc) error {
+	fi, err := os.Lstat(root)
+	if err != nil {
+		return walkFn(root, nil, err)
+	}
+	if !fi.IsDir() {
+		return walkFn(root, fi, nil)
+	}
+
+	var stack []walkFrame
+	defer func() {
+		for _, frame := range stack {
+			if frame.fd >= 0 {
+				unix.Close(frame.fd)
+			}
+		}
+	}()
+
+	// descend calls walkFn for the directory at path, open as fd unless err
+	// is set, and pushes it to the stack for its entries to be walked. As
+	// with filepath.Walk, directories that cannot be read are passed to
+	// walkFn with the error, and the error it returns stops the walk unless
+	// it is nil.
+	descend := func(path string, fi os.FileInfo, fd int, err error) error {
+		var entries []dirent
+		if err == nil {
+			entries, err = readDirents(fd, path)
+			if err != nil {
+				unix.Close(fd)
+			}
+		}
+		if err1 := walkFn(path, fi, err); err1 != nil || err != nil {
+			if err == nil {
+				unix.Close(fd)
+			}
+			return err1
+		}
+		stack = append(stack, walkFrame{fd: fd, path: path, fi: fi, entries: entries})
+		if len(stack) > maxWalkFds {
+			// Only the entries of the directories further up the tree are
+			// needed until the walk gets back to them.
+			if frame := &stack[len(stack)-1-maxWalkFds]; frame.fd >= 0 {
+				unix.Close(frame.fd)
+				frame.fd = -1
+			}
+		}
+		return nil
+	}
+
+	fd, err := unix.Open(root, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		err = &os.PathError{Op: "open", Path: root, Err: err}
+	}
+	if err := descend(root, fi, fd, err); err != nil {
+		return err
+	}
+
+	for len(stack) > 0 {
+		top := &stack[len(stack)-1]
+		if top.next == len(top.entries) {
+			if top.fd >= 0 {
+				unix.Close(top.fd)
+			}
+			stack = stack[:len(stack)-1]
+			continue
+		}
+		if top.fd < 0 {
+			if err := top.reopen(); err != nil {
+				if err := walkFn(top.path, top.fi, err); err != nil && err != filepath.SkipDir {
+					return err
+				}
+				top.next = len(top.entries)
+				continue
+			}
+		}
+		entry := top.entries[top.next]
+		top.next++
+
+		p := filepath.Join(top.path, entry.name)
+		if entry.typ != unix.DT_UNKNOWN && skip(p, entry.typ == unix.DT_DIR) {
+			continue
+		}
+
+		fi, err := fstatat(top.fd, p, entry.name)
+		if err != nil {
+			if err := walkFn(p, nil, err); err != nil && err != filepath.SkipDir {
+				return err
+			}
+			continue
+		}
+		if entry.typ == unix.DT_UNKNOWN && skip(p, fi.IsDir()) {
+			continue
+		}
+
+		if !fi.IsDir() {
+			if err := walkFn(p, fi, nil); err != nil {
+				if err != filepath.SkipDir {
+					return err
+				}
+				// As with filepath.Walk, the remaining entries of the
+				// directory are skipped.
+				top.next = len(top.entries)
+			}
+			continue
+		}
+
+		fd, err := unix.Openat(top.fd, entry.name, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+		if err != nil {
+			err = &os.PathError{Op: "openat", Path: p, Err: err}
+		}
+		if err := descend(p, fi, fd, err); err != nil && err != filepath.SkipDir {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,40 @@
+//go:build !linux
+// +build !linux
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continuity
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// walkDirents walks the tree at root like filepath.Walk, leaving out the
+// entries for which skip returns true. Directory entries carry no types on
+// this platform, so every entry is stated before it is matched.
+func walkDirents(root string, skip func(p string, dir bool) bool, walkFn filepath.WalkFunc) error {
+	return filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		if err == nil && p != root && skip(p, fi.IsDir()) {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		return walkFn(p, fi, err)
+	})
+}
@@ -0,0 +1,253 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continuity
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/user"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// compareResources returns the fields of the resource actual that differ from
+// those of the resource expected, as verified: only the xattrs of expected
+// are compared, and digests are only compared if actual has any.
+func compareResources(expected, actual Resource) []FieldMismatch {
+	var fields []FieldMismatch
+	add := func(name, e, a string) {
+		fields = append(fields, FieldMismatch{Name: name, Expected: e, Actual: a})
+	}
+
+	if expected.Mode() != actual.Mode() {
+		add("mode", formatMode(expected.Mode()), formatMode(actual.Mode()))
+	}
+	if expected.UID() != actual.UID() {
+		add("uid", fmt.Sprint(expected.UID()), fmt.Sprint(actual.UID()))
+	}
+	if expected.GID() != actual.GID() {
+		add("gid", fmt.Sprint(expected.GID()), fmt.Sprint(actual.GID()))
+	}
+
+	if xattrer, ok := expected.(XAttrer); ok {
+		var actualXAttrs map[string][]byte
+		if txattrer, ok := actual.(XAttrer); ok {
+			actualXAttrs = txattrer.XAttrs()
+		}
+		xattrs := xattrer.XAttrs()
+		names := make([]string, 0, len(xattrs))
+		for name := range xattrs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			value, ok := actualXAttrs[name]
+			switch {
+			case !ok:
+				add("xattr."+name, fmt.Sprintf("%q", xattrs[name]), "")
+			case !bytes.Equal(value, xattrs[name]):
+				add("xattr."+name, fmt.Sprintf("%q", xattrs[name]), fmt.Sprintf("%q", value))
+			}
+		}
+	}
+
+	switch e := expected.(type) {
+	case RegularFile:
+		a, ok := actual.(RegularFile)
+		if !ok {
+			break
+		}
+		if e.Size() != a.Size() {
+			add("size", fmt.Sprint(e.Size()), fmt.Sprint(a.Size()))
+		}
+		if len(a.Digests()) > 0 && !digestsMatch(e.Digests(), a.Digests()) {
+			add("digest", formatDigests(e.Digests()), formatDigests(a.Digests()))
+		}
+	case SymLink:
+		if a, ok := actual.(SymLink); ok && e.Target() != a.Target() {
+			add("target", e.Target(), a.Target())
+		}
+	case Device:
+		if a, ok := actual.(Device); ok && (e.Major() != a.Major() || e.Minor() != a.Minor()) {
+			add("device", fmt.Sprintf("%d,%d", e.Major(), e.Minor()), fmt.Sprintf("%d,%d", a.Major(), a.Minor()))
+		}
+	}
+
+	return fields
+}
+
+// skipFields returns the fields that are not covered by the fields to skip.
+func skipFields(fields []FieldMismatch, skip map[VerifyField]bool) []FieldMismatch {
+	if len(skip) == 0 {
+		return fields
+	}
+
+	var kept []FieldMismatch
+	for _, f := range fields {
+		switch {
+		case f.Name == "mode" && skip[FieldMode]:
+			e, eerr := strconv.ParseUint(f.Expected, 0, 32)
+			a, aerr := strconv.ParseUint(f.Actual, 0, 32)
+			if eerr == nil && aerr == nil && e&sIFMT == a&sIFMT {
+				continue
+			}
+		case f.Name == "uid" && skip[FieldOwner],
+			f.Name == "gid" && skip[FieldGroup],
+			strings.HasPrefix(f.Name, "xattr.") && skip[FieldXAttrs]:
+			continue
+		}
+		kept = append(kept, f)
+	}
+	return kept
+}
+
+// formatMode formats the mode as an octal POSIX mode, for reports.
+func formatMode(mode os.FileMode) string {
+	return fmt.Sprintf("%#o", posixMode(mode))
+}
+
+func formatDigests(dgsts []digest.Digest) string {
+	s := make([]string, len(dgsts))
+	for i, dgst := range dgsts {
+		s[i] = dgst.String()
+	}
+	return strings.Join(s, ",")
+}
+
+// DriftRenderer renders verification failures for humans, as a line per
+// failure listing how each field drifted, such as:
+//
+//	/etc/passwd: mode 0644→0600, owner root→nobody, content sha256:0a1b2c3d4e5f→sha256:5f4e3d2c1b0a
+type DriftRenderer struct {
+	// Color highlights paths, and the expected and actual values of fields,
+	// with ANSI escape sequences.
+	Color bool
+
+	// Names shows the names of users and groups, where they are known to
+	// the system, rather than their ids.
+	Names bool
+}
+
+const (
+	ansiBold  = "\x1b[1m"
+	ansiRed   = "\x1b[31m"
+	ansiGreen = "\x1b[32m"
+	ansiReset = "\x1b[0m"
+)
+
+// Render returns the line describing the failure f, without a newline.
+// Failures without fields are described by their class and message.
+func (r DriftRenderer) Render(f VerifyFailure) string {
+	var b strings.Builder
+	b.WriteString(r.paint(ansiBold, f.Path))
+	b.WriteString(": ")
+
+	if len(f.Fields) == 0 {
+		if f.Class == FailureMissing {
+			b.WriteString("missing")
+		} else {
+			fmt.Fprintf(&b, "%s: %s", f.Class, f.Message)
+		}
+		return b.String()
+	}
+
+	for i, field := range f.Fields {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		name, expected, actual := r.field(field)
+		fmt.Fprintf(&b, "%s %s→%s", name, r.paint(ansiRed, expected), r.paint(ansiGreen, actual))
+	}
+	return b.String()
+}
+
+// field returns the label and the values of the field, formatted for humans.
+func (r DriftRenderer) field(f FieldMismatch) (string, string, string) {
+	name, expected, actual := f.Name, f.Expected, f.Actual
+	switch {
+	case name == "mode":
+		e, eerr := strconv.ParseUint(expected, 0, 32)
+		a, aerr := strconv.ParseUint(actual, 0, 32)
+		if eerr == nil && aerr == nil && e&sIFMT == a&sIFMT {
+			// Only show the permissions of files of the same type.
+			expected, actual = fmt.Sprintf("%04o", e&^sIFMT), fmt.Sprintf("%04o", a&^sIFMT)
+		}
+	case name == "uid":
+		name, expected, actual = "owner", r.user(expected), r.user(actual)
+	case name == "gid":
+		name, expected, actual = "group", r.group(expected), r.group(actual)
+	case name == "digest" || name == "verity_digest":
+		if name == "digest" {
+			name = "content"
+		}
+		expected, actual = shortDigests(expected), shortDigests(actual)
+	case strings.HasPrefix(name, "xattr."):
+		name = "xattr " + strings.TrimPrefix(name, "xattr.")
+	}
+
+	if expected == "" {
+		expected = "(none)"
+	}
+	if actual == "" {
+		actual = "(none)"
+	}
+	return name, expected, actual
+}
+
+func (r DriftRenderer) paint(color, s string) string {
+	if !r.Color {
+		return s
+	}
+	return color + s + ansiReset
+}
+
+func (r DriftRenderer) user(id string) string {
+	if r.Names {
+		if u, err := user.LookupId(id); err == nil {
+			return u.Username
+		}
+	}
+	return id
+}
+
+func (r DriftRenderer) group(id string) string {
+	if r.Names {
+		if g, err := user.LookupGroupId(id); err == nil {
+			return g.Name
+		}
+	}
+	return id
+}
+
+// shortDigests shortens the encoded part of the comma separated digests to
+// twelve characters.
+func shortDigests(s string) string {
+	if s == "" {
+		return s
+	}
+	dgsts := strings.Split(s, ",")
+	for i, dgst := range dgsts {
+		if alg, encoded, ok := strings.Cut(dgst, ":"); ok && len(encoded) > 12 {
+			dgsts[i] = alg + ":" + encoded[:12]
+		}
+	}
+	return strings.Join(dgsts, ",")
+}
@@ -0,0 +1,40 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continuity
+
+import "testing"
+
+func TestDriftRenderer(t *testing.T) {
+	f := VerifyFailure{
+		Path:  "a",
+		Class: FailureType,
+		Fields: []FieldMismatch{
+			{Name: "mode", Expected: "0100644", Actual: "040755"},
+			{Name: "uid", Expected: "0", Actual: "1"},
+			{Name: "xattr.user.a", Expected: `"1"`},
+		},
+	}
+	expected := `a: mode 0100644→040755, owner 0→1, xattr user.a "1"→(none)`
+	if actual := (DriftRenderer{}).Render(f); actual != expected {
+		t.Fatalf("expected %s, got %s", expected, actual)
+	}
+	expected = "\x1b[1ma\x1b[0m: mode \x1b[31m0100644\x1b[0m→\x1b[32m040755\x1b[0m"
+	f.Fields = f.Fields[:1]
+	if actual := (DriftRenderer{Color: true}).Render(f); actual != expected {
+		t.Fatalf("expected %q, got %q", expected, actual)
+	}
+}
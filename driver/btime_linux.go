@@ -0,0 +1,44 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package driver
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// BirthTime returns the creation time of the file at path, as reported by
+// statx(2). The zero time is returned if the filesystem did not record it.
+func (d *driver) BirthTime(path string) (time.Time, error) {
+	var stx unix.Statx_t
+	if err := unix.Statx(unix.AT_FDCWD, path, unix.AT_SYMLINK_NOFOLLOW|unix.AT_STATX_DONT_SYNC, unix.STATX_BTIME, &stx); err != nil {
+		if errors.Is(err, unix.ENOSYS) {
+			err = fmt.Errorf("%v: %w", err, ErrNotSupported)
+		}
+		return time.Time{}, &os.PathError{Op: "birthtime", Path: path, Err: err}
+	}
+
+	if stx.Mask&unix.STATX_BTIME == 0 {
+		return time.Time{}, nil
+	}
+
+	return time.Unix(stx.Btime.Sec, int64(stx.Btime.Nsec)).UTC(), nil
+}
@@ -20,6 +20,9 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"time"
+
+	"github.com/opencontainers/go-digest"
 )
 
 var ErrNotSupported = fmt.Errorf("not supported")
@@ -70,6 +73,37 @@ type File interface {
 	Readdir(n int) ([]os.FileInfo, error)
 }
 
+// FilesystemDriver identifies the filesystems files live on.
+type FilesystemDriver interface {
+	// StatFilesystem returns the name of the type and the id of the
+	// filesystem containing path. Empty strings are returned for unknown
+	// filesystem types and filesystems without an id.
+	StatFilesystem(path string) (fstype string, fsid string, err error)
+}
+
+// RenameDriver renames files, so that files can be replaced atomically.
+// Without it, files are rewritten in place.
+type RenameDriver interface {
+	// Rename renames oldpath to newpath, replacing any file at newpath.
+	Rename(oldpath, newpath string) error
+}
+
+// FileStat holds the ownership of a file, for drivers whose os.FileInfo
+// values do not come from the local system, such as drivers for remote
+// filesystems. Such drivers return a *FileStat from the Sys method of their
+// os.FileInfo values, in place of the system specific structure. Files
+// described this way are never considered mount points, and are only
+// considered hardlinks if Ino is set and Nlink is at least 2.
+type FileStat struct {
+	UID int64
+	GID int64
+
+	// Ino identifies the file within the driver, if the driver supports
+	// hardlinks. Nlink is the number of links to the file.
+	Ino   uint64
+	Nlink uint64
+}
+
 func NewSystemDriver() (Driver, error) {
 	// TODO(stevvooe): Consider having this take a "hint" path argument, which
 	// would be the context root. The hint could be used to resolve required
@@ -112,9 +146,120 @@ type DeviceInfoDriver interface {
 	DeviceInfo(fi os.FileInfo) (maj uint64, min uint64, err error)
 }
 
+// VerityDriver should be implemented by drivers on operating systems that
+// support fs-verity, such as Linux.
+type VerityDriver interface {
+	// MeasureVerity returns the fs-verity file digest of the regular file at
+	// path, as measured by the kernel. An empty digest is returned if
+	// fs-verity is not enabled on the file.
+	MeasureVerity(path string) (digest.Digest, error)
+}
+
+// ProjectIDDriver should be implemented by drivers on operating systems and
+// filesystems that support project quotas, such as XFS and ext4 on Linux.
+// Filesystems without project support fail with ErrNotSupported.
+type ProjectIDDriver interface {
+	// GetProjectID returns the project quota id of the regular file or
+	// directory at path.
+	GetProjectID(path string) (uint32, error)
+
+	// SetProjectID sets the project quota id of the regular file or
+	// directory at path.
+	SetProjectID(path string, id uint32) error
+}
+
+// BirthTimeDriver should be implemented by drivers on operating systems and
+// filesystems that record the creation time of files, such as Linux with
+// statx(2).
+type BirthTimeDriver interface {
+	// BirthTime returns the creation time of the file at path, without
+	// following symbolic links. The zero time is returned if the filesystem
+	// did not record it.
+	BirthTime(path string) (time.Time, error)
+}
+
+// Statx holds the metadata of a file beyond that of os.FileInfo, as reported
+// by statx(2) on Linux.
+type Statx struct {
+	// MountID identifies the mount the file was found on, or is zero if
+	// unknown.
+	MountID uint64
+
+	// Attributes holds the StatxAttr flags set on the file, and
+	// AttributesMask those the filesystem is able to report.
+	Attributes     uint64
+	AttributesMask uint64
+
+	// BirthTime is the creation time of the file, or the zero time if the
+	// filesystem did not record it.
+	BirthTime time.Time
+}
+
+// The attributes of files reported in Statx. The values are those of
+// statx(2).
+const (
+	StatxAttrImmutable = 0x10
+	StatxAttrMountRoot = 0x2000
+	StatxAttrVerity    = 0x100000
+	StatxAttrDAX       = 0x200000
+)
+
+// Attribute reports whether the file has the attribute attr, and whether the
+// filesystem is able to report it at all.
+func (s *Statx) Attribute(attr uint64) (set bool, known bool) {
+	return s.Attributes&attr != 0, s.AttributesMask&attr != 0
+}
+
+// StatxDriver should be implemented by drivers that can report the extended
+// metadata of a file along with its os.FileInfo in a single call, such as
+// with statx(2) on Linux. The Sys method of the os.FileInfo values returned
+// gives the same type as that of Lstat.
+type StatxDriver interface {
+	// Lstatx returns the os.FileInfo and the extended metadata of the file
+	// at path, without following symbolic links.
+	Lstatx(path string) (os.FileInfo, *Statx, error)
+}
+
+// ReparsePointDriver should be implemented by drivers on operating systems
+// that support reparse points, such as Windows.
+type ReparsePointDriver interface {
+	// GetReparsePoint returns the raw reparse data buffer of the reparse
+	// point at path, without following it. The reparse tag is held in the
+	// first four bytes of the buffer.
+	GetReparsePoint(path string) ([]byte, error)
+
+	// SetReparsePoint sets the raw reparse data buffer on the existing file
+	// or directory at path.
+	SetReparsePoint(path string, data []byte) error
+
+	// Junction creates a directory junction at path, pointing at the
+	// absolute path target.
+	Junction(target, path string) error
+}
+
+// SymlinkTypeDriver should be implemented by drivers on operating systems
+// that tell links to files from links to directories, such as Windows.
+type SymlinkTypeDriver interface {
+	// CreateSymlink creates a symbolic link at path to target, as a link to
+	// a directory if dir is true and to a file otherwise, whatever target
+	// is.
+	CreateSymlink(target, path string, dir bool) error
+}
+
+// FileAttributeDriver should be implemented by drivers on operating systems
+// with file attributes, such as Windows.
+type FileAttributeDriver interface {
+	// SetFileAttributes sets the attributes settable by SetFileAttributes
+	// on Windows, such as FILE_ATTRIBUTE_HIDDEN, of the file or directory at
+	// path, clearing the others.
+	SetFileAttributes(path string, attrs uint32) error
+}
+
 // driver is a simple default implementation that sends calls out to the "os"
 // package. Extend the "driver" type in system-specific files to add support,
-// such as xattrs, which can add support at compile time.
+// such as xattrs, which can add support at compile time. On Windows, all
+// paths are converted to their extended-length form before use so that trees
+// deeper than MAX_PATH can be built and applied.
 type driver struct{}
 
 var _ File = &os.File{}
@@ -123,27 +268,27 @@ var _ File = &os.File{}
 var LocalDriver Driver = &driver{}
 
 func (d *driver) Open(p string) (File, error) {
-	return os.Open(p)
+	return os.Open(fixLongPath(p))
 }
 
 func (d *driver) OpenFile(path string, flag int, perm os.FileMode) (File, error) {
-	return os.OpenFile(path, flag, perm)
+	return os.OpenFile(fixLongPath(path), flag, perm)
 }
 
 func (d *driver) Stat(p string) (os.FileInfo, error) {
-	return os.Stat(p)
+	return os.Stat(fixLongPath(p))
 }
 
 func (d *driver) Lstat(p string) (os.FileInfo, error) {
-	return os.Lstat(p)
+	return os.Lstat(fixLongPath(p))
 }
 
 func (d *driver) Readlink(p string) (string, error) {
-	return os.Readlink(p)
+	return os.Readlink(fixLongPath(p))
 }
 
 func (d *driver) Mkdir(p string, mode os.FileMode) error {
-	return os.Mkdir(p, mode)
+	return os.Mkdir(fixLongPath(p), mode)
 }
 
 // Remove is used to unlink files and remove directories.
@@ -153,26 +298,30 @@ func (d *driver) Mkdir(p string, mode os.FileMode) error {
 // to mirror system call is required, they should be
 // split up at that time.
 func (d *driver) Remove(path string) error {
-	return os.Remove(path)
+	return os.Remove(fixLongPath(path))
 }
 
 func (d *driver) Link(oldname, newname string) error {
-	return os.Link(oldname, newname)
+	return os.Link(fixLongPath(oldname), fixLongPath(newname))
 }
 
 func (d *driver) Lchown(name string, uid, gid int64) error {
 	// TODO: error out if uid excesses int bit width?
-	return os.Lchown(name, int(uid), int(gid))
+	return os.Lchown(fixLongPath(name), int(uid), int(gid))
 }
 
 func (d *driver) Symlink(oldname, newname string) error {
-	return os.Symlink(oldname, newname)
+	return os.Symlink(oldname, fixLongPath(newname))
 }
 
 func (d *driver) MkdirAll(path string, perm os.FileMode) error {
-	return os.MkdirAll(path, perm)
+	return os.MkdirAll(fixLongPath(path), perm)
 }
 
 func (d *driver) RemoveAll(path string) error {
-	return os.RemoveAll(path)
+	return os.RemoveAll(fixLongPath(path))
+}
+
+func (d *driver) Rename(oldpath, newpath string) error {
+	return os.Rename(fixLongPath(oldpath), fixLongPath(newpath))
 }
@@ -25,6 +25,10 @@ package driver
 
 import (
 	"os"
+	"path/filepath"
+
+	winio "github.com/Microsoft/go-winio"
+	"golang.org/x/sys/windows"
 )
 
 func (d *driver) Mknod(path string, mode os.FileMode, major, minor int) error {
@@ -38,5 +42,120 @@ func (d *driver) Mkfifo(path string, mode os.FileMode) error {
 // Lchmod changes the mode of an file not following symlinks.
 func (d *driver) Lchmod(path string, mode os.FileMode) (err error) {
 	// TODO: Use Window's equivalent
-	return os.Chmod(path, mode)
+	return os.Chmod(fixLongPath(path), mode)
+}
+
+// GetReparsePoint returns the raw reparse data buffer of the reparse point at
+// path, without following it.
+func (d *driver) GetReparsePoint(path string) ([]byte, error) {
+	h, err := openReparsePoint(path, windows.GENERIC_READ)
+	if err != nil {
+		return nil, &os.PathError{Op: "getreparsepoint", Path: path, Err: err}
+	}
+	defer windows.CloseHandle(h)
+
+	buf := make([]byte, windows.MAXIMUM_REPARSE_DATA_BUFFER_SIZE)
+	var n uint32
+	if err := windows.DeviceIoControl(h, windows.FSCTL_GET_REPARSE_POINT, nil, 0, &buf[0], uint32(len(buf)), &n, nil); err != nil {
+		return nil, &os.PathError{Op: "getreparsepoint", Path: path, Err: err}
+	}
+
+	return buf[:n], nil
+}
+
+// SetReparsePoint sets the raw reparse data buffer on the existing file or
+// directory at path.
+func (d *driver) SetReparsePoint(path string, data []byte) error {
+	if len(data) == 0 {
+		return &os.PathError{Op: "setreparsepoint", Path: path, Err: os.ErrInvalid}
+	}
+
+	h, err := openReparsePoint(path, windows.GENERIC_WRITE)
+	if err != nil {
+		return &os.PathError{Op: "setreparsepoint", Path: path, Err: err}
+	}
+	defer windows.CloseHandle(h)
+
+	var n uint32
+	if err := windows.DeviceIoControl(h, windows.FSCTL_SET_REPARSE_POINT, &data[0], uint32(len(data)), nil, 0, &n, nil); err != nil {
+		return &os.PathError{Op: "setreparsepoint", Path: path, Err: err}
+	}
+
+	return nil
+}
+
+// Junction creates a directory junction at path, pointing at the absolute
+// path target.
+func (d *driver) Junction(target, path string) error {
+	if err := os.Mkdir(fixLongPath(path), 0o777); err != nil {
+		return err
+	}
+
+	data := winio.EncodeReparsePoint(&winio.ReparsePoint{Target: target, IsMountPoint: true})
+	if err := d.SetReparsePoint(path, data); err != nil {
+		os.Remove(fixLongPath(path))
+		return err
+	}
+
+	return nil
+}
+
+// CreateSymlink creates a symbolic link at path to target, as a link to a
+// directory if dir is true and to a file otherwise. Unlike os.Symlink, the
+// type of the link does not depend on what target is.
+func (d *driver) CreateSymlink(target, path string, dir bool) error {
+	p, err := windows.UTF16PtrFromString(fixLongPath(path))
+	if err != nil {
+		return &os.LinkError{Op: "symlink", Old: target, New: path, Err: err}
+	}
+	t, err := windows.UTF16PtrFromString(filepath.FromSlash(target))
+	if err != nil {
+		return &os.LinkError{Op: "symlink", Old: target, New: path, Err: err}
+	}
+
+	var flags uint32
+	if dir {
+		flags |= windows.SYMBOLIC_LINK_FLAG_DIRECTORY
+	}
+	err = windows.CreateSymbolicLink(p, t, flags|symbolicLinkFlagAllowUnprivilegedCreate)
+	if err == windows.ERROR_INVALID_PARAMETER {
+		// Older versions of Windows do not know the flag.
+		err = windows.CreateSymbolicLink(p, t, flags)
+	}
+	if err != nil {
+		return &os.LinkError{Op: "symlink", Old: target, New: path, Err: err}
+	}
+	return nil
+}
+
+// symbolicLinkFlagAllowUnprivilegedCreate allows symbolic links to be
+// created without privileges in developer mode.
+const symbolicLinkFlagAllowUnprivilegedCreate = 0x2
+
+// SetFileAttributes sets the attributes settable by SetFileAttributes of the
+// file or directory at path, clearing the others.
+func (d *driver) SetFileAttributes(path string, attrs uint32) error {
+	p, err := windows.UTF16PtrFromString(fixLongPath(path))
+	if err != nil {
+		return &os.PathError{Op: "setfileattributes", Path: path, Err: err}
+	}
+	if attrs == 0 {
+		attrs = windows.FILE_ATTRIBUTE_NORMAL
+	}
+	if err := windows.SetFileAttributes(p, attrs); err != nil {
+		return &os.PathError{Op: "setfileattributes", Path: path, Err: err}
+	}
+	return nil
+}
+
+// openReparsePoint opens the file or directory at path without following it,
+// if it is a reparse point.
+func openReparsePoint(path string, access uint32) (windows.Handle, error) {
+	p, err := windows.UTF16PtrFromString(fixLongPath(path))
+	if err != nil {
+		return windows.InvalidHandle, err
+	}
+
+	return windows.CreateFile(p, access, 0, nil, windows.OPEN_EXISTING,
+		windows.FILE_FLAG_OPEN_REPARSE_POINT|windows.FILE_FLAG_BACKUP_SEMANTICS, 0)
 }
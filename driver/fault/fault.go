@@ -0,0 +1,379 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package fault provides a driver that injects faults into another driver,
+// so that the handling of errors by users of the library can be tested.
+//
+// For example, to fail every third stat of the files of a tree:
+//
+//	d := fault.New(driver.LocalDriver, fault.Faults{StatEvery: 3})
+//	ctx, err := continuity.NewContextWithOptions(root, continuity.ContextOptions{
+//		Driver:     d,
+//		PathDriver: d.PathDriver(pathdriver.LocalPathDriver),
+//	})
+package fault
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/containerd/continuity/driver"
+	"github.com/containerd/continuity/pathdriver"
+	"github.com/opencontainers/go-digest"
+)
+
+// Faults configures the faults injected by a Driver. The zero value injects
+// no faults.
+type Faults struct {
+	// Match selects the paths faults are injected for. If nil, faults are
+	// injected for all paths.
+	Match func(path string) bool
+
+	// StatEvery makes every Nth call to Stat or Lstat for a matching path
+	// fail with StatErr, or with EPERM if StatErr is nil.
+	StatEvery int
+	StatErr   error
+
+	// OpenFailures makes the first OpenFailures calls to Open or OpenFile
+	// for matching paths fail with OpenErr, or with EBUSY if OpenErr is nil,
+	// as opens of files that are transiently busy do.
+	OpenFailures int
+	OpenErr      error
+
+	// ReadSize limits the reads of matching files to at most ReadSize bytes
+	// at a time, so that reads are short.
+	ReadSize int
+
+	// ModifyAt simulates the modification of matching files while they are
+	// read. Once a file has been read up to the offset ModifyAt, the rest of
+	// its content is returned altered, and later calls to Stat or Lstat for
+	// the file report a later modification time.
+	ModifyAt int64
+}
+
+// Driver injects faults into the calls made to an underlying driver. The
+// optional interfaces of the driver package are passed on to the underlying
+// driver, failing with driver.ErrNotSupported where it does not implement
+// them, except for driver.RenameDriver: files are always written in place
+// through a Driver. It is safe for concurrent use if the underlying driver
+// is.
+type Driver struct {
+	driver.Driver
+	faults Faults
+
+	mu       sync.Mutex
+	stats    int
+	opens    int
+	modified map[string]bool
+}
+
+var (
+	_ driver.XAttrDriver      = &Driver{}
+	_ driver.LXAttrDriver     = &Driver{}
+	_ driver.DeviceInfoDriver = &Driver{}
+	_ driver.FilesystemDriver = &Driver{}
+	_ driver.VerityDriver     = &Driver{}
+	_ driver.ProjectIDDriver  = &Driver{}
+	_ driver.BirthTimeDriver  = &Driver{}
+)
+
+// New returns a driver injecting faults into the calls made to d.
+func New(d driver.Driver, faults Faults) *Driver {
+	return &Driver{
+		Driver:   d,
+		faults:   faults,
+		modified: map[string]bool{},
+	}
+}
+
+func (d *Driver) match(path string) bool {
+	return d.faults.Match == nil || d.faults.Match(path)
+}
+
+// stat injects the faults into a call to Stat or Lstat.
+func (d *Driver) stat(op, path string, stat func(string) (os.FileInfo, error)) (os.FileInfo, error) {
+	if !d.match(path) {
+		return stat(path)
+	}
+
+	d.mu.Lock()
+	d.stats++
+	fail := d.faults.StatEvery > 0 && d.stats%d.faults.StatEvery == 0
+	modified := d.modified[path]
+	d.mu.Unlock()
+
+	if fail {
+		err := d.faults.StatErr
+		if err == nil {
+			err = syscall.EPERM
+		}
+		return nil, &os.PathError{Op: op, Path: path, Err: err}
+	}
+
+	fi, err := stat(path)
+	if err != nil || !modified {
+		return fi, err
+	}
+	return &modifiedFileInfo{FileInfo: fi}, nil
+}
+
+func (d *Driver) Stat(path string) (os.FileInfo, error) {
+	return d.stat("stat", path, d.Driver.Stat)
+}
+
+func (d *Driver) Lstat(path string) (os.FileInfo, error) {
+	return d.stat("lstat", path, d.Driver.Lstat)
+}
+
+func (d *Driver) Open(path string) (driver.File, error) {
+	return d.OpenFile(path, os.O_RDONLY, 0)
+}
+
+func (d *Driver) OpenFile(path string, flag int, perm os.FileMode) (driver.File, error) {
+	if !d.match(path) {
+		return d.Driver.OpenFile(path, flag, perm)
+	}
+
+	d.mu.Lock()
+	d.opens++
+	fail := d.opens <= d.faults.OpenFailures
+	d.mu.Unlock()
+
+	if fail {
+		err := d.faults.OpenErr
+		if err == nil {
+			err = syscall.EBUSY
+		}
+		return nil, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+
+	f, err := d.Driver.OpenFile(path, flag, perm)
+	if err != nil {
+		return f, err
+	}
+	return &file{File: f, driver: d, path: path}, nil
+}
+
+func (d *Driver) Getxattr(path string) (map[string][]byte, error) {
+	xattrDriver, ok := d.Driver.(driver.XAttrDriver)
+	if !ok {
+		return nil, driver.ErrNotSupported
+	}
+	return xattrDriver.Getxattr(path)
+}
+
+func (d *Driver) Setxattr(path string, attr map[string][]byte) error {
+	xattrDriver, ok := d.Driver.(driver.XAttrDriver)
+	if !ok {
+		return driver.ErrNotSupported
+	}
+	return xattrDriver.Setxattr(path, attr)
+}
+
+func (d *Driver) LGetxattr(path string) (map[string][]byte, error) {
+	lxattrDriver, ok := d.Driver.(driver.LXAttrDriver)
+	if !ok {
+		return nil, driver.ErrNotSupported
+	}
+	return lxattrDriver.LGetxattr(path)
+}
+
+func (d *Driver) LSetxattr(path string, attr map[string][]byte) error {
+	lxattrDriver, ok := d.Driver.(driver.LXAttrDriver)
+	if !ok {
+		return driver.ErrNotSupported
+	}
+	return lxattrDriver.LSetxattr(path, attr)
+}
+
+func (d *Driver) DeviceInfo(fi os.FileInfo) (uint64, uint64, error) {
+	deviceDriver, ok := d.Driver.(driver.DeviceInfoDriver)
+	if !ok {
+		return 0, 0, driver.ErrNotSupported
+	}
+	if mfi, ok := fi.(*modifiedFileInfo); ok {
+		fi = mfi.FileInfo
+	}
+	return deviceDriver.DeviceInfo(fi)
+}
+
+func (d *Driver) StatFilesystem(path string) (string, string, error) {
+	fsDriver, ok := d.Driver.(driver.FilesystemDriver)
+	if !ok {
+		return "", "", driver.ErrNotSupported
+	}
+	return fsDriver.StatFilesystem(path)
+}
+
+func (d *Driver) MeasureVerity(path string) (digest.Digest, error) {
+	verityDriver, ok := d.Driver.(driver.VerityDriver)
+	if !ok {
+		return "", driver.ErrNotSupported
+	}
+	return verityDriver.MeasureVerity(path)
+}
+
+func (d *Driver) GetProjectID(path string) (uint32, error) {
+	projectIDDriver, ok := d.Driver.(driver.ProjectIDDriver)
+	if !ok {
+		return 0, driver.ErrNotSupported
+	}
+	return projectIDDriver.GetProjectID(path)
+}
+
+func (d *Driver) SetProjectID(path string, id uint32) error {
+	projectIDDriver, ok := d.Driver.(driver.ProjectIDDriver)
+	if !ok {
+		return driver.ErrNotSupported
+	}
+	return projectIDDriver.SetProjectID(path, id)
+}
+
+func (d *Driver) BirthTime(path string) (time.Time, error) {
+	birthTimeDriver, ok := d.Driver.(driver.BirthTimeDriver)
+	if !ok {
+		return time.Time{}, driver.ErrNotSupported
+	}
+	return birthTimeDriver.BirthTime(path)
+}
+
+// PathDriver returns a path driver that walks trees through the driver, so
+// that faults are injected into walks, and otherwise handles paths with pd.
+func (d *Driver) PathDriver(pd pathdriver.PathDriver) pathdriver.PathDriver {
+	return &pathDriver{PathDriver: pd, driver: d}
+}
+
+// pathDriver walks trees through a Driver.
+type pathDriver struct {
+	pathdriver.PathDriver
+	driver *Driver
+}
+
+// Walk walks the tree at root like filepath.Walk, describing each file with
+// a call to Lstat.
+func (pd *pathDriver) Walk(root string, walkFn filepath.WalkFunc) error {
+	fi, err := pd.driver.Lstat(root)
+	if err != nil {
+		err = walkFn(root, nil, err)
+	} else {
+		err = pd.walk(root, fi, walkFn)
+	}
+	if err == filepath.SkipDir {
+		return nil
+	}
+	return err
+}
+
+func (pd *pathDriver) walk(p string, fi os.FileInfo, walkFn filepath.WalkFunc) error {
+	if !fi.IsDir() {
+		return walkFn(p, fi, nil)
+	}
+
+	names, err := pd.readDirNames(p)
+	err1 := walkFn(p, fi, err)
+	if err != nil || err1 != nil {
+		return err1
+	}
+
+	for _, name := range names {
+		cp := pd.Join(p, name)
+		cfi, err := pd.driver.Lstat(cp)
+		if err != nil {
+			if err := walkFn(cp, cfi, err); err != nil && err != filepath.SkipDir {
+				return err
+			}
+			continue
+		}
+		if err := pd.walk(cp, cfi, walkFn); err != nil {
+			if !cfi.IsDir() || err != filepath.SkipDir {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (pd *pathDriver) readDirNames(p string) ([]string, error) {
+	f, err := pd.driver.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fis, err := f.Readdir(-1)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(fis))
+	for i, fi := range fis {
+		names[i] = fi.Name()
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// file injects faults into the reads of a matching file.
+type file struct {
+	driver.File
+	driver *Driver
+	path   string
+	offset int64
+}
+
+func (f *file) Read(p []byte) (int, error) {
+	faults := f.driver.faults
+	if faults.ReadSize > 0 && len(p) > faults.ReadSize {
+		p = p[:faults.ReadSize]
+	}
+
+	n, err := f.File.Read(p)
+	if faults.ModifyAt > 0 && f.offset+int64(n) > faults.ModifyAt {
+		start := faults.ModifyAt - f.offset
+		if start < 0 {
+			start = 0
+		}
+		for i := start; i < int64(n); i++ {
+			p[i] = ^p[i]
+		}
+
+		f.driver.mu.Lock()
+		f.driver.modified[f.path] = true
+		f.driver.mu.Unlock()
+	}
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *file) Seek(offset int64, whence int) (int64, error) {
+	n, err := f.File.Seek(offset, whence)
+	if err == nil {
+		f.offset = n
+	}
+	return n, err
+}
+
+// modifiedFileInfo describes a file modified by the driver.
+type modifiedFileInfo struct {
+	os.FileInfo
+}
+
+func (fi *modifiedFileInfo) ModTime() time.Time {
+	return fi.FileInfo.ModTime().Add(time.Second)
+}
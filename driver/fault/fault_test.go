@@ -0,0 +1,202 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fault
+
+import (
+	"errors"
+	"io"
+	"os"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/containerd/continuity"
+	"github.com/containerd/continuity/driver"
+	"github.com/containerd/continuity/driver/memfs"
+)
+
+func newTree(t *testing.T) *memfs.FS {
+	fs := memfs.New()
+	if err := fs.Mkdir("/dir", 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"/a", "/dir/b", "/dir/c"} {
+		f, err := fs.OpenFile(p, os.O_WRONLY|os.O_CREATE, 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(f, "content of "+p); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+	}
+	return fs
+}
+
+func newContext(t *testing.T, fs *memfs.FS, d driver.Driver) continuity.Context {
+	pd := fs.PathDriver()
+	if fd, ok := d.(*Driver); ok {
+		pd = fd.PathDriver(pd)
+	}
+	ctx, err := continuity.NewContextWithOptions("/", continuity.ContextOptions{
+		Driver:     d,
+		PathDriver: pd,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ctx
+}
+
+func TestStatFaults(t *testing.T) {
+	fs := newTree(t)
+	d := New(fs, Faults{
+		Match:     func(path string) bool { return path == "/dir/b" },
+		StatEvery: 1,
+	})
+
+	_, err := continuity.BuildManifest(newContext(t, fs, d))
+	if !errors.Is(err, syscall.EPERM) {
+		t.Fatalf("expected EPERM, got %v", err)
+	}
+
+	if _, err := d.Stat("/dir/c"); err != nil {
+		t.Fatalf("expected other paths to be unaffected, got %v", err)
+	}
+}
+
+func TestShortReads(t *testing.T) {
+	fs := newTree(t)
+	expected, err := continuity.BuildManifest(newContext(t, fs, fs))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := New(fs, Faults{ReadSize: 1})
+	f, err := d.Open("/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if n, err := f.Read(make([]byte, 4)); n != 1 || err != nil {
+		t.Fatalf("expected a short read, got %d, %v", n, err)
+	}
+
+	if err := continuity.VerifyManifest(newContext(t, fs, d), expected); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestModifyWhileReading(t *testing.T) {
+	fs := newTree(t)
+	expected, err := continuity.BuildManifest(newContext(t, fs, fs))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := New(fs, Faults{
+		Match:    func(path string) bool { return path == "/a" },
+		ModifyAt: 4,
+	})
+	before, err := d.Stat("/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := continuity.VerifyManifest(newContext(t, fs, d), expected); err == nil {
+		t.Fatal("expected the modified file to be found")
+	}
+
+	after, err := d.Stat("/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !after.ModTime().After(before.ModTime()) {
+		t.Fatal("expected the modification time to change")
+	}
+}
+
+func TestRetryBusyFiles(t *testing.T) {
+	fs := newTree(t)
+	expected, err := continuity.BuildManifest(newContext(t, fs, fs))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		attempts int
+		err      error
+	}{
+		{attempts: 0, err: syscall.EBUSY},
+		{attempts: 1, err: syscall.EBUSY},
+		{attempts: 2},
+	} {
+		d := New(fs, Faults{
+			Match:        func(path string) bool { return path == "/a" },
+			OpenFailures: 2,
+		})
+		ctx, err := continuity.NewContextWithOptions("/", continuity.ContextOptions{
+			Driver:     d,
+			PathDriver: d.PathDriver(fs.PathDriver()),
+			Retry:      continuity.RetryPolicy{Attempts: tc.attempts, Backoff: time.Millisecond},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		m, err := continuity.BuildManifest(ctx)
+		if !errors.Is(err, tc.err) {
+			t.Fatalf("%d attempts: expected %v, got %v", tc.attempts, tc.err, err)
+		}
+		if err == nil && !reflect.DeepEqual(continuity.Stats(m), continuity.Stats(expected)) {
+			t.Fatalf("%d attempts: expected the manifest to be built in full", tc.attempts)
+		}
+	}
+}
+
+func TestRetryModifiedFiles(t *testing.T) {
+	for _, attempts := range []int{0, 1} {
+		fs := newTree(t)
+		d := New(fs, Faults{
+			Match:    func(path string) bool { return path == "/a" },
+			ModifyAt: 4,
+		})
+		ctx, err := continuity.NewContextWithOptions("/", continuity.ContextOptions{
+			Driver:     d,
+			PathDriver: d.PathDriver(fs.PathDriver()),
+			Retry:      continuity.RetryPolicy{Attempts: attempts},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The file is stated again once read and found to have changed.
+		// Without retries, it is flagged, and otherwise read again, which
+		// digests it in the state stated last.
+		m, err := continuity.BuildManifest(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := continuity.Stats(m).Unstable; n != 1-attempts {
+			t.Fatalf("%d attempts: expected %d unstable files, got %d", attempts, 1-attempts, n)
+		}
+		if err := continuity.VerifyManifest(ctx, m); err != nil {
+			t.Fatalf("%d attempts: expected the file to be recorded as it was read last: %v", attempts, err)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package driver
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// filesystemTypes maps the statfs magic numbers of well known filesystems to
+// the names used in /proc/filesystems. Note that devtmpfs cannot be told apart
+// from tmpfs this way and is reported as tmpfs.
+var filesystemTypes = map[int64]string{
+	unix.BPF_FS_MAGIC:          "bpf",
+	unix.BTRFS_SUPER_MAGIC:     "btrfs",
+	unix.CGROUP_SUPER_MAGIC:    "cgroup",
+	unix.CGROUP2_SUPER_MAGIC:   "cgroup2",
+	unix.DEBUGFS_MAGIC:         "debugfs",
+	unix.DEVPTS_SUPER_MAGIC:    "devpts",
+	unix.EFIVARFS_MAGIC:        "efivarfs",
+	unix.EXT4_SUPER_MAGIC:      "ext4",
+	unix.HUGETLBFS_MAGIC:       "hugetlbfs",
+	unix.NFS_SUPER_MAGIC:       "nfs",
+	unix.NSFS_MAGIC:            "nsfs",
+	unix.OVERLAYFS_SUPER_MAGIC: "overlay",
+	unix.PROC_SUPER_MAGIC:      "proc",
+	unix.PSTOREFS_MAGIC:        "pstore",
+	unix.RAMFS_MAGIC:           "ramfs",
+	unix.SECURITYFS_MAGIC:      "securityfs",
+	unix.SELINUX_MAGIC:         "selinuxfs",
+	unix.SQUASHFS_MAGIC:        "squashfs",
+	unix.SYSFS_MAGIC:           "sysfs",
+	unix.TMPFS_MAGIC:           "tmpfs",
+	unix.TRACEFS_MAGIC:         "tracefs",
+	unix.XFS_SUPER_MAGIC:       "xfs",
+}
+
+func (d *driver) StatFilesystem(path string) (fstype string, fsid string, err error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(path, &st); err != nil {
+		return "", "", &os.PathError{Op: "statfs", Path: path, Err: err}
+	}
+
+	if st.Fsid.Val != [2]int32{} {
+		fsid = fmt.Sprintf("%08x%08x", uint32(st.Fsid.Val[0]), uint32(st.Fsid.Val[1]))
+	}
+
+	//nolint:unconvert
+	return filesystemTypes[int64(st.Type)], fsid, nil
+}
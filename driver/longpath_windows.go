@@ -0,0 +1,50 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package driver
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// longPathPrefix is the prefix that instructs the Windows API to skip path
+// normalization and lift the MAX_PATH restriction.
+const longPathPrefix = `\\?\`
+
+// fixLongPath returns the extended-length form of path so that trees deeper
+// than MAX_PATH can be accessed. Only absolute paths can be converted;
+// relative paths and paths already in a device or extended-length form are
+// returned unmodified.
+func fixLongPath(path string) string {
+	if !filepath.IsAbs(path) {
+		return path
+	}
+
+	if strings.HasPrefix(path, longPathPrefix) || strings.HasPrefix(path, `\\.\`) {
+		return path
+	}
+
+	// The extended-length form is passed to the filesystem verbatim, so the
+	// path must be cleaned here and cannot contain forward slashes.
+	path = filepath.Clean(path)
+	if strings.HasPrefix(path, `\\`) {
+		// UNC path, \\server\share becomes \\?\UNC\server\share.
+		return longPathPrefix + `UNC` + path[1:]
+	}
+
+	return longPathPrefix + path
+}
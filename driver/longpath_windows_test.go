@@ -0,0 +1,39 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package driver
+
+import "testing"
+
+func TestFixLongPath(t *testing.T) {
+	for _, tc := range []struct {
+		path     string
+		expected string
+	}{
+		{path: `C:\foo\bar`, expected: `\\?\C:\foo\bar`},
+		{path: `C:/foo/bar`, expected: `\\?\C:\foo\bar`},
+		{path: `C:\foo\..\bar`, expected: `\\?\C:\bar`},
+		{path: `\\server\share\foo`, expected: `\\?\UNC\server\share\foo`},
+		{path: `\\?\C:\foo`, expected: `\\?\C:\foo`},
+		{path: `\\.\pipe\foo`, expected: `\\.\pipe\foo`},
+		{path: `foo\bar`, expected: `foo\bar`},
+		{path: `\foo\bar`, expected: `\foo\bar`},
+	} {
+		if actual := fixLongPath(tc.path); actual != tc.expected {
+			t.Errorf("fixLongPath(%q): expected %q, got %q", tc.path, tc.expected, actual)
+		}
+	}
+}
@@ -0,0 +1,691 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package memfs provides an in-memory filesystem driver, supporting
+// symlinks, hardlinks, devices, ownership and extended attributes, so that
+// building and applying manifests can be exercised deterministically and
+// without privileges.
+//
+// Paths are slash separated and absolute, and must be handled with the path
+// driver returned by PathDriver:
+//
+//	fs := memfs.New()
+//	ctx, err := continuity.NewContextWithOptions("/", continuity.ContextOptions{
+//		Driver:     fs,
+//		PathDriver: fs.PathDriver(),
+//	})
+package memfs
+
+import (
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/containerd/continuity/driver"
+	"github.com/containerd/continuity/pathdriver"
+)
+
+// maxSymlinks limits the number of symlinks followed to resolve a path.
+const maxSymlinks = 40
+
+// FS is an in-memory filesystem. It is safe for concurrent use.
+type FS struct {
+	mu      sync.Mutex
+	root    *node
+	nextIno uint64
+
+	// Now returns the modification time of changed files. If nil, the zero
+	// time is used, so that the filesystem is deterministic.
+	Now func() time.Time
+}
+
+var (
+	_ driver.Driver           = &FS{}
+	_ driver.XAttrDriver      = &FS{}
+	_ driver.LXAttrDriver     = &FS{}
+	_ driver.DeviceInfoDriver = &FS{}
+	_ driver.RenameDriver     = &FS{}
+)
+
+// node is a file of the filesystem. Hardlinks share their node.
+type node struct {
+	ino      uint64
+	mode     os.FileMode
+	uid, gid int64
+	nlink    uint64
+	modTime  time.Time
+
+	data     []byte           // content of regular files
+	target   string           // target of symlinks
+	children map[string]*node // entries of directories
+	xattrs   map[string][]byte
+
+	major, minor uint64 // device numbers of devices
+}
+
+// New returns an empty filesystem, with its root directory owned by uid and
+// gid 0.
+func New() *FS {
+	fs := &FS{}
+	fs.root = fs.newNode(os.ModeDir | 0o755)
+	fs.root.children = map[string]*node{}
+	return fs
+}
+
+// PathDriver returns the path driver for the paths of the filesystem.
+func (fs *FS) PathDriver() pathdriver.PathDriver {
+	return &pathDriver{fs: fs}
+}
+
+func (fs *FS) now() time.Time {
+	if fs.Now == nil {
+		return time.Time{}
+	}
+	return fs.Now()
+}
+
+func (fs *FS) newNode(mode os.FileMode) *node {
+	fs.nextIno++
+	return &node{ino: fs.nextIno, mode: mode, nlink: 1, modTime: fs.now()}
+}
+
+// split returns the cleaned components of the absolute path p.
+func split(p string) []string {
+	p = strings.TrimPrefix(path.Clean("/"+p), "/")
+	if p == "" {
+		return nil
+	}
+	return strings.Split(p, "/")
+}
+
+// lookup resolves the path p, following symlinks in all but the last
+// component, and following the last one too if follow is set. The parent
+// directory is returned along with the node, which is nil if the last
+// component does not exist. Like filepath.Clean, ".." is resolved lexically.
+func (fs *FS) lookup(op, p string, follow bool) (parent *node, name string, n *node, err error) {
+	for links := 0; ; links++ {
+		if links > maxSymlinks {
+			return nil, "", nil, &os.PathError{Op: op, Path: p, Err: syscall.ELOOP}
+		}
+
+		var target string
+		parent, name, n, target, err = fs.walk(op, p, follow)
+		if err != nil || target == "" {
+			return parent, name, n, err
+		}
+		p = target
+	}
+}
+
+// walk resolves the path p up to the first symlink to follow, returning the
+// path that the symlink resolves p to, if any.
+func (fs *FS) walk(op, p string, follow bool) (*node, string, *node, string, error) {
+	parts := split(p)
+	if len(parts) == 0 {
+		return nil, "", fs.root, "", nil
+	}
+
+	dir := fs.root
+	for i, part := range parts {
+		if !dir.mode.IsDir() {
+			return nil, "", nil, "", &os.PathError{Op: op, Path: p, Err: syscall.ENOTDIR}
+		}
+
+		n := dir.children[part]
+		last := i == len(parts)-1
+		if n == nil {
+			if last {
+				return dir, part, nil, "", nil
+			}
+			return nil, "", nil, "", &os.PathError{Op: op, Path: p, Err: os.ErrNotExist}
+		}
+
+		if n.mode&os.ModeSymlink != 0 && (!last || follow) {
+			target := n.target
+			if !path.IsAbs(target) {
+				target = path.Join("/", path.Join(parts[:i]...), target)
+			}
+			return nil, "", nil, path.Join(target, path.Join(parts[i+1:]...)), nil
+		}
+		if last {
+			return dir, part, n, "", nil
+		}
+		dir = n
+	}
+	panic("unreachable")
+}
+
+// get returns the node at p, failing if it does not exist.
+func (fs *FS) get(op, p string, follow bool) (*node, error) {
+	_, _, n, err := fs.lookup(op, p, follow)
+	if err != nil {
+		return nil, err
+	}
+	if n == nil {
+		return nil, &os.PathError{Op: op, Path: p, Err: os.ErrNotExist}
+	}
+	return n, nil
+}
+
+// create adds the node n at p, which must not exist.
+func (fs *FS) create(op, p string, n *node) error {
+	dir, name, existing, err := fs.lookup(op, p, false)
+	if err != nil {
+		return err
+	}
+	if dir == nil {
+		return &os.PathError{Op: op, Path: p, Err: os.ErrExist}
+	}
+	if existing != nil {
+		return &os.PathError{Op: op, Path: p, Err: os.ErrExist}
+	}
+	dir.children[name] = n
+	dir.modTime = fs.now()
+	return nil
+}
+
+func (fs *FS) Open(p string) (driver.File, error) {
+	return fs.OpenFile(p, os.O_RDONLY, 0)
+}
+
+func (fs *FS) OpenFile(p string, flag int, perm os.FileMode) (driver.File, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	dir, name, n, err := fs.lookup("open", p, true)
+	if err != nil {
+		return nil, err
+	}
+
+	writable := flag&(os.O_WRONLY|os.O_RDWR) != 0
+	switch {
+	case n == nil && flag&os.O_CREATE == 0:
+		return nil, &os.PathError{Op: "open", Path: p, Err: os.ErrNotExist}
+	case n == nil:
+		n = fs.newNode(perm.Perm())
+		dir.children[name] = n
+		dir.modTime = fs.now()
+	case flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, &os.PathError{Op: "open", Path: p, Err: os.ErrExist}
+	case n.mode.IsDir() && writable:
+		return nil, &os.PathError{Op: "open", Path: p, Err: syscall.EISDIR}
+	case !n.mode.IsRegular() && !n.mode.IsDir():
+		return nil, &os.PathError{Op: "open", Path: p, Err: driver.ErrNotSupported}
+	}
+
+	if writable && flag&os.O_TRUNC != 0 {
+		n.data = nil
+		n.modTime = fs.now()
+	}
+
+	f := &file{fs: fs, node: n, path: p, writable: writable}
+	if flag&os.O_APPEND != 0 {
+		f.offset = int64(len(n.data))
+	}
+	return f, nil
+}
+
+func (fs *FS) Stat(p string) (os.FileInfo, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	n, err := fs.get("stat", p, true)
+	if err != nil {
+		return nil, err
+	}
+	return newFileInfo(path.Base(path.Clean("/"+p)), n), nil
+}
+
+func (fs *FS) Lstat(p string) (os.FileInfo, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	n, err := fs.get("lstat", p, false)
+	if err != nil {
+		return nil, err
+	}
+	return newFileInfo(path.Base(path.Clean("/"+p)), n), nil
+}
+
+func (fs *FS) Readlink(p string) (string, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	n, err := fs.get("readlink", p, false)
+	if err != nil {
+		return "", err
+	}
+	if n.mode&os.ModeSymlink == 0 {
+		return "", &os.PathError{Op: "readlink", Path: p, Err: os.ErrInvalid}
+	}
+	return n.target, nil
+}
+
+func (fs *FS) Mkdir(p string, mode os.FileMode) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	n := fs.newNode(os.ModeDir | mode.Perm())
+	n.children = map[string]*node{}
+	return fs.create("mkdir", p, n)
+}
+
+func (fs *FS) MkdirAll(p string, perm os.FileMode) error {
+	parts := split(p)
+	for i := range parts {
+		dp := "/" + strings.Join(parts[:i+1], "/")
+		if fi, err := fs.Stat(dp); err == nil {
+			if !fi.IsDir() {
+				return &os.PathError{Op: "mkdir", Path: dp, Err: syscall.ENOTDIR}
+			}
+			continue
+		}
+		if err := fs.Mkdir(dp, perm); err != nil && !os.IsExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (fs *FS) Remove(p string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	dir, name, n, err := fs.lookup("remove", p, false)
+	if err != nil {
+		return err
+	}
+	if n == nil {
+		return &os.PathError{Op: "remove", Path: p, Err: os.ErrNotExist}
+	}
+	if dir == nil {
+		return &os.PathError{Op: "remove", Path: p, Err: os.ErrInvalid}
+	}
+	if n.mode.IsDir() && len(n.children) > 0 {
+		return &os.PathError{Op: "remove", Path: p, Err: syscall.ENOTEMPTY}
+	}
+
+	delete(dir.children, name)
+	n.nlink--
+	dir.modTime = fs.now()
+	return nil
+}
+
+func (fs *FS) RemoveAll(p string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	dir, name, n, err := fs.lookup("remove", p, false)
+	if err != nil || n == nil {
+		// As with os.RemoveAll, missing paths are not an error.
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if dir == nil {
+		return &os.PathError{Op: "remove", Path: p, Err: os.ErrInvalid}
+	}
+
+	delete(dir.children, name)
+	n.nlink--
+	dir.modTime = fs.now()
+	return nil
+}
+
+func (fs *FS) Link(oldname, newname string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	n, err := fs.get("link", oldname, false)
+	if err != nil {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: err}
+	}
+	if n.mode.IsDir() {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: syscall.EPERM}
+	}
+	if err := fs.create("link", newname, n); err != nil {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: err}
+	}
+	n.nlink++
+	return nil
+}
+
+func (fs *FS) Symlink(oldname, newname string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	n := fs.newNode(os.ModeSymlink | 0o777)
+	n.target = oldname
+	if err := fs.create("symlink", newname, n); err != nil {
+		return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: err}
+	}
+	return nil
+}
+
+func (fs *FS) Rename(oldpath, newpath string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	odir, oname, n, err := fs.lookup("rename", oldpath, false)
+	if err == nil && (n == nil || odir == nil) {
+		err = os.ErrNotExist
+	}
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: err}
+	}
+
+	ndir, nname, existing, err := fs.lookup("rename", newpath, false)
+	if err == nil && ndir == nil {
+		err = os.ErrInvalid
+	}
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: err}
+	}
+	if existing != nil && existing.mode.IsDir() && len(existing.children) > 0 {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.ENOTEMPTY}
+	}
+	if existing != nil && existing != n {
+		existing.nlink--
+	}
+
+	delete(odir.children, oname)
+	ndir.children[nname] = n
+	odir.modTime, ndir.modTime = fs.now(), fs.now()
+	return nil
+}
+
+func (fs *FS) Lchmod(p string, mode os.FileMode) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	n, err := fs.get("lchmod", p, false)
+	if err != nil {
+		return err
+	}
+	if n.mode&os.ModeSymlink != 0 {
+		// As on Linux, the mode of symlinks cannot be changed.
+		return nil
+	}
+
+	const settable = os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+	n.mode = n.mode&^settable | mode&settable
+	return nil
+}
+
+func (fs *FS) Lchown(p string, uid, gid int64) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	n, err := fs.get("lchown", p, false)
+	if err != nil {
+		return err
+	}
+	n.uid, n.gid = uid, gid
+	return nil
+}
+
+func (fs *FS) Mknod(p string, mode os.FileMode, major, minor int) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if mode&os.ModeDevice == 0 {
+		return &os.PathError{Op: "mknod", Path: p, Err: os.ErrInvalid}
+	}
+	n := fs.newNode(mode & (os.ModeType | os.ModePerm))
+	n.major, n.minor = uint64(major), uint64(minor)
+	return fs.create("mknod", p, n)
+}
+
+func (fs *FS) Mkfifo(p string, mode os.FileMode) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	return fs.create("mkfifo", p, fs.newNode(os.ModeNamedPipe|mode.Perm()))
+}
+
+func (fs *FS) Getxattr(p string) (map[string][]byte, error) {
+	return fs.getxattr(p, true)
+}
+
+func (fs *FS) LGetxattr(p string) (map[string][]byte, error) {
+	return fs.getxattr(p, false)
+}
+
+func (fs *FS) getxattr(p string, follow bool) (map[string][]byte, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	n, err := fs.get("getxattr", p, follow)
+	if err != nil {
+		return nil, err
+	}
+
+	xattrs := make(map[string][]byte, len(n.xattrs))
+	for k, v := range n.xattrs {
+		xattrs[k] = append([]byte(nil), v...)
+	}
+	return xattrs, nil
+}
+
+func (fs *FS) Setxattr(p string, attr map[string][]byte) error {
+	return fs.setxattr(p, attr, true)
+}
+
+func (fs *FS) LSetxattr(p string, attr map[string][]byte) error {
+	return fs.setxattr(p, attr, false)
+}
+
+func (fs *FS) setxattr(p string, attr map[string][]byte, follow bool) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	n, err := fs.get("setxattr", p, follow)
+	if err != nil {
+		return err
+	}
+
+	n.xattrs = make(map[string][]byte, len(attr))
+	for k, v := range attr {
+		n.xattrs[k] = append([]byte(nil), v...)
+	}
+	return nil
+}
+
+func (fs *FS) DeviceInfo(fi os.FileInfo) (uint64, uint64, error) {
+	mfi, ok := fi.(*fileInfo)
+	if !ok || mfi.mode&os.ModeDevice == 0 {
+		return 0, 0, driver.ErrNotSupported
+	}
+	return mfi.major, mfi.minor, nil
+}
+
+// readDir returns the entries of the directory at p, sorted by name.
+func (fs *FS) readDir(p string) ([]os.FileInfo, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	n, err := fs.get("readdir", p, true)
+	if err != nil {
+		return nil, err
+	}
+	if !n.mode.IsDir() {
+		return nil, &os.PathError{Op: "readdir", Path: p, Err: syscall.ENOTDIR}
+	}
+	return n.entries(), nil
+}
+
+func (n *node) entries() []os.FileInfo {
+	fis := make([]os.FileInfo, 0, len(n.children))
+	for name, child := range n.children {
+		fis = append(fis, newFileInfo(name, child))
+	}
+	sort.Slice(fis, func(i, j int) bool { return fis[i].Name() < fis[j].Name() })
+	return fis
+}
+
+// file is an open file of the filesystem.
+type file struct {
+	fs       *FS
+	node     *node
+	path     string
+	offset   int64
+	writable bool
+
+	// dirents holds the entries of a directory not returned by Readdir
+	// yet, once listed.
+	dirents []os.FileInfo
+	listed  bool
+}
+
+func (f *file) Read(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if f.node.mode.IsDir() {
+		return 0, &os.PathError{Op: "read", Path: f.path, Err: syscall.EISDIR}
+	}
+	if f.offset >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.node.data[f.offset:])
+	f.offset += int64(n)
+	return n, nil
+}
+
+func (f *file) Write(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if !f.writable {
+		return 0, &os.PathError{Op: "write", Path: f.path, Err: os.ErrPermission}
+	}
+
+	end := f.offset + int64(len(p))
+	if end > int64(len(f.node.data)) {
+		data := make([]byte, end)
+		copy(data, f.node.data)
+		f.node.data = data
+	}
+	copy(f.node.data[f.offset:], p)
+	f.offset = end
+	f.node.modTime = f.fs.now()
+	return len(p), nil
+}
+
+func (f *file) Seek(offset int64, whence int) (int64, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += int64(len(f.node.data))
+	default:
+		return 0, &os.PathError{Op: "seek", Path: f.path, Err: os.ErrInvalid}
+	}
+	if offset < 0 {
+		return 0, &os.PathError{Op: "seek", Path: f.path, Err: os.ErrInvalid}
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+// Readdir returns the entries of the directory like os.File.Readdir,
+// continuing from the entries returned by previous calls.
+func (f *file) Readdir(n int) ([]os.FileInfo, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if !f.node.mode.IsDir() {
+		return nil, &os.PathError{Op: "readdir", Path: f.path, Err: syscall.ENOTDIR}
+	}
+	if !f.listed {
+		f.dirents, f.listed = f.node.entries(), true
+	}
+
+	fis := f.dirents
+	if n > 0 {
+		if len(fis) == 0 {
+			return nil, io.EOF
+		}
+		if len(fis) > n {
+			fis = fis[:n]
+		}
+	}
+	f.dirents = f.dirents[len(fis):]
+	return fis, nil
+}
+
+func (f *file) Close() error {
+	return nil
+}
+
+// fileInfo is a snapshot of the metadata of a node.
+type fileInfo struct {
+	name         string
+	size         int64
+	mode         os.FileMode
+	modTime      time.Time
+	stat         driver.FileStat
+	major, minor uint64
+}
+
+func newFileInfo(name string, n *node) *fileInfo {
+	fi := &fileInfo{
+		name:    name,
+		size:    int64(len(n.data)),
+		mode:    n.mode,
+		modTime: n.modTime,
+		stat:    driver.FileStat{UID: n.uid, GID: n.gid, Ino: n.ino, Nlink: n.nlink},
+		major:   n.major,
+		minor:   n.minor,
+	}
+	if n.mode&os.ModeSymlink != 0 {
+		fi.size = int64(len(n.target))
+	}
+	return fi
+}
+
+func (fi *fileInfo) Name() string       { return fi.name }
+func (fi *fileInfo) Size() int64        { return fi.size }
+func (fi *fileInfo) Mode() os.FileMode  { return fi.mode }
+func (fi *fileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *fileInfo) IsDir() bool        { return fi.mode.IsDir() }
+
+func (fi *fileInfo) Sys() interface{} {
+	st := fi.stat
+	return &st
+}
+
+// pathDriver handles the paths of the filesystem.
+type pathDriver struct {
+	pathdriver.SlashPathDriver
+	fs *FS
+}
+
+// Walk walks the filesystem in lexical order, like filepath.Walk.
+func (d *pathDriver) Walk(root string, walkFn filepath.WalkFunc) error {
+	return pathdriver.WalkTree(root, d.fs.Lstat, d.fs.readDir, walkFn)
+}
@@ -0,0 +1,222 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package memfs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/containerd/continuity"
+	"github.com/opencontainers/go-digest"
+)
+
+// provider reads the content of the regular files of a manifest from the
+// filesystem it was built from.
+type provider struct {
+	fs    *FS
+	paths map[digest.Digest]string
+}
+
+func newProvider(fs *FS, m *continuity.Manifest) *provider {
+	p := &provider{fs: fs, paths: map[digest.Digest]string{}}
+	for _, r := range m.Resources {
+		if f, ok := r.(continuity.RegularFile); ok {
+			for _, dgst := range f.Digests() {
+				p.paths[dgst] = f.Path()
+			}
+		}
+	}
+	return p
+}
+
+func (p *provider) Reader(dgst digest.Digest) (io.ReadCloser, error) {
+	path, ok := p.paths[dgst]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return p.fs.Open(path)
+}
+
+func newContext(t *testing.T, fs *FS, provider continuity.ContentProvider) continuity.Context {
+	ctx, err := continuity.NewContextWithOptions("/", continuity.ContextOptions{
+		Driver:     fs,
+		PathDriver: fs.PathDriver(),
+		Provider:   provider,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ctx
+}
+
+func writeFile(t *testing.T, fs *FS, p, content string) {
+	f, err := fs.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := io.WriteString(f, content); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBuildApplyVerify(t *testing.T) {
+	src := New()
+	for _, err := range []error{
+		src.MkdirAll("/etc/conf.d", 0o755),
+		src.Mkdir("/dev", 0o755),
+		src.Mkdir("/tmp", 0o1777),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile(t, src, "/etc/passwd", "root:x:0:0::/root:/bin/sh\n")
+	writeFile(t, src, "/etc/conf.d/app", "key=value\n")
+	writeFile(t, src, "/setuid", "#!/bin/sh\n")
+	for _, err := range []error{
+		src.Link("/etc/passwd", "/etc/passwd-"),
+		src.Symlink("conf.d/app", "/etc/app.conf"),
+		src.Mknod("/dev/null", os.ModeDevice|os.ModeCharDevice|0o666, 1, 3),
+		src.Mkfifo("/dev/fifo", 0o600),
+		src.Lchown("/etc/conf.d/app", 1000, 100),
+		src.Lchmod("/setuid", os.ModeSetuid|0o755),
+		src.LSetxattr("/etc/conf.d", map[string][]byte{"user.label": []byte("config")}),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m, err := continuity.BuildManifest(newContext(t, src, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var hardlinked bool
+	for _, r := range m.Resources {
+		if h, ok := r.(continuity.Hardlinkable); ok && len(h.Paths()) == 2 {
+			hardlinked = true
+		}
+	}
+	if !hardlinked {
+		t.Fatal("expected the hardlink to be recorded")
+	}
+
+	dst := New()
+	dstCtx := newContext(t, dst, newProvider(src, m))
+	if err := continuity.ApplyManifest(dstCtx, m); err != nil {
+		t.Fatal(err)
+	}
+	if err := continuity.VerifyManifest(dstCtx, m); err != nil {
+		t.Fatal(err)
+	}
+
+	writeFile(t, dst, "/etc/conf.d/app", "key=changed\n")
+	if err := continuity.VerifyManifest(dstCtx, m); err == nil {
+		t.Fatal("expected the changed file to be found")
+	}
+}
+
+func TestPaths(t *testing.T) {
+	fs := New()
+	if err := fs.MkdirAll("/a/b", 0o755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, fs, "/a/b/file", "content")
+	for _, err := range []error{
+		fs.Symlink("/a/b", "/abs"),
+		fs.Symlink("b", "/a/rel"),
+		fs.Symlink("../rel/file", "/a/b/up"),
+		fs.Symlink("loop", "/loop"),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, p := range []string{"/abs/file", "/a/rel/file", "/abs/up", "/a/b/../b/file"} {
+		f, err := fs.Open(p)
+		if err != nil {
+			t.Fatalf("%s: %v", p, err)
+		}
+		b, err := io.ReadAll(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != "content" {
+			t.Fatalf("%s: unexpected content %q", p, b)
+		}
+	}
+
+	if _, err := fs.Stat("/loop"); !errors.Is(err, syscall.ELOOP) {
+		t.Fatalf("expected ELOOP, got %v", err)
+	}
+	if fi, err := fs.Lstat("/loop"); err != nil || fi.Mode()&os.ModeSymlink == 0 {
+		t.Fatalf("expected a symlink, got %v, %v", fi, err)
+	}
+	if _, err := fs.Stat("/a/b/file/x"); !errors.Is(err, syscall.ENOTDIR) {
+		t.Fatalf("expected ENOTDIR, got %v", err)
+	}
+	if err := fs.Remove("/a/b"); !errors.Is(err, syscall.ENOTEMPTY) {
+		t.Fatalf("expected ENOTEMPTY, got %v", err)
+	}
+	if err := fs.RemoveAll("/a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Stat("/abs/file"); !os.IsNotExist(err) {
+		t.Fatalf("expected the file to be removed, got %v", err)
+	}
+}
+
+func TestReaddir(t *testing.T) {
+	fs := New()
+	for _, name := range []string{"/a", "/b", "/c"} {
+		writeFile(t, fs, name, "")
+	}
+	f, err := fs.Open("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var names []string
+	for _, expected := range []int{2, 1} {
+		fis, err := f.Readdir(2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(fis) != expected {
+			t.Fatalf("expected %d entries, got %d", expected, len(fis))
+		}
+		for _, fi := range fis {
+			names = append(names, fi.Name())
+		}
+	}
+	if len(names) != 3 || names[0] != "a" || names[1] != "b" || names[2] != "c" {
+		t.Fatalf("expected every entry once, got %v", names)
+	}
+	if fis, err := f.Readdir(2); len(fis) != 0 || err != io.EOF {
+		t.Fatalf("expected io.EOF once exhausted, got %v, %v", fis, err)
+	}
+	if fis, err := f.Readdir(0); len(fis) != 0 || err != nil {
+		t.Fatalf("expected no entries once exhausted, got %v, %v", fis, err)
+	}
+}
@@ -0,0 +1,92 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package driver
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"unsafe"
+
+	"github.com/containerd/continuity/internal/ioctl"
+	"golang.org/x/sys/unix"
+)
+
+// fsxattr mirrors struct fsxattr from linux/fs.h.
+type fsxattr struct {
+	xflags     uint32
+	extsize    uint32
+	nextents   uint32
+	projid     uint32
+	cowextsize uint32
+	pad        [8]byte
+}
+
+var (
+	// fsIocFsgetxattr is FS_IOC_FSGETXATTR, _IOR('X', 31, struct fsxattr).
+	fsIocFsgetxattr = ioctl.IOR('X', 31, unsafe.Sizeof(fsxattr{}))
+	// fsIocFssetxattr is FS_IOC_FSSETXATTR, _IOW('X', 32, struct fsxattr).
+	fsIocFssetxattr = ioctl.IOW('X', 32, unsafe.Sizeof(fsxattr{}))
+)
+
+// GetProjectID returns the project quota id of the regular file or directory
+// at path.
+func (d *driver) GetProjectID(path string) (uint32, error) {
+	var fsx fsxattr
+	if err := fsxattrIoctl(path, unix.O_RDONLY, fsIocFsgetxattr, &fsx); err != nil {
+		return 0, &os.PathError{Op: "getprojectid", Path: path, Err: err}
+	}
+
+	return fsx.projid, nil
+}
+
+// SetProjectID sets the project quota id of the regular file or directory at
+// path.
+func (d *driver) SetProjectID(path string, id uint32) error {
+	var fsx fsxattr
+	if err := fsxattrIoctl(path, unix.O_RDONLY, fsIocFsgetxattr, &fsx); err != nil {
+		return &os.PathError{Op: "setprojectid", Path: path, Err: err}
+	}
+
+	if fsx.projid == id {
+		return nil
+	}
+
+	fsx.projid = id
+	if err := fsxattrIoctl(path, unix.O_RDONLY, fsIocFssetxattr, &fsx); err != nil {
+		return &os.PathError{Op: "setprojectid", Path: path, Err: err}
+	}
+
+	return nil
+}
+
+func fsxattrIoctl(path string, flags int, req uintptr, fsx *fsxattr) error {
+	fd, err := unix.Open(path, flags|unix.O_NOFOLLOW|unix.O_NONBLOCK|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), req, uintptr(unsafe.Pointer(fsx))); errno != 0 {
+		if errors.Is(errno, unix.ENOTTY) || errors.Is(errno, unix.EOPNOTSUPP) {
+			return fmt.Errorf("%v: %w", errno, ErrNotSupported)
+		}
+		return errno
+	}
+
+	return nil
+}
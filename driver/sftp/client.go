@@ -0,0 +1,512 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package sftp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/containerd/continuity/driver"
+)
+
+// The packet types of version 3 of the SFTP protocol, as described in
+// draft-ietf-secsh-filexfer-02. Only those needed for reading are used.
+const (
+	fxpInit     = 1
+	fxpVersion  = 2
+	fxpOpen     = 3
+	fxpClose    = 4
+	fxpRead     = 5
+	fxpLstat    = 7
+	fxpFstat    = 8
+	fxpOpendir  = 11
+	fxpReaddir  = 12
+	fxpRealpath = 16
+	fxpStat     = 17
+	fxpReadlink = 19
+	fxpStatus   = 101
+	fxpHandle   = 102
+	fxpData     = 103
+	fxpName     = 104
+	fxpAttrs    = 105
+)
+
+const (
+	fxOK               = 0
+	fxEOF              = 1
+	fxNoSuchFile       = 2
+	fxPermissionDenied = 3
+	fxOpUnsupported    = 8
+)
+
+const (
+	attrSize        = 0x00000001
+	attrUIDGID      = 0x00000002
+	attrPermissions = 0x00000004
+	attrACModTime   = 0x00000008
+	attrExtended    = 0x80000000
+)
+
+const fxfRead = 0x00000001
+
+// protocolVersion is the version of the SFTP protocol spoken by the client.
+const protocolVersion = 3
+
+// maxPacket limits the size of the packets accepted from the server.
+const maxPacket = 256 * 1024
+
+// statusError is an error status returned by the server.
+type statusError struct {
+	code uint32
+	msg  string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("sftp: %s (status %d)", e.msg, e.code)
+}
+
+func (e *statusError) Unwrap() error {
+	switch e.code {
+	case fxEOF:
+		return io.EOF
+	case fxNoSuchFile:
+		return os.ErrNotExist
+	case fxPermissionDenied:
+		return os.ErrPermission
+	case fxOpUnsupported:
+		return driver.ErrNotSupported
+	}
+	return nil
+}
+
+// client makes requests to an SFTP server, one at a time.
+type client struct {
+	mu sync.Mutex
+	r  io.Reader
+	w  io.WriteCloser
+	id uint32
+}
+
+func newClient(r io.Reader, w io.WriteCloser) (*client, error) {
+	c := &client{r: r, w: w}
+
+	var b buffer
+	b.uint32(protocolVersion)
+	if err := c.send(fxpInit, b); err != nil {
+		return nil, err
+	}
+
+	typ, p, err := c.recv()
+	if err != nil {
+		return nil, err
+	}
+	if typ != fxpVersion {
+		return nil, fmt.Errorf("sftp: unexpected packet type %d in handshake", typ)
+	}
+	rb := buffer(p)
+	version, err := rb.readUint32()
+	if err != nil {
+		return nil, err
+	}
+	if version < protocolVersion {
+		return nil, fmt.Errorf("sftp: unsupported protocol version %d", version)
+	}
+
+	return c, nil
+}
+
+func (c *client) Close() error {
+	return c.w.Close()
+}
+
+func (c *client) send(typ byte, payload buffer) error {
+	hdr := make([]byte, 5)
+	binary.BigEndian.PutUint32(hdr, uint32(len(payload)+1))
+	hdr[4] = typ
+	if _, err := c.w.Write(append(hdr, payload...)); err != nil {
+		return fmt.Errorf("sftp: %w", err)
+	}
+	return nil
+}
+
+func (c *client) recv() (byte, []byte, error) {
+	hdr := make([]byte, 5)
+	if _, err := io.ReadFull(c.r, hdr); err != nil {
+		return 0, nil, fmt.Errorf("sftp: %w", err)
+	}
+
+	n := binary.BigEndian.Uint32(hdr)
+	if n < 1 || n > maxPacket {
+		return 0, nil, fmt.Errorf("sftp: invalid packet length %d", n)
+	}
+
+	p := make([]byte, n-1)
+	if _, err := io.ReadFull(c.r, p); err != nil {
+		return 0, nil, fmt.Errorf("sftp: %w", err)
+	}
+
+	return hdr[4], p, nil
+}
+
+// request sends a request and returns the type and the rest of the payload
+// of its response. Error statuses are returned as errors.
+func (c *client) request(typ byte, args buffer) (byte, buffer, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.id++
+	var b buffer
+	b.uint32(c.id)
+	b = append(b, args...)
+	if err := c.send(typ, b); err != nil {
+		return 0, nil, err
+	}
+
+	rtyp, p, err := c.recv()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	rb := buffer(p)
+	id, err := rb.readUint32()
+	if err != nil {
+		return 0, nil, err
+	}
+	if id != c.id {
+		return 0, nil, fmt.Errorf("sftp: unexpected response id %d", id)
+	}
+
+	if rtyp == fxpStatus {
+		code, err := rb.readUint32()
+		if err != nil {
+			return 0, nil, err
+		}
+		if code == fxOK {
+			return rtyp, rb, nil
+		}
+		msg, _ := rb.readString()
+		return 0, nil, &statusError{code: code, msg: msg}
+	}
+
+	return rtyp, rb, nil
+}
+
+func (c *client) expect(typ byte, args buffer, expected byte) (buffer, error) {
+	rtyp, rb, err := c.request(typ, args)
+	if err != nil {
+		return nil, err
+	}
+	if rtyp != expected {
+		return nil, fmt.Errorf("sftp: unexpected packet type %d in response", rtyp)
+	}
+	return rb, nil
+}
+
+func (c *client) stat(typ byte, p string) (*attrs, error) {
+	var b buffer
+	b.string(p)
+	rb, err := c.expect(typ, b, fxpAttrs)
+	if err != nil {
+		return nil, err
+	}
+	return rb.readAttrs()
+}
+
+func (c *client) fstat(handle string) (*attrs, error) {
+	return c.stat(fxpFstat, handle)
+}
+
+func (c *client) open(typ byte, p string) (string, error) {
+	var b buffer
+	b.string(p)
+	if typ == fxpOpen {
+		b.uint32(fxfRead)
+		b.uint32(0) // no attributes
+	}
+	rb, err := c.expect(typ, b, fxpHandle)
+	if err != nil {
+		return "", err
+	}
+	return rb.readString()
+}
+
+func (c *client) close(handle string) error {
+	var b buffer
+	b.string(handle)
+	_, _, err := c.request(fxpClose, b)
+	return err
+}
+
+// read reads up to len(p) bytes at the offset, returning io.EOF at the end
+// of the file.
+func (c *client) read(handle string, offset int64, p []byte) (int, error) {
+	var b buffer
+	b.string(handle)
+	b.uint64(uint64(offset))
+	b.uint32(uint32(len(p)))
+	rb, err := c.expect(fxpRead, b, fxpData)
+	if err != nil {
+		return 0, err
+	}
+	data, err := rb.readString()
+	if err != nil {
+		return 0, err
+	}
+	if len(data) > len(p) {
+		return 0, errors.New("sftp: server returned more data than requested")
+	}
+	return copy(p, data), nil
+}
+
+// name makes a request answered with a single name, returning it.
+func (c *client) name(typ byte, p string) (string, error) {
+	var b buffer
+	b.string(p)
+	rb, err := c.expect(typ, b, fxpName)
+	if err != nil {
+		return "", err
+	}
+	names, err := rb.readNames()
+	if err != nil {
+		return "", err
+	}
+	if len(names) != 1 {
+		return "", fmt.Errorf("sftp: expected one name in response, got %d", len(names))
+	}
+	return names[0].name, nil
+}
+
+// readDir returns the entries of the directory, except "." and "..".
+func (c *client) readDir(p string) ([]nameEntry, error) {
+	handle, err := c.open(fxpOpendir, p)
+	if err != nil {
+		return nil, err
+	}
+	defer c.close(handle)
+
+	var entries []nameEntry
+	for {
+		var b buffer
+		b.string(handle)
+		rb, err := c.expect(fxpReaddir, b, fxpName)
+		if errors.Is(err, io.EOF) {
+			return entries, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		names, err := rb.readNames()
+		if err != nil {
+			return nil, err
+		}
+		for _, n := range names {
+			if n.name != "." && n.name != ".." {
+				entries = append(entries, n)
+			}
+		}
+	}
+}
+
+// attrs holds the file attributes of the SFTP protocol.
+type attrs struct {
+	flags    uint32
+	size     uint64
+	uid, gid uint32
+	perm     uint32
+	mtime    uint32
+}
+
+// mode converts the POSIX permissions to an os.FileMode.
+func (a *attrs) mode() os.FileMode {
+	const (
+		sIFMT   = 0o170000
+		sIFSOCK = 0o140000
+		sIFLNK  = 0o120000
+		sIFREG  = 0o100000
+		sIFBLK  = 0o060000
+		sIFDIR  = 0o040000
+		sIFCHR  = 0o020000
+		sIFIFO  = 0o010000
+		sISUID  = 0o4000
+		sISGID  = 0o2000
+		sISVTX  = 0o1000
+	)
+
+	mode := os.FileMode(a.perm & 0o777)
+	switch a.perm & sIFMT {
+	case sIFSOCK:
+		mode |= os.ModeSocket
+	case sIFLNK:
+		mode |= os.ModeSymlink
+	case sIFBLK:
+		mode |= os.ModeDevice
+	case sIFDIR:
+		mode |= os.ModeDir
+	case sIFCHR:
+		mode |= os.ModeDevice | os.ModeCharDevice
+	case sIFIFO:
+		mode |= os.ModeNamedPipe
+	case sIFREG:
+	default:
+		mode |= os.ModeIrregular
+	}
+	if a.perm&sISUID != 0 {
+		mode |= os.ModeSetuid
+	}
+	if a.perm&sISGID != 0 {
+		mode |= os.ModeSetgid
+	}
+	if a.perm&sISVTX != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode
+}
+
+func (a *attrs) modTime() time.Time {
+	return time.Unix(int64(a.mtime), 0)
+}
+
+type nameEntry struct {
+	name  string
+	attrs *attrs
+}
+
+// buffer encodes and decodes the data types of the SFTP protocol.
+type buffer []byte
+
+var errShortPacket = errors.New("sftp: packet too short")
+
+func (b *buffer) uint32(v uint32) {
+	*b = binary.BigEndian.AppendUint32(*b, v)
+}
+
+func (b *buffer) uint64(v uint64) {
+	*b = binary.BigEndian.AppendUint64(*b, v)
+}
+
+func (b *buffer) string(s string) {
+	b.uint32(uint32(len(s)))
+	*b = append(*b, s...)
+}
+
+func (b *buffer) readUint32() (uint32, error) {
+	if len(*b) < 4 {
+		return 0, errShortPacket
+	}
+	v := binary.BigEndian.Uint32(*b)
+	*b = (*b)[4:]
+	return v, nil
+}
+
+func (b *buffer) readUint64() (uint64, error) {
+	if len(*b) < 8 {
+		return 0, errShortPacket
+	}
+	v := binary.BigEndian.Uint64(*b)
+	*b = (*b)[8:]
+	return v, nil
+}
+
+func (b *buffer) readString() (string, error) {
+	n, err := b.readUint32()
+	if err != nil {
+		return "", err
+	}
+	if uint32(len(*b)) < n {
+		return "", errShortPacket
+	}
+	s := string((*b)[:n])
+	*b = (*b)[n:]
+	return s, nil
+}
+
+func (b *buffer) readAttrs() (*attrs, error) {
+	var (
+		a   attrs
+		err error
+	)
+	if a.flags, err = b.readUint32(); err != nil {
+		return nil, err
+	}
+	if a.flags&attrSize != 0 {
+		if a.size, err = b.readUint64(); err != nil {
+			return nil, err
+		}
+	}
+	if a.flags&attrUIDGID != 0 {
+		if a.uid, err = b.readUint32(); err != nil {
+			return nil, err
+		}
+		if a.gid, err = b.readUint32(); err != nil {
+			return nil, err
+		}
+	}
+	if a.flags&attrPermissions != 0 {
+		if a.perm, err = b.readUint32(); err != nil {
+			return nil, err
+		}
+	}
+	if a.flags&attrACModTime != 0 {
+		if _, err = b.readUint32(); err != nil { // atime
+			return nil, err
+		}
+		if a.mtime, err = b.readUint32(); err != nil {
+			return nil, err
+		}
+	}
+	if a.flags&attrExtended != 0 {
+		n, err := b.readUint32()
+		if err != nil {
+			return nil, err
+		}
+		for i := uint32(0); i < 2*n; i++ {
+			if _, err := b.readString(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return &a, nil
+}
+
+func (b *buffer) readNames() ([]nameEntry, error) {
+	n, err := b.readUint32()
+	if err != nil {
+		return nil, err
+	}
+
+	var names []nameEntry
+	for i := uint32(0); i < n; i++ {
+		name, err := b.readString()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := b.readString(); err != nil { // long name
+			return nil, err
+		}
+		a, err := b.readAttrs()
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, nameEntry{name: name, attrs: a})
+	}
+	return names, nil
+}
@@ -0,0 +1,50 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package sftp
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/containerd/continuity/pathdriver"
+)
+
+// pathDriver handles the slash separated paths of the remote host.
+type pathDriver struct {
+	pathdriver.SlashPathDriver
+	driver *Driver
+}
+
+// Abs resolves relative paths against the directory the SFTP session
+// starts in, usually the home directory of the remote user.
+func (d *pathDriver) Abs(p string) (string, error) {
+	if path.IsAbs(p) {
+		return path.Clean(p), nil
+	}
+
+	wd, err := d.driver.client.name(fxpRealpath, ".")
+	if err != nil {
+		return "", &os.PathError{Op: "realpath", Path: ".", Err: err}
+	}
+	return path.Join(wd, p), nil
+}
+
+// Walk walks the remote tree in lexical order, like filepath.Walk.
+func (d *pathDriver) Walk(root string, walkFn filepath.WalkFunc) error {
+	return pathdriver.WalkTree(root, d.driver.Lstat, d.driver.readDir, walkFn)
+}
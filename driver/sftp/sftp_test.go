@@ -0,0 +1,315 @@
+//go:build !windows
+// +build !windows
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package sftp
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+
+	"github.com/containerd/continuity"
+	"github.com/containerd/continuity/driver"
+)
+
+// testServer serves the requests of the driver from the local filesystem,
+// speaking just enough of the SFTP protocol.
+type testServer struct {
+	r       io.Reader
+	w       io.Writer
+	handles map[string]*os.File
+	next    int
+}
+
+func startTestServer(t *testing.T) *Driver {
+	cr, sw := io.Pipe()
+	sr, cw := io.Pipe()
+
+	s := &testServer{r: sr, w: sw, handles: map[string]*os.File{}}
+	go func() {
+		err := s.serve()
+		sw.CloseWithError(err)
+	}()
+
+	d, err := NewDriver(cr, cw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.Close() })
+	return d
+}
+
+func (s *testServer) serve() error {
+	for {
+		hdr := make([]byte, 5)
+		if _, err := io.ReadFull(s.r, hdr); err != nil {
+			return err
+		}
+		p := make([]byte, binary.BigEndian.Uint32(hdr)-1)
+		if _, err := io.ReadFull(s.r, p); err != nil {
+			return err
+		}
+
+		b := buffer(p)
+		if hdr[4] == fxpInit {
+			var resp buffer
+			resp.uint32(protocolVersion)
+			if err := s.send(fxpVersion, resp); err != nil {
+				return err
+			}
+			continue
+		}
+
+		id, _ := b.readUint32()
+		typ, resp := s.handle(hdr[4], b)
+		var out buffer
+		out.uint32(id)
+		if err := s.send(typ, append(out, resp...)); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *testServer) send(typ byte, payload buffer) error {
+	hdr := make([]byte, 5)
+	binary.BigEndian.PutUint32(hdr, uint32(len(payload)+1))
+	hdr[4] = typ
+	_, err := s.w.Write(append(hdr, payload...))
+	return err
+}
+
+func (s *testServer) handle(typ byte, b buffer) (byte, buffer) {
+	var resp buffer
+	arg, _ := b.readString()
+
+	switch typ {
+	case fxpStat, fxpLstat, fxpFstat:
+		var (
+			fi  os.FileInfo
+			err error
+		)
+		switch typ {
+		case fxpStat:
+			fi, err = os.Stat(arg)
+		case fxpLstat:
+			fi, err = os.Lstat(arg)
+		default:
+			fi, err = s.handles[arg].Stat()
+		}
+		if err != nil {
+			return status(err)
+		}
+		writeAttrs(&resp, fi)
+		return fxpAttrs, resp
+	case fxpOpen, fxpOpendir:
+		f, err := os.Open(arg)
+		if err != nil {
+			return status(err)
+		}
+		s.next++
+		handle := strconv.Itoa(s.next)
+		s.handles[handle] = f
+		resp.string(handle)
+		return fxpHandle, resp
+	case fxpClose:
+		s.handles[arg].Close()
+		delete(s.handles, arg)
+		return status(nil)
+	case fxpRead:
+		offset, _ := b.readUint64()
+		n, _ := b.readUint32()
+		p := make([]byte, n)
+		n2, err := s.handles[arg].ReadAt(p, int64(offset))
+		if n2 == 0 && err != nil {
+			return status(err)
+		}
+		resp.string(string(p[:n2]))
+		return fxpData, resp
+	case fxpReaddir:
+		fis, err := s.handles[arg].Readdir(2)
+		if err != nil {
+			return status(err)
+		}
+		resp.uint32(uint32(len(fis)))
+		for _, fi := range fis {
+			resp.string(fi.Name())
+			resp.string(fi.Name())
+			writeAttrs(&resp, fi)
+		}
+		return fxpName, resp
+	case fxpReadlink, fxpRealpath:
+		var (
+			name string
+			err  error
+		)
+		if typ == fxpReadlink {
+			name, err = os.Readlink(arg)
+		} else {
+			name, err = filepath.Abs(arg)
+		}
+		if err != nil {
+			return status(err)
+		}
+		resp.uint32(1)
+		resp.string(name)
+		resp.string(name)
+		resp.uint32(0)
+		return fxpName, resp
+	}
+
+	var unsupported buffer
+	unsupported.uint32(fxOpUnsupported)
+	unsupported.string("unsupported")
+	unsupported.string("")
+	return fxpStatus, unsupported
+}
+
+func status(err error) (byte, buffer) {
+	code := uint32(fxOK)
+	msg := "ok"
+	switch {
+	case err == nil:
+	case errors.Is(err, io.EOF):
+		code, msg = fxEOF, "eof"
+	case errors.Is(err, os.ErrNotExist):
+		code, msg = fxNoSuchFile, err.Error()
+	default:
+		code, msg = 4, err.Error()
+	}
+
+	var resp buffer
+	resp.uint32(code)
+	resp.string(msg)
+	resp.string("")
+	return fxpStatus, resp
+}
+
+func writeAttrs(b *buffer, fi os.FileInfo) {
+	st := fi.Sys().(*syscall.Stat_t)
+	b.uint32(attrSize | attrUIDGID | attrPermissions)
+	b.uint64(uint64(fi.Size()))
+	b.uint32(st.Uid)
+	b.uint32(st.Gid)
+	b.uint32(uint32(st.Mode))
+}
+
+func TestDriver(t *testing.T) {
+	root := t.TempDir()
+	if err := os.Mkdir(filepath.Join(root, "dir"), 0o750); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", "dir/b", "dir/c", "dir/d"} {
+		if err := os.WriteFile(filepath.Join(root, name), []byte(name), 0o640); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("dir/b", filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	d := startTestServer(t)
+	remote, err := continuity.NewContextWithOptions(root, continuity.ContextOptions{
+		Driver:     d,
+		PathDriver: d.PathDriver(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := continuity.BuildManifest(remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	local, err := continuity.NewContext(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := continuity.BuildManifest(local)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(m.Resources) != len(expected.Resources) {
+		t.Fatalf("expected %d resources, got %d", len(expected.Resources), len(m.Resources))
+	}
+	for i := range m.Resources {
+		if err := continuity.VerifyManifest(local, &continuity.Manifest{Resources: m.Resources[i : i+1]}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := continuity.VerifyManifest(remote, expected); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(root, "dir", "c"), []byte("changed"), 0o640); err != nil {
+		t.Fatal(err)
+	}
+	if err := continuity.VerifyManifest(remote, expected); err == nil {
+		t.Fatal("expected the changed file to be found")
+	}
+
+	if err := d.Mkdir(filepath.Join(root, "new"), 0o755); !errors.Is(err, driver.ErrNotSupported) {
+		t.Fatalf("expected changes to be unsupported, got %v", err)
+	}
+}
+
+func TestReaddir(t *testing.T) {
+	root := t.TempDir()
+	for _, name := range []string{"a", "b", "c"} {
+		if err := os.WriteFile(filepath.Join(root, name), nil, 0o640); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	d := startTestServer(t)
+	f, err := d.Open(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	names := map[string]bool{}
+	for _, expected := range []int{2, 1} {
+		fis, err := f.Readdir(2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(fis) != expected {
+			t.Fatalf("expected %d entries, got %d", expected, len(fis))
+		}
+		for _, fi := range fis {
+			names[fi.Name()] = true
+		}
+	}
+	if len(names) != 3 {
+		t.Fatalf("expected every entry once, got %v", names)
+	}
+	if fis, err := f.Readdir(2); len(fis) != 0 || err != io.EOF {
+		t.Fatalf("expected io.EOF once exhausted, got %v, %v", fis, err)
+	}
+	if fis, err := f.Readdir(0); len(fis) != 0 || err != nil {
+		t.Fatalf("expected no entries once exhausted, got %v, %v", fis, err)
+	}
+}
@@ -0,0 +1,122 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package driver
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// statxMask lists the fields requested from statx(2): those of stat(2), the
+// birth time and the mount id.
+const statxMask = unix.STATX_BASIC_STATS | unix.STATX_BTIME | unix.STATX_MNT_ID
+
+// Lstatx returns the os.FileInfo and the extended metadata of the file at
+// path from a single call to statx(2). The Sys method of the os.FileInfo
+// returns a *syscall.Stat_t, as with os.Lstat.
+func (d *driver) Lstatx(path string) (os.FileInfo, *Statx, error) {
+	var stx unix.Statx_t
+	if err := unix.Statx(unix.AT_FDCWD, fixLongPath(path), unix.AT_SYMLINK_NOFOLLOW, statxMask, &stx); err != nil {
+		return nil, nil, &os.PathError{Op: "statx", Path: path, Err: err}
+	}
+
+	fi := &statxFileInfo{name: filepath.Base(path), mode: statxMode(uint32(stx.Mode))}
+	setInt(&fi.sys.Dev, unix.Mkdev(stx.Dev_major, stx.Dev_minor))
+	setInt(&fi.sys.Ino, stx.Ino)
+	setInt(&fi.sys.Nlink, uint64(stx.Nlink))
+	setInt(&fi.sys.Mode, uint64(stx.Mode))
+	setInt(&fi.sys.Uid, uint64(stx.Uid))
+	setInt(&fi.sys.Gid, uint64(stx.Gid))
+	setInt(&fi.sys.Rdev, unix.Mkdev(stx.Rdev_major, stx.Rdev_minor))
+	setInt(&fi.sys.Size, stx.Size)
+	setInt(&fi.sys.Blksize, uint64(stx.Blksize))
+	setInt(&fi.sys.Blocks, stx.Blocks)
+	fi.sys.Atim = statxTimespec(stx.Atime)
+	fi.sys.Mtim = statxTimespec(stx.Mtime)
+	fi.sys.Ctim = statxTimespec(stx.Ctime)
+
+	st := &Statx{
+		Attributes:     stx.Attributes,
+		AttributesMask: stx.Attributes_mask,
+	}
+	if stx.Mask&unix.STATX_MNT_ID != 0 {
+		st.MountID = stx.Mnt_id
+	}
+	if stx.Mask&unix.STATX_BTIME != 0 {
+		st.BirthTime = time.Unix(stx.Btime.Sec, int64(stx.Btime.Nsec)).UTC()
+	}
+
+	return fi, st, nil
+}
+
+// setInt assigns v to the field of syscall.Stat_t at dst, whose type varies
+// between architectures.
+func setInt[T ~int32 | ~int64 | ~uint32 | ~uint64](dst *T, v uint64) {
+	*dst = T(v)
+}
+
+func statxTimespec(ts unix.StatxTimestamp) syscall.Timespec {
+	return syscall.NsecToTimespec(ts.Sec*int64(time.Second) + int64(ts.Nsec))
+}
+
+// statxMode returns the os.FileMode equivalent to the mode reported by
+// statx(2), as os.Lstat does.
+func statxMode(m uint32) os.FileMode {
+	mode := os.FileMode(m & 0o777)
+	switch m & unix.S_IFMT {
+	case unix.S_IFBLK:
+		mode |= os.ModeDevice
+	case unix.S_IFCHR:
+		mode |= os.ModeDevice | os.ModeCharDevice
+	case unix.S_IFDIR:
+		mode |= os.ModeDir
+	case unix.S_IFIFO:
+		mode |= os.ModeNamedPipe
+	case unix.S_IFLNK:
+		mode |= os.ModeSymlink
+	case unix.S_IFSOCK:
+		mode |= os.ModeSocket
+	}
+	if m&unix.S_ISUID != 0 {
+		mode |= os.ModeSetuid
+	}
+	if m&unix.S_ISGID != 0 {
+		mode |= os.ModeSetgid
+	}
+	if m&unix.S_ISVTX != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode
+}
+
+// statxFileInfo is the os.FileInfo returned by Lstatx.
+type statxFileInfo struct {
+	name string
+	mode os.FileMode
+	sys  syscall.Stat_t
+}
+
+func (fi *statxFileInfo) Name() string       { return fi.name }
+func (fi *statxFileInfo) Size() int64        { return fi.sys.Size }
+func (fi *statxFileInfo) Mode() os.FileMode  { return fi.mode }
+func (fi *statxFileInfo) ModTime() time.Time { return time.Unix(fi.sys.Mtim.Unix()) }
+func (fi *statxFileInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi *statxFileInfo) Sys() interface{}   { return &fi.sys }
@@ -0,0 +1,60 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package driver
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestLstatx(t *testing.T) {
+	root := t.TempDir()
+	file := filepath.Join(root, "a")
+	if err := os.WriteFile(file, []byte("a"), 0o4755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(file, 0o4755); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(root, "b")
+	if err := os.Symlink("a", link); err != nil {
+		t.Fatal(err)
+	}
+
+	d := &driver{}
+	for _, p := range []string{root, file, link} {
+		fi, _, err := d.Lstatx(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected, err := os.Lstat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if fi.Name() != expected.Name() || fi.Mode() != expected.Mode() || fi.Size() != expected.Size() || !fi.ModTime().Equal(expected.ModTime()) {
+			t.Fatalf("%s: expected %v %v %d %v, got %v %v %d %v", p,
+				expected.Name(), expected.Mode(), expected.Size(), expected.ModTime(),
+				fi.Name(), fi.Mode(), fi.Size(), fi.ModTime())
+		}
+		if st, est := fi.Sys().(*syscall.Stat_t), expected.Sys().(*syscall.Stat_t); *st != *est {
+			t.Fatalf("%s: expected %+v, got %+v", p, est, st)
+		}
+	}
+}
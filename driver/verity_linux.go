@@ -0,0 +1,74 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package driver
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"unsafe"
+
+	"github.com/opencontainers/go-digest"
+	"golang.org/x/sys/unix"
+)
+
+// fsverityDigest mirrors struct fsverity_digest from linux/fsverity.h, with
+// room for the largest digest the kernel can report.
+type fsverityDigest struct {
+	algorithm uint16
+	size      uint16
+	digest    [64]byte
+}
+
+// MeasureVerity returns the fs-verity file digest of the regular file at path.
+// An empty digest is returned if fs-verity is not enabled on the file.
+func (d *driver) MeasureVerity(path string) (digest.Digest, error) {
+	fd, err := unix.Open(path, unix.O_RDONLY|unix.O_NOFOLLOW|unix.O_NONBLOCK|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return "", &os.PathError{Op: "measureverity", Path: path, Err: err}
+	}
+	defer unix.Close(fd)
+
+	fsd := fsverityDigest{size: uint16(len(fsverityDigest{}.digest))}
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), unix.FS_IOC_MEASURE_VERITY, uintptr(unsafe.Pointer(&fsd))); errno != 0 {
+		switch {
+		case errors.Is(errno, unix.ENODATA):
+			return "", nil
+		case errors.Is(errno, unix.ENOTTY) || errors.Is(errno, unix.EOPNOTSUPP):
+			err = fmt.Errorf("%v: %w", errno, ErrNotSupported)
+		default:
+			err = errno
+		}
+		return "", &os.PathError{Op: "measureverity", Path: path, Err: err}
+	}
+
+	var algorithm digest.Algorithm
+	switch fsd.algorithm {
+	case unix.FS_VERITY_HASH_ALG_SHA256:
+		algorithm = digest.SHA256
+	case unix.FS_VERITY_HASH_ALG_SHA512:
+		algorithm = digest.SHA512
+	default:
+		return "", &os.PathError{Op: "measureverity", Path: path, Err: fmt.Errorf("unknown fs-verity hash algorithm %d", fsd.algorithm)}
+	}
+
+	if int(fsd.size) != algorithm.Size() {
+		return "", &os.PathError{Op: "measureverity", Path: path, Err: fmt.Errorf("unexpected fs-verity digest size %d", fsd.size)}
+	}
+
+	return digest.NewDigestFromBytes(algorithm, fsd.digest[:fsd.size]), nil
+}
@@ -0,0 +1,98 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continuity
+
+import (
+	"fmt"
+)
+
+// DuplicatePolicy selects how resources sharing a path are handled when a
+// manifest is read. Manifests built by BuildManifest never have duplicate
+// paths, but manifests merged from several sources or edited by hand may.
+type DuplicatePolicy int
+
+const (
+	// DuplicatesError rejects manifests with duplicate paths.
+	DuplicatesError DuplicatePolicy = iota
+
+	// DuplicatesFirstWins keeps the first resource at each path.
+	DuplicatesFirstWins
+
+	// DuplicatesLastWins keeps the last resource at each path.
+	DuplicatesLastWins
+)
+
+// resolveDuplicates applies the policy to resources sharing a path. Where a
+// hardlinked resource loses one of its paths to another resource, it keeps
+// its other paths.
+func resolveDuplicates(resources []Resource, policy DuplicatePolicy) ([]Resource, error) {
+	var (
+		owners = map[string]int{} // index of the resource owning each path
+		paths  = make([][]string, len(resources))
+		dups   bool
+	)
+	for i, r := range resources {
+		for _, p := range resourcePaths(r) {
+			owner, ok := owners[p]
+			if !ok {
+				owners[p] = i
+				paths[i] = append(paths[i], p)
+				continue
+			}
+
+			dups = true
+			switch policy {
+			case DuplicatesError:
+				return nil, fmt.Errorf("path %q appears more than once", p)
+			case DuplicatesFirstWins:
+			case DuplicatesLastWins:
+				paths[owner] = removePath(paths[owner], p)
+				owners[p] = i
+				paths[i] = append(paths[i], p)
+			default:
+				return nil, fmt.Errorf("unknown duplicate policy %d", policy)
+			}
+		}
+	}
+	if !dups {
+		return resources, nil
+	}
+
+	var resolved []Resource
+	for i, r := range resources {
+		switch {
+		case len(paths[i]) == 0:
+			continue
+		case len(paths[i]) != len(resourcePaths(r)):
+			var err error
+			if r, err = withPaths(r, paths[i]); err != nil {
+				return nil, err
+			}
+		}
+		resolved = append(resolved, r)
+	}
+	return resolved, nil
+}
+
+func removePath(paths []string, p string) []string {
+	for i := range paths {
+		if paths[i] == p {
+			return append(paths[:i:i], paths[i+1:]...)
+		}
+	}
+	return paths
+}
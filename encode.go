@@ -0,0 +1,147 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continuity
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	pb "github.com/containerd/continuity/proto"
+	"google.golang.org/protobuf/encoding/protodelim"
+	"google.golang.org/protobuf/proto"
+)
+
+// Format names an encoding of reports, such as the changes returned by Plan
+// and Repair, for humans or for other programs to consume.
+type Format string
+
+const (
+	// FormatText writes a line of plain text per entry.
+	FormatText Format = "text"
+
+	// FormatJSON writes a JSON object per entry, each on its own line.
+	FormatJSON Format = "json"
+
+	// FormatProto writes a protobuf message per entry, each prefixed by its
+	// size as a varint.
+	FormatProto Format = "proto"
+)
+
+// ChangeEncoder writes changes to a stream.
+type ChangeEncoder interface {
+	Encode(Change) error
+}
+
+// NewChangeEncoder returns a ChangeEncoder writing changes to w in the given
+// format. Text lines are formatted by Change.String, JSON objects have the
+// fields "kind", "path" and "detail", and protobuf messages are Change
+// messages of the manifest service.
+func NewChangeEncoder(w io.Writer, format Format) (ChangeEncoder, error) {
+	switch format {
+	case FormatText:
+		return textChangeEncoder{w: w}, nil
+	case FormatJSON:
+		return jsonChangeEncoder{enc: json.NewEncoder(w)}, nil
+	case FormatProto:
+		return protoChangeEncoder{w: w}, nil
+	}
+	return nil, fmt.Errorf("unknown format %q: %w", format, ErrNotSupported)
+}
+
+type textChangeEncoder struct {
+	w io.Writer
+}
+
+func (e textChangeEncoder) Encode(c Change) error {
+	_, err := fmt.Fprintln(e.w, c)
+	return err
+}
+
+type jsonChangeEncoder struct {
+	enc *json.Encoder
+}
+
+func (e jsonChangeEncoder) Encode(c Change) error {
+	return e.enc.Encode(c)
+}
+
+type protoChangeEncoder struct {
+	w io.Writer
+}
+
+func (e protoChangeEncoder) Encode(c Change) error {
+	_, err := protodelim.MarshalTo(e.w, ChangeToProto(c))
+	return err
+}
+
+// EncodeVerifyReport writes the report r to w in the given format. Text has a
+// line per failure, with its class, path and message, followed by a line per
+// path ignored, JSON is that of
+// VerifyReport.MarshalJSON on a single line, and protobuf is the VerifyReport
+// message, without a size prefix.
+func EncodeVerifyReport(w io.Writer, r *VerifyReport, format Format) error {
+	var (
+		p   []byte
+		err error
+	)
+	switch format {
+	case FormatText:
+		for _, f := range r.Failures {
+			if _, err := fmt.Fprintf(w, "%s %s: %s\n", f.Class, f.Path, f.Message); err != nil {
+				return err
+			}
+		}
+		for _, p := range r.Ignored {
+			if _, err := fmt.Fprintf(w, "ignored %s\n", p); err != nil {
+				return err
+			}
+		}
+		return nil
+	case FormatJSON:
+		if p, err = r.MarshalJSON(); err == nil {
+			p = append(p, '\n')
+		}
+	case FormatProto:
+		p, err = proto.Marshal(VerifyReportToProto(r))
+	default:
+		return fmt.Errorf("unknown format %q: %w", format, ErrNotSupported)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(p)
+	return err
+}
+
+// ChangeToProto converts a change to its protobuf message.
+func ChangeToProto(c Change) *pb.Change {
+	return &pb.Change{
+		Kind:   string(c.Kind),
+		Path:   c.Path,
+		Detail: c.Detail,
+	}
+}
+
+// ChangeFromProto converts a protobuf message to a change.
+func ChangeFromProto(b *pb.Change) Change {
+	return Change{
+		Kind:   ChangeKind(b.Kind),
+		Path:   b.Path,
+		Detail: b.Detail,
+	}
+}
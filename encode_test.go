@@ -0,0 +1,110 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continuity
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+
+	pb "github.com/containerd/continuity/proto"
+	"google.golang.org/protobuf/encoding/protodelim"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestChangeEncoder(t *testing.T) {
+	changes := []Change{
+		{Kind: ChangeCreate, Path: "a"},
+		{Kind: ChangeChmod, Path: "a/b", Detail: "-rw-------"},
+	}
+
+	for format, expected := range map[Format]string{
+		FormatText: "create a\nchmod a/b (-rw-------)\n",
+		FormatJSON: "{\"kind\":\"create\",\"path\":\"a\"}\n{\"kind\":\"chmod\",\"path\":\"a/b\",\"detail\":\"-rw-------\"}\n",
+	} {
+		var buf bytes.Buffer
+		enc, err := NewChangeEncoder(&buf, format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range changes {
+			if err := enc.Encode(c); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if buf.String() != expected {
+			t.Fatalf("unexpected %s encoding %q", format, buf.String())
+		}
+	}
+
+	var buf bytes.Buffer
+	enc, err := NewChangeEncoder(&buf, FormatProto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range changes {
+		if err := enc.Encode(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r := bufio.NewReader(&buf)
+	for _, c := range changes {
+		var b pb.Change
+		if err := protodelim.UnmarshalFrom(r, &b); err != nil {
+			t.Fatal(err)
+		}
+		if decoded := ChangeFromProto(&b); decoded != c {
+			t.Fatalf("expected %v, got %v", c, decoded)
+		}
+	}
+
+	if _, err := NewChangeEncoder(&buf, "yaml"); err == nil {
+		t.Fatal("expected an unknown format to be rejected")
+	}
+}
+
+func TestEncodeVerifyReport(t *testing.T) {
+	report := &VerifyReport{
+		Resources: 2,
+		Failures: []VerifyFailure{{
+			Path:    "a",
+			Class:   FailureMetadata,
+			Fields:  []FieldMismatch{{Name: "uid", Expected: "0", Actual: "1"}},
+			Message: "unexpected uid",
+		}},
+	}
+
+	var buf bytes.Buffer
+	if err := EncodeVerifyReport(&buf, report, FormatText); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "metadata a: unexpected uid\n" {
+		t.Fatalf("unexpected text report %q", buf.String())
+	}
+
+	buf.Reset()
+	if err := EncodeVerifyReport(&buf, report, FormatProto); err != nil {
+		t.Fatal(err)
+	}
+	var b pb.VerifyReport
+	if err := proto.Unmarshal(buf.Bytes(), &b); err != nil {
+		t.Fatal(err)
+	}
+	if !proto.Equal(&b, VerifyReportToProto(report)) || b.Failure[0].Field[0].Actual != "1" {
+		t.Fatalf("unexpected protobuf report %v", &b)
+	}
+}
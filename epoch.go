@@ -0,0 +1,62 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continuity
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// SourceDateEpoch returns the time given by the SOURCE_DATE_EPOCH
+// environment variable, in seconds since the Unix epoch, and whether it is
+// set. Reproducible builds set it to clamp the times recorded in their
+// outputs, as described at https://reproducible-builds.org/specs/source-date-epoch/.
+func SourceDateEpoch() (time.Time, bool, error) {
+	v, ok := os.LookupEnv("SOURCE_DATE_EPOCH")
+	if !ok || v == "" {
+		return time.Time{}, false, nil
+	}
+	secs, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("invalid SOURCE_DATE_EPOCH %q: %w", v, err)
+	}
+	return time.Unix(secs, 0).UTC(), true, nil
+}
+
+// ClampTimes returns a Transformer that clamps the birth times of resources
+// to t, so that no resource is recorded as created after t.
+func ClampTimes(t time.Time) Transformer {
+	return func(r Resource) (Resource, error) {
+		bt, ok := r.(BirthTimer)
+		if !ok || !bt.BirthTime().After(t) {
+			return r, nil
+		}
+		b := ResourceToProto(r)
+		b.BirthTime = t.UnixNano()
+		return ResourceFromProto(b)
+	}
+}
+
+// clampTime returns t, or clamp if t is after it and clamp is not zero.
+func clampTime(t, clamp time.Time) time.Time {
+	if !clamp.IsZero() && t.After(clamp) {
+		return clamp
+	}
+	return t
+}
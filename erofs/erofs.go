@@ -0,0 +1,446 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package erofs writes EROFS images of manifests, with the content of their
+// regular files from a content provider. Images are uncompressed, with 4 KiB
+// blocks, and keep ownership, extended attributes and hardlinks. They are
+// reproducible: the same manifest and content always give the same image.
+package erofs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/containerd/continuity"
+	"github.com/containerd/continuity/internal/imagetree"
+)
+
+// Options controls how images are written.
+type Options struct {
+	// ModTime is recorded as the modification time of all inodes, since
+	// manifests do not record them. It defaults to the Unix epoch.
+	ModTime time.Time
+
+	// UUID is the UUID of the filesystem.
+	UUID [16]byte
+}
+
+const (
+	magic       = 0xe0f5e1e2
+	blockBits   = 12
+	blockSize   = 1 << blockBits
+	superOffset = 1024
+	superSize   = 128
+
+	// Inodes are located by their offset in units of slots.
+	slotSize = 32
+
+	compactSize  = 32
+	extendedSize = 64
+	direntSize   = 12
+
+	xattrHeaderSize = 12
+	xattrEntrySize  = 4
+
+	layoutPlain  = 0
+	layoutInline = 2
+)
+
+// File types of directory entries.
+const (
+	typeFile = iota + 1
+	typeDir
+	typeCharDev
+	typeBlockDev
+	typeFifo
+	typeSocket
+	typeSymlink
+)
+
+// xattrPrefixes are the prefixes of extended attribute names EROFS stores
+// by index. The ACLs are stored by index alone.
+var xattrPrefixes = []struct {
+	prefix string
+	index  uint8
+}{
+	{"user.", 1},
+	{"system.posix_acl_access", 2},
+	{"system.posix_acl_default", 3},
+	{"trusted.", 4},
+	{"security.", 6},
+}
+
+// Write writes the EROFS image of the manifest to w, reading the content of
+// regular files from the provider. Directories missing from the manifest are
+// added as imagetree.Build does.
+func Write(w io.Writer, m *continuity.Manifest, provider continuity.ContentProvider, opts Options) error {
+	root, err := imagetree.Build[inode](m)
+	if err != nil {
+		return err
+	}
+
+	// Inodes are laid out in the order of their first paths, so that the
+	// root comes first.
+	var nodes []*node
+	if err := root.Walk(func(n *node) error {
+		if n.Inode.ino != 0 {
+			return nil
+		}
+		n.Inode.ino = uint32(len(nodes) + 1)
+		nodes = append(nodes, n)
+		return prepare(n)
+	}); err != nil {
+		return err
+	}
+
+	// The metadata follows the superblock, and the data blocks of inodes
+	// not inlined follow the metadata.
+	offset := uint64(superOffset + superSize)
+	for _, n := range nodes {
+		ino := n.Inode
+		size := ino.inodeSize() + uint64(len(ino.xattrs))
+		if ino.layout == layoutInline {
+			// Inline data may not cross a block boundary.
+			if offset%blockSize+size+ino.size > blockSize {
+				offset = align(offset, blockSize)
+			}
+			size += ino.size
+		}
+		ino.nid = offset / slotSize
+		offset = align(offset+size, slotSize)
+	}
+	blocks := align(offset, blockSize) / blockSize
+	for _, n := range nodes {
+		if ino := n.Inode; ino.layout == layoutPlain && ino.size > 0 {
+			ino.blkaddr = blocks
+			blocks += align(ino.size, blockSize) / blockSize
+		}
+	}
+	if blocks > 0xffffffff {
+		return fmt.Errorf("image of %d blocks is too large", blocks)
+	}
+
+	var mtime uint64
+	if !opts.ModTime.IsZero() {
+		mtime = uint64(opts.ModTime.Unix())
+	}
+	meta := make([]byte, align(offset, blockSize))
+	var sb bytes.Buffer
+	binary.Write(&sb, binary.LittleEndian, struct {
+		Magic         uint32
+		Checksum      uint32
+		FeatureCompat uint32
+		BlockBits     uint8
+		ExtSlots      uint8
+		RootNID       uint16
+		Inodes        uint64
+		BuildTime     uint64
+		BuildTimeNsec uint32
+		Blocks        uint32
+		MetaBlock     uint32
+		XattrBlock    uint32
+		UUID          [16]byte
+	}{magic, 0, 0, blockBits, 0, uint16(root.Inode.nid), uint64(len(nodes)), mtime, 0, uint32(blocks), 0, 0, opts.UUID})
+	copy(meta[superOffset:], sb.Bytes())
+
+	for _, n := range nodes {
+		if n.IsDir() {
+			n.Inode.data = dirData(n)
+		}
+		copy(meta[n.Inode.nid*slotSize:], n.Inode.encode(n, mtime))
+	}
+	if _, err := w.Write(meta); err != nil {
+		return err
+	}
+
+	for _, n := range nodes {
+		ino := n.Inode
+		if ino.layout != layoutPlain || ino.size == 0 {
+			continue
+		}
+		if ino.data == nil {
+			if err := imagetree.CopyContent(w, provider, n.Resource.(continuity.RegularFile)); err != nil {
+				return fmt.Errorf("failed to write %s: %w", n.Path, err)
+			}
+		} else if _, err := w.Write(ino.data); err != nil {
+			return err
+		}
+		if pad := align(ino.size, blockSize) - ino.size; pad > 0 {
+			if _, err := w.Write(make([]byte, pad)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// node is a path of the image.
+type node = imagetree.Node[inode]
+
+// inode holds the layout of the inode of a node.
+type inode struct {
+	ino      uint32
+	nid      uint64
+	mode     uint16
+	typ      uint8
+	extended bool
+	layout   int
+	size     uint64
+	blkaddr  uint64
+	rdev     uint32
+
+	// xattrs holds the encoded extended attributes.
+	xattrs []byte
+
+	// data holds the content of directories, once their entries are known,
+	// and of symlinks.
+	data []byte
+
+	// dirBlocks holds the entries of directories in their blocks.
+	dirBlocks [][]dirent
+}
+
+type dirent struct {
+	name string
+	node *node
+}
+
+// prepare works out the type, size and layout of the inode of n.
+func prepare(n *node) error {
+	ino := n.Inode
+	var format uint16
+	switch r := n.Resource.(type) {
+	case continuity.RegularFile:
+		format, ino.typ = 0o100000, typeFile
+		ino.size = uint64(r.Size())
+	case continuity.SymLink:
+		format, ino.typ = 0o120000, typeSymlink
+		ino.data = []byte(r.Target())
+		ino.size = uint64(len(ino.data))
+	case continuity.Device:
+		format, ino.typ = 0o060000, typeBlockDev
+		if n.Mode&os.ModeCharDevice != 0 {
+			format, ino.typ = 0o020000, typeCharDev
+		}
+		major, minor := uint32(r.Major()), uint32(r.Minor())
+		ino.rdev = minor&0xff | major<<8&0xfff00 | (minor&^0xff)<<12
+	case continuity.NamedPipe:
+		format, ino.typ = 0o010000, typeFifo
+	default:
+		if !n.IsDir() {
+			return fmt.Errorf("%s: unsupported resource of mode %v", n.Path, n.Mode)
+		}
+		format, ino.typ = 0o040000, typeDir
+		ino.dirBlocks = dirBlocks(n)
+		last := ino.dirBlocks[len(ino.dirBlocks)-1]
+		ino.size = uint64(len(ino.dirBlocks)-1)*blockSize + dirBlockSize(last)
+	}
+
+	ino.mode = format | uint16(n.Perm())
+
+	if xa, ok := n.Resource.(continuity.XAttrer); ok {
+		xattrs, err := encodeXattrs(xa.XAttrs())
+		if err != nil {
+			return fmt.Errorf("%s: %w", n.Path, err)
+		}
+		ino.xattrs = xattrs
+	}
+
+	ino.extended = n.UID > 0xffff || n.GID > 0xffff || n.Links() > 0xffff || ino.size > 0xffffffff
+	if (ino.data != nil || n.IsDir()) && ino.inodeSize()+uint64(len(ino.xattrs))+ino.size <= blockSize {
+		ino.layout = layoutInline
+	}
+	return nil
+}
+
+func (ino *inode) inodeSize() uint64 {
+	if ino.extended {
+		return extendedSize
+	}
+	return compactSize
+}
+
+// encode returns the inode of n, its extended attributes and any inline
+// data.
+func (ino *inode) encode(n *node, mtime uint64) []byte {
+	var xattrCount uint16
+	if len(ino.xattrs) > 0 {
+		xattrCount = uint16((len(ino.xattrs)-xattrHeaderSize)/xattrEntrySize + 1)
+	}
+	format := uint16(ino.layout) << 1
+
+	u := uint32(ino.blkaddr)
+	if ino.typ == typeCharDev || ino.typ == typeBlockDev {
+		u = ino.rdev
+	}
+
+	var buf bytes.Buffer
+	if ino.extended {
+		binary.Write(&buf, binary.LittleEndian, struct {
+			Format     uint16
+			XattrCount uint16
+			Mode       uint16
+			_          uint16
+			Size       uint64
+			U          uint32
+			Ino        uint32
+			UID, GID   uint32
+			MTime      uint64
+			MTimeNsec  uint32
+			Nlink      uint32
+			_          [16]byte
+		}{Format: format | 1, XattrCount: xattrCount, Mode: ino.mode, Size: ino.size, U: u, Ino: ino.ino, UID: n.UID, GID: n.GID, MTime: mtime, Nlink: n.Links()})
+	} else {
+		binary.Write(&buf, binary.LittleEndian, struct {
+			Format     uint16
+			XattrCount uint16
+			Mode       uint16
+			Nlink      uint16
+			Size       uint32
+			_          uint32
+			U          uint32
+			Ino        uint32
+			UID, GID   uint16
+			_          uint32
+		}{Format: format, XattrCount: xattrCount, Mode: ino.mode, Nlink: uint16(n.Links()), Size: uint32(ino.size), U: u, Ino: ino.ino, UID: uint16(n.UID), GID: uint16(n.GID)})
+	}
+	buf.Write(ino.xattrs)
+	if ino.layout == layoutInline {
+		buf.Write(ino.data)
+	}
+	return buf.Bytes()
+}
+
+// encodeXattrs returns the inline extended attributes, in the order of
+// their names.
+func encodeXattrs(xattrs map[string][]byte) ([]byte, error) {
+	if len(xattrs) == 0 {
+		return nil, nil
+	}
+	names := make([]string, 0, len(xattrs))
+	for name := range xattrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	b := make([]byte, xattrHeaderSize)
+	for _, name := range names {
+		index, suffix, err := xattrIndex(name)
+		if err != nil {
+			return nil, err
+		}
+		value := xattrs[name]
+		if len(suffix) > 0xff || len(value) > 0xffff {
+			return nil, fmt.Errorf("extended attribute %q is too large", name)
+		}
+		b = append(b, uint8(len(suffix)), index)
+		b = binary.LittleEndian.AppendUint16(b, uint16(len(value)))
+		b = append(b, suffix...)
+		b = append(b, value...)
+		b = append(b, make([]byte, int(align(uint64(len(b)), xattrEntrySize))-len(b))...)
+	}
+	if (len(b)-xattrHeaderSize)/xattrEntrySize+1 > 0xffff {
+		return nil, fmt.Errorf("extended attributes are too large")
+	}
+	return b, nil
+}
+
+// xattrIndex returns the index of the prefix of the name of an extended
+// attribute and the rest of the name.
+func xattrIndex(name string) (uint8, string, error) {
+	for _, p := range xattrPrefixes {
+		if !strings.HasPrefix(name, p.prefix) {
+			continue
+		}
+		// The ACLs have no names beyond their prefixes, and everything
+		// else must have one.
+		suffix := name[len(p.prefix):]
+		if strings.HasSuffix(p.prefix, ".") == (suffix != "") {
+			return p.index, suffix, nil
+		}
+	}
+	return 0, "", fmt.Errorf("unsupported extended attribute %q", name)
+}
+
+// dirBlocks returns the entries of the directory n, including "." and "..",
+// packed into blocks in the order of their names.
+func dirBlocks(n *node) [][]dirent {
+	parent := n.Parent
+	if parent == nil {
+		parent = n
+	}
+	entries := []dirent{{".", n}, {"..", parent}}
+	for _, child := range n.Sorted() {
+		entries = append(entries, dirent{child.Name, child})
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].name < entries[j].name })
+
+	var blocks [][]dirent
+	var block []dirent
+	used := uint64(0)
+	for _, e := range entries {
+		size := uint64(direntSize + len(e.name))
+		if used+size > blockSize {
+			blocks = append(blocks, block)
+			block, used = nil, 0
+		}
+		block = append(block, e)
+		used += size
+	}
+	return append(blocks, block)
+}
+
+func dirBlockSize(block []dirent) uint64 {
+	size := uint64(len(block)) * direntSize
+	for _, e := range block {
+		size += uint64(len(e.name))
+	}
+	return size
+}
+
+// dirData returns the content of the directory n, once the inodes of its
+// entries are laid out. Each block holds the entries, then their names; all
+// but the last block are padded.
+func dirData(n *node) []byte {
+	var b []byte
+	for i, block := range n.Inode.dirBlocks {
+		start := len(b)
+		nameOff := len(block) * direntSize
+		for _, e := range block {
+			b = binary.LittleEndian.AppendUint64(b, e.node.Inode.nid)
+			b = binary.LittleEndian.AppendUint16(b, uint16(nameOff))
+			b = append(b, e.node.Inode.typ, 0)
+			nameOff += len(e.name)
+		}
+		for _, e := range block {
+			b = append(b, e.name...)
+		}
+		if i < len(n.Inode.dirBlocks)-1 {
+			b = append(b, make([]byte, blockSize-(len(b)-start))...)
+		}
+	}
+	return b
+}
+
+func align(n, to uint64) uint64 {
+	return (n + to - 1) / to * to
+}
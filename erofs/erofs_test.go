@@ -0,0 +1,284 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package erofs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/containerd/continuity"
+	"github.com/containerd/continuity/testutil"
+	"github.com/opencontainers/go-digest"
+)
+
+func TestWrite(t *testing.T) {
+	small := []byte("hello\n")
+	large := bytes.Repeat([]byte("0123456789"), 1000)
+	provider := testutil.MapProvider{digest.FromBytes(small): small, digest.FromBytes(large): large}
+
+	must := func(r continuity.Resource, err error) continuity.Resource {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+	empty := digest.FromBytes(nil)
+	resources := []continuity.Resource{
+		must(continuity.NewDirectory("/a", continuity.Attributes{Mode: 0o700, UID: 1000, GID: 1000, XAttrs: map[string][]byte{"user.foo": []byte("bar")}})),
+		must(continuity.NewRegularFile([]string{"/a/b", "/c"}, continuity.Attributes{Mode: 0o644, XAttrs: map[string][]byte{"security.capability": {1, 2, 3, 4, 5}}}, int64(len(small)), digest.FromBytes(small))),
+		must(continuity.NewDevice([]string{"/dev"}, continuity.Attributes{Mode: 0o600}, true, 1, 3)),
+		must(continuity.NewRegularFile([]string{"/large"}, continuity.Attributes{Mode: 0o755, UID: 70000}, int64(len(large)), digest.FromBytes(large))),
+		must(continuity.NewSymLink("/link", continuity.Attributes{Mode: 0o777}, "a/b")),
+	}
+	// Enough entries to need several directory blocks.
+	for i := 0; i < 400; i++ {
+		resources = append(resources, must(continuity.NewRegularFile([]string{fmt.Sprintf("/many/file%03d", i)}, continuity.Attributes{Mode: 0o644}, 0, empty)))
+	}
+	m := &continuity.Manifest{Resources: resources}
+
+	modTime := time.Unix(1700000000, 0)
+	var buf bytes.Buffer
+	if err := Write(&buf, m, provider, Options{ModTime: modTime}); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	var again bytes.Buffer
+	if err := Write(&again, m, provider, Options{ModTime: modTime}); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, again.Bytes()) {
+		t.Fatal("images of the same manifest differ")
+	}
+
+	img := readImage(t, data)
+	if len(data)%blockSize != 0 || img.sb.Blocks != uint32(len(data)/blockSize) || img.sb.Inodes != 407 || img.sb.BuildTime != uint64(modTime.Unix()) {
+		t.Fatalf("unexpected superblock of image of %d bytes: %+v", len(data), img.sb)
+	}
+
+	root := img.inode(uint64(img.sb.RootNID))
+	if root.mode != 0o040755 || root.nlink != 4 {
+		t.Fatalf("unexpected root: %+v", root)
+	}
+	entries := img.readDir(root)
+	if got := fmt.Sprint(names(entries)); got != "[. .. a c dev large link many]" {
+		t.Fatalf("unexpected root entries: %s", got)
+	}
+	if entries[0].nid != root.nid || entries[1].nid != root.nid {
+		t.Fatalf("unexpected dot entries: %+v", entries[:2])
+	}
+
+	a := img.inode(entries[2].nid)
+	if a.mode != 0o040700 || a.uid != 1000 || a.gid != 1000 || a.nlink != 2 || string(a.xattrs["user.foo"]) != "bar" || a.extended {
+		t.Fatalf("unexpected directory: %+v", a)
+	}
+	aEntries := img.readDir(a)
+	if aEntries[1].nid != root.nid || aEntries[2].name != "b" || aEntries[2].nid != entries[3].nid {
+		t.Fatalf("unexpected entries of directory: %+v", aEntries)
+	}
+	b := img.inode(entries[3].nid)
+	if b.nlink != 2 || !bytes.Equal(b.xattrs["security.capability"], []byte{1, 2, 3, 4, 5}) || !bytes.Equal(img.content(b), small) {
+		t.Fatalf("unexpected hardlinked file: %+v", b)
+	}
+
+	if dev := img.inode(entries[4].nid); dev.mode != 0o020600 || dev.u != 1<<8|3 || entries[4].typ != typeCharDev {
+		t.Fatalf("unexpected device: %+v", dev)
+	}
+	large2 := img.inode(entries[5].nid)
+	if !large2.extended || large2.uid != 70000 || large2.mtime != uint64(modTime.Unix()) || !bytes.Equal(img.content(large2), large) {
+		t.Fatalf("unexpected large file: %+v", large2)
+	}
+	if link := img.inode(entries[6].nid); link.mode != 0o120777 || link.layout != layoutInline || string(img.content(link)) != "a/b" {
+		t.Fatalf("unexpected symlink: %+v", link)
+	}
+
+	many := img.inode(entries[7].nid)
+	if many.layout != layoutPlain || many.size <= blockSize {
+		t.Fatalf("unexpected large directory: %+v", many)
+	}
+	manyEntries := img.readDir(many)
+	if len(manyEntries) != 402 || manyEntries[2].name != "file000" || manyEntries[401].name != "file399" {
+		t.Fatalf("unexpected entries of large directory: %d", len(manyEntries))
+	}
+
+	// Content not matching its digest fails the image.
+	provider[digest.FromBytes(small)] = []byte("bye\n")
+	if err := Write(io.Discard, m, provider, Options{}); err == nil {
+		t.Fatal("expected an error for content not matching its digest")
+	}
+}
+
+func TestWriteInvalidXattr(t *testing.T) {
+	dir, err := continuity.NewDirectory("/a", continuity.Attributes{Mode: 0o755, XAttrs: map[string][]byte{"unknown.foo": nil}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Write(io.Discard, &continuity.Manifest{Resources: []continuity.Resource{dir}}, testutil.MapProvider{}, Options{}); err == nil {
+		t.Fatal("expected an error for an unsupported extended attribute")
+	}
+}
+
+type superblock struct {
+	Magic         uint32
+	Checksum      uint32
+	FeatureCompat uint32
+	BlockBits     uint8
+	ExtSlots      uint8
+	RootNID       uint16
+	Inodes        uint64
+	BuildTime     uint64
+	BuildTimeNsec uint32
+	Blocks        uint32
+	MetaBlock     uint32
+	XattrBlock    uint32
+}
+
+// image reads back the parts of images the tests check.
+type image struct {
+	t    *testing.T
+	data []byte
+	sb   superblock
+}
+
+type testInode struct {
+	nid      uint64
+	extended bool
+	layout   int
+	mode     uint16
+	nlink    uint32
+	size     uint64
+	u        uint32
+	uid, gid uint32
+	mtime    uint64
+	xattrs   map[string][]byte
+	inline   []byte
+}
+
+type entry struct {
+	name string
+	nid  uint64
+	typ  uint8
+}
+
+func names(entries []entry) []string {
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.name)
+	}
+	return names
+}
+
+func readImage(t *testing.T, data []byte) *image {
+	img := &image{t: t, data: data}
+	if err := binary.Read(bytes.NewReader(data[superOffset:]), binary.LittleEndian, &img.sb); err != nil {
+		t.Fatal(err)
+	}
+	if img.sb.Magic != magic || img.sb.BlockBits != blockBits {
+		t.Fatalf("unexpected superblock: %+v", img.sb)
+	}
+	return img
+}
+
+func (img *image) inode(nid uint64) testInode {
+	le := binary.LittleEndian
+	b := img.data[nid*slotSize:]
+	format := le.Uint16(b)
+	ino := testInode{
+		nid:      nid,
+		extended: format&1 != 0,
+		layout:   int(format >> 1 & 7),
+		mode:     le.Uint16(b[4:]),
+		mtime:    img.sb.BuildTime,
+	}
+	if ino.extended {
+		ino.size, ino.u = le.Uint64(b[8:]), le.Uint32(b[16:])
+		ino.uid, ino.gid = le.Uint32(b[24:]), le.Uint32(b[28:])
+		ino.mtime, ino.nlink = le.Uint64(b[32:]), le.Uint32(b[44:])
+		b = b[extendedSize:]
+	} else {
+		ino.nlink, ino.size, ino.u = uint32(le.Uint16(b[6:])), uint64(le.Uint32(b[8:])), le.Uint32(b[16:])
+		ino.uid, ino.gid = uint32(le.Uint16(b[24:])), uint32(le.Uint16(b[26:]))
+		b = b[compactSize:]
+	}
+
+	if count := le.Uint16(img.data[nid*slotSize+2:]); count > 0 {
+		size := xattrHeaderSize + (int(count)-1)*xattrEntrySize
+		xb := b[xattrHeaderSize:size]
+		ino.xattrs = map[string][]byte{}
+		for len(xb) > 0 {
+			nameLen, index, valueLen := int(xb[0]), xb[1], int(le.Uint16(xb[2:]))
+			var prefix string
+			for _, p := range xattrPrefixes {
+				if p.index == index {
+					prefix = p.prefix
+				}
+			}
+			name := prefix + string(xb[4:4+nameLen])
+			ino.xattrs[name] = xb[4+nameLen : 4+nameLen+valueLen]
+			xb = xb[align(uint64(4+nameLen+valueLen), xattrEntrySize):]
+		}
+		b = b[size:]
+	}
+	if ino.layout == layoutInline {
+		if uint64(nid*slotSize)%blockSize+uint64(len(img.data[nid*slotSize:])-len(b))+ino.size > blockSize {
+			img.t.Fatalf("inline data of inode %d crosses a block", nid)
+		}
+		ino.inline = b[:ino.size]
+	}
+	return ino
+}
+
+func (img *image) content(ino testInode) []byte {
+	if ino.layout == layoutInline {
+		return ino.inline
+	}
+	start := uint64(ino.u) * blockSize
+	return img.data[start : start+ino.size]
+}
+
+func (img *image) readDir(dir testInode) []entry {
+	le := binary.LittleEndian
+	data := img.content(dir)
+	var entries []entry
+	for len(data) > 0 {
+		block := data
+		if len(block) > blockSize {
+			block = block[:blockSize]
+		}
+		count := int(le.Uint16(block[8:])) / direntSize
+		for i := 0; i < count; i++ {
+			d := block[i*direntSize:]
+			start, end := int(le.Uint16(d[8:])), len(block)
+			if i < count-1 {
+				end = int(le.Uint16(d[direntSize+8:]))
+			}
+			name := bytes.TrimRight(block[start:end], "\x00")
+			entries = append(entries, entry{name: string(name), nid: le.Uint64(d), typ: d[10]})
+		}
+		data = data[len(block):]
+	}
+	for i := 1; i < len(entries); i++ {
+		if entries[i-1].name >= entries[i].name {
+			img.t.Fatalf("unsorted entries %q, %q", entries[i-1].name, entries[i].name)
+		}
+	}
+	return entries
+}
@@ -0,0 +1,422 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continuity
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// ParseFilter parses a filter expression into a predicate, such as
+// "type==regular && size>10MB && mode&0111" to match executable files larger
+// than 10MB.
+//
+// Expressions compare fields of resources with values, using ==, !=, <,
+// <=, > and >= for numbers and ==, != and ~, matching patterns as
+// filepath.Match does, for strings. They are combined with &&, || and !,
+// and grouped with parentheses. A field alone matches when it is not zero
+// or empty, and & masks a number, so that "mode&0111" matches resources
+// executable by anyone.
+//
+// The fields are path, name, type (regular, directory, symlink, pipe or
+// device), size, mode (the permission, setuid, setgid and sticky bits), uid,
+// gid, nlink, target and digest.
+// Numbers are decimal, octal with a leading 0 or hexadecimal with a leading
+// 0x, and may have a unit such as KB or MiB. Strings are quoted, or words.
+func ParseFilter(expr string) (Predicate, error) {
+	tokens, err := lexFilter(expr)
+	if err != nil {
+		return nil, err
+	}
+	p := &filterParser{tokens: tokens}
+	pred, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if !p.done() {
+		return nil, fmt.Errorf("unexpected %q in filter", p.tokens[p.pos].text)
+	}
+	return pred, nil
+}
+
+type filterToken struct {
+	text   string
+	quoted bool
+}
+
+// filterOperators lists the operators, longest first.
+var filterOperators = []string{"&&", "||", "==", "!=", "<=", ">=", "!~", "<", ">", "~", "!", "&", "(", ")"}
+
+func lexFilter(expr string) ([]filterToken, error) {
+	var tokens []filterToken
+	for s := expr; ; {
+		s = strings.TrimLeftFunc(s, unicode.IsSpace)
+		if s == "" {
+			return tokens, nil
+		}
+
+		if s[0] == '"' {
+			quoted, err := strconv.QuotedPrefix(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid string in filter: %s", s)
+			}
+			text, err := strconv.Unquote(quoted)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, filterToken{text: text, quoted: true})
+			s = s[len(quoted):]
+			continue
+		}
+
+		var op string
+		for _, o := range filterOperators {
+			if strings.HasPrefix(s, o) {
+				op = o
+				break
+			}
+		}
+		if op != "" {
+			tokens = append(tokens, filterToken{text: op})
+			s = s[len(op):]
+			continue
+		}
+
+		end := strings.IndexFunc(s, func(r rune) bool {
+			return unicode.IsSpace(r) || strings.ContainsRune("\"!=<>~&|()", r)
+		})
+		if end < 0 {
+			end = len(s)
+		} else if end == 0 {
+			// A character of an operator that is not one, such as a lone |.
+			_, size := utf8.DecodeRuneInString(s)
+			return nil, fmt.Errorf("unexpected %q in filter", s[:size])
+		}
+		tokens = append(tokens, filterToken{text: s[:end]})
+		s = s[end:]
+	}
+}
+
+type filterParser struct {
+	tokens []filterToken
+	pos    int
+}
+
+func (p *filterParser) done() bool {
+	return p.pos >= len(p.tokens)
+}
+
+// accept consumes the next token if it is the operator op.
+func (p *filterParser) accept(op string) bool {
+	if p.done() || p.tokens[p.pos].quoted || p.tokens[p.pos].text != op {
+		return false
+	}
+	p.pos++
+	return true
+}
+
+func (p *filterParser) or() (Predicate, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("||") {
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(path string, r Resource) bool { return l(path, r) || right(path, r) }
+	}
+	return left, nil
+}
+
+func (p *filterParser) and() (Predicate, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("&&") {
+		right, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(path string, r Resource) bool { return l(path, r) && right(path, r) }
+	}
+	return left, nil
+}
+
+func (p *filterParser) unary() (Predicate, error) {
+	if p.accept("!") {
+		pred, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return func(path string, r Resource) bool { return !pred(path, r) }, nil
+	}
+	if p.accept("(") {
+		pred, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if !p.accept(")") {
+			return nil, fmt.Errorf("missing ) in filter")
+		}
+		return pred, nil
+	}
+	return p.comparison()
+}
+
+func (p *filterParser) comparison() (Predicate, error) {
+	left, err := p.operand()
+	if err != nil {
+		return nil, err
+	}
+
+	var op string
+	for _, o := range []string{"==", "!=", "<=", ">=", "<", ">", "~", "!~"} {
+		if p.accept(o) {
+			op = o
+			break
+		}
+	}
+	if op == "" {
+		return func(path string, r Resource) bool {
+			v := left(path, r)
+			return v.num != 0 || v.str != ""
+		}, nil
+	}
+
+	right, err := p.operand()
+	if err != nil {
+		return nil, err
+	}
+	return compareFilter(left, op, right)
+}
+
+// filterValue is the value of an operand, either a number or a string.
+type filterValue struct {
+	num   int64
+	str   string
+	isNum bool
+}
+
+// filterOperand evaluates an operand for the resource at a path.
+type filterOperand func(path string, r Resource) filterValue
+
+// operand parses a field, optionally masked with &, or a literal. The type
+// of fields is known when parsing, so that mismatched comparisons fail
+// then. Literals are both strings and numbers, where they parse as one.
+func (p *filterParser) operand() (filterOperand, error) {
+	if p.done() {
+		return nil, fmt.Errorf("unexpected end of filter")
+	}
+	tok := p.tokens[p.pos]
+	if !tok.quoted && strings.ContainsAny(tok.text, "&|=!<>~()") {
+		return nil, fmt.Errorf("unexpected %q in filter", tok.text)
+	}
+	p.pos++
+
+	field, ok := filterFields[tok.text]
+	if tok.quoted || !ok {
+		v := filterValue{str: tok.text}
+		if !tok.quoted {
+			if n, err := parseFilterNumber(tok.text); err == nil {
+				v.num, v.isNum = n, true
+			}
+		}
+		return func(string, Resource) filterValue { return v }, nil
+	}
+
+	if !p.accept("&") {
+		return field, nil
+	}
+	if p.done() {
+		return nil, fmt.Errorf("unexpected end of filter")
+	}
+	mask, err := parseFilterNumber(p.tokens[p.pos].text)
+	if err != nil || p.tokens[p.pos].quoted {
+		return nil, fmt.Errorf("invalid mask %q in filter", p.tokens[p.pos].text)
+	}
+	p.pos++
+	if !field("/", nil).isNum {
+		return nil, fmt.Errorf("cannot mask %s in filter", tok.text)
+	}
+	return func(path string, r Resource) filterValue {
+		v := field(path, r)
+		v.num &= mask
+		return v
+	}, nil
+}
+
+func compareFilter(left filterOperand, op string, right filterOperand) (Predicate, error) {
+	// Fields return their zero value without a resource, telling their type.
+	l, r := left("/", nil), right("/", nil)
+	numeric := l.isNum && r.isNum
+	if (isNumField(l) && !r.isNum) || (isNumField(r) && !l.isNum) {
+		return nil, fmt.Errorf("cannot compare a number with a string in filter")
+	}
+
+	switch op {
+	case "~", "!~":
+		pattern := r.str
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q in filter: %w", pattern, err)
+		}
+		return func(path string, res Resource) bool {
+			ok, _ := filepath.Match(right(path, res).str, left(path, res).str)
+			return ok == (op == "~")
+		}, nil
+	case "==", "!=":
+		return func(path string, res Resource) bool {
+			lv, rv := left(path, res), right(path, res)
+			equal := lv.str == rv.str
+			if numeric {
+				equal = lv.num == rv.num
+			}
+			return equal == (op == "==")
+		}, nil
+	}
+
+	if !numeric {
+		return nil, fmt.Errorf("cannot compare strings with %s in filter", op)
+	}
+	return func(path string, res Resource) bool {
+		lv, rv := left(path, res).num, right(path, res).num
+		switch op {
+		case "<":
+			return lv < rv
+		case "<=":
+			return lv <= rv
+		case ">":
+			return lv > rv
+		default:
+			return lv >= rv
+		}
+	}, nil
+}
+
+// isNumField returns whether the zero value v is that of a numeric field,
+// rather than a literal number, which is also a string.
+func isNumField(v filterValue) bool {
+	return v.isNum && v.str == ""
+}
+
+// filterFields are the fields of resources in filters. With a nil
+// resource, they return their zero value.
+var filterFields = map[string]filterOperand{
+	"path": func(path string, r Resource) filterValue {
+		return filterValue{str: path}
+	},
+	"name": func(path string, r Resource) filterValue {
+		return filterValue{str: filepath.Base(path)}
+	},
+	"type": func(path string, r Resource) filterValue {
+		if r == nil {
+			return filterValue{str: "/"}
+		}
+		return filterValue{str: resourceKind(r)}
+	},
+	"size": func(path string, r Resource) filterValue {
+		v := filterValue{isNum: true}
+		if rf, ok := r.(RegularFile); ok {
+			v.num = rf.Size()
+		}
+		return v
+	},
+	"mode": func(path string, r Resource) filterValue {
+		v := filterValue{isNum: true}
+		if r != nil {
+			v.num = int64(posixMode(r.Mode()) &^ sIFMT)
+		}
+		return v
+	},
+	"uid": func(path string, r Resource) filterValue {
+		v := filterValue{isNum: true}
+		if r != nil {
+			v.num = r.UID()
+		}
+		return v
+	},
+	"gid": func(path string, r Resource) filterValue {
+		v := filterValue{isNum: true}
+		if r != nil {
+			v.num = r.GID()
+		}
+		return v
+	},
+	"nlink": func(path string, r Resource) filterValue {
+		v := filterValue{isNum: true}
+		if r != nil {
+			v.num = int64(len(resourcePaths(r)))
+		}
+		return v
+	},
+	"target": func(path string, r Resource) filterValue {
+		if r == nil {
+			return filterValue{str: "/"}
+		}
+		var v filterValue
+		if sl, ok := r.(SymLink); ok {
+			v.str = sl.Target()
+		}
+		return v
+	},
+	"digest": func(path string, r Resource) filterValue {
+		if r == nil {
+			return filterValue{str: "/"}
+		}
+		var v filterValue
+		if rf, ok := r.(RegularFile); ok && len(rf.Digests()) > 0 {
+			v.str = rf.Digests()[0].String()
+		}
+		return v
+	},
+}
+
+// filterUnits are the units of numbers in filters, longest first.
+var filterUnits = []struct {
+	suffix string
+	scale  int64
+}{
+	{"kib", 1 << 10}, {"mib", 1 << 20}, {"gib", 1 << 30}, {"tib", 1 << 40},
+	{"kb", 1e3}, {"mb", 1e6}, {"gb", 1e9}, {"tb", 1e12},
+	{"k", 1e3}, {"m", 1e6}, {"g", 1e9}, {"t", 1e12}, {"b", 1},
+}
+
+func parseFilterNumber(s string) (int64, error) {
+	scale := int64(1)
+	if !strings.HasPrefix(s, "0x") && !strings.HasPrefix(s, "0X") {
+		lower := strings.ToLower(s)
+		for _, unit := range filterUnits {
+			if strings.HasSuffix(lower, unit.suffix) && len(s) > len(unit.suffix) {
+				s, scale = s[:len(s)-len(unit.suffix)], unit.scale
+				break
+			}
+		}
+	}
+	n, err := strconv.ParseInt(s, 0, 64)
+	if err != nil {
+		return 0, err
+	}
+	return n * scale, nil
+}
@@ -0,0 +1,118 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continuity
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+)
+
+func TestParseFilter(t *testing.T) {
+	must := mustResource(t)
+	resources := []Resource{
+		must(NewDirectory("/bin", Attributes{Mode: os.ModeDir | 0o755})),
+		must(NewRegularFile([]string{"/bin/big", "/bin/big2"}, Attributes{Mode: 0o755}, 20e6, digest.FromString("big"))),
+		must(NewRegularFile([]string{"/bin/small"}, Attributes{Mode: os.ModeSetuid | 0o755}, 10, digest.FromString("small"))),
+		must(NewRegularFile([]string{"/etc.conf"}, Attributes{UID: 1000, Mode: 0o644}, 20e6, digest.FromString("conf"))),
+		must(NewSymLink("/link", Attributes{Mode: os.ModeSymlink | 0o777}, "bin/big")),
+	}
+	idx := NewIndex(&Manifest{Resources: resources})
+
+	for _, tc := range []struct {
+		expr     string
+		expected string
+	}{
+		{"type==regular && size>10MB && mode&0111", "[/bin/big /bin/big2]"},
+		{"type == directory || type == symlink", "[/bin /link]"},
+		{"!(type==regular)", "[/bin /link]"},
+		{"mode&04000", "[/bin/small]"},
+		{"mode==0644", "[/etc.conf]"},
+		{"uid!=0", "[/etc.conf]"},
+		{"size>=0x10 && size<20MiB && uid==0", "[/bin/big /bin/big2]"},
+		{"path~/bin/*", "[/bin/big /bin/big2 /bin/small]"},
+		{"name!~big* && type==regular", "[/bin/small /etc.conf]"},
+		{"nlink>1", "[/bin/big /bin/big2]"},
+		{"target", "[/link]"},
+		{`target=="bin/big"`, "[/link]"},
+		{"digest==" + digest.FromString("small").String(), "[/bin/small]"},
+	} {
+		pred, err := ParseFilter(tc.expr)
+		if err != nil {
+			t.Errorf("%s: %v", tc.expr, err)
+			continue
+		}
+		if actual := fmt.Sprint(idx.Select(pred)); actual != tc.expected {
+			t.Errorf("%s: expected %s, got %s", tc.expr, tc.expected, actual)
+		}
+	}
+
+	for _, expr := range []string{
+		"",
+		"size>",
+		"size>big",
+		"type<regular",
+		"(type==regular",
+		"type==regular)",
+		"path&1",
+		"size&x",
+		"path~[",
+		`path=="unterminated`,
+		"type==regular | size>0",
+		"|",
+	} {
+		if _, err := ParseFilter(expr); err == nil {
+			t.Errorf("%s: expected an error", expr)
+		}
+	}
+}
+
+func TestFilter(t *testing.T) {
+	f, err := NewRegularFile([]string{"/a", "/b/c"}, Attributes{Mode: 0o644}, 1, digest.FromString("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := NewDirectory("/b", Attributes{Mode: os.ModeDir | 0o755})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pred, err := ParseFilter("path~/b*")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := Filter(&Manifest{Resources: []Resource{f, d}}, pred)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Resources) != 1 || m.Resources[0] != d {
+		t.Fatalf("unexpected resources %v", m.Resources)
+	}
+
+	pred, err = ParseFilter("type==regular && name==c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m, err = Filter(&Manifest{Resources: []Resource{f, d}}, pred); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Resources) != 1 || fmt.Sprint(m.Resources[0].(RegularFile).Paths()) != "[/b/c]" {
+		t.Fatalf("expected the hardlink to keep its matching path, got %v", m.Resources)
+	}
+}
@@ -0,0 +1,47 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continuity
+
+import (
+	"os"
+	"syscall"
+)
+
+// btrfsFirstFreeObjectID is the inode number of the root directory of every
+// btrfs subvolume.
+const btrfsFirstFreeObjectID = 256
+
+// isSubvolume reports whether fi, on a filesystem of type fstype, describes
+// the root directory of a btrfs subvolume. The root of a separately mounted
+// btrfs filesystem is one too; resolveMountPoint tells them apart by their
+// mount id or filesystem id.
+func isSubvolume(fi os.FileInfo, fstype string) bool {
+	if fstype != "btrfs" || !fi.IsDir() {
+		return false
+	}
+
+	sys, ok := fi.Sys().(*syscall.Stat_t)
+	return ok && sys.Ino == btrfsFirstFreeObjectID
+}
+
+// sameBtrfs reports whether fsid and other, filesystem ids returned by
+// driver.FilesystemDriver, are those of subvolumes of the same btrfs
+// filesystem. Btrfs derives them from the UUID of the filesystem, masking
+// the id of the subvolume into their second half.
+func sameBtrfs(fsid, other string) bool {
+	return len(fsid) == 16 && len(other) == 16 && fsid[:8] == other[:8]
+}
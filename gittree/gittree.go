@@ -0,0 +1,394 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package gittree converts between git trees and manifests. ToManifest
+// describes the tree of a commit, so that a directory deployed from it can
+// be verified with continuity.VerifyManifest, and TreeID gives the id of the
+// git tree of a manifest, to compare with that of a commit.
+//
+// Git trees only hold the names, types and executable bits of files, the
+// content of files and the targets of symbolic links, along with the
+// commits of submodules. Ownership, other permission bits, extended
+// attributes and empty directories are not described by them, so
+// directories deployed from a tree are best verified without the fields
+// for ownership and extended attributes, and where the umask may differ,
+// without the mode. Only repositories with SHA-1 object ids are supported.
+package gittree
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/containerd/continuity"
+	"github.com/containerd/continuity/internal/imagetree"
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	// BlobAnnotation is the annotation holding the id of the blob of the
+	// content of regular files, or of the target of symbolic links, in
+	// manifests of trees. TreeID uses it for regular files without a
+	// content provider.
+	BlobAnnotation = "git.blob"
+
+	// CommitAnnotation is the annotation holding the commit of submodules,
+	// which are described as directories, in manifests of trees.
+	CommitAnnotation = "git.commit"
+)
+
+// Modes of tree entries.
+const (
+	modeTree       = "40000"
+	modeFile       = "100644"
+	modeExecutable = "100755"
+	modeSymlink    = "120000"
+	modeGitlink    = "160000"
+
+	// modeGroupWritable is found in trees written by old versions of git,
+	// and taken as modeFile.
+	modeGroupWritable = "100664"
+)
+
+// ObjectReader reads the objects of a git repository.
+type ObjectReader interface {
+	// ReadObject returns the type and content of the object of the given
+	// name.
+	ReadObject(name string) (typ string, data []byte, err error)
+}
+
+// Repository reads the objects of a git repository with git cat-file, which
+// must be in the PATH.
+type Repository struct {
+	mu     sync.Mutex
+	cmd    *exec.Cmd
+	in     io.WriteCloser
+	out    *bufio.Reader
+	stderr bytes.Buffer
+	waited bool
+	err    error
+}
+
+var _ ObjectReader = &Repository{}
+
+// OpenRepository opens the git repository at dir, or containing it.
+func OpenRepository(dir string) (*Repository, error) {
+	r := &Repository{cmd: exec.Command("git", "-C", dir, "cat-file", "--batch")}
+	r.cmd.Stderr = &r.stderr
+	in, err := r.cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	out, err := r.cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := r.cmd.Start(); err != nil {
+		return nil, err
+	}
+	r.in, r.out = in, bufio.NewReader(out)
+	return r, nil
+}
+
+// ReadObject reads the object of the given name, which may be any revision
+// git understands, such as "HEAD^{tree}" for the tree of the current commit.
+func (r *Repository) ReadObject(name string) (string, []byte, error) {
+	if strings.ContainsAny(name, "\n") {
+		return "", nil, fmt.Errorf("invalid object name %q", name)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.waited {
+		return "", nil, fmt.Errorf("repository is closed")
+	}
+	if _, err := fmt.Fprintln(r.in, name); err != nil {
+		return "", nil, r.failed(err)
+	}
+	line, err := r.out.ReadString('\n')
+	if err != nil {
+		return "", nil, r.failed(err)
+	}
+
+	// The content follows a line of the id, type and size of the object,
+	// or a line telling why it is not there.
+	fields := strings.Fields(line)
+	if len(fields) != 3 {
+		return "", nil, fmt.Errorf("object %s: %s: %w", name, strings.TrimSpace(line), continuity.ErrNotFound)
+	}
+	size, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid object size %q", fields[2])
+	}
+	data := make([]byte, size+1)
+	if _, err := io.ReadFull(r.out, data); err != nil {
+		return "", nil, r.failed(err)
+	}
+	return fields[1], data[:size], nil
+}
+
+// failed returns the error of git, which stopped while err was returned
+// talking to it, or err if git exited cleanly.
+func (r *Repository) failed(err error) error {
+	if werr := r.wait(); werr != nil {
+		return werr
+	}
+	return err
+}
+
+// wait stops git, returning its error along with what it wrote to its
+// standard error.
+func (r *Repository) wait() error {
+	if !r.waited {
+		r.waited = true
+		r.in.Close()
+		if err := r.cmd.Wait(); err != nil {
+			r.err = fmt.Errorf("git cat-file: %w: %s", err, strings.TrimSpace(r.stderr.String()))
+		}
+	}
+	return r.err
+}
+
+// Close stops git.
+func (r *Repository) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.wait()
+}
+
+// ToManifest returns the manifest of the tree of the given name. Directories
+// have mode 0755, regular files 0644 or 0755 with the executable bit, and
+// everything is owned by root. Submodules are described as directories,
+// holding their commit in CommitAnnotation, without their content.
+func ToManifest(r ObjectReader, tree string) (*continuity.Manifest, error) {
+	var resources []continuity.Resource
+	if err := readTree(r, tree, "/", &resources); err != nil {
+		return nil, err
+	}
+	sort.Stable(continuity.ByPath(resources))
+	return &continuity.Manifest{Resources: resources}, nil
+}
+
+// readTree adds the resources of the tree of the given name at the
+// directory dir.
+func readTree(r ObjectReader, name, dir string, resources *[]continuity.Resource) error {
+	typ, data, err := r.ReadObject(name)
+	if err != nil {
+		return err
+	}
+	if typ != "tree" {
+		return fmt.Errorf("object %s is a %s, not a tree", name, typ)
+	}
+
+	for len(data) > 0 {
+		// Entries are the mode and name, then the binary id of the object.
+		i := bytes.IndexByte(data, 0)
+		if i < 0 || len(data) < i+1+sha1.Size {
+			return fmt.Errorf("tree %s is corrupt", name)
+		}
+		mode, entryName, ok := strings.Cut(string(data[:i]), " ")
+		id := hex.EncodeToString(data[i+1 : i+1+sha1.Size])
+		data = data[i+1+sha1.Size:]
+		if !ok || entryName == "" || entryName == "." || entryName == ".." || strings.ContainsAny(entryName, "/\x00") {
+			return fmt.Errorf("tree %s has an invalid entry %q", name, entryName)
+		}
+
+		p := dir + entryName
+		var resource continuity.Resource
+		switch mode {
+		case modeTree:
+			resource, err = continuity.NewDirectory(p, continuity.Attributes{Mode: 0o755})
+			if err == nil {
+				err = readTree(r, id, p+"/", resources)
+			}
+		case modeGitlink:
+			resource, err = continuity.NewDirectory(p, continuity.Attributes{
+				Mode:        0o755,
+				Annotations: map[string]string{CommitAnnotation: id},
+			})
+		case modeFile, modeExecutable, modeSymlink, modeGroupWritable:
+			resource, err = readBlob(r, id, p, mode)
+		default:
+			err = fmt.Errorf("unknown mode %s", mode)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", p, err)
+		}
+		*resources = append(*resources, resource)
+	}
+	return nil
+}
+
+// readBlob returns the resource of the blob id at the path p.
+func readBlob(r ObjectReader, id, p, mode string) (continuity.Resource, error) {
+	typ, data, err := r.ReadObject(id)
+	if err != nil {
+		return nil, err
+	}
+	if typ != "blob" {
+		return nil, fmt.Errorf("object %s is a %s, not a blob", id, typ)
+	}
+
+	attrs := continuity.Attributes{Mode: 0o644, Annotations: map[string]string{BlobAnnotation: id}}
+	switch mode {
+	case modeSymlink:
+		attrs.Mode = 0o777
+		return continuity.NewSymLink(p, attrs, string(data))
+	case modeExecutable:
+		attrs.Mode = 0o755
+	}
+	return continuity.NewRegularFile([]string{p}, attrs, int64(len(data)), digest.FromBytes(data))
+}
+
+// node is a path of the tree of a manifest.
+type node = imagetree.Node[blob]
+
+// blob holds the blob id of a regular file, once known, shared by its
+// hardlinked paths.
+type blob struct {
+	id string
+}
+
+// TreeID returns the id of the git tree of the manifest, as git would
+// record it on committing the tree. Executable bits are taken from the
+// owner, and empty directories are left out, as git does; directories
+// holding CommitAnnotation are submodules. Blob ids of regular files are
+// computed from their content read from the provider, which is checked
+// against their digests, or else taken from BlobAnnotation when there is no
+// provider. Blob ids of symbolic links are computed from their targets.
+// Manifests holding devices or named pipes have no tree.
+func TreeID(m *continuity.Manifest, provider continuity.ContentProvider) (string, error) {
+	root, err := imagetree.Build[blob](m)
+	if err != nil {
+		return "", err
+	}
+	id, _, err := treeID(root, provider)
+	return id, err
+}
+
+// treeID returns the id of the tree of the directory n, and whether it has
+// any entries.
+func treeID(n *node, provider continuity.ContentProvider) (string, bool, error) {
+	type entry struct {
+		mode, name, id string
+	}
+	var entries []entry
+	for _, child := range n.Sorted() {
+		var (
+			mode string
+			id   string
+			err  error
+		)
+		annotations := map[string]string{}
+		if a, ok := child.Resource.(continuity.Annotator); ok {
+			annotations = a.Annotations()
+		}
+
+		switch r := child.Resource.(type) {
+		case continuity.RegularFile:
+			mode = modeFile
+			if child.Mode&0o100 != 0 {
+				mode = modeExecutable
+			}
+			if id = annotations[BlobAnnotation]; id == "" || provider != nil {
+				id, err = fileBlobID(child, r, provider)
+			}
+		case continuity.SymLink:
+			mode = modeSymlink
+			h := newObjectHash("blob", int64(len(r.Target())))
+			io.WriteString(h, r.Target())
+			id = hex.EncodeToString(h.Sum(nil))
+		default:
+			if !child.IsDir() {
+				return "", false, fmt.Errorf("%s: git trees cannot hold resources of mode %v", child.Path, child.Mode)
+			}
+			if id = annotations[CommitAnnotation]; id != "" {
+				mode = modeGitlink
+				break
+			}
+			var ok bool
+			mode = modeTree
+			if id, ok, err = treeID(child, provider); err == nil && !ok {
+				continue
+			}
+		}
+		if err != nil {
+			return "", false, err
+		}
+		entries = append(entries, entry{mode, child.Name, id})
+	}
+
+	// Git sorts trees as if their names ended with a slash.
+	key := func(e entry) string {
+		if e.mode == modeTree {
+			return e.name + "/"
+		}
+		return e.name
+	}
+	sort.Slice(entries, func(i, j int) bool { return key(entries[i]) < key(entries[j]) })
+
+	var b bytes.Buffer
+	for _, e := range entries {
+		raw, err := hex.DecodeString(e.id)
+		if err != nil || len(raw) != sha1.Size {
+			return "", false, fmt.Errorf("%s: invalid object id %q", n.Path, e.id)
+		}
+		fmt.Fprintf(&b, "%s %s\x00", e.mode, e.name)
+		b.Write(raw)
+	}
+	h := newObjectHash("tree", int64(b.Len()))
+	h.Write(b.Bytes())
+	return hex.EncodeToString(h.Sum(nil)), len(entries) > 0, nil
+}
+
+// fileBlobID returns the blob id of the content of the regular file n.
+func fileBlobID(n *node, rf continuity.RegularFile, provider continuity.ContentProvider) (string, error) {
+	if n.Inode.id != "" {
+		return n.Inode.id, nil
+	}
+	if provider == nil {
+		return "", fmt.Errorf("%s: no blob id and no content provider", n.Path)
+	}
+	r, err := continuity.OpenContent(provider, rf)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", n.Path, err)
+	}
+	defer r.Close()
+
+	h := newObjectHash("blob", rf.Size())
+	if _, err := io.Copy(h, r); err != nil {
+		return "", fmt.Errorf("%s: %w", n.Path, err)
+	}
+	n.Inode.id = hex.EncodeToString(h.Sum(nil))
+	return n.Inode.id, nil
+}
+
+// newObjectHash returns the hash of an object of the given type and size,
+// to be written its content.
+func newObjectHash(typ string, size int64) hash.Hash {
+	h := sha1.New()
+	fmt.Fprintf(h, "%s %d\x00", typ, size)
+	return h
+}
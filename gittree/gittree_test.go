@@ -0,0 +1,168 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package gittree
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/containerd/continuity"
+	"github.com/containerd/continuity/content"
+	"github.com/opencontainers/go-digest"
+)
+
+func TestTree(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	dir := t.TempDir()
+	git := func(args ...string) string {
+		t.Helper()
+		cmd := exec.Command("git", append([]string{"-C", dir, "-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v: %v: %s", args, err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	git("init", "-q")
+	for _, f := range []struct {
+		path string
+		data string
+		mode os.FileMode
+	}{
+		{"README", "hello\n", 0o644},
+		{"bin/run", "#!/bin/sh\n", 0o755},
+		{"bin/lib/a", "a\n", 0o644},
+		{"bin-x", "x\n", 0o644},
+	} {
+		p := filepath.Join(dir, f.path)
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(f.data), f.mode); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chmod(p, f.mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("bin/run", filepath.Join(dir, "run")); err != nil {
+		t.Fatal(err)
+	}
+	git("add", ".")
+	git("commit", "-q", "-m", "test")
+	tree := git("rev-parse", "HEAD^{tree}")
+
+	repo, err := OpenRepository(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Close()
+
+	m, err := ToManifest(repo, "HEAD^{tree}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, r := range m.Resources {
+		paths = append(paths, r.Path())
+	}
+	if got := strings.Join(paths, " "); got != "/README /bin /bin-x /bin/lib /bin/lib/a /bin/run /run" {
+		t.Fatalf("unexpected resources: %s", got)
+	}
+	if run := m.Resources[5].(continuity.RegularFile); run.Mode() != 0o755 || run.Digests()[0] != digest.FromString("#!/bin/sh\n") {
+		t.Fatalf("unexpected executable: %v %v", run.Mode(), run.Digests())
+	}
+	if link := m.Resources[6].(continuity.SymLink); link.Target() != "bin/run" {
+		t.Fatalf("unexpected symlink target %q", link.Target())
+	}
+
+	// The manifest of the tree gives it back, from its blob ids alone.
+	if id, err := TreeID(m, nil); err != nil || id != tree {
+		t.Fatalf("unexpected tree id %s, expected %s: %v", id, tree, err)
+	}
+
+	// The worktree matches the tree.
+	ctx, err := continuity.NewContext(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := continuity.VerifyManifest(ctx, m, continuity.WithoutFields(continuity.FieldOwner, continuity.FieldGroup, continuity.FieldXAttrs)); err != nil {
+		t.Fatal(err)
+	}
+
+	// So does the manifest built from it, with its content, once the
+	// repository and an empty directory git cannot hold are added.
+	if err := os.Mkdir(filepath.Join(dir, "empty"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	store := content.NewDir(t.TempDir())
+	ctx, err = continuity.NewContextWithOptions(dir, continuity.ContextOptions{Sink: store, Exclude: []string{".git/"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	built, err := continuity.BuildManifest(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, err := TreeID(built, store); err != nil || id != tree {
+		t.Fatalf("unexpected tree id %s of the worktree, expected %s: %v", id, tree, err)
+	}
+
+	// Blob ids recorded in the manifest are not trusted over the content.
+	run := m.Resources[5].(continuity.RegularFile)
+	readme, err := continuity.NewRegularFile([]string{"/README"}, continuity.Attributes{
+		Mode:        0o644,
+		Annotations: run.(continuity.Annotator).Annotations(),
+	}, int64(len("hello\n")), digest.FromString("hello\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged := &continuity.Manifest{Resources: append([]continuity.Resource{readme}, m.Resources[1:]...)}
+	if id, err := TreeID(forged, store); err != nil || id != tree {
+		t.Fatalf("unexpected tree id %s with a forged blob id, expected %s: %v", id, tree, err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "README"), []byte("changed\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := continuity.VerifyManifest(ctx, m, continuity.WithoutFields(continuity.FieldOwner, continuity.FieldGroup, continuity.FieldXAttrs)); err == nil || !strings.Contains(err.Error(), "/README") {
+		t.Fatalf("expected /README to have changed, got %v", err)
+	}
+}
+
+func TestRepositoryErrors(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	repo, err := OpenRepository(filepath.Join(t.TempDir(), "missing"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := repo.ReadObject("HEAD"); err == nil || !strings.Contains(err.Error(), "git cat-file") {
+		t.Fatalf("expected the error of git, got %v", err)
+	}
+	if err := repo.Close(); err == nil {
+		t.Fatal("expected git to have failed")
+	}
+}
@@ -6,9 +6,9 @@ require (
 	github.com/Microsoft/go-winio v0.5.2
 	github.com/opencontainers/go-digest v1.0.0
 	github.com/sirupsen/logrus v1.8.1
-	golang.org/x/sync v0.0.0-20210220032951-036812b2e83c
-	golang.org/x/sys v0.0.0-20220405210540-1e041c57c461
-	google.golang.org/protobuf v1.26.0
+	golang.org/x/sync v0.6.0
+	golang.org/x/sys v0.18.0
+	google.golang.org/protobuf v1.33.0
 )
 
 require github.com/stretchr/testify v1.3.0 // indirect
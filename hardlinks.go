@@ -19,6 +19,11 @@ package continuity
 import (
 	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
+
+	pb "github.com/containerd/continuity/proto"
+	"google.golang.org/protobuf/proto"
 )
 
 var errNotAHardLink = fmt.Errorf("invalid hardlink")
@@ -69,3 +74,129 @@ func (hlm *hardlinkManager) Merge() ([]Resource, error) {
 
 	return resources, nil
 }
+
+// CheckHardlinks checks the hardlinks of the manifest record bm that are
+// recorded as links rather than as resources with more than one path. A link
+// is a regular file record with a target, naming the canonical record of the
+// file, which must be a regular file that is not a link itself. All of the
+// problems found are returned, including links to other links, which
+// FromProto collapses, and cycles of links, which it rejects.
+func CheckHardlinks(bm *pb.Manifest) error {
+	g := newLinkGraph(bm.Resource)
+
+	var errs []error
+	for _, b := range g.links {
+		canonical, hops, err := g.resolve(b)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if hops > 1 {
+			errs = append(errs, fmt.Errorf("hardlink %q points at the link %q rather than at %q", b.Path[0], linkTarget(b), canonical.Path[0]))
+		}
+	}
+	return joinErrors(errs...)
+}
+
+// collapseHardlinks returns the records with the paths of each link added to
+// the canonical record it leads to, following chains of links, and the links
+// removed. The other fields of links are ignored, as the canonical record
+// describes the file.
+func collapseHardlinks(records []*pb.Resource) ([]*pb.Resource, error) {
+	g := newLinkGraph(records)
+	if len(g.links) == 0 {
+		return records, nil
+	}
+
+	linked := map[*pb.Resource][]string{}
+	for _, b := range g.links {
+		canonical, _, err := g.resolve(b)
+		if err != nil {
+			return nil, err
+		}
+		linked[canonical] = append(linked[canonical], b.Path...)
+	}
+
+	collapsed := make([]*pb.Resource, 0, len(records)-len(g.links))
+	for _, b := range records {
+		if g.isLink[b] {
+			continue
+		}
+		if paths, ok := linked[b]; ok {
+			b = proto.Clone(b).(*pb.Resource)
+			b.Path = append(b.Path, paths...)
+		}
+		collapsed = append(collapsed, b)
+	}
+	return collapsed, nil
+}
+
+// linkGraph indexes the records of a manifest to follow hardlinks.
+type linkGraph struct {
+	byPath map[string]*pb.Resource
+	links  []*pb.Resource
+	isLink map[*pb.Resource]bool
+}
+
+func newLinkGraph(records []*pb.Resource) *linkGraph {
+	g := &linkGraph{
+		byPath: map[string]*pb.Resource{},
+		isLink: map[*pb.Resource]bool{},
+	}
+	for _, b := range records {
+		for _, p := range b.Path {
+			g.byPath[p] = b
+		}
+		if isLinkRecord(b) {
+			g.links = append(g.links, b)
+			g.isLink[b] = true
+		}
+	}
+	return g
+}
+
+// resolve returns the canonical record the link b leads to, and the number of
+// links followed to reach it.
+func (g *linkGraph) resolve(b *pb.Resource) (*pb.Resource, int, error) {
+	var (
+		link = b
+		seen = map[*pb.Resource]bool{}
+	)
+	for hops := 1; ; hops++ {
+		seen[b] = true
+
+		target := linkTarget(b)
+		next, ok := g.byPath[target]
+		switch {
+		case !ok:
+			return nil, 0, fmt.Errorf("hardlink %q points at %q, which is not in the manifest", link.Path[0], target)
+		case seen[next]:
+			return nil, 0, fmt.Errorf("hardlink %q is part of a cycle of links", link.Path[0])
+		case !g.isLink[next]:
+			if mode, err := recordMode(next); err != nil || !mode.IsRegular() {
+				return nil, 0, fmt.Errorf("hardlink %q points at %q, which is not a regular file", link.Path[0], target)
+			}
+			return next, hops, nil
+		}
+		b = next
+	}
+}
+
+// isLinkRecord returns true if the record b describes a hardlink by target.
+func isLinkRecord(b *pb.Resource) bool {
+	if b.Target == "" || len(b.Path) == 0 {
+		return false
+	}
+	mode, err := recordMode(b)
+	return err == nil && mode.IsRegular()
+}
+
+// linkTarget returns the path of the target of the link b. Relative targets
+// are relative to the directory of the link, as for symlinks.
+func linkTarget(b *pb.Resource) string {
+	target := b.Target
+	if !strings.HasPrefix(target, string(os.PathSeparator)) {
+		target = filepath.Join(filepath.Dir(b.Path[0]), target)
+	}
+	return filepath.Join(string(os.PathSeparator), target)
+}
@@ -23,6 +23,8 @@ import (
 	"fmt"
 	"os"
 	"syscall"
+
+	driverpkg "github.com/containerd/continuity/driver"
 )
 
 // hardlinkKey provides a tuple-key for managing hardlinks. This is system-
@@ -36,6 +38,13 @@ type hardlinkKey struct {
 // resource does not represent a possible hardlink, errNotAHardLink will be
 // returned.
 func newHardlinkKey(fi os.FileInfo) (hardlinkKey, error) {
+	if st, ok := fi.Sys().(*driverpkg.FileStat); ok {
+		if st.Ino == 0 || st.Nlink < 2 {
+			return hardlinkKey{}, errNotAHardLink
+		}
+		return hardlinkKey{inode: st.Ino}, nil
+	}
+
 	sys, ok := fi.Sys().(*syscall.Stat_t)
 	if !ok {
 		return hardlinkKey{}, fmt.Errorf("cannot resolve (*syscall.Stat_t) from os.FileInfo")
@@ -0,0 +1,94 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continuity
+
+import (
+	"fmt"
+	"time"
+)
+
+// BuildHooks are called around the walk of a context by BuildManifest and
+// BuildNDJSON, so that callers can prepare the tree, such as by taking a
+// snapshot or dropping caches, and observe the build, without wrapping it.
+type BuildHooks struct {
+	// Before is called before the walk starts. An error fails the build
+	// before anything is walked.
+	Before func(ctx Context) error
+
+	// After is called once the walk completes or fails, with the statistics
+	// of the walk so far and its error, if any. It is called if Before
+	// returned without error, even when the build fails, so that it can
+	// release what Before acquired. An error fails the build.
+	After func(ctx Context, stats BuildStats, err error) error
+}
+
+// BuildStats describes the walk of a build, as passed to BuildHooks.After.
+type BuildStats struct {
+	// Entries is the number of resources built, counting every path of
+	// hardlinked files.
+	Entries int64
+
+	// Bytes is the total size of the regular files built.
+	Bytes int64
+
+	// Duration is the time taken by the walk.
+	Duration time.Duration
+
+	// Truncated is set if resources were left out at the limits of the
+	// build.
+	Truncated bool
+}
+
+// WithHooks adds hooks to call around the build. The Before hooks are called
+// in the order they were given and the After hooks in reverse order.
+func WithHooks(hooks BuildHooks) BuildOpt {
+	return func(o *buildOpts) error {
+		o.hooks = append(o.hooks, hooks)
+		return nil
+	}
+}
+
+// runBeforeHooks calls the Before hooks in order, returning the number of
+// hooks whose Before returned without error.
+func runBeforeHooks(ctx Context, hooks []BuildHooks) (int, error) {
+	for i, h := range hooks {
+		if h.Before == nil {
+			continue
+		}
+		if err := h.Before(ctx); err != nil {
+			return i, fmt.Errorf("build hook failed before walking: %w", err)
+		}
+	}
+	return len(hooks), nil
+}
+
+// runAfterHooks calls the After hooks in reverse order with the result of
+// the walk, returning its error joined with those of the hooks.
+func runAfterHooks(ctx Context, hooks []BuildHooks, stats BuildStats, err error) error {
+	var errs []error
+	for i := len(hooks) - 1; i >= 0; i-- {
+		if after := hooks[i].After; after != nil {
+			if herr := after(ctx, stats, err); herr != nil {
+				errs = append(errs, fmt.Errorf("build hook failed after walking: %w", herr))
+			}
+		}
+	}
+	if len(errs) == 0 {
+		return err
+	}
+	return joinErrors(append([]error{err}, errs...)...)
+}
@@ -0,0 +1,93 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continuity
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"path"
+)
+
+// imaPCR is the platform configuration register IMA extends by default.
+const imaPCR = 10
+
+// MarshalIMA writes the regular files of the manifest to w as records in the
+// format of the IMA ASCII runtime measurement list, using the "ima-ng"
+// template. One record is written for each path of each file, with the first
+// digest of the file as its file data hash. The manifest paths are joined to
+// root, which should be the location of the manifest's root on the measured
+// system, so that the records can be compared with IMA and EVM audit data.
+//
+// The template hash of each record is computed as the kernel would, so
+// records can also be matched by template hash. Files without digests are
+// skipped.
+func MarshalIMA(w io.Writer, m *Manifest, root string) error {
+	for _, resource := range m.Resources {
+		rf, ok := resource.(RegularFile)
+		if !ok {
+			continue
+		}
+
+		digests := rf.Digests()
+		if len(digests) == 0 {
+			continue
+		}
+
+		dgst := digests[0]
+		if err := dgst.Validate(); err != nil {
+			return fmt.Errorf("invalid digest for resource %q: %w", rf.Path(), err)
+		}
+
+		p, err := hex.DecodeString(dgst.Encoded())
+		if err != nil {
+			return fmt.Errorf("invalid digest for resource %q: %w", rf.Path(), err)
+		}
+
+		for _, fp := range rf.Paths() {
+			name := path.Join(root, fp)
+			if _, err := fmt.Fprintf(w, "%d %x ima-ng %s %s\n", imaPCR, imaTemplateHash(string(dgst.Algorithm()), p, name), dgst, name); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// imaTemplateHash returns the SHA-1 hash of the "ima-ng" template data for a
+// file, which is the "d-ng" and "n-ng" fields, each prefixed with its length.
+func imaTemplateHash(algorithm string, dgst []byte, name string) []byte {
+	var buf bytes.Buffer
+
+	// d-ng: the algorithm name, a colon and a NUL, followed by the digest.
+	binary.Write(&buf, binary.LittleEndian, uint32(len(algorithm)+2+len(dgst)))
+	buf.WriteString(algorithm)
+	buf.WriteString(":\x00")
+	buf.Write(dgst)
+
+	// n-ng: the NUL terminated file name.
+	binary.Write(&buf, binary.LittleEndian, uint32(len(name)+1))
+	buf.WriteString(name)
+	buf.WriteByte(0)
+
+	h := sha1.Sum(buf.Bytes())
+	return h[:]
+}
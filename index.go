@@ -0,0 +1,256 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continuity
+
+import (
+	"sort"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// Index provides lookups of the resources of a manifest by path, in
+// constant time, and ordered queries over ranges of paths. Every path of a
+// hardlinked resource is indexed. Regular files are also indexed by the
+// digests of their content. The manifest must not be modified while it is
+// indexed.
+type Index struct {
+	paths    []string // sorted
+	byPath   map[string]Resource
+	byDigest map[digest.Digest][]string
+}
+
+// NewIndex returns the index of the resources of m.
+func NewIndex(m *Manifest) *Index {
+	idx := &Index{
+		byPath:   make(map[string]Resource, len(m.Resources)),
+		byDigest: map[digest.Digest][]string{},
+	}
+	for _, r := range m.Resources {
+		paths := resourcePaths(r)
+		for _, p := range paths {
+			if _, ok := idx.byPath[p]; !ok {
+				idx.paths = append(idx.paths, p)
+			}
+			idx.byPath[p] = r
+		}
+
+		if rf, ok := r.(RegularFile); ok {
+			for _, dgst := range rf.Digests() {
+				idx.byDigest[dgst] = append(idx.byDigest[dgst], paths...)
+			}
+		}
+	}
+	sort.Strings(idx.paths)
+	for _, paths := range idx.byDigest {
+		sort.Strings(paths)
+	}
+	return idx
+}
+
+// Len returns the number of indexed paths.
+func (idx *Index) Len() int {
+	return len(idx.paths)
+}
+
+// Lookup returns the resource at path p.
+func (idx *Index) Lookup(p string) (Resource, bool) {
+	r, ok := idx.byPath[p]
+	return r, ok
+}
+
+// Range calls fn for each path from start, inclusive, to end, exclusive, in
+// lexical order, with the resource at the path, until fn returns false. An
+// empty end ranges to the last path.
+func (idx *Index) Range(start, end string, fn func(p string, r Resource) bool) {
+	i := sort.SearchStrings(idx.paths, start)
+	for ; i < len(idx.paths); i++ {
+		p := idx.paths[i]
+		if end != "" && p >= end {
+			return
+		}
+		if !fn(p, idx.byPath[p]) {
+			return
+		}
+	}
+}
+
+// Prefix calls fn for each path starting with prefix, in lexical order, with
+// the resource at the path, until fn returns false. Since the paths below a
+// directory share a prefix, this lists the contents of a directory with a
+// prefix ending with a separator.
+func (idx *Index) Prefix(prefix string, fn func(p string, r Resource) bool) {
+	i := sort.SearchStrings(idx.paths, prefix)
+	for ; i < len(idx.paths); i++ {
+		p := idx.paths[i]
+		if len(p) < len(prefix) || p[:len(prefix)] != prefix {
+			return
+		}
+		if !fn(p, idx.byPath[p]) {
+			return
+		}
+	}
+}
+
+// Digests returns the digests of the content of all regular files, in
+// lexical order.
+func (idx *Index) Digests() []digest.Digest {
+	dgsts := make([]digest.Digest, 0, len(idx.byDigest))
+	for dgst := range idx.byDigest {
+		dgsts = append(dgsts, dgst)
+	}
+	sort.Slice(dgsts, func(i, j int) bool { return dgsts[i] < dgsts[j] })
+	return dgsts
+}
+
+// PathsOf returns the paths of the regular files whose content has the
+// digest dgst, in lexical order. Files sharing content, whether hardlinked or
+// not, are all returned.
+func (idx *Index) PathsOf(dgst digest.Digest) []string {
+	paths := idx.byDigest[dgst]
+	return append([]string(nil), paths...)
+}
+
+// Predicate reports whether the resource r at path p matches a query.
+type Predicate func(p string, r Resource) bool
+
+// Select returns the paths whose resources match all of the predicates, in
+// lexical order.
+func (idx *Index) Select(preds ...Predicate) []string {
+	var paths []string
+	for _, p := range idx.paths {
+		if matchAll(preds, p, idx.byPath[p]) {
+			paths = append(paths, p)
+		}
+	}
+	return paths
+}
+
+// Largest returns the paths of the n largest regular files matching all of
+// the predicates, largest first, or of all of them if n is negative.
+// Hardlinked files are listed once, by their first matching path.
+func (idx *Index) Largest(n int, preds ...Predicate) []string {
+	return idx.top(n, preds, func(r Resource) (int64, bool) {
+		rf, ok := r.(RegularFile)
+		if !ok {
+			return 0, false
+		}
+		return rf.Size(), true
+	})
+}
+
+// Newest returns the paths of the n most recently created resources
+// matching all of the predicates, newest first, or of all of them if n is
+// negative. Manifests do not record modification times, so resources are
+// ordered by their birth time, and those without one are not returned.
+// Hardlinked files are listed once, by their first matching path.
+func (idx *Index) Newest(n int, preds ...Predicate) []string {
+	return idx.top(n, preds, func(r Resource) (int64, bool) {
+		bt, ok := r.(BirthTimer)
+		if !ok || bt.BirthTime().IsZero() {
+			return 0, false
+		}
+		return bt.BirthTime().UnixNano(), true
+	})
+}
+
+// top returns the paths of the n resources with the highest keys, among
+// those matching the predicates and having a key.
+func (idx *Index) top(n int, preds []Predicate, key func(Resource) (int64, bool)) []string {
+	type entry struct {
+		path string
+		key  int64
+	}
+	var (
+		entries []entry
+		seen    = map[Resource]bool{}
+	)
+	for _, p := range idx.paths {
+		r := idx.byPath[p]
+		if seen[r] || !matchAll(preds, p, r) {
+			continue
+		}
+		k, ok := key(r)
+		if !ok {
+			continue
+		}
+		seen[r] = true
+		entries = append(entries, entry{path: p, key: k})
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].key > entries[j].key
+	})
+	if n >= 0 && len(entries) > n {
+		entries = entries[:n]
+	}
+	paths := make([]string, len(entries))
+	for i, e := range entries {
+		paths[i] = e.path
+	}
+	return paths
+}
+
+func matchAll(preds []Predicate, p string, r Resource) bool {
+	for _, pred := range preds {
+		if !pred(p, r) {
+			return false
+		}
+	}
+	return true
+}
+
+// MatchPaths returns a predicate matching the paths matching any of the
+// patterns, or below a directory that does. Patterns are those of Prune.
+func MatchPaths(patterns ...string) (Predicate, error) {
+	patterns, err := compilePatterns(patterns)
+	if err != nil {
+		return nil, err
+	}
+	return func(p string, r Resource) bool {
+		return matchPatterns(patterns, p)
+	}, nil
+}
+
+// OfKind returns a predicate matching resources of any of the kinds:
+// regular, directory, symlink, pipe or device.
+func OfKind(kinds ...string) Predicate {
+	return func(p string, r Resource) bool {
+		kind := resourceKind(r)
+		for _, k := range kinds {
+			if k == kind {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// LargerThan returns a predicate matching regular files larger than size
+// bytes.
+func LargerThan(size int64) Predicate {
+	return func(p string, r Resource) bool {
+		rf, ok := r.(RegularFile)
+		return ok && rf.Size() > size
+	}
+}
+
+// OwnedBy returns a predicate matching resources owned by the uid.
+func OwnedBy(uid int64) Predicate {
+	return func(p string, r Resource) bool {
+		return r.UID() == uid
+	}
+}
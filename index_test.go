@@ -0,0 +1,142 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continuity
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+)
+
+func TestIndex(t *testing.T) {
+	var resources []Resource
+	for _, p := range []string{"/a", "/a-b", "/a/c", "/a/d", "/e"} {
+		r, err := NewDirectory(p, Attributes{Mode: 0o755})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resources = append(resources, r)
+	}
+	dgst := digest.FromString("content")
+	f, err := NewRegularFile([]string{"/a/f", "/g"}, Attributes{Mode: 0o644}, 7, dgst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copied, err := NewRegularFile([]string{"/copy"}, Attributes{Mode: 0o644}, 7, dgst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewRegularFile([]string{"/other"}, Attributes{Mode: 0o644}, 5, digest.FromString("other"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resources = append(resources, f, copied, other)
+
+	idx := NewIndex(&Manifest{Resources: resources})
+	if idx.Len() != 9 {
+		t.Fatalf("expected 9 paths, got %d", idx.Len())
+	}
+	if r, ok := idx.Lookup("/g"); !ok || r != f {
+		t.Fatal("expected the hardlink to be found")
+	}
+	if _, ok := idx.Lookup("/missing"); ok {
+		t.Fatal("expected a missing path not to be found")
+	}
+
+	collect := func(query func(func(string, Resource) bool)) string {
+		var paths []string
+		query(func(p string, _ Resource) bool {
+			paths = append(paths, p)
+			return true
+		})
+		return fmt.Sprint(paths)
+	}
+	for _, tc := range []struct {
+		query    func(func(string, Resource) bool)
+		expected string
+	}{
+		{func(fn func(string, Resource) bool) { idx.Range("/a/", "/b", fn) }, "[/a/c /a/d /a/f]"},
+		{func(fn func(string, Resource) bool) { idx.Range("/a/d", "", fn) }, "[/a/d /a/f /copy /e /g /other]"},
+		{func(fn func(string, Resource) bool) { idx.Prefix("/a/", fn) }, "[/a/c /a/d /a/f]"},
+		{func(fn func(string, Resource) bool) { idx.Prefix("/a", fn) }, "[/a /a-b /a/c /a/d /a/f]"},
+	} {
+		if actual := collect(tc.query); actual != tc.expected {
+			t.Fatalf("expected %s, got %s", tc.expected, actual)
+		}
+	}
+
+	if paths := idx.PathsOf(dgst); fmt.Sprint(paths) != "[/a/f /copy /g]" {
+		t.Fatalf("unexpected paths sharing content: %v", paths)
+	}
+	if paths := idx.PathsOf(digest.FromString("missing")); len(paths) != 0 {
+		t.Fatalf("expected no paths, got %v", paths)
+	}
+	if dgsts := idx.Digests(); len(dgsts) != 2 {
+		t.Fatalf("expected 2 digests, got %v", dgsts)
+	}
+
+	var n int
+	idx.Range("", "", func(string, Resource) bool {
+		n++
+		return n < 2
+	})
+	if n != 2 {
+		t.Fatalf("expected the range to stop, got %d calls", n)
+	}
+}
+
+func TestIndexQueries(t *testing.T) {
+	now := time.Now()
+	must := mustResource(t)
+	resources := []Resource{
+		must(NewDirectory("/etc", Attributes{Mode: os.ModeDir | 0o755})),
+		must(NewRegularFile([]string{"/etc/a.conf", "/etc/b.conf"}, Attributes{Mode: 0o644, BirthTime: now}, 10, digest.FromString("a"))),
+		must(NewRegularFile([]string{"/big.log"}, Attributes{UID: 1000, Mode: 0o644, BirthTime: now.Add(-time.Hour)}, 30, digest.FromString("big"))),
+		must(NewRegularFile([]string{"/small.log"}, Attributes{Mode: 0o644}, 5, digest.FromString("small"))),
+		must(NewSymLink("/link", Attributes{Mode: os.ModeSymlink | 0o777}, "big.log")),
+	}
+	idx := NewIndex(&Manifest{Resources: resources})
+
+	logs, err := MatchPaths("*.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := MatchPaths("["); err == nil {
+		t.Fatal("expected an invalid pattern to fail")
+	}
+	for _, tc := range []struct {
+		paths    []string
+		expected string
+	}{
+		{idx.Select(), "[/big.log /etc /etc/a.conf /etc/b.conf /link /small.log]"},
+		{idx.Select(logs), "[/big.log /small.log]"},
+		{idx.Select(OfKind("directory", "symlink")), "[/etc /link]"},
+		{idx.Select(LargerThan(5), OwnedBy(0)), "[/etc/a.conf /etc/b.conf]"},
+		{idx.Largest(-1), "[/big.log /etc/a.conf /small.log]"},
+		{idx.Largest(1, OwnedBy(0)), "[/etc/a.conf]"},
+		{idx.Largest(2, logs), "[/big.log /small.log]"},
+		{idx.Newest(-1), "[/etc/a.conf /big.log]"},
+		{idx.Newest(-1, logs), "[/big.log]"},
+	} {
+		if actual := fmt.Sprint(tc.paths); actual != tc.expected {
+			t.Errorf("expected %s, got %s", tc.expected, actual)
+		}
+	}
+}
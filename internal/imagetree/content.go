@@ -0,0 +1,96 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package imagetree
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/containerd/continuity"
+)
+
+// OpenContent opens the content of the regular file from the provider, as
+// a reader of exactly its size. The read of its last bytes fails if the
+// content turns out longer, or does not match its digest.
+func OpenContent(provider continuity.ContentProvider, rf continuity.RegularFile) (io.ReadCloser, error) {
+	r, err := continuity.OpenContent(provider, rf)
+	if err != nil {
+		return nil, err
+	}
+	return &contentReader{r: r, size: rf.Size(), remaining: rf.Size()}, nil
+}
+
+// CopyContent copies the content of the regular file from the provider to
+// w.
+func CopyContent(w io.Writer, provider continuity.ContentProvider, rf continuity.RegularFile) error {
+	r, err := OpenContent(provider, rf)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	_, err = io.Copy(w, r)
+	return err
+}
+
+type contentReader struct {
+	r         io.ReadCloser
+	size      int64
+	remaining int64
+	err       error
+}
+
+func (cr *contentReader) Read(p []byte) (int, error) {
+	if cr.remaining == 0 {
+		return 0, cr.finish()
+	}
+
+	if int64(len(p)) > cr.remaining {
+		p = p[:cr.remaining]
+	}
+	n, err := cr.r.Read(p)
+	cr.remaining -= int64(n)
+	if cr.remaining == 0 {
+		if err := cr.finish(); err != io.EOF {
+			return n, err
+		}
+		return n, nil
+	}
+	if err == io.EOF {
+		return n, io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// finish reads the content to the end, which checks it against its digest,
+// returning io.EOF if it ends with the size of the file.
+func (cr *contentReader) finish() error {
+	if cr.err == nil {
+		if extra, err := io.Copy(io.Discard, cr.r); err != nil {
+			cr.err = err
+		} else if extra > 0 {
+			cr.err = fmt.Errorf("content is longer than %d bytes", cr.size)
+		} else {
+			cr.err = io.EOF
+		}
+	}
+	return cr.err
+}
+
+func (cr *contentReader) Close() error {
+	return cr.r.Close()
+}
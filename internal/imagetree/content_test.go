@@ -0,0 +1,57 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package imagetree
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/containerd/continuity"
+	"github.com/containerd/continuity/testutil"
+	"github.com/opencontainers/go-digest"
+)
+
+func TestCopyContent(t *testing.T) {
+	content := []byte("content")
+	provider := testutil.MapProvider{digest.FromBytes(content): content}
+
+	for _, tc := range []struct {
+		size  int64
+		valid bool
+	}{
+		{int64(len(content)), true},
+		{int64(len(content)) - 1, false},
+		{int64(len(content)) + 1, false},
+	} {
+		rf, err := continuity.NewRegularFile([]string{"/f"}, continuity.Attributes{Mode: 0o644}, tc.size, digest.FromBytes(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var buf bytes.Buffer
+		err = CopyContent(&buf, provider, rf)
+		if tc.valid {
+			if err != nil || !bytes.Equal(buf.Bytes(), content) {
+				t.Fatalf("unexpected content %q: %v", buf.Bytes(), err)
+			}
+		} else if err == nil {
+			t.Fatalf("expected content of size %d to be rejected", tc.size)
+		} else if int64(buf.Len()) > tc.size {
+			t.Fatalf("expected at most %d bytes, got %d", tc.size, buf.Len())
+		}
+	}
+}
@@ -0,0 +1,210 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package imagetree builds the trees of the paths of manifests, as writers
+// of filesystem images and archives lay them out.
+package imagetree
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/containerd/continuity"
+)
+
+// Node is a path of a tree, holding the inode type I of the writer.
+type Node[I any] struct {
+	Name string
+	Path string
+
+	// Resource is the resource of the path, nil for the root and the
+	// directories the manifest lacks.
+	Resource continuity.Resource
+
+	Mode     os.FileMode
+	UID, GID uint32
+
+	// Parent is the directory of the node, nil for the root.
+	Parent *Node[I]
+
+	// Children holds the nodes of directories by name, and is nil for
+	// everything else.
+	Children map[string]*Node[I]
+
+	// Inode is shared by the paths of hardlinked files.
+	Inode *I
+
+	links uint32
+}
+
+// Build returns the root of the tree of the paths of the manifest. The
+// root, unless the manifest describes it, and the parent directories missing
+// from the manifest are directories with mode 0755 owned by root.
+func Build[I any](m *continuity.Manifest) (*Node[I], error) {
+	root := newDir[I]("", "/", nil)
+	for _, r := range m.Resources {
+		paths := []string{r.Path()}
+		if h, ok := r.(continuity.Hardlinkable); ok {
+			paths = h.Paths()
+		}
+		if r.UID() < 0 || r.UID() > 0xffffffff || r.GID() < 0 || r.GID() > 0xffffffff {
+			return nil, fmt.Errorf("%s has an invalid owner %d:%d", r.Path(), r.UID(), r.GID())
+		}
+
+		inode := new(I)
+		for _, p := range paths {
+			n, err := root.add(p, r, inode)
+			if err != nil {
+				return nil, err
+			}
+			n.Resource, n.Mode = r, r.Mode()
+			n.UID, n.GID = uint32(r.UID()), uint32(r.GID())
+			n.links = uint32(len(paths))
+		}
+	}
+	return root, nil
+}
+
+func newDir[I any](name, path string, parent *Node[I]) *Node[I] {
+	return &Node[I]{
+		Name:     name,
+		Path:     path,
+		Mode:     os.ModeDir | 0o755,
+		Parent:   parent,
+		Children: map[string]*Node[I]{},
+		Inode:    new(I),
+	}
+}
+
+// add returns the node for the path p of the resource r, creating it and
+// its missing parents.
+func (root *Node[I]) add(p string, r continuity.Resource, inode *I) (*Node[I], error) {
+	_, isDir := r.(continuity.Directory)
+	if p == "/" {
+		if !isDir {
+			return nil, fmt.Errorf("root is not a directory")
+		}
+		return root, nil
+	}
+
+	parent := root
+	components := strings.Split(strings.TrimPrefix(p, "/"), "/")
+	for i, name := range components {
+		switch {
+		case name == "" || name == "." || name == "..":
+			return nil, fmt.Errorf("invalid path %q", p)
+		case len(name) > 255:
+			return nil, fmt.Errorf("name of %q is longer than 255 bytes", p)
+		}
+
+		n, ok := parent.Children[name]
+		if i < len(components)-1 {
+			if !ok {
+				n = newDir(name, parent.join(name), parent)
+				parent.Children[name] = n
+			} else if !n.IsDir() {
+				return nil, fmt.Errorf("parent of %q is not a directory", p)
+			}
+			parent = n
+			continue
+		}
+
+		switch {
+		case ok && (n.Resource != nil || !isDir):
+			return nil, fmt.Errorf("path %q appears more than once", p)
+		case ok:
+			return n, nil
+		case isDir:
+			n = newDir(name, p, parent)
+		default:
+			n = &Node[I]{Name: name, Path: p, Parent: parent, Inode: inode}
+		}
+		parent.Children[name] = n
+		return n, nil
+	}
+	return nil, fmt.Errorf("invalid path %q", p)
+}
+
+func (n *Node[I]) join(name string) string {
+	if n.Path == "/" {
+		return "/" + name
+	}
+	return n.Path + "/" + name
+}
+
+// IsDir reports whether the node is a directory.
+func (n *Node[I]) IsDir() bool {
+	return n.Children != nil
+}
+
+// Links returns the number of links to the inode of the node: its paths,
+// or for directories, their own entry, "." and the ".." of each of their
+// subdirectories.
+func (n *Node[I]) Links() uint32 {
+	if !n.IsDir() {
+		return n.links
+	}
+	links := uint32(2)
+	for _, child := range n.Children {
+		if child.IsDir() {
+			links++
+		}
+	}
+	return links
+}
+
+// Perm returns the permission bits of the node, with the setuid, setgid
+// and sticky bits where Unix keeps them.
+func (n *Node[I]) Perm() uint32 {
+	perm := uint32(n.Mode.Perm())
+	if n.Mode&os.ModeSetuid != 0 {
+		perm |= 0o4000
+	}
+	if n.Mode&os.ModeSetgid != 0 {
+		perm |= 0o2000
+	}
+	if n.Mode&os.ModeSticky != 0 {
+		perm |= 0o1000
+	}
+	return perm
+}
+
+// Sorted returns the children of the directory in the order of the bytes
+// of their names.
+func (n *Node[I]) Sorted() []*Node[I] {
+	children := make([]*Node[I], 0, len(n.Children))
+	for _, child := range n.Children {
+		children = append(children, child)
+	}
+	sort.Slice(children, func(i, j int) bool { return children[i].Name < children[j].Name })
+	return children
+}
+
+// Walk calls fn for the node and every node below it, depth first in the
+// order of their names, stopping at the first error.
+func (n *Node[I]) Walk(fn func(*Node[I]) error) error {
+	if err := fn(n); err != nil {
+		return err
+	}
+	for _, child := range n.Sorted() {
+		if err := child.Walk(fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package ioctl builds the request numbers of Linux ioctls, as the _IOR,
+// _IOW and _IOWR macros of asm/ioctl.h do.
+package ioctl
+
+import "golang.org/x/sys/unix"
+
+// The direction bits of ioctl request numbers vary between architectures, so
+// they are taken from FS_IOC_GETFLAGS and FS_IOC_SETFLAGS, which are defined
+// for all of them.
+const (
+	dirMask = 0xe0000000
+	read    = unix.FS_IOC_GETFLAGS & dirMask
+	write   = unix.FS_IOC_SETFLAGS & dirMask
+)
+
+// IOR returns the number of the ioctl nr of type typ that reads size bytes.
+func IOR(typ, nr, size uintptr) uintptr {
+	return read | number(typ, nr, size)
+}
+
+// IOW returns the number of the ioctl nr of type typ that writes size bytes.
+func IOW(typ, nr, size uintptr) uintptr {
+	return write | number(typ, nr, size)
+}
+
+// IOWR returns the number of the ioctl nr of type typ that both reads and
+// writes size bytes.
+func IOWR(typ, nr, size uintptr) uintptr {
+	return read | write | number(typ, nr, size)
+}
+
+func number(typ, nr, size uintptr) uintptr {
+	return size<<16 | typ<<8 | nr
+}
@@ -0,0 +1,42 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ioctl
+
+import (
+	"testing"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestNumbers(t *testing.T) {
+	long := unsafe.Sizeof(uintptr(0))
+	for _, tc := range []struct {
+		name     string
+		actual   uintptr
+		expected uintptr
+	}{
+		{"FS_IOC_GETFLAGS", IOR('f', 1, long), unix.FS_IOC_GETFLAGS},
+		{"FS_IOC_SETFLAGS", IOW('f', 2, long), unix.FS_IOC_SETFLAGS},
+		{"FS_IOC_ENABLE_VERITY", IOW('f', 133, 128), unix.FS_IOC_ENABLE_VERITY},
+		{"FS_IOC_MEASURE_VERITY", IOWR('f', 134, 4), unix.FS_IOC_MEASURE_VERITY},
+	} {
+		if tc.actual != tc.expected {
+			t.Errorf("%s: expected %#x, got %#x", tc.name, tc.expected, tc.actual)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continuity
+
+import (
+	"fmt"
+
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	// InTotoStatementType is the type of in-toto statements.
+	InTotoStatementType = "https://in-toto.io/Statement/v1"
+
+	// InTotoPredicateType identifies the predicate of statements returned by
+	// NewInTotoStatement.
+	InTotoPredicateType = "https://github.com/containerd/continuity/manifest/v1"
+)
+
+// InTotoStatement is an in-toto attestation statement, suitable for encoding
+// as JSON and signing in a DSSE envelope.
+type InTotoStatement struct {
+	Type          string          `json:"_type"`
+	Subject       []InTotoSubject `json:"subject"`
+	PredicateType string          `json:"predicateType"`
+	Predicate     InTotoPredicate `json:"predicate"`
+}
+
+// InTotoSubject is a named artifact with a set of digests, keyed by
+// algorithm and hex encoded.
+type InTotoSubject struct {
+	Name   string            `json:"name"`
+	Digest map[string]string `json:"digest"`
+}
+
+// InTotoPredicate describes the manifest a statement was made from.
+type InTotoPredicate struct {
+	// Resources is the number of resources in the manifest.
+	Resources int `json:"resources"`
+}
+
+// NewInTotoStatement returns an in-toto statement whose subjects are the
+// manifest, under the given name, followed by every path of every regular
+// file in the manifest with the digests of its content. Files without digests
+// are left out. The manifest is
+// digested in its protobuf encoding, as returned by Marshal, so the statement
+// can be checked against a stored manifest as well as against the files.
+func NewInTotoStatement(m *Manifest, name string) (*InTotoStatement, error) {
+	p, err := Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+
+	dgst := digest.FromBytes(p)
+	statement := &InTotoStatement{
+		Type: InTotoStatementType,
+		Subject: []InTotoSubject{
+			{Name: name, Digest: map[string]string{string(dgst.Algorithm()): dgst.Encoded()}},
+		},
+		PredicateType: InTotoPredicateType,
+		Predicate:     InTotoPredicate{Resources: len(m.Resources)},
+	}
+
+	for _, resource := range m.Resources {
+		rf, ok := resource.(RegularFile)
+		if !ok {
+			continue
+		}
+
+		digests := make(map[string]string)
+		for _, dgst := range rf.Digests() {
+			if err := dgst.Validate(); err != nil {
+				return nil, fmt.Errorf("invalid digest for resource %q: %w", rf.Path(), err)
+			}
+			digests[string(dgst.Algorithm())] = dgst.Encoded()
+		}
+		if len(digests) == 0 {
+			continue
+		}
+
+		for _, p := range rf.Paths() {
+			statement.Subject = append(statement.Subject, InTotoSubject{Name: p, Digest: digests})
+		}
+	}
+
+	return statement, nil
+}
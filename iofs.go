@@ -0,0 +1,319 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continuity
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	driverpkg "github.com/containerd/continuity/driver"
+	"github.com/containerd/continuity/pathdriver"
+)
+
+// ReadLinkFS is implemented by file systems that hold symbolic links. Without
+// it, files are described as returned by fs.Stat.
+type ReadLinkFS interface {
+	fs.FS
+
+	// ReadLink returns the target of the symbolic link at name.
+	ReadLink(name string) (string, error)
+
+	// Lstat describes the file at name, without following symbolic links.
+	Lstat(name string) (fs.FileInfo, error)
+}
+
+// XAttrFS is implemented by file systems that hold extended attributes.
+type XAttrFS interface {
+	fs.FS
+
+	// Xattrs returns the extended attributes of the file at name, without
+	// following symbolic links.
+	Xattrs(name string) (map[string][]byte, error)
+}
+
+// NewContextFS returns a read-only context for building and verifying
+// manifests of fsys, such as an embedded file system, a zip archive or a
+// test fake. Paths of the context are those of fsys, anchored at its root.
+//
+// The ownership of files is taken from the Sys method of their fs.FileInfo,
+// which may return a *driver.FileStat. Files of other file systems are
+// owned by uid and gid 0. Symbolic links and extended attributes are
+// captured from file systems implementing ReadLinkFS and XAttrFS. Hardlinks
+// and devices are never captured.
+func NewContextFS(fsys fs.FS, options ContextOptions) (Context, error) {
+	d := &fsDriver{fsys: fsys}
+	if _, ok := fsys.(XAttrFS); ok {
+		options.Driver = &xattrFSDriver{d}
+	} else {
+		options.Driver = d
+	}
+	options.PathDriver = &fsPathDriver{driver: d}
+
+	return NewContextWithOptions("/", options)
+}
+
+// fsDriver is a read-only driver for an fs.FS. It takes slash separated
+// absolute paths, rooted at the root of the file system.
+type fsDriver struct {
+	fsys fs.FS
+}
+
+// name returns the name in the file system of the path.
+func (d *fsDriver) name(op, p string) (string, error) {
+	name := strings.TrimPrefix(path.Clean(p), "/")
+	if name == "" {
+		name = "."
+	}
+	if !fs.ValidPath(name) {
+		return "", &os.PathError{Op: op, Path: p, Err: fs.ErrInvalid}
+	}
+	return name, nil
+}
+
+func (d *fsDriver) Open(p string) (driverpkg.File, error) {
+	name, err := d.name("open", p)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := d.fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &fsFile{File: f, driver: d, path: p}, nil
+}
+
+func (d *fsDriver) OpenFile(p string, flag int, perm os.FileMode) (driverpkg.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_TRUNC) != 0 {
+		return nil, &os.PathError{Op: "open", Path: p, Err: ErrNotSupported}
+	}
+	return d.Open(p)
+}
+
+func (d *fsDriver) Stat(p string) (os.FileInfo, error) {
+	name, err := d.name("stat", p)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := fs.Stat(d.fsys, name)
+	if err != nil {
+		return nil, err
+	}
+	return newFSFileInfo(fi), nil
+}
+
+func (d *fsDriver) Lstat(p string) (os.FileInfo, error) {
+	rfs, ok := d.fsys.(ReadLinkFS)
+	if !ok {
+		return d.Stat(p)
+	}
+
+	name, err := d.name("lstat", p)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := rfs.Lstat(name)
+	if err != nil {
+		return nil, err
+	}
+	return newFSFileInfo(fi), nil
+}
+
+func (d *fsDriver) Readlink(p string) (string, error) {
+	name, err := d.name("readlink", p)
+	if err != nil {
+		return "", err
+	}
+
+	rfs, ok := d.fsys.(ReadLinkFS)
+	if !ok {
+		return "", &os.PathError{Op: "readlink", Path: p, Err: ErrNotSupported}
+	}
+	return rfs.ReadLink(name)
+}
+
+// readDir returns the entries of the directory, sorted by name.
+func (d *fsDriver) readDir(p string) ([]os.FileInfo, error) {
+	name, err := d.name("readdir", p)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := fs.ReadDir(d.fsys, name)
+	if err != nil {
+		return nil, err
+	}
+
+	fis := make([]os.FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		fi, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		fis = append(fis, newFSFileInfo(fi))
+	}
+	return fis, nil
+}
+
+func (d *fsDriver) Mkdir(p string, mode os.FileMode) error {
+	return &os.PathError{Op: "mkdir", Path: p, Err: ErrNotSupported}
+}
+
+func (d *fsDriver) Remove(p string) error {
+	return &os.PathError{Op: "remove", Path: p, Err: ErrNotSupported}
+}
+
+func (d *fsDriver) Link(oldname, newname string) error {
+	return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: ErrNotSupported}
+}
+
+func (d *fsDriver) Lchmod(p string, mode os.FileMode) error {
+	return &os.PathError{Op: "lchmod", Path: p, Err: ErrNotSupported}
+}
+
+func (d *fsDriver) Lchown(p string, uid, gid int64) error {
+	return &os.PathError{Op: "lchown", Path: p, Err: ErrNotSupported}
+}
+
+func (d *fsDriver) Symlink(oldname, newname string) error {
+	return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: ErrNotSupported}
+}
+
+func (d *fsDriver) MkdirAll(p string, perm os.FileMode) error {
+	return &os.PathError{Op: "mkdir", Path: p, Err: ErrNotSupported}
+}
+
+func (d *fsDriver) RemoveAll(p string) error {
+	return &os.PathError{Op: "remove", Path: p, Err: ErrNotSupported}
+}
+
+func (d *fsDriver) Mknod(p string, mode os.FileMode, major, minor int) error {
+	return &os.PathError{Op: "mknod", Path: p, Err: ErrNotSupported}
+}
+
+func (d *fsDriver) Mkfifo(p string, mode os.FileMode) error {
+	return &os.PathError{Op: "mkfifo", Path: p, Err: ErrNotSupported}
+}
+
+// xattrFSDriver is an fsDriver for file systems implementing XAttrFS.
+type xattrFSDriver struct {
+	*fsDriver
+}
+
+func (d *xattrFSDriver) Getxattr(p string) (map[string][]byte, error) {
+	return d.LGetxattr(p)
+}
+
+func (d *xattrFSDriver) Setxattr(p string, attr map[string][]byte) error {
+	return &os.PathError{Op: "setxattr", Path: p, Err: ErrNotSupported}
+}
+
+func (d *xattrFSDriver) LGetxattr(p string) (map[string][]byte, error) {
+	name, err := d.name("getxattr", p)
+	if err != nil {
+		return nil, err
+	}
+	return d.fsys.(XAttrFS).Xattrs(name)
+}
+
+func (d *xattrFSDriver) LSetxattr(p string, attr map[string][]byte) error {
+	return &os.PathError{Op: "lsetxattr", Path: p, Err: ErrNotSupported}
+}
+
+// fsFile adapts an fs.File to a driver file.
+type fsFile struct {
+	fs.File
+	driver *fsDriver
+	path   string
+
+	// dirents holds the entries of a directory not returned by Readdir
+	// yet, once listed.
+	dirents []os.FileInfo
+	listed  bool
+}
+
+func (f *fsFile) Write(p []byte) (int, error) {
+	return 0, &os.PathError{Op: "write", Path: f.path, Err: ErrNotSupported}
+}
+
+func (f *fsFile) Seek(offset int64, whence int) (int64, error) {
+	seeker, ok := f.File.(io.Seeker)
+	if !ok {
+		return 0, &os.PathError{Op: "seek", Path: f.path, Err: ErrNotSupported}
+	}
+	return seeker.Seek(offset, whence)
+}
+
+// Readdir returns the entries of the directory like os.File.Readdir,
+// continuing from the entries returned by previous calls.
+func (f *fsFile) Readdir(n int) ([]os.FileInfo, error) {
+	if !f.listed {
+		fis, err := f.driver.readDir(f.path)
+		if err != nil {
+			return nil, err
+		}
+		f.dirents, f.listed = fis, true
+	}
+
+	fis := f.dirents
+	if n > 0 {
+		if len(fis) == 0 {
+			return nil, io.EOF
+		}
+		if len(fis) > n {
+			fis = fis[:n]
+		}
+	}
+	f.dirents = f.dirents[len(fis):]
+	return fis, nil
+}
+
+// fsFileInfo describes a file of an fs.FS, with its ownership held in a
+// *driver.FileStat.
+type fsFileInfo struct {
+	fs.FileInfo
+	stat *driverpkg.FileStat
+}
+
+func newFSFileInfo(fi fs.FileInfo) os.FileInfo {
+	st := fileStat(fi)
+	if st == nil {
+		st = &driverpkg.FileStat{}
+	}
+	return &fsFileInfo{FileInfo: fi, stat: st}
+}
+
+func (fi *fsFileInfo) Sys() interface{} {
+	return fi.stat
+}
+
+// fsPathDriver handles the slash separated paths of an fsDriver.
+type fsPathDriver struct {
+	pathdriver.SlashPathDriver
+	driver *fsDriver
+}
+
+// Walk walks the file system in lexical order, like filepath.Walk.
+func (d *fsPathDriver) Walk(root string, walkFn filepath.WalkFunc) error {
+	return pathdriver.WalkTree(root, d.driver.Lstat, d.driver.readDir, walkFn)
+}
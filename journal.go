@@ -0,0 +1,205 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continuity
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	pb "github.com/containerd/continuity/proto"
+	"google.golang.org/protobuf/proto"
+)
+
+// journalFlushInterval is how often the journal is checkpointed to disk.
+const journalFlushInterval = 5 * time.Second
+
+// journalEntry records a regular file resource that has been built, along
+// with the file information it was built from.
+type journalEntry struct {
+	Path    string `json:"path"`
+	Size    int64  `json:"size"`
+	Mode    uint32 `json:"mode"`
+	ModTime int64  `json:"mtime"`
+	Ctime   int64  `json:"ctime"`
+	Inode   uint64 `json:"ino"`
+
+	// Resource is the protobuf encoding of the resource.
+	Resource []byte `json:"resource"`
+}
+
+// journalHeader is the first line of a journal, recording the
+// configuration of the build that wrote it.
+type journalHeader struct {
+	Config string `json:"config"`
+}
+
+// journal lets an interrupted build resume without digesting again the
+// files it has already done. Entries are appended as JSON lines and are only
+// reused if the file still has the same size, mode, modification time,
+// status change time and inode number, and only by a build with the same
+// configuration.
+type journal struct {
+	path    string
+	f       *os.File
+	w       *bufio.Writer
+	enc     *json.Encoder
+	entries map[string]journalEntry
+	flushed time.Time
+}
+
+// openJournal opens the journal at path, loading the entries of a previous
+// build with the configuration config, as returned by journalConfig, or
+// creates it. The entries of builds with another configuration are
+// discarded.
+func openJournal(path string, config string) (*journal, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := map[string]journalEntry{}
+	dec := json.NewDecoder(f)
+	var (
+		header journalHeader
+		offset int64
+	)
+	if err := dec.Decode(&header); err == nil && header.Config == config {
+		offset = dec.InputOffset()
+	}
+	for offset > 0 {
+		var entry journalEntry
+		if err := dec.Decode(&entry); err != nil {
+			// Stop at the end, or at the torn entry left by a build
+			// interrupted while writing it, which is overwritten below.
+			break
+		}
+		entries[entry.Path] = entry
+		offset = dec.InputOffset()
+	}
+
+	if err := f.Truncate(offset); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	if offset == 0 {
+		if err := enc.Encode(journalHeader{Config: config}); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return &journal{
+		path:    path,
+		f:       f,
+		w:       w,
+		enc:     enc,
+		entries: entries,
+		flushed: time.Now(),
+	}, nil
+}
+
+// journalConfig describes the configuration resources are built with by
+// ctx, so that journals are only reused by builds building the same
+// resources.
+func journalConfig(ctx Context) (string, error) {
+	c, ok := ctx.(*context)
+	if !ok {
+		return fmt.Sprintf("%T", ctx), nil
+	}
+
+	// The digest of no content tells the algorithm of the digester.
+	dgst, err := c.digester.Digest(strings.NewReader(""))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("driver=%T digest=%s apple=%t projectids=%t birthtimes=%t clamp=%s modemask=%o verity=%t follow=%t",
+		c.driver, dgst, c.appleMetadata, c.projectIDs, c.birthTimes, c.clampTime.Format(time.RFC3339Nano), c.modeMask, c.trustVerity, c.follow), nil
+}
+
+// lookup returns the resource recorded for path p, if the file described
+// by fi has not changed since.
+func (j *journal) lookup(p string, fi os.FileInfo) (Resource, error) {
+	entry, ok := j.entries[p]
+	if !ok || entry.Size != fi.Size() || entry.Mode != uint32(fi.Mode()) || entry.ModTime != fi.ModTime().UnixNano() {
+		return nil, nil
+	}
+	if ino, ctime := changeID(fi); entry.Inode != ino || entry.Ctime != ctime {
+		return nil, nil
+	}
+
+	var b pb.Resource
+	if err := proto.Unmarshal(entry.Resource, &b); err != nil {
+		return nil, err
+	}
+
+	return ResourceFromProto(&b)
+}
+
+// record appends the resource built for path p from fi to the journal.
+func (j *journal) record(p string, fi os.FileInfo, resource Resource) error {
+	b, err := deterministic.Marshal(ResourceToProto(resource))
+	if err != nil {
+		return err
+	}
+
+	ino, ctime := changeID(fi)
+	if err := j.enc.Encode(journalEntry{
+		Path:     p,
+		Size:     fi.Size(),
+		Mode:     uint32(fi.Mode()),
+		ModTime:  fi.ModTime().UnixNano(),
+		Ctime:    ctime,
+		Inode:    ino,
+		Resource: b,
+	}); err != nil {
+		return err
+	}
+
+	if time.Since(j.flushed) < journalFlushInterval {
+		return nil
+	}
+
+	j.flushed = time.Now()
+	return j.w.Flush()
+}
+
+// Close checkpoints and closes the journal, leaving it for a later build to
+// resume from.
+func (j *journal) Close() error {
+	err := j.w.Flush()
+	if cerr := j.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Remove closes and removes the journal, once the build is complete.
+func (j *journal) Remove() error {
+	j.f.Close()
+	return os.Remove(j.path)
+}
@@ -0,0 +1,201 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continuity
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+)
+
+// LazyTree is a tree applied by ApplyManifestLazy, whose regular files are
+// filled in with their content when they are fetched.
+type LazyTree struct {
+	c *context
+
+	mu    sync.Mutex
+	files map[string]*lazyFile // by every path of pending files
+}
+
+// lazyFile is a regular file waiting for its content.
+type lazyFile struct {
+	mu      sync.Mutex
+	file    RegularFile
+	fetched bool
+}
+
+// ApplyManifestLazy applies the manifest like ApplyManifest, except that the
+// content of regular files is not written: files that do not have their
+// content already are created with their size, as sparse files where the
+// filesystem supports them, and all their other attributes, so that the
+// whole tree is in place right away. Until their content is fetched, they
+// are only writable by their owner, so that their missing content is not
+// read as zeros, and they are given their mode once fetched. Their content is only fetched from the
+// provider of the context once Fetch is called for them, such as by a
+// filesystem overlay when they are first opened. Only contexts returned by
+// NewContext and NewContextWithOptions support lazy applies.
+func ApplyManifestLazy(ctx Context, manifest *Manifest) (*LazyTree, error) {
+	c, ok := ctx.(*context)
+	if !ok {
+		return nil, fmt.Errorf("lazy apply is not supported for %T: %w", ctx, ErrNotSupported)
+	}
+
+	t := &LazyTree{c: c, files: map[string]*lazyFile{}}
+	lc := *c
+	lc.lazy = t
+	for _, resource := range applyOrder(manifest.Resources) {
+		if err := lc.Apply(resource); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// placeholderMode is the mode of files whose content has not been fetched.
+const placeholderMode os.FileMode = 0o200
+
+// placeholder creates the file at the full path fp with the size of rf and
+// no content, recording it as pending.
+func (t *LazyTree) placeholder(fp string, rf RegularFile) error {
+	f, err := t.c.driver.OpenFile(fp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, placeholderMode)
+	if err != nil {
+		return err
+	}
+	if err := truncate(f, rf.Size()); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := t.c.driver.Lchmod(fp, placeholderMode); err != nil {
+		return err
+	}
+
+	lf := &lazyFile{file: rf}
+	t.mu.Lock()
+	for _, p := range resourcePaths(rf) {
+		t.files[p] = lf
+	}
+	t.mu.Unlock()
+	return nil
+}
+
+// pending returns whether the file at path p, a path of the manifest, is
+// waiting for its content. It is false for a nil tree.
+func (t *LazyTree) pending(p string) bool {
+	if t == nil {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.files[p] != nil
+}
+
+// truncate extends the empty file f to size, leaving a hole where the
+// file supports it.
+func truncate(f io.WriteSeeker, size int64) error {
+	if truncater, ok := f.(interface{ Truncate(int64) error }); ok {
+		return truncater.Truncate(size)
+	}
+	if size == 0 {
+		return nil
+	}
+	if _, err := f.Seek(size-1, io.SeekStart); err != nil {
+		return err
+	}
+	_, err := f.Write([]byte{0})
+	return err
+}
+
+// Fetch writes the content of the regular file at path p, a path of the
+// manifest, if it is still pending. Other paths do nothing. It is safe to
+// call concurrently, and the content of a file is only fetched once,
+// unless fetching fails. The content is written in place, so that the
+// hardlinks of the file and its attributes are kept.
+func (t *LazyTree) Fetch(p string) error {
+	t.mu.Lock()
+	lf := t.files[p]
+	t.mu.Unlock()
+	if lf == nil {
+		return nil
+	}
+
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+	if lf.fetched {
+		return nil
+	}
+
+	if err := t.fetch(lf.file); err != nil {
+		return fmt.Errorf("error fetching file %q: %w", p, err)
+	}
+
+	lf.fetched = true
+	t.mu.Lock()
+	for _, p := range resourcePaths(lf.file) {
+		delete(t.files, p)
+	}
+	t.mu.Unlock()
+	return nil
+}
+
+func (t *LazyTree) fetch(rf RegularFile) error {
+	c := t.c
+	fp, err := c.fullpath(rf.Path())
+	if err != nil {
+		return err
+	}
+
+	r, err := c.readContent(rf)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	return c.copyToFile(fp, os.O_WRONLY, r, rf.Size(), rf.Mode())
+}
+
+// FetchAll fetches the content of all the pending files, such as to fill
+// the tree in the background.
+func (t *LazyTree) FetchAll() error {
+	for _, p := range t.Pending() {
+		if err := t.Fetch(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Pending returns the paths of the regular files whose content has not
+// been fetched yet, in lexical order. Hardlinked files are listed by their
+// first path only.
+func (t *LazyTree) Pending() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var paths []string
+	for p, lf := range t.files {
+		if p == lf.file.Path() {
+			paths = append(paths, p)
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
@@ -0,0 +1,56 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continuity
+
+// LogLevel is the severity of a log message.
+type LogLevel int
+
+const (
+	LogLevelDebug LogLevel = iota
+	LogLevelInfo
+	LogLevelWarn
+	LogLevelError
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LogLevelDebug:
+		return "debug"
+	case LogLevelInfo:
+		return "info"
+	case LogLevelWarn:
+		return "warn"
+	case LogLevelError:
+		return "error"
+	}
+
+	return "unknown"
+}
+
+// Logger receives the log messages of a context. The package never writes
+// to stdout or stderr itself; consumers decide where messages go by setting
+// ContextOptions.Logger.
+type Logger interface {
+	// Log logs msg at the given level. Fields are given as alternating keys
+	// and values, such as "path", "/a", in the style of go-logr.
+	Log(level LogLevel, msg string, fields ...interface{})
+}
+
+// discardLogger is the Logger used when none is configured.
+type discardLogger struct{}
+
+func (discardLogger) Log(LogLevel, string, ...interface{}) {}
@@ -17,33 +17,239 @@
 package continuity
 
 import (
+	"bufio"
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	pb "github.com/containerd/continuity/proto"
+	"github.com/opencontainers/go-digest"
+	"google.golang.org/protobuf/encoding/protojson"
 	"google.golang.org/protobuf/encoding/prototext"
 	"google.golang.org/protobuf/proto"
 )
 
+// ManifestVersion is the version of the manifest format written by this
+// package. Manifests of later versions are rejected when read.
+const ManifestVersion = 1
+
 // Manifest provides the contents of a manifest. Users of this struct should
 // not typically modify any fields directly.
+//
+// Fields of encoded manifests that are not known to this package, such as
+// extensions numbered in the range set aside in manifest.proto, are kept and
+// written back when the manifest, or one derived from it by Transform, is
+// marshaled again.
 type Manifest struct {
 	// Resources specifies all the resources for a manifest in order by path.
 	Resources []Resource
+
+	// Header describes the format of the manifest, as built or read. Apart
+	// from Truncated, it is ignored when the manifest is written, since it is
+	// derived from the resources.
+	Header Header
+
+	// Provenance describes how the manifest was built, if recorded. It is
+	// nil unless set, so that manifests of the same tree are identical.
+	Provenance *Provenance
+
+	// unknown holds the encoded fields of the manifest that this package
+	// does not know, so that they survive when it is written back.
+	unknown []byte
+}
+
+// Header describes the version and the features of a manifest.
+type Header struct {
+	// Version is the version of the manifest format, zero for manifests
+	// written before headers were introduced.
+	Version uint32
+
+	// XAttrs is set if any resource carries extended attributes.
+	XAttrs bool
+
+	// Timestamps is set if any resource carries a time, such as its birth
+	// time.
+	Timestamps bool
+
+	// DigestAlgorithms lists the algorithms of the digests of regular files.
+	DigestAlgorithms []digest.Algorithm
+
+	// Truncated is set if resources were left out of the manifest as it was
+	// built, because the tree exceeded the limits given with WithLimits.
+	Truncated bool
+
+	// unknown holds the encoded fields of the header that this package does
+	// not know.
+	unknown []byte
+}
+
+// newHeader returns the header of a manifest of the given resources.
+func newHeader(resources []Resource) Header {
+	h := Header{Version: ManifestVersion}
+
+	algorithms := map[digest.Algorithm]bool{}
+	for _, r := range resources {
+		if xattrer, ok := r.(XAttrer); ok && len(xattrer.XAttrs()) > 0 {
+			h.XAttrs = true
+		}
+		if bt, ok := r.(BirthTimer); ok && !bt.BirthTime().IsZero() {
+			h.Timestamps = true
+		}
+		if rf, ok := r.(RegularFile); ok {
+			for _, dgst := range rf.Digests() {
+				algorithms[dgst.Algorithm()] = true
+			}
+		}
+	}
+	for alg := range algorithms {
+		h.DigestAlgorithms = append(h.DigestAlgorithms, alg)
+	}
+	sort.Slice(h.DigestAlgorithms, func(i, j int) bool { return h.DigestAlgorithms[i] < h.DigestAlgorithms[j] })
+
+	return h
+}
+
+type unmarshalOpts struct {
+	duplicates DuplicatePolicy
+	strict     *StrictLimits
+	safePaths  bool
+}
+
+// UnmarshalOpt is an option for reading manifests, with Unmarshal and the
+// other functions decoding manifests.
+type UnmarshalOpt func(*unmarshalOpts) error
+
+// WithDuplicates selects how resources sharing a path are handled when a
+// manifest is read. Manifests with duplicate paths are rejected by default.
+func WithDuplicates(policy DuplicatePolicy) UnmarshalOpt {
+	return func(o *unmarshalOpts) error {
+		o.duplicates = policy
+		return nil
+	}
+}
+
+// WithSafePaths makes reading a manifest fail if any of its paths could lead
+// outside of the root it is applied to, or be interpreted differently by
+// different systems: paths must not name a volume, hold ".." or "."
+// components, empty components or NUL bytes. Paths are otherwise taken as
+// they are, relative to the root whether or not they start with a
+// separator.
+func WithSafePaths() UnmarshalOpt {
+	return func(o *unmarshalOpts) error {
+		o.safePaths = true
+		return nil
+	}
+}
+
+// StrictLimits bounds the manifests read in strict mode. Zero means no
+// limit.
+type StrictLimits struct {
+	// MaxEntries is the maximum number of paths of the manifest, counting
+	// every path of hardlinked files.
+	MaxEntries int
+
+	// MaxPathLength is the maximum length of paths, in bytes.
+	MaxPathLength int
 }
 
-func Unmarshal(p []byte) (*Manifest, error) {
+// WithStrict makes reading a manifest fail, rather than repair or
+// tolerate, manifests that BuildManifest would not have written, for
+// services ingesting manifests from untrusted sources. The records of the
+// manifest must be sorted by path with no path appearing twice, paths must
+// be safe, as with WithSafePaths, as well as clean and absolute, digests
+// must parse, and the manifest must be within the limits, or reading it
+// fails with ErrLimitExceeded. The checks are made on the records as read,
+// before resources are built from them.
+func WithStrict(limits StrictLimits) UnmarshalOpt {
+	return func(o *unmarshalOpts) error {
+		if limits.MaxEntries < 0 || limits.MaxPathLength < 0 {
+			return fmt.Errorf("invalid limits: %+v", limits)
+		}
+		o.strict = &limits
+		return nil
+	}
+}
+
+func Unmarshal(p []byte, opts ...UnmarshalOpt) (*Manifest, error) {
 	var bm pb.Manifest
 
 	if err := proto.Unmarshal(p, &bm); err != nil {
 		return nil, err
 	}
 
+	return FromProto(&bm, opts...)
+}
+
+// Marshal encodes the manifest as a protobuf message. Maps such as
+// annotations are sorted, so that a manifest always encodes to the same bytes.
+func Marshal(m *Manifest) ([]byte, error) {
+	return deterministic.Marshal(ToProto(m))
+}
+
+// deterministic marshals messages with their maps sorted by key.
+var deterministic = proto.MarshalOptions{Deterministic: true}
+
+// FromProto returns the manifest described by the protobuf message, for
+// use where manifests are embedded in other messages. Manifests of versions
+// later than ManifestVersion are rejected. Hardlinks recorded as links are
+// collapsed into the files they lead to, as checked by CheckHardlinks.
+func FromProto(bm *pb.Manifest, opts ...UnmarshalOpt) (*Manifest, error) {
+	var o unmarshalOpts
+	for _, opt := range opts {
+		if err := opt(&o); err != nil {
+			return nil, err
+		}
+	}
+
 	var m Manifest
-	for _, b := range bm.Resource {
-		r, err := fromProto(b)
+	if bh := bm.Header; bh != nil {
+		if bh.Version > ManifestVersion {
+			return nil, fmt.Errorf("manifest version %d is newer than %d: %w", bh.Version, ManifestVersion, ErrNotSupported)
+		}
+
+		m.Header = Header{
+			Version:    bh.Version,
+			XAttrs:     bh.HasXattrs,
+			Timestamps: bh.HasTimestamps,
+			Truncated:  bh.Truncated,
+		}
+		for _, alg := range bh.DigestAlgorithms {
+			m.Header.DigestAlgorithms = append(m.Header.DigestAlgorithms, digest.Algorithm(alg))
+		}
+		m.Header.unknown = unknownFields(bh)
+	}
+	m.unknown = unknownFields(bm)
+
+	m.Provenance = provenanceFromProto(bm.Provenance)
+
+	if o.safePaths {
+		for _, b := range bm.Resource {
+			for _, p := range b.Path {
+				if err := checkSafePath(p); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	if o.strict != nil {
+		if err := checkRecords(bm.Resource, *o.strict); err != nil {
+			return nil, err
+		}
+	}
+
+	records, err := collapseHardlinks(bm.Resource)
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range records {
+		r, err := ResourceFromProto(b)
 		if err != nil {
 			return nil, err
 		}
@@ -51,25 +257,79 @@ func Unmarshal(p []byte) (*Manifest, error) {
 		m.Resources = append(m.Resources, r)
 	}
 
+	m.Resources, err = resolveDuplicates(m.Resources, o.duplicates)
+	if err != nil {
+		return nil, err
+	}
+
 	return &m, nil
 }
 
-func Marshal(m *Manifest) ([]byte, error) {
-	var bm pb.Manifest
+// unknownFields returns a copy of the encoded fields of msg that are not
+// known to this package, or nil if there are none.
+func unknownFields(msg proto.Message) []byte {
+	unknown := msg.ProtoReflect().GetUnknown()
+	if len(unknown) == 0 {
+		return nil
+	}
+	return append([]byte(nil), unknown...)
+}
+
+// setUnknownFields sets the fields of msg not known to this package, as
+// recorded by unknownFields.
+func setUnknownFields(msg proto.Message, unknown []byte) {
+	if len(unknown) > 0 {
+		msg.ProtoReflect().SetUnknown(append([]byte(nil), unknown...))
+	}
+}
+
+// ToProto returns the protobuf message describing the manifest, with a
+// header of the current version.
+func ToProto(m *Manifest) *pb.Manifest {
+	h := newHeader(m.Resources)
+	bm := pb.Manifest{
+		Header: &pb.Header{
+			Version:       h.Version,
+			HasXattrs:     h.XAttrs,
+			HasTimestamps: h.Timestamps,
+			Truncated:     m.Header.Truncated,
+		},
+		Provenance: provenanceToProto(m.Provenance),
+	}
+	for _, alg := range h.DigestAlgorithms {
+		bm.Header.DigestAlgorithms = append(bm.Header.DigestAlgorithms, alg.String())
+	}
+	setUnknownFields(bm.Header, m.Header.unknown)
+	setUnknownFields(&bm, m.unknown)
+
 	for _, resource := range m.Resources {
-		bm.Resource = append(bm.Resource, toProto(resource))
+		bm.Resource = append(bm.Resource, ResourceToProto(resource))
 	}
 
-	return proto.Marshal(&bm)
+	return &bm
 }
 
-func MarshalText(w io.Writer, m *Manifest) error {
+// MarshalJSON encodes the manifest in the JSON mapping of its protobuf
+// message, with the field names of the proto file. Decoding the result with
+// UnmarshalJSON returns the same manifest, but the encoding is not stable:
+// the same manifest may be encoded differently by other versions.
+func MarshalJSON(m *Manifest) ([]byte, error) {
+	return protojson.MarshalOptions{UseProtoNames: true}.Marshal(ToProto(m))
+}
+
+// UnmarshalJSON decodes a manifest encoded by MarshalJSON. Unknown fields are
+// rejected rather than dropped, since they could not be preserved.
+func UnmarshalJSON(p []byte, opts ...UnmarshalOpt) (*Manifest, error) {
 	var bm pb.Manifest
-	for _, resource := range m.Resources {
-		bm.Resource = append(bm.Resource, toProto(resource))
+	if err := protojson.Unmarshal(p, &bm); err != nil {
+		return nil, err
 	}
 
-	b, err := prototext.Marshal(&bm)
+	return FromProto(&bm, opts...)
+}
+
+func MarshalText(w io.Writer, m *Manifest) error {
+	b, err := prototext.Marshal(ToProto(m))
 	if err != nil {
 		return err
 	}
@@ -77,29 +337,74 @@ func MarshalText(w io.Writer, m *Manifest) error {
 	return err
 }
 
-// BuildManifest creates the manifest for the given context
-func BuildManifest(ctx Context) (*Manifest, error) {
-	resourcesByPath := map[string]Resource{}
-	hardLinks := newHardlinkManager()
+type buildOpts struct {
+	journal string
+	limits  Limits
+	hooks   []BuildHooks
+}
 
-	if err := ctx.Walk(func(p string, fi os.FileInfo, err error) error {
-		if err != nil {
-			return fmt.Errorf("error walking %s: %w", p, err)
-		}
+// BuildOpt is an option for BuildManifest.
+type BuildOpt func(*buildOpts) error
 
-		if p == string(os.PathSeparator) {
-			// skip root
-			return nil
-		}
+// WithJournal makes BuildManifest record the regular files it has built in a
+// journal at path, checkpointed every few seconds. If the build is
+// interrupted, building again with the same journal reuses the recorded
+// files that have not changed since, rather than digesting them again. The
+// journal is removed once the build completes.
+func WithJournal(path string) BuildOpt {
+	return func(o *buildOpts) error {
+		o.journal = path
+		return nil
+	}
+}
 
-		resource, err := ctx.Resource(p, fi)
-		if err != nil {
-			if err == ErrNotFound {
-				return nil
-			}
-			return fmt.Errorf("failed to get resource %q: %w", p, err)
+// ErrLimitExceeded is returned, wrapped, by BuildManifest when the tree
+// exceeds the limits given with WithLimits.
+var ErrLimitExceeded = errors.New("limit exceeded")
+
+// Limits bounds the trees walked by BuildManifest, so that services building
+// manifests of untrusted input are protected from runaway trees.
+type Limits struct {
+	// MaxDepth is the maximum number of components of the paths of
+	// resources, so that resources directly below the root are at depth 1.
+	// Zero means no limit.
+	MaxDepth int
+
+	// MaxEntries is the maximum number of resources, counting every path of
+	// hardlinked files. Zero means no limit.
+	MaxEntries int
+
+	// MaxFileSize is the maximum size of regular files, checked before their
+	// content is read. Zero means no limit.
+	MaxFileSize int64
+
+	// Truncate makes BuildManifest leave out the resources beyond the limits
+	// and mark the manifest as truncated in its header, rather than fail.
+	Truncate bool
+}
+
+// WithLimits makes BuildManifest fail with ErrLimitExceeded, or truncate the
+// manifest, when the tree exceeds the limits.
+func WithLimits(limits Limits) BuildOpt {
+	return func(o *buildOpts) error {
+		if limits.MaxDepth < 0 || limits.MaxEntries < 0 || limits.MaxFileSize < 0 {
+			return fmt.Errorf("invalid limits: %+v", limits)
 		}
+		o.limits = limits
+		return nil
+	}
+}
+
+// errTruncated stops the walk of BuildManifest once the manifest is
+// truncated.
+var errTruncated = errors.New("truncated")
 
+// BuildManifest creates the manifest for the given context
+func BuildManifest(ctx Context, opts ...BuildOpt) (*Manifest, error) {
+	resourcesByPath := map[string]Resource{}
+	hardLinks := newHardlinkManager()
+
+	truncated, err := walkResources(ctx, opts, func(p string, fi os.FileInfo, resource Resource) error {
 		// add to the hardlink manager
 		if err := hardLinks.Add(fi, resource); err == nil {
 			// Resource has been accepted by hardlink manager so we don't add
@@ -111,9 +416,9 @@ func BuildManifest(ctx Context) (*Manifest, error) {
 		}
 
 		resourcesByPath[p] = resource
-
 		return nil
-	}); err != nil {
+	})
+	if err != nil {
 		return nil, err
 	}
 
@@ -134,31 +439,653 @@ func BuildManifest(ctx Context) (*Manifest, error) {
 
 	sort.Stable(ByPath(resources))
 
+	h := newHeader(resources)
+	h.Truncated = truncated
 	return &Manifest{
 		Resources: resources,
+		Header:    h,
 	}, nil
 }
 
+// walkResources walks the context, applying the build options, and calls fn
+// with the resource of each entry in walk order. It returns true if entries
+// were left out at the limits of the build. The journal, if any, is removed
+// once the walk completes.
+func walkResources(ctx Context, opts []BuildOpt, fn func(p string, fi os.FileInfo, resource Resource) error) (bool, error) {
+	var o buildOpts
+	for _, opt := range opts {
+		if err := opt(&o); err != nil {
+			return false, err
+		}
+	}
+
+	ran, err := runBeforeHooks(ctx, o.hooks)
+	if err != nil {
+		return false, runAfterHooks(ctx, o.hooks[:ran], BuildStats{}, err)
+	}
+
+	var stats BuildStats
+	start := time.Now()
+	stats.Truncated, err = walkContext(ctx, &o, &stats, fn)
+	flushProgress(ctx)
+	stats.Duration = time.Since(start)
+	return stats.Truncated, runAfterHooks(ctx, o.hooks, stats, err)
+}
+
+// walkContext does the walk of walkResources, counting the resources built in
+// stats.
+func walkContext(ctx Context, o *buildOpts, stats *BuildStats, fn func(p string, fi os.FileInfo, resource Resource) error) (bool, error) {
+	var j *journal
+	if o.journal != "" {
+		config, err := journalConfig(ctx)
+		if err != nil {
+			return false, fmt.Errorf("failed to open journal: %w", err)
+		}
+		j, err = openJournal(o.journal, config)
+		if err != nil {
+			return false, fmt.Errorf("failed to open journal: %w", err)
+		}
+		defer func() {
+			if j != nil {
+				j.Close()
+			}
+		}()
+	}
+
+	var entries int
+	var truncated bool
+
+	if err := ctx.Walk(func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return fmt.Errorf("error walking %s: %w", p, err)
+		}
+
+		if p == string(os.PathSeparator) {
+			// skip root
+			return nil
+		}
+
+		if limits := o.limits; limits.MaxDepth > 0 && strings.Count(p, string(os.PathSeparator)) > limits.MaxDepth {
+			if !limits.Truncate {
+				return fmt.Errorf("%s is deeper than %d: %w", p, limits.MaxDepth, ErrLimitExceeded)
+			}
+			truncated = true
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		entries++
+		if limits := o.limits; limits.MaxEntries > 0 && entries > limits.MaxEntries {
+			if !limits.Truncate {
+				return fmt.Errorf("more than %d entries: %w", limits.MaxEntries, ErrLimitExceeded)
+			}
+			truncated = true
+			return errTruncated
+		}
+
+		if limits := o.limits; limits.MaxFileSize > 0 && fi.Mode().IsRegular() && fi.Size() > limits.MaxFileSize {
+			if !limits.Truncate {
+				return fmt.Errorf("%s is larger than %d bytes: %w", p, limits.MaxFileSize, ErrLimitExceeded)
+			}
+			truncated = true
+			return nil
+		}
+
+		var resource Resource
+		if j != nil && fi.Mode().IsRegular() {
+			resource, err = j.lookup(p, fi)
+			if err != nil {
+				return fmt.Errorf("failed to read journal entry for %q: %w", p, err)
+			}
+		}
+
+		if resource == nil {
+			resource, err = ctx.Resource(p, fi)
+			if err != nil {
+				if err == ErrNotFound {
+					return nil
+				}
+				return fmt.Errorf("failed to get resource %q: %w", p, err)
+			}
+
+			if j != nil && fi.Mode().IsRegular() {
+				if err := j.record(p, fi, resource); err != nil {
+					return fmt.Errorf("failed to write journal: %w", err)
+				}
+			}
+		}
+
+		if err := fn(p, fi, resource); err != nil {
+			return err
+		}
+		stats.Entries++
+		if fi.Mode().IsRegular() {
+			stats.Bytes += fi.Size()
+		}
+		return nil
+	}); err != nil && !errors.Is(err, errTruncated) {
+		return false, err
+	}
+
+	if j != nil {
+		err := j.Remove()
+		j = nil
+		if err != nil {
+			return false, fmt.Errorf("failed to remove journal: %w", err)
+		}
+	}
+
+	return truncated, nil
+}
+
+type verifyOpts struct {
+	sampling    *Sampling
+	report      *VerifyReport
+	concurrency int
+	all         bool
+	ignore      []string
+	skip        map[VerifyField]bool
+}
+
+// VerifyOpt is an option for VerifyManifest.
+type VerifyOpt func(*verifyOpts) error
+
+// WithSampling makes VerifyManifest verify the metadata of every resource,
+// but the content of only the given percentage of regular files, picked
+// reproducibly from the seed. This is much faster on large trees, at the
+// cost of only statistical assurance about their content. Contexts not
+// returned by NewContext and NewContextWithOptions verify the content of
+// every file.
+func WithSampling(percent float64, seed int64) VerifyOpt {
+	return func(o *verifyOpts) error {
+		if percent < 0 || percent > 100 {
+			return fmt.Errorf("invalid sampling percentage %v", percent)
+		}
+		o.sampling = &Sampling{Percent: percent, Seed: seed}
+		return nil
+	}
+}
+
+// WithVerifyReport makes VerifyManifest describe how it verified the
+// manifest in report, whether or not it succeeds.
+func WithVerifyReport(report *VerifyReport) VerifyOpt {
+	return func(o *verifyOpts) error {
+		o.report = report
+		return nil
+	}
+}
+
+// WithIgnore makes VerifyManifest skip the resources matching any of the
+// patterns, which are those of Prune, such as known mutable paths like logs.
+// Hardlinked resources are only skipped if all of their paths match. The paths
+// of the resources skipped are listed in the report.
+func WithIgnore(patterns ...string) VerifyOpt {
+	return func(o *verifyOpts) error {
+		compiled, err := compilePatterns(patterns)
+		if err != nil {
+			return err
+		}
+		o.ignore = append(o.ignore, compiled...)
+		return nil
+	}
+}
+
+// ReadIgnoreFile reads the patterns of a file listing paths to ignore, one per
+// line, for WithIgnore. Blank lines and lines starting with "#" are skipped.
+func ReadIgnoreFile(r io.Reader) ([]string, error) {
+	var patterns []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patterns = append(patterns, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return patterns, nil
+}
+
+// VerifyField names a field of resources that verification may be told to
+// skip with WithoutFields. Modification times are not recorded in manifests,
+// and are never verified, and neither are the names of users and groups,
+// only their ids.
+type VerifyField string
+
+const (
+	// FieldMode is the permissions and the setuid, setgid and sticky bits
+	// of resources. The type of resources is always verified.
+	FieldMode VerifyField = "mode"
+
+	// FieldOwner is the uid of resources.
+	FieldOwner VerifyField = "owner"
+
+	// FieldGroup is the gid of resources.
+	FieldGroup VerifyField = "group"
+
+	// FieldXAttrs is the extended attributes of resources.
+	FieldXAttrs VerifyField = "xattrs"
+)
+
+// WithoutFields makes VerifyManifest skip the given fields of resources, such
+// as their ownership where ids are mapped differently than where the manifest
+// was built. Contexts not returned by NewContext and NewContextWithOptions
+// verify every field.
+func WithoutFields(fields ...VerifyField) VerifyOpt {
+	return func(o *verifyOpts) error {
+		if o.skip == nil {
+			o.skip = map[VerifyField]bool{}
+		}
+		for _, field := range fields {
+			switch field {
+			case FieldMode, FieldOwner, FieldGroup, FieldXAttrs:
+			default:
+				return fmt.Errorf("unknown field %q", field)
+			}
+			o.skip[field] = true
+		}
+		return nil
+	}
+}
+
+// WithAllFailures makes VerifyManifest verify every resource, rather than
+// stop at the first that fails, so that the report lists all of the
+// failures. The error returned is still that of the first failing resource.
+func WithAllFailures() VerifyOpt {
+	return func(o *verifyOpts) error {
+		o.all = true
+		return nil
+	}
+}
+
+// WithConcurrency makes VerifyManifest verify up to n resources at once,
+// which speeds up the verification of trees on storage that serves parallel
+// reads well. The error returned, if any, is that of the first failing
+// resource in the manifest, but resources after it may have been verified
+// too.
+func WithConcurrency(n int) VerifyOpt {
+	return func(o *verifyOpts) error {
+		if n < 1 {
+			return fmt.Errorf("invalid concurrency %d", n)
+		}
+		o.concurrency = n
+		return nil
+	}
+}
+
 // VerifyManifest verifies all the resources in a manifest
 // against files from the given context.
-func VerifyManifest(ctx Context, manifest *Manifest) error {
-	for _, resource := range manifest.Resources {
-		if err := ctx.Verify(resource); err != nil {
+func VerifyManifest(ctx Context, manifest *Manifest, opts ...VerifyOpt) error {
+	var o verifyOpts
+	for _, opt := range opts {
+		if err := opt(&o); err != nil {
 			return err
 		}
 	}
 
-	return nil
+	report := o.report
+	if report == nil {
+		report = &VerifyReport{}
+	}
+	*report = VerifyReport{}
+
+	c, _ := ctx.(*context)
+	if c != nil {
+		report.Sampling = o.sampling
+	}
+	defer flushProgress(ctx)
+
+	resources := manifest.Resources
+	if len(o.ignore) > 0 {
+		var err error
+		if resources, report.Ignored, err = ignoreResources(resources, o.ignore); err != nil {
+			return err
+		}
+	}
+
+	verify := func(resource Resource, checkContent bool) error {
+		if c != nil {
+			return c.verify(resource, checkContent, o.skip)
+		}
+		return ctx.Verify(resource)
+	}
+
+	// dispatch accounts for the resource in the report and returns whether
+	// its content is to be verified.
+	dispatch := func(resource Resource) bool {
+		report.Resources++
+
+		checkContent := report.Sampling.includes(resource.Path())
+		if _, ok := resource.(RegularFile); ok && checkContent {
+			report.ContentVerified++
+		}
+		return checkContent
+	}
+
+	if o.concurrency <= 1 {
+		var first error
+		for _, resource := range resources {
+			if err := verify(resource, dispatch(resource)); err != nil {
+				report.Failures = append(report.Failures, failureOf(resource.Path(), err))
+				if first == nil {
+					first = err
+				}
+				if !o.all {
+					break
+				}
+			}
+		}
+
+		return first
+	}
+
+	type job struct {
+		i            int
+		checkContent bool
+	}
+
+	var (
+		wg     sync.WaitGroup
+		jobs   = make(chan job)
+		errs   = make([]error, len(resources))
+		failed int32
+	)
+	for i := 0; i < o.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				if errs[j.i] = verify(resources[j.i], j.checkContent); errs[j.i] != nil {
+					atomic.StoreInt32(&failed, 1)
+				}
+			}
+		}()
+	}
+
+	for i, resource := range resources {
+		if !o.all && atomic.LoadInt32(&failed) != 0 {
+			break
+		}
+		jobs <- job{i: i, checkContent: dispatch(resource)}
+	}
+	close(jobs)
+	wg.Wait()
+
+	var first error
+	for i, err := range errs {
+		if err != nil {
+			report.Failures = append(report.Failures, failureOf(resources[i].Path(), err))
+			if first == nil {
+				first = err
+			}
+		}
+	}
+
+	return first
+}
+
+// ignoreResources returns the resources with the paths matching the
+// patterns removed, and the paths removed.
+func ignoreResources(resources []Resource, patterns []string) ([]Resource, []string, error) {
+	var (
+		kept    = make([]Resource, 0, len(resources))
+		ignored []string
+	)
+	for _, r := range resources {
+		var paths []string
+		for _, p := range resourcePaths(r) {
+			if matchPatterns(patterns, p) {
+				ignored = append(ignored, p)
+			} else {
+				paths = append(paths, p)
+			}
+		}
+
+		switch {
+		case len(paths) == 0:
+			continue
+		case len(paths) < len(resourcePaths(r)):
+			var err error
+			if r, err = withPaths(r, paths); err != nil {
+				return nil, nil, err
+			}
+		}
+		kept = append(kept, r)
+	}
+	return kept, ignored, nil
+}
+
+type applyOpts struct {
+	rollback    bool
+	concurrency int
+}
+
+// ApplyOpt is an option for ApplyManifest.
+type ApplyOpt func(*applyOpts) error
+
+// WithRollback makes ApplyManifest restore the files it has changed if it
+// fails, leaving the root as it was before the apply. Files the apply will
+// change are copied to a directory next to the root before they are first
+// changed; files that already match the manifest are not copied. Extended
+// attributes added by the apply are not removed.
+// Only contexts returned by NewContext and NewContextWithOptions support
+// rollback.
+func WithRollback() ApplyOpt {
+	return func(o *applyOpts) error {
+		o.rollback = true
+		return nil
+	}
+}
+
+// WithApplyConcurrency makes ApplyManifest write up to n regular files at
+// once, which speeds up the materialization of large trees. Directories and
+// the other resources are still applied one at a time, in order, before any
+// regular file is written, so that the files find their directories in
+// place. The error returned, if any, is that of the first failing resource
+// in the order of the apply, but files after it may have been written too.
+func WithApplyConcurrency(n int) ApplyOpt {
+	return func(o *applyOpts) error {
+		if n < 1 {
+			return fmt.Errorf("invalid concurrency %d", n)
+		}
+		o.concurrency = n
+		return nil
+	}
 }
 
 // ApplyManifest applies on the resources in a manifest to
 // the given context.
-func ApplyManifest(ctx Context, manifest *Manifest) error {
-	for _, resource := range manifest.Resources {
+//
+// Whatever the order of the resources of the manifest, directories are
+// created before their contents and hardlinked files before the links to
+// them: resources are applied in the order of their paths, and hardlinked
+// files at the last of their paths, by which point the directories holding
+// each of their paths exist. The file is created at its first path and
+// linked at the others. Directories that their owner may not write to or
+// search, which would keep their contents from being created by users other
+// than root, are applied with these permissions added at first, and their
+// recorded modes are set once the rest of the manifest is applied, deepest
+// first. An apply that fails part way may leave them with the added
+// permissions.
+func ApplyManifest(ctx Context, manifest *Manifest, opts ...ApplyOpt) (err error) {
+	var o applyOpts
+	for _, opt := range opts {
+		if err := opt(&o); err != nil {
+			return err
+		}
+	}
+
+	var undo *undoLog
+	if o.rollback {
+		c, ok := ctx.(*context)
+		if !ok {
+			return fmt.Errorf("rollback is not supported for %T: %w", ctx, ErrNotSupported)
+		}
+
+		undo, err = newUndoLog(c)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err != nil {
+				if rerr := undo.rollback(); rerr != nil {
+					err = fmt.Errorf("%w (rollback failed, backups kept in %s: %v)", err, undo.dir, rerr)
+					return
+				}
+			}
+			if cerr := undo.Close(); err == nil {
+				err = cerr
+			}
+		}()
+	}
+
+	ordered := applyOrder(manifest.Resources)
+	if c, ok := ctx.(*context); ok {
+		c.progress.expect(applyTotals(ordered))
+	}
+	defer flushProgress(ctx)
+
+	var (
+		locked []Resource
+		files  []Resource // regular files left to concurrent writers
+	)
+	for _, resource := range ordered {
+		if _, ok := resource.(RegularFile); ok && o.concurrency > 1 {
+			files = append(files, resource)
+			continue
+		}
+
+		if undo != nil {
+			if err := undo.record(resource); err != nil {
+				return err
+			}
+		}
+
+		if isLocked(resource) {
+			locked = append(locked, resource)
+			if resource, err = withMode(resource, resource.Mode()|ownerWriteSearch); err != nil {
+				return err
+			}
+		}
+
 		if err := ctx.Apply(resource); err != nil {
 			return err
 		}
 	}
 
+	if err := applyConcurrently(ctx, files, o.concurrency, undo); err != nil {
+		return err
+	}
+
+	for i := len(locked) - 1; i >= 0; i-- {
+		if err := ctx.Apply(locked[i]); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
+
+// flushProgress reports the last progress made through ctx, which the
+// progress interval may have held back.
+func flushProgress(ctx Context) {
+	if c, ok := ctx.(*context); ok {
+		c.progress.flush()
+	}
+}
+
+// isLocked returns whether the resource is a directory that its owner may
+// not create entries in.
+func isLocked(r Resource) bool {
+	_, ok := r.(Directory)
+	return ok && r.Mode()&ownerWriteSearch != ownerWriteSearch
+}
+
+// applyTotals returns the number of resources ApplyManifest applies,
+// counting locked directories twice, and the size of the regular files.
+func applyTotals(resources []Resource) (entries, bytes int64) {
+	for _, r := range resources {
+		entries++
+		if isLocked(r) {
+			entries++
+		}
+		if rf, ok := r.(RegularFile); ok {
+			bytes += rf.Size()
+		}
+	}
+	return entries, bytes
+}
+
+// applyConcurrently applies the resources, none of which depend on another,
+// up to n at once. Each resource is recorded in the undo log, if any, before
+// it is applied. The error returned is that of the first failing resource.
+func applyConcurrently(ctx Context, resources []Resource, n int, undo *undoLog) error {
+	var (
+		wg     sync.WaitGroup
+		jobs   = make(chan int)
+		errs   = make([]error, len(resources))
+		failed int32
+	)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				if errs[i] = ctx.Apply(resources[i]); errs[i] != nil {
+					atomic.StoreInt32(&failed, 1)
+				}
+			}
+		}()
+	}
+
+	var err error
+	for i, resource := range resources {
+		if atomic.LoadInt32(&failed) != 0 {
+			break
+		}
+		if undo != nil {
+			if err = undo.record(resource); err != nil {
+				break
+			}
+		}
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+// applyOrder returns the resources in the order ApplyManifest applies them:
+// by path, with hardlinked files placed at the last of their paths.
+func applyOrder(resources []Resource) []Resource {
+	ordered := make([]Resource, len(resources))
+	copy(ordered, resources)
+
+	last := func(r Resource) string {
+		var p string
+		for _, rp := range resourcePaths(r) {
+			if rp > p {
+				p = rp
+			}
+		}
+		return p
+	}
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return last(ordered[i]) < last(ordered[j])
+	})
+	return ordered
+}
+
+// ownerWriteSearch are the permissions the owner of a directory needs to
+// create entries in it.
+const ownerWriteSearch os.FileMode = 0o300
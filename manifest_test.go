@@ -22,17 +22,29 @@ package continuity
 import (
 	"bytes"
 	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"math/rand"
 	"os"
 	"path/filepath"
+	"reflect"
 	"sort"
+	"strings"
 	"syscall"
 	"testing"
+	"time"
 
 	"github.com/containerd/continuity/devices"
+	driverpkg "github.com/containerd/continuity/driver"
+	"github.com/containerd/continuity/fs"
+	"github.com/containerd/continuity/pathdriver"
+	pb "github.com/containerd/continuity/proto"
+	"github.com/containerd/continuity/testutil"
 	"github.com/opencontainers/go-digest"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
 )
 
 // Hard things:
@@ -428,3 +440,2986 @@ func expectedResourceList(root string, resources []dresource) ([]Resource, error
 
 	return manifestResources, nil
 }
+
+func TestReparsePointRoundTrip(t *testing.T) {
+	junction, err := newSymLink(resource{
+		paths:      []string{"/junction"},
+		mode:       os.ModeSymlink | 0o777,
+		reparseTag: ReparseTagMountPoint,
+	}, `C:\target`, SymlinkTypeDirectory)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := []byte{0x1d, 0x00, 0x00, 0x90, 0x04, 0x00, 0x00, 0x00, 0xde, 0xad, 0xbe, 0xef}
+	dir, err := newDirectory(resource{
+		paths:       []string{"/reparse"},
+		mode:        os.ModeDir | 0o755,
+		reparseTag:  0x9000001d,
+		reparseData: data,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := Marshal(&Manifest{Resources: []Resource{junction, dir}})
+	if err != nil {
+		t.Fatalf("error marshaling manifest: %v", err)
+	}
+
+	m, err := Unmarshal(p)
+	if err != nil {
+		t.Fatalf("error unmarshaling manifest: %v", err)
+	}
+
+	if len(m.Resources) != 2 {
+		t.Fatalf("unexpected number of resources: %d", len(m.Resources))
+	}
+
+	l, ok := m.Resources[0].(SymLink)
+	if !ok {
+		t.Fatalf("expected a symlink, got %#v", m.Resources[0])
+	}
+	if tag := l.(ReparsePoint).ReparseTag(); tag != ReparseTagMountPoint {
+		t.Fatalf("unexpected reparse tag for junction: %#x", tag)
+	}
+	if l.Target() != `C:\target` {
+		t.Fatalf("unexpected junction target: %q", l.Target())
+	}
+
+	d, ok := m.Resources[1].(Directory)
+	if !ok {
+		t.Fatalf("expected a directory, got %#v", m.Resources[1])
+	}
+	if tag := d.(ReparsePoint).ReparseTag(); tag != 0x9000001d {
+		t.Fatalf("unexpected reparse tag: %#x", tag)
+	}
+	if !bytes.Equal(d.(ReparsePoint).ReparseData(), data) {
+		t.Fatalf("unexpected reparse data: %x", d.(ReparsePoint).ReparseData())
+	}
+}
+
+func TestMarshalDeterministic(t *testing.T) {
+	annotations := make(map[string]string)
+	for i := 0; i < 32; i++ {
+		annotations[fmt.Sprintf("key%d", i)] = fmt.Sprint(i)
+	}
+	f, err := NewRegularFile([]string{"/a"}, Attributes{Mode: 0o644, Annotations: annotations}, 1, digest.FromString("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &Manifest{Resources: []Resource{f}}
+
+	expected, err := Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		p, err := Marshal(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(p, expected) {
+			t.Fatal("expected marshaling the same manifest to give the same bytes")
+		}
+	}
+}
+
+func TestMarshalChecksums(t *testing.T) {
+	dir, err := NewDirectory("/dir", Attributes{Mode: os.ModeDir | 0o755})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := NewRegularFile([]string{"/dir/a", "/dir/b"}, Attributes{Mode: 0o644}, 3, digest.FromString("abc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	odd, err := NewRegularFile([]string{"/odd\\name"}, Attributes{Mode: 0o644}, 0, digest.FromString(""), digest.SHA512.FromString(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &Manifest{Resources: []Resource{dir, a, odd}}
+
+	var buf bytes.Buffer
+	if err := MarshalChecksums(&buf, m, digest.SHA256, "."); err != nil {
+		t.Fatal(err)
+	}
+	expected := digest.FromString("abc").Encoded() + "  dir/a\n" +
+		digest.FromString("abc").Encoded() + "  dir/b\n" +
+		"\\" + digest.FromString("").Encoded() + "  odd\\\\name\n"
+	if buf.String() != expected {
+		t.Fatalf("unexpected checksums:\n%s", buf.String())
+	}
+
+	if err := MarshalChecksums(&buf, m, digest.SHA512, "."); err == nil {
+		t.Fatal("expected files without a digest of the algorithm to fail")
+	}
+
+	buf.Reset()
+	if err := MarshalHashdeep(&buf, m, "/root"); err != nil {
+		t.Fatal(err)
+	}
+	expected = "%%%% HASHDEEP-1.0\n%%%% size,sha256,filename\n## Written by continuity\n##\n" +
+		"3," + digest.FromString("abc").Encoded() + ",/root/dir/a\n" +
+		"3," + digest.FromString("abc").Encoded() + ",/root/dir/b\n" +
+		"0," + digest.FromString("").Encoded() + ",/root/odd\\name\n"
+	if buf.String() != expected {
+		t.Fatalf("unexpected hashdeep records:\n%s", buf.String())
+	}
+}
+
+func TestMarshalIMA(t *testing.T) {
+	base := resource{paths: []string{"/a", "/b"}, mode: 0o644}
+	rf, err := newRegularFile(base, base.paths, 1, digest.FromString("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := newDirectory(resource{paths: []string{"/"}, mode: os.ModeDir | 0o755})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := MarshalIMA(&buf, &Manifest{Resources: []Resource{dir, rf}}, "/usr/bin"); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "10 6444a311ade0f1901a30bd1ed7a1f076755e416c ima-ng sha256:ca978112ca1bbdcafac231b39a23dc4da786eff8147c4e72b9807785afee48bb /usr/bin/a\n"
+	if lines := strings.SplitAfter(buf.String(), "\n"); len(lines) != 3 || lines[0] != expected || !strings.HasSuffix(lines[1], " /usr/bin/b\n") {
+		t.Fatalf("unexpected IMA records:\n%s", buf.String())
+	}
+}
+
+func TestInTotoStatement(t *testing.T) {
+	base := resource{paths: []string{"/a", "/b"}, mode: 0o644}
+	rf, err := newRegularFile(base, base.paths, 1, digest.FromString("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := &Manifest{Resources: []Resource{rf}}
+	statement, err := NewInTotoStatement(m, "manifest.pb")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(statement.Subject) != 3 {
+		t.Fatalf("expected 3 subjects, got %v", statement.Subject)
+	}
+	if s := statement.Subject[0]; s.Name != "manifest.pb" || s.Digest["sha256"] != digest.FromBytes(p).Encoded() {
+		t.Fatalf("unexpected manifest subject: %v", s)
+	}
+	for i, name := range []string{"/a", "/b"} {
+		if s := statement.Subject[i+1]; s.Name != name || s.Digest["sha256"] != digest.FromString("a").Encoded() {
+			t.Fatalf("unexpected file subject: %v", s)
+		}
+	}
+}
+
+func TestSourceDateEpoch(t *testing.T) {
+	t.Setenv("SOURCE_DATE_EPOCH", "")
+	if _, ok, err := SourceDateEpoch(); ok || err != nil {
+		t.Fatalf("expected no time to be set, got %v, %v", ok, err)
+	}
+
+	t.Setenv("SOURCE_DATE_EPOCH", "invalid")
+	if _, _, err := SourceDateEpoch(); err == nil {
+		t.Fatal("expected an invalid time to fail")
+	}
+
+	t.Setenv("SOURCE_DATE_EPOCH", "1700000000")
+	epoch, ok, err := SourceDateEpoch()
+	if err != nil || !ok || !epoch.Equal(time.Unix(1700000000, 0)) {
+		t.Fatalf("unexpected time %v, %v, %v", epoch, ok, err)
+	}
+
+	doc, err := NewSPDXDocument(&Manifest{}, "manifest.pb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc.CreationInfo.Created != "2023-11-14T22:13:20Z" {
+		t.Fatalf("expected the document to be created at the epoch, got %s", doc.CreationInfo.Created)
+	}
+
+	var resources []Resource
+	for _, bt := range []time.Time{epoch.Add(-time.Hour), epoch.Add(time.Hour), {}} {
+		r, err := NewDirectory(fmt.Sprintf("/%d", len(resources)), Attributes{Mode: 0o755, BirthTime: bt})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resources = append(resources, r)
+	}
+	m, err := Transform(&Manifest{Resources: resources}, ClampTimes(epoch))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, expected := range []time.Time{epoch.Add(-time.Hour), epoch, {}} {
+		if bt := m.Resources[i].(BirthTimer).BirthTime(); !bt.Equal(expected) {
+			t.Errorf("expected %s to be created at %v, got %v", m.Resources[i].Path(), expected, bt)
+		}
+	}
+}
+
+func TestSPDXFiles(t *testing.T) {
+	base := resource{paths: []string{"/a", "/b"}, mode: 0o644}
+	rf, err := newRegularFile(base, base.paths, 1, digest.FromString("a"), digest.Digest("md5:0cc175b9c0f1b6a831c399e269772661"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := newDirectory(resource{paths: []string{"/c"}, mode: os.ModeDir | 0o755})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	doc, err := NewSPDXDocument(&Manifest{Resources: []Resource{rf, dir}}, "manifest.pb")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if doc.SPDXVersion != SPDXVersion || doc.Name != "manifest.pb" {
+		t.Fatalf("unexpected document: %+v", doc)
+	}
+	if len(doc.Files) != 2 {
+		t.Fatalf("expected 2 files, got %v", doc.Files)
+	}
+	for i, name := range []string{"./a", "./b"} {
+		f := doc.Files[i]
+		if f.FileName != name || f.SPDXID != fmt.Sprintf("SPDXRef-File-%d", i+1) {
+			t.Fatalf("unexpected file: %+v", f)
+		}
+		expected := []SPDXChecksum{{Algorithm: "SHA256", Value: digest.FromString("a").Encoded()}}
+		if !reflect.DeepEqual(f.Checksums, expected) {
+			t.Fatalf("unexpected checksums: %v", f.Checksums)
+		}
+	}
+}
+
+func TestBuildExclude(t *testing.T) {
+	root := t.TempDir()
+	for _, dir := range []string{"a/cache/x", "b", "logs"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, file := range []string{"a/cache/x/y", "a/z.log", "b/cache", "logs/keep"} {
+		if err := os.WriteFile(filepath.Join(root, file), []byte(file), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A path driver other than the local one makes the context walk
+	// through it, rather than reading directories itself.
+	type otherPathDriver struct{ pathdriver.PathDriver }
+
+	expected := []string{"/a", "/b", "/b/cache", "/logs", "/logs/keep"}
+	for _, pd := range []pathdriver.PathDriver{pathdriver.LocalPathDriver, otherPathDriver{pathdriver.LocalPathDriver}} {
+		ctx, err := NewContextWithOptions(root, ContextOptions{
+			PathDriver: pd,
+			Exclude:    []string{"*.log", "cache/", "logs/*/"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		m, err := BuildManifest(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var paths []string
+		for _, r := range m.Resources {
+			paths = append(paths, r.Path())
+		}
+		if !reflect.DeepEqual(paths, expected) {
+			t.Fatalf("expected %v, got %v", expected, paths)
+		}
+	}
+
+	if _, err := NewContextWithOptions(root, ContextOptions{Exclude: []string{"["}}); err == nil {
+		t.Fatal("expected an invalid pattern to be rejected")
+	}
+}
+
+func TestBuildNDJSON(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "a/b"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []string{"a/b/c", "d"} {
+		if err := os.WriteFile(filepath.Join(root, file), []byte(file), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Link(filepath.Join(root, "a/b/c"), filepath.Join(root, "e")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("d", filepath.Join(root, "f")); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, err := NewContext(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := BuildManifest(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	truncated, err := BuildNDJSON(ctx, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if truncated {
+		t.Fatal("expected the stream not to be truncated")
+	}
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != 6 {
+		t.Fatalf("expected a line for each path, got %q", lines)
+	}
+	for _, line := range lines {
+		if !json.Valid([]byte(line)) {
+			t.Fatalf("expected a JSON object, got %q", line)
+		}
+	}
+
+	m, err := ReadNDJSON(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !proto.Equal(ToProto(expected), ToProto(m)) {
+		t.Fatalf("expected %v, got %v", ToProto(expected), ToProto(m))
+	}
+
+	buf.Reset()
+	if err := MarshalNDJSON(&buf, expected); err != nil {
+		t.Fatal(err)
+	}
+	if m, err := ReadNDJSON(&buf); err != nil || !proto.Equal(ToProto(expected), ToProto(m)) {
+		t.Fatalf("manifest differs after a round trip: %v", err)
+	}
+
+	if _, err := ReadNDJSON(strings.NewReader("{\"path\": [\"/a\"]}\n{\"unknown\": 1}\n")); err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Fatalf("expected unknown fields to be rejected at their line, got %v", err)
+	}
+}
+
+func TestBuildHooks(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "a"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []string{"a/b", "c"} {
+		if err := os.WriteFile(filepath.Join(root, file), []byte(file), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx, err := NewContext(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var calls []string
+	hooks := func(name string, before error) BuildHooks {
+		return BuildHooks{
+			Before: func(Context) error {
+				calls = append(calls, "before "+name)
+				return before
+			},
+			After: func(_ Context, stats BuildStats, err error) error {
+				calls = append(calls, fmt.Sprintf("after %s %d %d %v", name, stats.Entries, stats.Bytes, err != nil))
+				return nil
+			},
+		}
+	}
+
+	if _, err := BuildManifest(ctx, WithHooks(hooks("x", nil)), WithHooks(hooks("y", nil))); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"before x", "before y", "after y 3 4 false", "after x 3 4 false"}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Fatalf("expected %q, got %q", expected, calls)
+	}
+
+	// The hooks whose Before succeeded are still called after, with the
+	// error, when a later Before fails.
+	calls = nil
+	failed := errors.New("snapshot failed")
+	if _, err := BuildManifest(ctx, WithHooks(hooks("x", nil)), WithHooks(hooks("y", failed))); !errors.Is(err, failed) {
+		t.Fatalf("expected the hook error, got %v", err)
+	}
+	expected = []string{"before x", "before y", "after x 0 0 true"}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Fatalf("expected %q, got %q", expected, calls)
+	}
+
+	if _, err := BuildManifest(ctx, WithHooks(BuildHooks{
+		After: func(Context, BuildStats, error) error { return failed },
+	})); !errors.Is(err, failed) {
+		t.Fatalf("expected the hook error, got %v", err)
+	}
+}
+
+// copySnapshotter snapshots trees by copying them, for tests.
+type copySnapshotter struct {
+	dir      string
+	released bool
+}
+
+func (s *copySnapshotter) Snapshot(root string) (string, func() error, error) {
+	snapshot := filepath.Join(s.dir, "snapshot")
+	if err := fs.CopyDir(snapshot, root); err != nil {
+		return "", nil, err
+	}
+	return snapshot, func() error {
+		s.released = true
+		return os.RemoveAll(snapshot)
+	}, nil
+}
+
+func TestBuildFromSnapshot(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "a"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "a/b"), []byte("b"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &copySnapshotter{dir: t.TempDir()}
+	m, err := BuildFromSnapshot(root, s, ContextOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.released {
+		t.Fatal("expected the snapshot to be released")
+	}
+
+	ctx, err := NewContext(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyManifest(ctx, m); err != nil {
+		t.Fatalf("expected the manifest of the snapshot to match the tree: %v", err)
+	}
+}
+
+// memorySink stores the content of files in memory, for tests.
+type memorySink struct {
+	committed map[string][]byte
+	discarded int
+}
+
+func (s *memorySink) Writer(p string) (ContentWriter, error) {
+	return &memoryWriter{sink: s, path: p}, nil
+}
+
+type memoryWriter struct {
+	bytes.Buffer
+	sink      *memorySink
+	path      string
+	committed bool
+}
+
+func (w *memoryWriter) Commit(dgst digest.Digest, size int64) error {
+	if digest.FromBytes(w.Bytes()) != dgst || int64(w.Len()) != size {
+		return fmt.Errorf("content of %s does not match %s", w.path, dgst)
+	}
+	w.sink.committed[w.path] = w.Bytes()
+	w.committed = true
+	return nil
+}
+
+func (w *memoryWriter) Close() error {
+	if !w.committed {
+		w.sink.discarded++
+	}
+	return nil
+}
+
+func TestBuildSink(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "a"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []string{"a/b", "c"} {
+		if err := os.WriteFile(filepath.Join(root, file), []byte("content of "+file), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sink := &memorySink{committed: map[string][]byte{}}
+	ctx, err := NewContextWithOptions(root, ContextOptions{Sink: sink})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := BuildManifest(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string][]byte{
+		"/a/b": []byte("content of a/b"),
+		"/c":   []byte("content of c"),
+	}
+	if !reflect.DeepEqual(sink.committed, expected) || sink.discarded != 0 {
+		t.Fatalf("expected %q, got %q and %d discarded", expected, sink.committed, sink.discarded)
+	}
+
+	// Verifying does not store content.
+	sink.committed = map[string][]byte{}
+	if err := VerifyManifest(ctx, m); err != nil {
+		t.Fatal(err)
+	}
+	if len(sink.committed) != 0 {
+		t.Fatalf("expected no content to be stored, got %q", sink.committed)
+	}
+}
+
+func TestBuildLimits(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "a/b/c"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []string{"a/b/c/d", "a/e", "f"} {
+		if err := os.WriteFile(filepath.Join(root, file), []byte(file), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, err := NewContext(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		limits   Limits
+		expected []string
+	}{
+		{
+			name:   "Depth",
+			limits: Limits{MaxDepth: 2},
+		},
+		{
+			name:   "Entries",
+			limits: Limits{MaxEntries: 4},
+		},
+		{
+			name:     "TruncatedDepth",
+			limits:   Limits{MaxDepth: 2, Truncate: true},
+			expected: []string{"/a", "/a/b", "/a/e", "/f"},
+		},
+		{
+			name:     "TruncatedEntries",
+			limits:   Limits{MaxEntries: 4, Truncate: true},
+			expected: []string{"/a", "/a/b", "/a/b/c", "/a/b/c/d"},
+		},
+		{
+			name:   "FileSize",
+			limits: Limits{MaxFileSize: 5},
+		},
+		{
+			name:     "TruncatedFileSize",
+			limits:   Limits{MaxFileSize: 5, Truncate: true},
+			expected: []string{"/a", "/a/b", "/a/b/c", "/a/e", "/f"},
+		},
+		{
+			name:     "Within",
+			limits:   Limits{MaxDepth: 4, MaxEntries: 6, MaxFileSize: 7},
+			expected: []string{"/a", "/a/b", "/a/b/c", "/a/b/c/d", "/a/e", "/f"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m, err := BuildManifest(ctx, WithLimits(tc.limits))
+			if tc.expected == nil {
+				if !errors.Is(err, ErrLimitExceeded) {
+					t.Fatalf("expected the limit to be exceeded, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var paths []string
+			for _, r := range m.Resources {
+				paths = append(paths, r.Path())
+			}
+			if !reflect.DeepEqual(paths, tc.expected) {
+				t.Fatalf("expected %v, got %v", tc.expected, paths)
+			}
+			if m.Header.Truncated != tc.limits.Truncate {
+				t.Fatalf("expected truncated to be %v", tc.limits.Truncate)
+			}
+
+			p, err := Marshal(m)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if decoded, err := Unmarshal(p); err != nil {
+				t.Fatal(err)
+			} else if decoded.Header.Truncated != m.Header.Truncated {
+				t.Fatal("expected truncation to be preserved")
+			}
+		})
+	}
+}
+
+func TestBuildFollowSymlinks(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "usr/lib"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "usr/lib/x"), []byte("x"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for link, target := range map[string]string{
+		"lib":      "usr/lib",
+		"abs":      "/usr/lib/x",
+		"loop":     ".",
+		"dangling": "nowhere",
+		"out":      "../usr/lib/x",
+	} {
+		if err := os.Symlink(target, filepath.Join(root, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	build := func(escape EscapePolicy) (map[string]os.FileMode, error) {
+		ctx, err := NewContextWithOptions(root, ContextOptions{FollowSymlinks: true, SymlinkEscape: escape})
+		if err != nil {
+			return nil, err
+		}
+		m, err := BuildManifest(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if err := VerifyManifest(ctx, m); err != nil {
+			return nil, err
+		}
+
+		types := map[string]os.FileMode{}
+		for _, r := range m.Resources {
+			types[r.Path()] = r.Mode().Type()
+		}
+		return types, nil
+	}
+
+	expected := map[string]os.FileMode{
+		"/abs":       0,
+		"/dangling":  os.ModeSymlink,
+		"/lib":       os.ModeDir,
+		"/lib/x":     0,
+		"/loop":      os.ModeDir,
+		"/out":       0,
+		"/usr":       os.ModeDir,
+		"/usr/lib":   os.ModeDir,
+		"/usr/lib/x": 0,
+	}
+	types, err := build(EscapeScope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(types, expected) {
+		t.Fatalf("expected %v, got %v", expected, types)
+	}
+
+	expected["/out"] = os.ModeSymlink
+	types, err = build(EscapeKeep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(types, expected) {
+		t.Fatalf("expected %v, got %v", expected, types)
+	}
+
+	if _, err := build(EscapeReject); err == nil {
+		t.Fatal("expected the link leading out of the root to be rejected")
+	}
+}
+
+func TestProgressFlush(t *testing.T) {
+	root := t.TempDir()
+	for _, name := range []string{"a", "b"} {
+		if err := os.WriteFile(filepath.Join(root, name), []byte("content"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The last progress is reported at the end, whatever the interval.
+	var updates progressRecorder
+	ctx, err := NewContextWithOptions(root, ContextOptions{Progress: &updates, ProgressInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := BuildManifest(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last := updates[len(updates)-1]; last.Entries != 2 || last.Bytes != 14 {
+		t.Fatalf("expected the last progress to be flushed, got %+v", updates)
+	}
+
+	dst := t.TempDir()
+	updates = nil
+	ctx, err = NewContextWithOptions(dst, ContextOptions{
+		Progress:         &updates,
+		ProgressInterval: time.Hour,
+		Provider:         testutil.MapProvider{digest.FromString("content"): []byte("content")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ApplyManifest(ctx, m); err != nil {
+		t.Fatal(err)
+	}
+	if last := updates[len(updates)-1]; last.Entries != 2 || last.Written != 14 {
+		t.Fatalf("expected the last progress to be flushed, got %+v", updates)
+	}
+}
+
+func TestBuildJournal(t *testing.T) {
+	root := t.TempDir()
+	for _, name := range []string{"a", "b"} {
+		if err := os.WriteFile(filepath.Join(root, name), []byte(name), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, err := NewContext(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Leave a journal behind as an interrupted build would, with a digest
+	// for "a" that can only come from the journal.
+	path := filepath.Join(t.TempDir(), "journal")
+	journaled := digest.FromString("journaled")
+	interrupt := func() {
+		config, err := journalConfig(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		j, err := openJournal(path, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fi, err := os.Lstat(filepath.Join(root, "a"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := ctx.Resource("/a", fi)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err = newRegularFile(r.(*regularFile).resource, r.(RegularFile).Paths(), fi.Size(), journaled)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := j.record("/a", fi, r); err != nil {
+			t.Fatal(err)
+		}
+		if err := j.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	build := func(ctx Context) digest.Digest {
+		m, err := BuildManifest(ctx, WithJournal(path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Fatalf("expected journal to be removed after the build, got %v", err)
+		}
+		if dgsts := m.Resources[1].(RegularFile).Digests(); len(dgsts) != 1 || dgsts[0] != digest.FromString("b") {
+			t.Fatalf("unexpected digests for /b: %v", dgsts)
+		}
+		return m.Resources[0].(RegularFile).Digests()[0]
+	}
+
+	interrupt()
+	if dgst := build(ctx); dgst != journaled {
+		t.Fatalf("expected the journaled digest, got %v", dgst)
+	}
+
+	// Files whose status changed since are digested again, even if their
+	// modification time did not change.
+	interrupt()
+	time.Sleep(10 * time.Millisecond)
+	if err := os.Chmod(filepath.Join(root, "a"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if dgst := build(ctx); dgst != digest.FromString("a") {
+		t.Fatalf("expected the changed file to be digested again, got %v", dgst)
+	}
+
+	// Builds with another configuration do not reuse the journal.
+	interrupt()
+	other, err := NewContextWithOptions(root, ContextOptions{FollowSymlinks: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dgst := build(other); dgst != digest.FromString("a") {
+		t.Fatalf("expected the journal of another configuration to be ignored, got %v", dgst)
+	}
+}
+
+func TestPlan(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	for _, root := range []string{src, dst} {
+		if err := os.WriteFile(filepath.Join(root, "a"), []byte("a"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Chmod(filepath.Join(src, "a"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(src, "d"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("a", filepath.Join(src, "l")); err != nil {
+		t.Fatal(err)
+	}
+
+	srcCtx, err := NewContext(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := BuildManifest(srcCtx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dstCtx, err := NewContext(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changes, err := Plan(dstCtx, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var kinds []string
+	for _, change := range changes {
+		kinds = append(kinds, string(change.Kind)+" "+change.Path)
+	}
+	expected := []string{"chmod /a", "create /d", "create /l"}
+	if strings.Join(kinds, ", ") != strings.Join(expected, ", ") {
+		t.Fatalf("expected changes %v, got %v", expected, changes)
+	}
+
+	if _, err := os.Lstat(filepath.Join(dst, "d")); !os.IsNotExist(err) {
+		t.Fatalf("expected plan to leave the root untouched, got %v", err)
+	}
+}
+
+func TestPlanWithoutProvider(t *testing.T) {
+	attrs := Attributes{Mode: 0o644, UID: int64(os.Getuid()), GID: int64(os.Getgid())}
+	must := mustResource(t)
+	m := &Manifest{Resources: []Resource{
+		must(NewRegularFile([]string{"/a"}, attrs, 1, digest.FromString("a"))),
+	}}
+
+	dst := t.TempDir()
+	ctx, err := NewContext(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changes, err := Plan(ctx, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 || changes[0].Kind != ChangeWrite || changes[0].Path != "/a" {
+		t.Fatalf("expected a write of /a, got %v", changes)
+	}
+
+	if _, err := os.Lstat(filepath.Join(dst, "a")); !os.IsNotExist(err) {
+		t.Fatalf("expected plan to leave the root untouched, got %v", err)
+	}
+}
+
+// typedDriver is a driver that supports typed symlinks and file attributes,
+// without making any change.
+type typedDriver struct {
+	driverpkg.Driver
+}
+
+func (typedDriver) CreateSymlink(target, path string, dir bool) error {
+	return errors.New("unexpected symlink")
+}
+
+func (typedDriver) SetFileAttributes(path string, attrs uint32) error {
+	return errors.New("unexpected file attributes")
+}
+
+func TestPlanOptionalDrivers(t *testing.T) {
+	dir, err := newDirectory(resource{
+		paths:          []string{"/d"},
+		mode:           os.ModeDir | 0o755,
+		uid:            int64(os.Getuid()),
+		gid:            int64(os.Getgid()),
+		fileAttributes: FileAttributeHidden,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	link, err := newSymLink(resource{
+		paths: []string{"/l"},
+		mode:  os.ModeSymlink | 0o777,
+		uid:   int64(os.Getuid()),
+		gid:   int64(os.Getgid()),
+	}, "d", SymlinkTypeDirectory)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, err := NewContextWithOptions(t.TempDir(), ContextOptions{Driver: typedDriver{driverpkg.LocalDriver}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	changes, err := Plan(ctx, &Manifest{Resources: []Resource{dir, link}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, change := range changes {
+		got = append(got, fmt.Sprintf("%s %s: %s", change.Kind, change.Path, change.Detail))
+	}
+	expected := []string{
+		"create /d: directory, drwxr-xr-x",
+		"attributes /d: 0x0 to 0x2",
+		"create /l: directory symlink to d",
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected changes %q, got %q", expected, got)
+	}
+}
+
+func TestApplyManifestLazy(t *testing.T) {
+	src := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(src, "d"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []string{"a", "d/b"} {
+		if err := os.WriteFile(filepath.Join(src, file), []byte("content of "+file), 0o640); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Link(filepath.Join(src, "a"), filepath.Join(src, "c")); err != nil {
+		t.Fatal(err)
+	}
+	srcCtx, err := NewContext(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := BuildManifest(srcCtx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root := t.TempDir()
+	ctx, err := NewContextWithOptions(root, ContextOptions{Provider: testutil.MapProvider{
+		digest.FromString("content of a"):   []byte("content of a"),
+		digest.FromString("content of d/b"): []byte("content of d/b"),
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree, err := ApplyManifestLazy(ctx, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if pending := tree.Pending(); !reflect.DeepEqual(pending, []string{"/a", "/d/b"}) {
+		t.Fatalf("expected the files to be pending, got %v", pending)
+	}
+	if fi, err := os.Stat(filepath.Join(root, "d/b")); err != nil || fi.Size() != int64(len("content of d/b")) || fi.Mode().Perm() != 0o200 {
+		t.Fatalf("expected a write-only file of the size, got %v, %v", fi, err)
+	}
+
+	// Fetching through a hardlink fills in every path.
+	if err := tree.Fetch("/c"); err != nil {
+		t.Fatal(err)
+	}
+	if p, err := os.ReadFile(filepath.Join(root, "a")); err != nil || string(p) != "content of a" {
+		t.Fatalf("expected the content to be fetched, got %q, %v", p, err)
+	}
+	if fi, err := os.Stat(filepath.Join(root, "a")); err != nil || fi.Mode().Perm() != 0o640 {
+		t.Fatalf("expected the mode of the file to be applied, got %v, %v", fi, err)
+	}
+	if pending := tree.Pending(); !reflect.DeepEqual(pending, []string{"/d/b"}) {
+		t.Fatalf("expected a file to be pending, got %v", pending)
+	}
+
+	if err := tree.FetchAll(); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyManifest(ctx, m); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestApplyModes(t *testing.T) {
+	dir, err := NewDirectory("/d", Attributes{UID: int64(os.Getuid()), GID: int64(os.Getgid()), Mode: os.ModeDir | 0o555})
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := NewRegularFile([]string{"/d/f"}, Attributes{UID: int64(os.Getuid()), GID: int64(os.Getgid()), Mode: 0o666}, 1, digest.FromString("f"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &Manifest{Resources: []Resource{dir, file}}
+	provider := testutil.MapProvider{digest.FromString("f"): []byte("f")}
+
+	for _, tc := range []struct {
+		mask     os.FileMode
+		dirMode  os.FileMode
+		fileMode os.FileMode
+	}{
+		{dirMode: 0o555, fileMode: 0o666},
+		{mask: 0o022, dirMode: 0o555, fileMode: 0o644},
+		{mask: 0o027, dirMode: 0o550, fileMode: 0o640},
+	} {
+		root := t.TempDir()
+		ctx, err := NewContextWithOptions(root, ContextOptions{Provider: provider, ModeMask: tc.mask})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ApplyManifest(ctx, m); err != nil {
+			t.Fatalf("mask %o: %v", tc.mask, err)
+		}
+		// Let the temporary directory be removed.
+		defer os.Chmod(filepath.Join(root, "d"), 0o755)
+
+		for p, expected := range map[string]os.FileMode{"d": tc.dirMode, "d/f": tc.fileMode} {
+			if fi, err := os.Stat(filepath.Join(root, p)); err != nil || fi.Mode().Perm() != expected {
+				t.Errorf("mask %o: expected %s to have mode %o, got %v, %v", tc.mask, p, expected, fi, err)
+			}
+		}
+		if err := VerifyManifest(ctx, m); err != nil {
+			t.Errorf("mask %o: %v", tc.mask, err)
+		}
+	}
+}
+
+func TestApplyOrder(t *testing.T) {
+	attrs := Attributes{UID: int64(os.Getuid()), GID: int64(os.Getgid()), Mode: os.ModeDir | 0o755}
+	a, err := NewDirectory("/a", attrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	z, err := NewDirectory("/z", attrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zy, err := NewDirectory("/z/y", attrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	attrs.Mode = 0o644
+	linked, err := NewRegularFile([]string{"/a/f", "/z/y/g"}, attrs, 1, digest.FromString("f"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := NewRegularFile([]string{"/b"}, attrs, 1, digest.FromString("f"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The resources are given out of order, with the hardlinked file sorting
+	// before the directories holding its links.
+	m := &Manifest{Resources: []Resource{zy, linked, file, z, a}}
+	var order []string
+	for _, r := range applyOrder(m.Resources) {
+		order = append(order, r.Path())
+	}
+	if expected := []string{"/a", "/b", "/z", "/z/y", "/a/f"}; !reflect.DeepEqual(order, expected) {
+		t.Fatalf("expected order %v, got %v", expected, order)
+	}
+
+	root := t.TempDir()
+	ctx, err := NewContextWithOptions(root, ContextOptions{Provider: testutil.MapProvider{digest.FromString("f"): []byte("f")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ApplyManifest(ctx, m); err != nil {
+		t.Fatal(err)
+	}
+	fi1, err := os.Stat(filepath.Join(root, "a/f"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi2, err := os.Stat(filepath.Join(root, "z/y/g"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(fi1, fi2) {
+		t.Fatal("expected the paths of the file to be linked")
+	}
+}
+
+func TestApplyConcurrency(t *testing.T) {
+	src := t.TempDir()
+	provider := testutil.MapProvider{}
+	for i := 0; i < 4; i++ {
+		dir := filepath.Join(src, fmt.Sprintf("d%d", i), "e")
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+		for j := 0; j < 8; j++ {
+			content := fmt.Sprintf("content %d/%d", i, j)
+			if err := os.WriteFile(filepath.Join(dir, fmt.Sprint(j)), []byte(content), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			provider[digest.FromString(content)] = []byte(content)
+		}
+	}
+	if err := os.Link(filepath.Join(src, "d0/e/0"), filepath.Join(src, "d3/e/link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Join(src, "d1/e"), 0o555); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(filepath.Join(src, "d1/e"), 0o755)
+
+	srcCtx, err := NewContext(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := BuildManifest(srcCtx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root := t.TempDir()
+	ctx, err := NewContextWithOptions(root, ContextOptions{Provider: provider})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ApplyManifest(ctx, m, WithApplyConcurrency(4)); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(filepath.Join(root, "d1/e"), 0o755)
+	if err := VerifyManifest(ctx, m); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without content for a file, the apply fails with its error.
+	delete(provider, digest.FromString("content 2/3"))
+	ctx, err = NewContextWithOptions(t.TempDir(), ContextOptions{Provider: provider})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ApplyManifest(ctx, m, WithApplyConcurrency(4)); err == nil || !strings.Contains(err.Error(), "d2/e/3") {
+		t.Fatalf("expected the file without content to fail, got %v", err)
+	}
+
+	if err := ApplyManifest(ctx, m, WithApplyConcurrency(0)); err == nil {
+		t.Fatal("expected an invalid concurrency to be rejected")
+	}
+}
+
+func TestApplyProgress(t *testing.T) {
+	attrs := Attributes{UID: int64(os.Getuid()), GID: int64(os.Getgid()), Mode: 0o644}
+	var resources []Resource
+	for _, p := range []string{"/a", "/b"} {
+		r, err := NewRegularFile([]string{p}, attrs, 7, digest.FromString("content"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resources = append(resources, r)
+	}
+
+	var updates progressRecorder
+	ctx, err := NewContextWithOptions(t.TempDir(), ContextOptions{
+		Progress: &updates,
+		Provider: testutil.MapProvider{digest.FromString("content"): []byte("content")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ApplyManifest(ctx, &Manifest{Resources: resources}); err != nil {
+		t.Fatal(err)
+	}
+
+	last := updates[len(updates)-1]
+	last.Elapsed = 0
+	if expected := (ProgressUpdate{Entries: 2, Bytes: 14, Written: 14, Path: "/b", TotalEntries: 2, TotalBytes: 14}); last != expected {
+		t.Fatalf("expected last update %+v, got %+v", expected, last)
+	}
+	if remaining, ok := last.Remaining(); !ok || remaining != 0 {
+		t.Fatalf("expected no time to remain, got %v, %v", remaining, ok)
+	}
+}
+
+func TestApplyManifestAtomic(t *testing.T) {
+	src, parent := t.TempDir(), t.TempDir()
+	if err := os.WriteFile(filepath.Join(src, "a"), []byte("a"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(src, "d"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	srcCtx, err := NewContext(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := BuildManifest(srcCtx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root := filepath.Join(parent, "root")
+	if err := os.Mkdir(root, 0o750); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "old"), []byte("old"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	options := ContextOptions{Provider: testutil.MapProvider{digest.FromString("a"): []byte("a")}}
+	if err := ApplyManifestAtomic(root, m, options); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, err := NewContext(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyManifest(ctx, m); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(filepath.Join(root, "old")); !os.IsNotExist(err) {
+		t.Fatalf("expected previous contents to be gone, got %v", err)
+	}
+	fi, err := os.Stat(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0o750 {
+		t.Fatalf("expected root mode to be kept, got %v", fi.Mode())
+	}
+
+	entries, err := os.ReadDir(parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected staging directories to be removed, got %v", entries)
+	}
+
+	options.Driver = driverpkg.LocalDriver
+	if err := ApplyManifestAtomic(root, m, options); err != nil {
+		t.Fatalf("expected the local driver to be accepted, got %v", err)
+	}
+
+	options.Driver = &opsDriver{Driver: driverpkg.LocalDriver}
+	if err := ApplyManifestAtomic(root, m, options); !errors.Is(err, ErrNotSupported) {
+		t.Fatalf("expected drivers other than the local one to be rejected, got %v", err)
+	}
+}
+
+func TestApplyManifestRollback(t *testing.T) {
+	src, parent := t.TempDir(), t.TempDir()
+	for _, name := range []string{"a", "b", "c"} {
+		if err := os.WriteFile(filepath.Join(src, name), []byte(name), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	srcCtx, err := NewContext(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := BuildManifest(srcCtx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root := filepath.Join(parent, "root")
+	if err := os.Mkdir(root, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "a"), []byte("old"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The content of "c" is missing, so the apply fails after changing "a"
+	// and creating "b".
+	ctx, err := NewContextWithOptions(root, ContextOptions{
+		Provider: testutil.MapProvider{
+			digest.FromString("a"): []byte("a"),
+			digest.FromString("b"): []byte("b"),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ApplyManifest(ctx, m, WithRollback()); err == nil {
+		t.Fatal("expected apply to fail")
+	}
+
+	p, err := os.ReadFile(filepath.Join(root, "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Lstat(filepath.Join(root, "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(p) != "old" || fi.Mode().Perm() != 0o644 {
+		t.Fatalf("expected %q to be restored, got %q with mode %v", "a", p, fi.Mode())
+	}
+	if _, err := os.Lstat(filepath.Join(root, "b")); !os.IsNotExist(err) {
+		t.Fatalf("expected %q to be removed, got %v", "b", err)
+	}
+
+	entries, err := os.ReadDir(parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected backups to be removed, got %v", entries)
+	}
+}
+
+func TestUndoLogRecordsChangedFiles(t *testing.T) {
+	root := t.TempDir()
+	for _, name := range []string{"a", "b"} {
+		if err := os.WriteFile(filepath.Join(root, name), []byte(name), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	attrs := Attributes{Mode: 0o644, UID: int64(os.Getuid()), GID: int64(os.Getgid())}
+	must := mustResource(t)
+	resources := []Resource{
+		must(NewRegularFile([]string{"/a"}, attrs, 1, digest.FromString("a"))),
+		must(NewRegularFile([]string{"/b"}, attrs, 3, digest.FromString("new"))),
+		must(NewRegularFile([]string{"/c"}, attrs, 1, digest.FromString("c"))),
+	}
+
+	ctx, err := NewContext(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	undo, err := newUndoLog(ctx.(*context))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer undo.Close()
+
+	for _, resource := range resources {
+		if err := undo.record(resource); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var recorded []string
+	for _, entry := range undo.entries {
+		recorded = append(recorded, filepath.Base(entry.fp))
+	}
+	if strings.Join(recorded, ",") != "b,c" {
+		t.Fatalf("expected only the changed files to be recorded, got %v", recorded)
+	}
+}
+
+func TestRepair(t *testing.T) {
+	root := t.TempDir()
+	for _, name := range []string{"a", "b", "c", "e"} {
+		if err := os.WriteFile(filepath.Join(root, name), []byte(name), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Link(filepath.Join(root, "c"), filepath.Join(root, "d")); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, err := NewContextWithOptions(root, ContextOptions{
+		Provider: testutil.MapProvider{digest.FromString("b"): []byte("b")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := BuildManifest(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Drift the mode of "a", the content of "b" and the link of "d".
+	if err := os.Chmod(filepath.Join(root, "a"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "b"), []byte("x"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(root, "d")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "d"), []byte("c"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	before, err := os.Lstat(filepath.Join(root, "e"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changes, err := Repair(ctx, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var kinds []string
+	for _, change := range changes {
+		kinds = append(kinds, string(change.Kind)+" "+change.Path)
+	}
+	expected := []string{"chmod /a", "write /b", "remove /d", "link /d"}
+	if strings.Join(kinds, ", ") != strings.Join(expected, ", ") {
+		t.Fatalf("expected changes %v, got %v", expected, changes)
+	}
+
+	if err := VerifyManifest(ctx, m); err != nil {
+		t.Fatal(err)
+	}
+	after, err := os.Lstat(filepath.Join(root, "e"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(before, after) || !before.ModTime().Equal(after.ModTime()) {
+		t.Fatal("expected untouched files to be left alone")
+	}
+}
+
+func TestVerifySampling(t *testing.T) {
+	root := t.TempDir()
+	for i := 0; i < 100; i++ {
+		if err := os.WriteFile(filepath.Join(root, fmt.Sprint(i)), []byte("a"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, err := NewContext(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := BuildManifest(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Corrupt every file without changing its metadata.
+	for i := 0; i < 100; i++ {
+		p := filepath.Join(root, fmt.Sprint(i))
+		fi, err := os.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte("b"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(p, fi.ModTime(), fi.ModTime()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var report VerifyReport
+	if err := VerifyManifest(ctx, m, WithSampling(0, 1), WithVerifyReport(&report)); err != nil {
+		t.Fatalf("expected metadata-only verification to pass: %v", err)
+	}
+	if report.Resources != 100 || report.ContentVerified != 0 || *report.Sampling != (Sampling{Percent: 0, Seed: 1}) {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+
+	if err := VerifyManifest(ctx, m, WithSampling(10, 1), WithVerifyReport(&report)); err == nil {
+		t.Fatal("expected sampled verification to catch a corrupted file")
+	}
+	if report.ContentVerified != 1 {
+		t.Fatalf("expected to stop at the first sampled file, got %+v", report)
+	}
+
+	// The same seed picks the same files.
+	var picked []string
+	for _, seed := range []int64{1, 1, 2} {
+		s := &Sampling{Percent: 10, Seed: seed}
+		var sample []string
+		for _, r := range m.Resources {
+			if s.includes(r.Path()) {
+				sample = append(sample, r.Path())
+			}
+		}
+		picked = append(picked, strings.Join(sample, ","))
+	}
+	if picked[0] != picked[1] || picked[0] == picked[2] {
+		t.Fatalf("expected samples to depend only on the seed: %q", picked)
+	}
+}
+
+func TestVerifyConcurrency(t *testing.T) {
+	root := t.TempDir()
+	for i := 0; i < 50; i++ {
+		if err := os.WriteFile(filepath.Join(root, fmt.Sprintf("%02d", i)), []byte("a"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, err := NewContext(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := BuildManifest(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var report VerifyReport
+	if err := VerifyManifest(ctx, m, WithConcurrency(8), WithVerifyReport(&report)); err != nil {
+		t.Fatal(err)
+	}
+	if report.Resources != 50 || report.ContentVerified != 50 {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+
+	for _, name := range []string{"30", "40"} {
+		if err := os.WriteFile(filepath.Join(root, name), []byte("b"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = VerifyManifest(ctx, m, WithConcurrency(8))
+	if err == nil || !strings.Contains(err.Error(), `"/30"`) {
+		t.Fatalf("expected the first corrupted file to be reported, got %v", err)
+	}
+}
+
+// opsDriver records the names of the changes made through it.
+type opsDriver struct {
+	driverpkg.Driver
+	ops []string
+}
+
+func (d *opsDriver) OpenFile(path string, flag int, perm os.FileMode) (driverpkg.File, error) {
+	if flag&os.O_CREATE != 0 {
+		d.ops = append(d.ops, "create")
+	}
+	return d.Driver.OpenFile(path, flag, perm)
+}
+
+func (d *opsDriver) Rename(oldpath, newpath string) error {
+	d.ops = append(d.ops, "rename "+filepath.Base(newpath))
+	return d.Driver.(driverpkg.RenameDriver).Rename(oldpath, newpath)
+}
+
+func (d *opsDriver) Lchmod(path string, mode os.FileMode) error {
+	d.ops = append(d.ops, "chmod "+filepath.Base(path))
+	return d.Driver.Lchmod(path, mode)
+}
+
+func TestApplyThroughDriver(t *testing.T) {
+	src := t.TempDir()
+	if err := os.WriteFile(filepath.Join(src, "a"), []byte("a"), 0o640); err != nil {
+		t.Fatal(err)
+	}
+	// Without xattr support in the driver, no xattrs are recorded.
+	srcCtx, err := NewContextWithOptions(src, ContextOptions{Driver: &opsDriver{Driver: driverpkg.LocalDriver}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := BuildManifest(srcCtx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := &opsDriver{Driver: driverpkg.LocalDriver}
+	root := t.TempDir()
+	ctx, err := NewContextWithOptions(root, ContextOptions{
+		Driver:   d,
+		Provider: testutil.MapProvider{digest.FromString("a"): []byte("a")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ApplyManifest(ctx, m); err != nil {
+		t.Fatal(err)
+	}
+
+	// The content is written to a temporary file, which replaces the file.
+	if len(d.ops) < 3 || d.ops[0] != "create" || !strings.HasPrefix(d.ops[1], "chmod .tmp-a-") || d.ops[2] != "rename a" {
+		t.Fatalf("unexpected operations: %v", d.ops)
+	}
+	if err := VerifyManifest(ctx, m); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestManifestHeader(t *testing.T) {
+	attrs := Attributes{Mode: 0o644, XAttrs: map[string][]byte{"user.a": []byte("b")}}
+	a, err := NewRegularFile([]string{"/a"}, attrs, 1, digest.FromString("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewRegularFile([]string{"/b"}, Attributes{Mode: 0o644}, 1, digest.SHA512.FromString("b"), digest.FromString("b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := Marshal(&Manifest{Resources: []Resource{a, b}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := Unmarshal(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := m.Header
+	if h.Version != ManifestVersion || !h.XAttrs || h.Timestamps {
+		t.Fatalf("unexpected header %+v", h)
+	}
+	if fmt.Sprint(h.DigestAlgorithms) != "[sha256 sha512]" {
+		t.Fatalf("unexpected digest algorithms %v", h.DigestAlgorithms)
+	}
+
+	c, err := NewRegularFile([]string{"/c"}, Attributes{Mode: 0o644, BirthTime: time.Unix(1, 0)}, 1, digest.FromString("c"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p, err = Marshal(&Manifest{Resources: []Resource{a, c}}); err != nil {
+		t.Fatal(err)
+	}
+	if m, err = Unmarshal(p); err != nil {
+		t.Fatal(err)
+	}
+	if !m.Header.Timestamps {
+		t.Fatalf("expected timestamps in the header %+v", m.Header)
+	}
+
+	bm := ToProto(m)
+	bm.Header.Version = ManifestVersion + 1
+	if _, err := FromProto(bm); !errors.Is(err, ErrNotSupported) {
+		t.Fatalf("expected a newer version to be rejected, got %v", err)
+	}
+}
+
+func TestManifestProvenance(t *testing.T) {
+	t.Setenv("SOURCE_DATE_EPOCH", "1700000000")
+	provenance, err := NewProvenance("/src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !provenance.BuildTime.Equal(time.Unix(1700000000, 0)) {
+		t.Fatalf("expected the build time to be clamped to the epoch, got %v", provenance.BuildTime)
+	}
+	if provenance.Builder == "" || provenance.Root != "/src" {
+		t.Fatalf("unexpected provenance %+v", provenance)
+	}
+	provenance.Labels = map[string]string{"org.example.release": "1.0"}
+
+	p, err := Marshal(&Manifest{Provenance: provenance})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := Unmarshal(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(m.Provenance, provenance) {
+		t.Fatalf("expected provenance %+v, got %+v", provenance, m.Provenance)
+	}
+
+	p, err = Marshal(&Manifest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m, err = Unmarshal(p); err != nil {
+		t.Fatal(err)
+	}
+	if m.Provenance != nil {
+		t.Fatalf("expected no provenance, got %+v", m.Provenance)
+	}
+}
+
+func TestUnknownFields(t *testing.T) {
+	// An extension, as a third party would number it.
+	extension := protowire.AppendTag(nil, 1000, protowire.BytesType)
+	extension = protowire.AppendString(extension, "extension")
+
+	dir, err := NewDirectory("/a", Attributes{Mode: 0o755})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bm := ToProto(&Manifest{Resources: []Resource{dir}, Provenance: &Provenance{Builder: "test"}})
+	for _, msg := range []proto.Message{bm, bm.Header, bm.Provenance, bm.Resource[0]} {
+		msg.ProtoReflect().SetUnknown(extension)
+	}
+	p, err := proto.Marshal(bm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := Unmarshal(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m, err = Transform(m, Annotate(func(Resource) map[string]string {
+		return map[string]string{"org.example.package": "example"}
+	})); err != nil {
+		t.Fatal(err)
+	}
+	if p, err = Marshal(m); err != nil {
+		t.Fatal(err)
+	}
+
+	var written pb.Manifest
+	if err := proto.Unmarshal(p, &written); err != nil {
+		t.Fatal(err)
+	}
+	if written.Resource[0].Annotations["org.example.package"] != "example" {
+		t.Fatalf("expected the resource to be annotated, got %v", written.Resource[0].Annotations)
+	}
+	for _, msg := range []proto.Message{&written, written.Header, written.Provenance, written.Resource[0]} {
+		if unknown := msg.ProtoReflect().GetUnknown(); !bytes.Equal(unknown, extension) {
+			t.Errorf("expected the extension of %T to be preserved, got %x", msg, unknown)
+		}
+	}
+}
+
+func TestManifestRoundTrip(t *testing.T) {
+	xattrs := map[string][]byte{"user.a": {0, 1, 0xff}}
+	resources := []Resource{
+		&regularFile{
+			resource: resource{
+				paths:        []string{"/a", "/b"},
+				mode:         os.ModeAppend | os.ModeSetgid | 0o640,
+				uid:          1000,
+				gid:          100,
+				xattrs:       xattrs,
+				projectID:    42,
+				verityDigest: digest.Digest("sha256:" + strings.Repeat("0", 64)),
+				unstable:     true,
+				annotations:  map[string]string{"org.example.package": "example"},
+			},
+			size:    1 << 40,
+			digests: []digest.Digest{digest.FromString("a")},
+		},
+		&directory{resource: resource{
+			paths: []string{"/dir"},
+			mode:  os.ModeDir | os.ModeSticky | 0o1777,
+			mount: &MountPoint{Type: "tmpfs", FSID: "2a", Subvolume: true},
+
+			fileAttributes: FileAttributeHidden | FileAttributeArchive,
+		}},
+		&symLink{
+			resource: resource{
+				paths:       []string{"/link"},
+				mode:        os.ModeSymlink | 0o777,
+				reparseTag:  ReparseTagSymlink,
+				reparseData: []byte{1, 2, 3},
+			},
+			target: "a",
+			typ:    SymlinkTypeFile,
+		},
+		&device{
+			resource: resource{paths: []string{"/null"}, mode: os.ModeDevice | os.ModeCharDevice | 0o666},
+			major:    1,
+			minor:    3,
+		},
+		&namedPipe{resource: resource{paths: []string{"/fifo"}, mode: os.ModeNamedPipe | 0o600}},
+	}
+	m := &Manifest{Resources: resources}
+	expected := ToProto(m)
+	if id := expected.Resource[0].ProjectId; id != 42 {
+		t.Fatalf("expected project id 42 in the proto, got %d", id)
+	}
+
+	p, err := Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromProto, err := Unmarshal(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err = MarshalJSON(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromJSON, err := UnmarshalJSON(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, decoded := range map[string]*Manifest{"proto": fromProto, "json": fromJSON} {
+		if !proto.Equal(expected, ToProto(decoded)) {
+			t.Fatalf("%s: manifest differs after a round trip", name)
+		}
+		for i, r := range decoded.Resources {
+			if r.Mode() != resources[i].Mode() {
+				t.Fatalf("%s: %s: mode %v != %v", name, r.Path(), r.Mode(), resources[i].Mode())
+			}
+		}
+		if id := decoded.Resources[0].(ProjectIDer).ProjectID(); id != 42 {
+			t.Fatalf("%s: expected project id 42, got %d", name, id)
+		}
+	}
+
+	if _, err := UnmarshalJSON([]byte(`{"resource": [], "unknown": 1}`)); err == nil {
+		t.Fatal("expected unknown fields to be rejected")
+	}
+}
+
+func TestSubtree(t *testing.T) {
+	root := t.TempDir()
+	for _, dir := range []string{"usr/lib/sub", "usr/bin"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"usr/lib/a", "usr/lib/sub/b", "usr/bin/c"} {
+		if err := os.WriteFile(filepath.Join(root, name), []byte(name), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Link(filepath.Join(root, "usr/lib/a"), filepath.Join(root, "usr/bin/a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("sub/b", filepath.Join(root, "usr/lib/link")); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, err := NewContext(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := BuildManifest(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Validate(m); err != nil {
+		t.Fatal(err)
+	}
+
+	sub, err := Subtree(m, "usr/lib")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Validate(sub); err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, r := range sub.Resources {
+		paths = append(paths, resourcePaths(r)...)
+	}
+	if fmt.Sprint(paths) != "[/a /link /sub /sub/b]" {
+		t.Fatalf("unexpected paths %v", paths)
+	}
+
+	subCtx, err := NewContext(filepath.Join(root, "usr/lib"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyManifest(subCtx, sub); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Subtree(m, "usr/lib/a"); err == nil {
+		t.Fatal("expected a file to be rejected as a subtree")
+	}
+	if _, err := Subtree(m, "usr/local"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected a missing subtree to be rejected, got %v", err)
+	}
+}
+
+func TestStats(t *testing.T) {
+	attrs := Attributes{Mode: 0o644}
+	must := mustResource(t)
+	resources := []Resource{
+		must(NewDirectory("/dir", attrs)),
+		must(NewRegularFile([]string{"/dir/a", "/dir/b"}, attrs, 10, digest.FromString("a"))),
+		must(NewRegularFile([]string{"/c"}, attrs, 10, digest.FromString("a"))),
+		must(NewRegularFile([]string{"/dir/d"}, attrs, 20, digest.FromString("d"))),
+		must(NewSymLink("/link", attrs, "c")),
+		must(NewNamedPipe([]string{"/fifo"}, attrs)),
+		must(NewDevice([]string{"/null"}, attrs, true, 1, 3)),
+	}
+
+	stats := Stats(&Manifest{Resources: resources})
+	if stats.Resources != 7 || stats.Paths != 8 || stats.Files != 4 || stats.Directories != 1 ||
+		stats.SymLinks != 1 || stats.NamedPipes != 1 || stats.Devices != 1 || stats.HardlinkGroups != 1 {
+		t.Fatalf("unexpected counts %+v", stats)
+	}
+	if stats.TotalSize != 40 || stats.UniqueSize != 30 {
+		t.Fatalf("unexpected sizes %d, %d", stats.TotalSize, stats.UniqueSize)
+	}
+	if stats.Largest[0].Path != "/dir/d" || len(stats.Largest) != 3 {
+		t.Fatalf("unexpected largest files %v", stats.Largest)
+	}
+	if fmt.Sprint(stats.Depths) != "[0 5 3]" {
+		t.Fatalf("unexpected depths %v", stats.Depths)
+	}
+}
+
+func TestFindDuplicates(t *testing.T) {
+	attrs := Attributes{Mode: 0o644}
+	must := mustResource(t)
+	resources := []Resource{
+		must(NewRegularFile([]string{"/a", "/b"}, attrs, 10, digest.FromString("a"))),
+		must(NewRegularFile([]string{"/c"}, attrs, 10, digest.FromString("a"))),
+		must(NewRegularFile([]string{"/d"}, attrs, 20, digest.FromString("d"))),
+		must(NewRegularFile([]string{"/e"}, attrs, 20, digest.SHA512.FromString("d"), digest.FromString("d"))),
+		must(NewRegularFile([]string{"/f"}, attrs, 20, digest.FromString("d"))),
+		must(NewRegularFile([]string{"/g"}, attrs, 5, digest.FromString("g"))),
+		must(NewRegularFile([]string{"/empty"}, attrs, 0, digest.FromString(""))),
+		must(NewRegularFile([]string{"/empty2"}, attrs, 0, digest.FromString(""))),
+	}
+
+	report := FindDuplicates(&Manifest{Resources: resources})
+	if report.TotalSize != 85 || report.UniqueSize != 35 || report.Savings != 50 || report.HardlinkSavings != 10 {
+		t.Fatalf("unexpected sizes %+v", report)
+	}
+	expected := []DuplicateContent{
+		{Digest: digest.FromString("d"), Size: 20, Files: [][]string{{"/d"}, {"/e"}, {"/f"}}},
+		{Digest: digest.FromString("a"), Size: 10, Files: [][]string{{"/a", "/b"}, {"/c"}}},
+	}
+	if !reflect.DeepEqual(report.Duplicates, expected) {
+		t.Fatalf("unexpected duplicates %v", report.Duplicates)
+	}
+}
+
+func TestDiskUsage(t *testing.T) {
+	must := mustResource(t)
+	resources := []Resource{
+		must(NewDirectory("/usr", Attributes{Mode: os.ModeDir | 0o755})),
+		must(NewRegularFile([]string{"/usr/a", "/b"}, Attributes{Mode: 0o644}, 10, digest.FromString("a"))),
+		must(NewRegularFile([]string{"/usr/lib/c"}, Attributes{UID: 1000, Mode: 0o644}, 20, digest.FromString("c"))),
+		must(NewRegularFile([]string{"/d"}, Attributes{Mode: 0o644}, 5, digest.FromString("d"))),
+		must(NewSymLink("/link", Attributes{UID: 1000, Mode: os.ModeSymlink | 0o777}, "d")),
+	}
+	m := &Manifest{Resources: resources}
+
+	for _, tc := range []struct {
+		by       UsageBy
+		expected []Usage
+	}{
+		{UsageByDirectory, []Usage{{Key: "/usr", Size: 30, Resources: 3}, {Key: "/", Size: 5, Resources: 2}}},
+		{UsageByOwner, []Usage{{Key: "1000", Size: 20, Resources: 2}, {Key: "0", Size: 15, Resources: 3}}},
+		{UsageByType, []Usage{{Key: "regular", Size: 35, Resources: 3}, {Key: "directory", Resources: 1}, {Key: "symlink", Resources: 1}}},
+	} {
+		usage, err := DiskUsage(m, tc.by)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(usage, tc.expected) {
+			t.Errorf("unexpected usage by %d: %v", tc.by, usage)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	attrs := Attributes{Mode: 0o644}
+	must := mustResource(t)
+	dir := must(NewDirectory("/dir", attrs))
+	file := must(NewRegularFile([]string{"/dir/a", "/dir/b"}, attrs, 1, digest.FromString("a")))
+	link := must(NewSymLink("/link", attrs, "dir/a"))
+	whiteout := must(NewDevice([]string{"/removed"}, attrs, true, 0, 0))
+
+	if err := Validate(&Manifest{Resources: []Resource{dir, file, link, whiteout}}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		resources []Resource
+		expected  string
+	}{
+		{[]Resource{file, dir}, "not sorted"},
+		{[]Resource{dir, dir}, "more than once"},
+		{[]Resource{file}, "parent of \"/dir/a\" is not a directory"},
+		{[]Resource{must(NewDirectory("dir", attrs))}, "not absolute"},
+		{[]Resource{must(NewDirectory("/a/../b", attrs))}, "\"..\" component"},
+		{[]Resource{must(NewDirectory("/a/", attrs))}, "not clean"},
+		{[]Resource{must(NewSymLink("/l", attrs, ""))}, "no target"},
+		{[]Resource{must(NewDevice([]string{"/sda"}, attrs, false, 0, 0))}, "no device number"},
+		{[]Resource{must(NewRegularFile([]string{"/f"}, attrs, 1, digest.Digest("sha256:bad")))}, "invalid digest"},
+	} {
+		err := Validate(&Manifest{Resources: tc.resources})
+		if err == nil || !strings.Contains(err.Error(), tc.expected) {
+			t.Fatalf("expected an error containing %q, got %v", tc.expected, err)
+		}
+	}
+}
+
+func TestDuplicatePaths(t *testing.T) {
+	attrs := Attributes{Mode: 0o644}
+	first, err := NewRegularFile([]string{"/a"}, attrs, 1, digest.FromString("1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := NewDirectory("/b", Attributes{Mode: 0o755})
+	if err != nil {
+		t.Fatal(err)
+	}
+	last, err := NewRegularFile([]string{"/a"}, attrs, 2, digest.FromString("2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	linked, err := NewRegularFile([]string{"/b", "/c"}, attrs, 3, digest.FromString("3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := Marshal(&Manifest{Resources: []Resource{first, dir, last, linked}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Unmarshal(p); err == nil || !strings.Contains(err.Error(), "more than once") {
+		t.Fatalf("expected duplicates to be rejected, got %v", err)
+	}
+
+	describe := func(m *Manifest) string {
+		var s []string
+		for _, r := range m.Resources {
+			desc := fmt.Sprint(resourcePaths(r))
+			if rf, ok := r.(RegularFile); ok {
+				desc += fmt.Sprint(rf.Size())
+			}
+			s = append(s, desc)
+		}
+		return strings.Join(s, " ")
+	}
+	for policy, expected := range map[DuplicatePolicy]string{
+		DuplicatesFirstWins: "[/a]1 [/b] [/c]3",
+		DuplicatesLastWins:  "[/a]2 [/b /c]3",
+	} {
+		m, err := Unmarshal(p, WithDuplicates(policy))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual := describe(m); actual != expected {
+			t.Fatalf("policy %d: expected %s, got %s", policy, expected, actual)
+		}
+	}
+}
+
+func TestUnmarshalStrict(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "a/b"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "a/b/c"), []byte("c"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(filepath.Join(root, "a/b/c"), filepath.Join(root, "d")); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, err := NewContext(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := BuildManifest(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bm := ToProto(m)
+	p, err := proto.Marshal(bm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Unmarshal(p, WithStrict(StrictLimits{MaxEntries: 4, MaxPathLength: 6})); err != nil {
+		t.Fatalf("expected a built manifest to be accepted, got %v", err)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		limits   StrictLimits
+		modify   func(bm *pb.Manifest)
+		expected string
+	}{
+		{
+			name:     "entries",
+			limits:   StrictLimits{MaxEntries: 3},
+			expected: "more than 3 entries",
+		},
+		{
+			name:     "path length",
+			limits:   StrictLimits{MaxPathLength: 5},
+			expected: "longer than 5 bytes",
+		},
+		{
+			name: "unsorted",
+			modify: func(bm *pb.Manifest) {
+				bm.Resource[0], bm.Resource[1] = bm.Resource[1], bm.Resource[0]
+			},
+			expected: "not sorted",
+		},
+		{
+			name: "duplicate",
+			modify: func(bm *pb.Manifest) {
+				bm.Resource[0].Path = append(bm.Resource[0].Path, "/a/b")
+			},
+			expected: "more than once",
+		},
+		{
+			name: "digest",
+			modify: func(bm *pb.Manifest) {
+				bm.Resource[2].Digest = []string{"sha256:invalid"}
+			},
+			expected: "invalid digest",
+		},
+		{
+			name: "path",
+			modify: func(bm *pb.Manifest) {
+				bm.Resource[2].Path = []string{"/a/b/../../../c"}
+			},
+			expected: "\"..\" component",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			bm := proto.Clone(bm).(*pb.Manifest)
+			if tc.modify != nil {
+				tc.modify(bm)
+			}
+			p, err := proto.Marshal(bm)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = Unmarshal(p, WithStrict(tc.limits))
+			if err == nil || !strings.Contains(err.Error(), tc.expected) {
+				t.Fatalf("expected an error about %q, got %v", tc.expected, err)
+			}
+			if (tc.limits != StrictLimits{}) && !errors.Is(err, ErrLimitExceeded) {
+				t.Fatalf("expected ErrLimitExceeded, got %v", err)
+			}
+		})
+	}
+}
+
+func TestUnmarshalSafePaths(t *testing.T) {
+	for _, tc := range []struct {
+		path     string
+		expected string
+	}{
+		{path: "/a/b"},
+		{path: "a/b"},
+		{path: "/a\\..\\b"},
+		{path: "/a/../../b", expected: "\"..\" component"},
+		{path: "/a/./b", expected: "\".\" component"},
+		{path: "/a//b", expected: "empty component"},
+		{path: "/a/", expected: "empty component"},
+		{path: "", expected: "is empty"},
+		{path: "/a\x00b", expected: "NUL byte"},
+	} {
+		p, err := proto.Marshal(&pb.Manifest{
+			Resource: []*pb.Resource{{Path: []string{tc.path}, Mode: uint32(os.ModeDir | 0o755)}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Unmarshal(p); err != nil {
+			t.Fatalf("expected %q to be accepted by default, got %v", tc.path, err)
+		}
+
+		_, err = Unmarshal(p, WithSafePaths())
+		if tc.expected == "" {
+			if err != nil {
+				t.Errorf("expected %q to be accepted, got %v", tc.path, err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), tc.expected) {
+			t.Errorf("expected %q to be rejected with %q, got %v", tc.path, tc.expected, err)
+		}
+	}
+}
+
+func TestHardlinkLinks(t *testing.T) {
+	file := func(p string) *pb.Resource {
+		return &pb.Resource{Path: []string{p}, Mode: 0o644, Size: 1, Digest: []string{digest.FromString("a").String()}}
+	}
+	link := func(p, target string) *pb.Resource {
+		return &pb.Resource{Path: []string{p}, Mode: 0o644, Type: pb.Type_TYPE_HARDLINK, Target: target}
+	}
+
+	bm := &pb.Manifest{Resource: []*pb.Resource{
+		file("/a"),
+		link("/b", "/a"),
+		link("/c", "b"),
+		link("/d", "/c"),
+	}}
+	err := CheckHardlinks(bm)
+	if err == nil || strings.Count(err.Error(), "rather than at \"/a\"") != 2 {
+		t.Fatalf("expected the chains to be reported, got %v", err)
+	}
+
+	m, err := FromProto(bm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Resources) != 1 {
+		t.Fatalf("expected one resource, got %d", len(m.Resources))
+	}
+	if paths := m.Resources[0].(RegularFile).Paths(); !reflect.DeepEqual(paths, []string{"/a", "/b", "/c", "/d"}) {
+		t.Fatalf("unexpected paths %v", paths)
+	}
+	if len(bm.Resource[0].Path) != 1 {
+		t.Fatal("the records must not be modified")
+	}
+
+	for _, records := range [][]*pb.Resource{
+		{link("/a", "/b"), link("/b", "/a")},
+		{link("/a", "/b")},
+		{{Path: []string{"/a"}, Mode: uint32(os.ModeDir | 0o755)}, link("/b", "/a")},
+	} {
+		bm := &pb.Manifest{Resource: records}
+		if err := CheckHardlinks(bm); err == nil {
+			t.Fatalf("expected %v to be rejected", records)
+		}
+		if _, err := FromProto(bm); err == nil {
+			t.Fatalf("expected %v to be rejected", records)
+		}
+	}
+}
+
+func TestTransformOwnership(t *testing.T) {
+	dir, err := NewDirectory("/a", Attributes{Mode: 0o755, UID: 0, GID: 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := NewRegularFile([]string{"/a/b"}, Attributes{Mode: 0o644, UID: 1000, GID: 100}, 1, digest.FromString("b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &Manifest{Resources: []Resource{dir, file}}
+
+	owners := func(m *Manifest) string {
+		var s []string
+		for _, r := range m.Resources {
+			s = append(s, fmt.Sprintf("%s=%d:%d", r.Path(), r.UID(), r.GID()))
+		}
+		return strings.Join(s, " ")
+	}
+	for _, tc := range []struct {
+		transformer Transformer
+		expected    string
+	}{
+		{ShiftOwnership(100000, 200000), "/a=100000:200000 /a/b=101000:200100"},
+		{SquashOwnership(0, 0), "/a=0:0 /a/b=0:0"},
+		{MapOwnership(map[int64]int64{1000: 1}, map[int64]int64{0: 5}), "/a=0:5 /a/b=1:100"},
+	} {
+		transformed, err := Transform(m, tc.transformer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual := owners(transformed); actual != tc.expected {
+			t.Fatalf("expected %s, got %s", tc.expected, actual)
+		}
+	}
+	if actual := owners(m); actual != "/a=0:0 /a/b=1000:100" {
+		t.Fatalf("the manifest must not be modified, got %s", actual)
+	}
+
+	dropDirs := func(r Resource) (Resource, error) {
+		if _, ok := r.(Directory); ok {
+			return nil, nil
+		}
+		return r, nil
+	}
+	transformed, err := Transform(m, dropDirs, SquashOwnership(1, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual := owners(transformed); actual != "/a/b=1:1" {
+		t.Fatalf("unexpected resources %s", actual)
+	}
+
+	if _, err := Transform(m, ShiftOwnership(-1, 0)); err == nil {
+		t.Fatal("expected a negative uid to be rejected")
+	}
+}
+
+func TestScrub(t *testing.T) {
+	build := func(uid int64, xattrs map[string][]byte) *Manifest {
+		dir, err := NewDirectory("/a", Attributes{Mode: 0o755, UID: uid, GID: uid, XAttrs: xattrs})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &Manifest{Resources: []Resource{dir}}
+	}
+	m1 := build(1000, map[string][]byte{
+		"security.selinux":       []byte("system_u:object_r:container_file_t:s0"),
+		"trusted.overlay.opaque": []byte("y"),
+		"user.cache":             []byte("1"),
+		"user.mime_type":         []byte("text/plain"),
+	})
+	m2 := build(0, map[string][]byte{
+		"user.mime_type": []byte("text/plain"),
+	})
+
+	var encoded []string
+	for _, m := range []*Manifest{m1, m2} {
+		scrubbed, err := Transform(m, Scrub("user.cache"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, err := Marshal(scrubbed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		encoded = append(encoded, string(p))
+	}
+	if encoded[0] != encoded[1] {
+		t.Fatalf("expected scrubbed manifests to be equal:\n%s\n%s", encoded[0], encoded[1])
+	}
+}
+
+func TestAnnotate(t *testing.T) {
+	a, err := NewRegularFile([]string{"/a"}, Attributes{Mode: 0o644, Annotations: map[string]string{"org.example.scan": "clean"}}, 1, digest.FromString("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewRegularFile([]string{"/b"}, Attributes{Mode: 0o644}, 1, digest.FromString("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := Transform(&Manifest{Resources: []Resource{a, b}}, Annotate(func(r Resource) map[string]string {
+		if r.Path() != "/a" {
+			return nil
+		}
+		return map[string]string{"org.example.package": "example"}
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m, err = Unmarshal(p); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{"org.example.scan": "clean", "org.example.package": "example"}
+	if annotations := m.Resources[0].(Annotator).Annotations(); !reflect.DeepEqual(annotations, expected) {
+		t.Fatalf("unexpected annotations %v", annotations)
+	}
+	if annotations := m.Resources[1].(Annotator).Annotations(); annotations != nil {
+		t.Fatalf("expected no annotations, got %v", annotations)
+	}
+
+	// The annotations of the paths of a file must agree.
+	merged, err := Merge(m.Resources[0], b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if annotations := merged.(Annotator).Annotations(); !reflect.DeepEqual(annotations, expected) {
+		t.Fatalf("unexpected merged annotations %v", annotations)
+	}
+	c, err := NewRegularFile([]string{"/c"}, Attributes{Mode: 0o644, Annotations: map[string]string{"org.example.scan": "infected"}}, 1, digest.FromString("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Merge(m.Resources[0], c); err == nil {
+		t.Fatal("expected conflicting annotations not to merge")
+	}
+}
+
+func TestPrune(t *testing.T) {
+	var resources []Resource
+	for _, p := range []string{"/empty", "/var", "/var/cache", "/var/cache/apt", "/var/log"} {
+		dir, err := NewDirectory(p, Attributes{Mode: 0o755})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resources = append(resources, dir)
+	}
+	for _, paths := range [][]string{
+		{"/a.log", "/b"},
+		{"/var/cache/apt/pkgcache.bin"},
+		{"/var/log/dpkg.log"},
+	} {
+		f, err := NewRegularFile(paths, Attributes{Mode: 0o644}, 1, digest.FromString(paths[0]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resources = append(resources, f)
+	}
+	sort.Stable(ByPath(resources))
+	m := &Manifest{Resources: resources}
+
+	describe := func(m *Manifest) string {
+		var paths []string
+		for _, r := range m.Resources {
+			paths = append(paths, resourcePaths(r)...)
+		}
+		return fmt.Sprint(paths)
+	}
+	for _, tc := range []struct {
+		prune    func(*Manifest, ...string) (*Manifest, error)
+		expected string
+	}{
+		{Prune, "[/b /empty /var /var/cache /var/log]"},
+		{PruneEmptied, "[/b /empty]"},
+	} {
+		pruned, err := tc.prune(m, "*.log", "var/cache/*")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual := describe(pruned); actual != tc.expected {
+			t.Fatalf("expected %s, got %s", tc.expected, actual)
+		}
+		if err := Validate(pruned); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := Prune(m, "["); err == nil {
+		t.Fatal("expected an invalid pattern to be rejected")
+	}
+}
+
+func TestPrefix(t *testing.T) {
+	var resources []Resource
+	dir, err := NewDirectory("/a", Attributes{Mode: 0o755})
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := NewRegularFile([]string{"/a/b", "/c"}, Attributes{Mode: 0o644}, 1, digest.FromString("b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resources = append(resources, dir, file)
+	for name, target := range map[string]string{
+		"/a/abs":  "/a/b",
+		"/a/rel":  "b",
+		"/a/up":   "../c",
+		"/a/esc":  "../../a/b",
+		"/a/dots": "./../../../c",
+	} {
+		link, err := NewSymLink(name, Attributes{Mode: os.ModeSymlink | 0o777}, target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resources = append(resources, link)
+	}
+	sort.Stable(ByPath(resources))
+
+	prefixed, err := Prefix(&Manifest{Resources: resources}, "rootfs/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var actual []string
+	for _, r := range prefixed.Resources {
+		desc := strings.Join(resourcePaths(r), ",")
+		if link, ok := r.(SymLink); ok {
+			desc += "->" + link.Target()
+		}
+		actual = append(actual, desc)
+	}
+	expected := "[/rootfs/a /rootfs/a/abs->/rootfs/a/b /rootfs/a/b,/rootfs/c /rootfs/a/dots->../c /rootfs/a/esc->b /rootfs/a/rel->b /rootfs/a/up->../c]"
+	if fmt.Sprint(actual) != expected {
+		t.Fatalf("expected %s, got %v", expected, actual)
+	}
+
+	sub, err := Subtree(prefixed, "rootfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, r := range sub.Resources {
+		if r.Path() != resources[i].Path() {
+			t.Fatalf("expected Subtree to undo Prefix, got %q for %q", r.Path(), resources[i].Path())
+		}
+	}
+}
+
+func TestCombine(t *testing.T) {
+	build := func(dirs []string, content string, files ...string) *Manifest {
+		var resources []Resource
+		for _, p := range dirs {
+			dir, err := NewDirectory(p, Attributes{Mode: 0o755})
+			if err != nil {
+				t.Fatal(err)
+			}
+			resources = append(resources, dir)
+		}
+		for _, p := range files {
+			f, err := NewRegularFile([]string{p}, Attributes{Mode: 0o644}, 1, digest.FromString(p+content))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resources = append(resources, f)
+		}
+		sort.Stable(ByPath(resources))
+		return &Manifest{Resources: resources}
+	}
+
+	base := build([]string{"/usr", "/usr/lib"}, "", "/etc")
+	tools := build([]string{"/bin", "/lib"}, "", "/bin/sh")
+	libs := build([]string{"/x"}, "", "/x/libc.so")
+
+	m, err := Combine([]Component{
+		{Manifest: base},
+		{Prefix: "usr", Manifest: tools},
+		{Prefix: "/usr/lib", Manifest: libs},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Validate(m); err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, r := range m.Resources {
+		paths = append(paths, r.Path())
+	}
+	expected := "[/etc /usr /usr/bin /usr/bin/sh /usr/lib /usr/lib/x /usr/lib/x/libc.so]"
+	if fmt.Sprint(paths) != expected {
+		t.Fatalf("expected %s, got %v", expected, paths)
+	}
+
+	overlay := []Component{
+		{Manifest: base},
+		{Manifest: build([]string{"/usr"}, "new", "/etc", "/usr/lib")},
+	}
+	_, err = Combine(overlay)
+	if err == nil || strings.Count(err.Error(), "collides") != 2 {
+		t.Fatalf("expected two collisions, got %v", err)
+	}
+
+	var classes []string
+	m, err = Combine(overlay,
+		WithStrategy(ContentConflict, StrategyTheirs),
+		WithResolver(func(c Conflict) (Resource, bool) {
+			classes = append(classes, c.Path+"="+c.Class.String())
+			return c.Ours, true
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(classes) != "[/usr/lib=type]" {
+		t.Fatalf("unexpected conflicts passed to the resolver %v", classes)
+	}
+	if rf, ok := m.Resources[0].(RegularFile); !ok || rf.Digests()[0] != digest.FromString("/etcnew") {
+		t.Fatalf("expected /etc to be theirs, got %v", m.Resources[0])
+	}
+	if _, ok := m.Resources[2].(Directory); !ok {
+		t.Fatalf("expected /usr/lib to be ours, got %v", m.Resources[2])
+	}
+}
+
+func TestMergeManifests(t *testing.T) {
+	build := func(entries map[string]string) *Manifest {
+		var resources []Resource
+		for p, content := range entries {
+			var (
+				r   Resource
+				err error
+			)
+			if content == "" {
+				r, err = NewDirectory(p, Attributes{Mode: 0o755})
+			} else {
+				r, err = NewRegularFile([]string{p}, Attributes{Mode: 0o644}, int64(len(content)), digest.FromString(content))
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			resources = append(resources, r)
+		}
+		sort.Stable(ByPath(resources))
+		return &Manifest{Resources: resources}
+	}
+
+	base := build(map[string]string{"/a": "", "/a/f": "x", "/g": "1", "/h": "1", "/del": "1", "/same": "1"})
+	ours := build(map[string]string{"/a": "", "/a/f": "x", "/a/mine": "m", "/g": "2", "/h": "1", "/del": "1", "/same": "2", "/new-ours": "o"})
+	theirs := build(map[string]string{"/g": "3", "/h": "4", "/same": "2", "/new-theirs": "t"})
+
+	merged, conflicts, err := MergeManifests(base, ours, theirs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var actual []string
+	for _, r := range merged.Resources {
+		desc := r.Path()
+		if rf, ok := r.(RegularFile); ok {
+			desc += "=" + rf.Digests()[0].Encoded()[:4]
+		}
+		actual = append(actual, desc)
+	}
+	expected := []string{
+		"/a",
+		"/a/mine=" + digest.FromString("m").Encoded()[:4],
+		"/g=" + digest.FromString("2").Encoded()[:4],
+		"/h=" + digest.FromString("4").Encoded()[:4],
+		"/new-ours=" + digest.FromString("o").Encoded()[:4],
+		"/new-theirs=" + digest.FromString("t").Encoded()[:4],
+		"/same=" + digest.FromString("2").Encoded()[:4],
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("expected %v, got %v", expected, actual)
+	}
+
+	var conflicted []string
+	for _, c := range conflicts {
+		conflicted = append(conflicted, c.Path)
+	}
+	if fmt.Sprint(conflicted) != "[/a /g]" {
+		t.Fatalf("unexpected conflicts %v", conflicted)
+	}
+	if conflicts[0].Theirs != nil || conflicts[1].Base == nil {
+		t.Fatalf("unexpected conflicts %#v", conflicts)
+	}
+	if conflicts[0].Class != TypeConflict || conflicts[1].Class != ContentConflict {
+		t.Fatalf("unexpected classes %v and %v", conflicts[0].Class, conflicts[1].Class)
+	}
+
+	merged, conflicts, err = MergeManifests(base, ours, theirs,
+		WithStrategy(ContentConflict, StrategyTheirs),
+		WithStrategy(TypeConflict, StrategyTheirs),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conflicts) != 1 || conflicts[0].Path != "/a" {
+		t.Fatalf("expected the directory to stay in conflict, got %v", conflicts)
+	}
+	if g := merged.Resources[2].(RegularFile); g.Path() != "/g" || g.Digests()[0] != digest.FromString("3") {
+		t.Fatalf("expected /g to be theirs, got %v", g)
+	}
+
+	chmod := func(m *Manifest) *Manifest {
+		transformed, err := Transform(m, func(r Resource) (Resource, error) {
+			b := ResourceToProto(r)
+			b.Mode, b.PosixMode = b.Mode|0o2, b.PosixMode|0o2
+			return ResourceFromProto(b)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return transformed
+	}
+	squash, err := Transform(base, SquashOwnership(1, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, conflicts, err = MergeManifests(base, chmod(base), squash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range conflicts {
+		if c.Class != MetadataConflict {
+			t.Fatalf("expected a metadata conflict for %s, got %v", c.Path, c.Class)
+		}
+	}
+	if len(conflicts) != len(base.Resources) {
+		t.Fatalf("expected every path to conflict, got %v", conflicts)
+	}
+}
+
+func TestVerifyFailures(t *testing.T) {
+	root := t.TempDir()
+	if err := os.Mkdir(filepath.Join(root, "d"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", "b", "c"} {
+		if err := os.WriteFile(filepath.Join(root, name), []byte(name), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, err := NewContext(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := BuildManifest(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Chmod(filepath.Join(root, "a"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "b"), []byte("bb"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(root, "d")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, concurrency := range []int{1, 4} {
+		var report VerifyReport
+		err := VerifyManifest(ctx, m, WithAllFailures(), WithConcurrency(concurrency), WithVerifyReport(&report))
+		var verr *VerifyError
+		if !errors.As(err, &verr) || verr.Path != "/a" {
+			t.Fatalf("expected the first failure to be returned, got %v", err)
+		}
+
+		var actual []string
+		for _, f := range report.Failures {
+			desc := f.Path + " " + f.Class.String()
+			for _, field := range f.Fields {
+				desc += fmt.Sprintf(" %s:%s->%s", field.Name, field.Expected, field.Actual)
+			}
+			actual = append(actual, desc)
+		}
+		expected := []string{
+			"/a metadata mode:0100644->0100600",
+			fmt.Sprintf("/b content size:1->2 digest:%s->%s", digest.FromString("b"), digest.FromString("bb")),
+			"/d missing",
+		}
+		if !reflect.DeepEqual(actual, expected) {
+			t.Fatalf("expected %q, got %q", expected, actual)
+		}
+
+		p, err := json.Marshal(&report)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Contains(p, []byte(`"class":"FAILURE_CLASS_MISSING"`)) {
+			t.Fatalf("unexpected JSON report %s", p)
+		}
+
+		var rendered []string
+		for _, f := range report.Failures {
+			rendered = append(rendered, DriftRenderer{}.Render(f))
+		}
+		expected = []string{
+			"/a: mode 0644→0600",
+			fmt.Sprintf("/b: size 1→2, content sha256:%s→sha256:%s", digest.FromString("b").Encoded()[:12], digest.FromString("bb").Encoded()[:12]),
+			"/d: missing",
+		}
+		if !reflect.DeepEqual(rendered, expected) {
+			t.Fatalf("expected %q, got %q", expected, rendered)
+		}
+	}
+
+	var report VerifyReport
+	if err := VerifyManifest(ctx, m, WithVerifyReport(&report)); err == nil || len(report.Failures) != 1 {
+		t.Fatalf("expected verification to stop at the first failure, got %v", report.Failures)
+	}
+}
+
+func TestVerifyIgnore(t *testing.T) {
+	root := t.TempDir()
+	for _, dir := range []string{"etc", "var/log"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"etc/machine-id", "etc/passwd", "var/log/x.log"} {
+		if err := os.WriteFile(filepath.Join(root, name), []byte(name), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Link(filepath.Join(root, "etc/passwd"), filepath.Join(root, "var/log/passwd.log")); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, err := NewContext(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := BuildManifest(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"etc/machine-id", "var/log/x.log"} {
+		if err := os.WriteFile(filepath.Join(root, name), []byte("changed"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := VerifyManifest(ctx, m); err == nil {
+		t.Fatal("expected the changed files to fail verification")
+	}
+
+	patterns, err := ReadIgnoreFile(strings.NewReader("# mutable\n\n  etc/machine-id\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var report VerifyReport
+	if err := VerifyManifest(ctx, m, WithIgnore(patterns...), WithIgnore("*.log"), WithVerifyReport(&report)); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(report.Ignored) != "[/etc/machine-id /var/log/passwd.log /var/log/x.log]" {
+		t.Fatalf("unexpected ignored paths %v", report.Ignored)
+	}
+	if report.Resources != 4 {
+		t.Fatalf("expected the hardlinked file to be verified, got %+v", report)
+	}
+}
+
+func TestVerifyWithoutFields(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "a"), []byte("a"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, err := NewContext(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := BuildManifest(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err = Transform(m, ShiftOwnership(100000, 100000), func(r Resource) (Resource, error) {
+		b := ResourceToProto(r)
+		b.Mode, b.PosixMode = b.Mode|0o111, b.PosixMode|0o111
+		return ResourceFromProto(b)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var report VerifyReport
+	if err := VerifyManifest(ctx, m, WithVerifyReport(&report)); err == nil {
+		t.Fatal("expected the mapped manifest to fail verification")
+	}
+	if fields := report.Failures[0].Fields; len(fields) != 3 {
+		t.Fatalf("expected the mode, uid and gid to differ, got %v", fields)
+	}
+	if err := VerifyManifest(ctx, m, WithVerifyReport(&report), WithoutFields(FieldOwner, FieldGroup)); err == nil {
+		t.Fatal("expected the mode to fail verification")
+	}
+	if fields := report.Failures[0].Fields; len(fields) != 1 || fields[0].Name != "mode" {
+		t.Fatalf("expected only the mode to be reported, got %v", fields)
+	}
+	if err := VerifyManifest(ctx, m, WithoutFields(FieldOwner, FieldGroup, FieldMode)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(root, "a"), []byte("b"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyManifest(ctx, m, WithoutFields(FieldOwner, FieldGroup, FieldMode)); err == nil {
+		t.Fatal("expected the content to still be verified")
+	}
+	if err := VerifyManifest(ctx, m, WithoutFields("mtime")); err == nil {
+		t.Fatal("expected an unknown field to be rejected")
+	}
+}
+
+func TestAuditSpecialModes(t *testing.T) {
+	root := t.TempDir()
+	for name, mode := range map[string]os.FileMode{
+		"a": 0o755,
+		"b": 0o755 | os.ModeSetuid,
+	} {
+		p := filepath.Join(root, name)
+		if err := os.WriteFile(p, []byte(name), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chmod(p, mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(root, "tmp"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Join(root, "tmp"), 0o777|os.ModeSticky); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, err := NewContext(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := BuildManifest(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var paths []string
+	for _, s := range SpecialModes(m) {
+		paths = append(paths, s.Path)
+	}
+	if fmt.Sprint(paths) != "[/b /tmp]" {
+		t.Fatalf("unexpected special modes %v", paths)
+	}
+
+	if err := os.Chmod(filepath.Join(root, "a"), 0o755|os.ModeSetuid); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Join(root, "b"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "c"), []byte("c"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Join(root, "c"), 0o755|os.ModeSetgid); err != nil {
+		t.Fatal(err)
+	}
+
+	changes, err := AuditSpecialModes(ctx, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var actual []string
+	for _, c := range changes {
+		actual = append(actual, c.String())
+	}
+	expected := []string{"/a: none→setuid", "/b: lost setuid", "/c: unexpected setgid"}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("expected %q, got %q", expected, actual)
+	}
+}
+
+func TestAudit(t *testing.T) {
+	var resources []Resource
+	for p, mode := range map[string]os.FileMode{
+		"/etc":          os.ModeDir | 0o755,
+		"/tmp":          os.ModeDir | os.ModeSticky | 0o777,
+		"/var":          os.ModeDir | 0o777,
+		"/var/tmp":      os.ModeDir | os.ModeSticky | 0o777,
+		"/var/tmp/x.sh": 0o755,
+		"/etc/shadow":   0o666,
+		"/etc/link":     os.ModeSymlink | 0o777,
+	} {
+		var (
+			r   Resource
+			err error
+		)
+		attrs := Attributes{Mode: mode}
+		if p == "/etc/shadow" {
+			attrs.UID = 1000
+		}
+		switch {
+		case mode.IsDir():
+			r, err = NewDirectory(p, attrs)
+		case mode&os.ModeSymlink != 0:
+			r, err = NewSymLink(p, attrs, "shadow")
+		default:
+			r, err = NewRegularFile([]string{p}, attrs, 1, digest.FromString(p))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		resources = append(resources, r)
+	}
+	sort.Stable(ByPath(resources))
+	m := &Manifest{Resources: resources}
+
+	var findings []string
+	for _, f := range Audit(m, append(DefaultRules(), AllowedOwners(0))...) {
+		findings = append(findings, f.String())
+	}
+	expected := []string{
+		"world-writable /etc/shadow: -rw-rw-rw- is writable by anyone",
+		"owner /etc/shadow: owned by unexpected uid 1000",
+		"world-writable /var: drwxrwxrwx is writable by anyone",
+		"executable /var/tmp/x.sh: executable in /var/tmp",
+	}
+	if !reflect.DeepEqual(findings, expected) {
+		t.Fatalf("expected %q, got %q", expected, findings)
+	}
+}
@@ -0,0 +1,354 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continuity
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	pb "github.com/containerd/continuity/proto"
+	"google.golang.org/protobuf/proto"
+)
+
+// logMagic starts a manifest log, and ends it once it is closed.
+const logMagic = "CTYLOG\x00\x01"
+
+// logFooterSize is the size of the footer of a closed log: the offset of the
+// index entry, as a big-endian uint64, followed by logMagic.
+const logFooterSize = 8 + len(logMagic)
+
+// ManifestLog is a manifest stored as a log of changes, so that changes can
+// be appended, as a tree is watched or built again, without writing the
+// whole manifest each time.
+//
+// The log starts with a magic number, followed by LogEntry messages of
+// manifest.proto, each prefixed by its size as a varint. When the log is
+// closed, an entry indexing the latest entry of every path is appended,
+// followed by a footer locating it. Logs that were not closed, such as after
+// a crash, are read by replaying their entries instead, and an entry that
+// was only partly written is discarded.
+type ManifestLog struct {
+	f       *os.File
+	end     int64            // offset at which the next entry is written
+	index   map[string]int64 // offsets of the latest entries, by path
+	indexed bool             // whether the index entry is at end
+}
+
+// CreateManifestLog creates the log at path, replacing any file there, with
+// an entry for each resource of m.
+func CreateManifestLog(path string, m *Manifest) (*ManifestLog, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Write([]byte(logMagic)); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	l := &ManifestLog{
+		f:     f,
+		end:   int64(len(logMagic)),
+		index: map[string]int64{},
+	}
+	for _, resource := range m.Resources {
+		if err := l.Put(resource); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// OpenManifestLog opens the log at path to read it and append to it.
+func OpenManifestLog(path string) (*ManifestLog, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &ManifestLog{f: f}
+	if err := l.load(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to read manifest log %s: %w", path, err)
+	}
+	return l, nil
+}
+
+// load reads the index of the log from its footer, or rebuilds it from the
+// entries if the log was not closed.
+func (l *ManifestLog) load() error {
+	fi, err := l.f.Stat()
+	if err != nil {
+		return err
+	}
+	size := fi.Size()
+
+	magic := make([]byte, len(logMagic))
+	if _, err := l.f.ReadAt(magic, 0); err != nil || string(magic) != logMagic {
+		return errors.New("not a manifest log")
+	}
+
+	if size >= int64(len(logMagic)+logFooterSize) {
+		footer := make([]byte, logFooterSize)
+		if _, err := l.f.ReadAt(footer, size-int64(logFooterSize)); err != nil {
+			return err
+		}
+		if string(footer[8:]) == logMagic {
+			off := int64(binary.BigEndian.Uint64(footer))
+			if off >= int64(len(logMagic)) && off < size-int64(logFooterSize) {
+				e, _, err := l.readEntry(off)
+				if err == nil && e.Index != nil {
+					l.end = off
+					l.indexed = true
+					l.index = make(map[string]int64, len(e.Index.Entry))
+					for _, ie := range e.Index.Entry {
+						l.index[ie.Path] = int64(ie.Offset)
+					}
+					return nil
+				}
+			}
+		}
+	}
+
+	l.index = map[string]int64{}
+	end, err := l.scan(func(off int64, e *pb.LogEntry) error {
+		l.apply(off, e)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	l.end = end
+	return nil
+}
+
+// scan calls fn with each entry of the log in order, up to an index entry or
+// an entry that was only partly written, and returns the offset at which it
+// stopped.
+func (l *ManifestLog) scan(fn func(off int64, e *pb.LogEntry) error) (int64, error) {
+	off := int64(len(logMagic))
+	br := bufio.NewReader(io.NewSectionReader(l.f, off, 1<<62))
+	for {
+		e, n, err := readLogEntry(br)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return off, nil
+		}
+		if err != nil {
+			return 0, fmt.Errorf("entry at offset %d: %w", off, err)
+		}
+		if e.Index != nil {
+			return off, nil
+		}
+		if err := fn(off, e); err != nil {
+			return 0, err
+		}
+		off += n
+	}
+}
+
+// readEntry reads the entry at offset off.
+func (l *ManifestLog) readEntry(off int64) (*pb.LogEntry, int64, error) {
+	return readLogEntry(bufio.NewReader(io.NewSectionReader(l.f, off, 1<<62)))
+}
+
+// readLogEntry reads an entry prefixed by its size, returning the number of
+// bytes read. It returns io.EOF if there are no more entries, and
+// io.ErrUnexpectedEOF if the entry was only partly written.
+func readLogEntry(br *bufio.Reader) (*pb.LogEntry, int64, error) {
+	size, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, 0, err
+	}
+	if size > 1<<30 {
+		return nil, 0, fmt.Errorf("entry of %d bytes is too large", size)
+	}
+	p := make([]byte, size)
+	if _, err := io.ReadFull(br, p); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, 0, err
+	}
+
+	var e pb.LogEntry
+	if err := proto.Unmarshal(p, &e); err != nil {
+		return nil, 0, err
+	}
+	return &e, int64(binary.PutUvarint(make([]byte, binary.MaxVarintLen64), size)) + int64(size), nil
+}
+
+// apply updates the index with the entry at offset off.
+func (l *ManifestLog) apply(off int64, e *pb.LogEntry) {
+	for _, p := range e.Removed {
+		delete(l.index, p)
+	}
+	if e.Resource != nil {
+		for _, p := range e.Resource.Path {
+			l.index[p] = off
+		}
+	}
+}
+
+// append writes the entry at the end of the log, replacing the index entry
+// if the log was closed before.
+func (l *ManifestLog) append(e *pb.LogEntry) error {
+	if l.indexed {
+		if err := l.f.Truncate(l.end); err != nil {
+			return err
+		}
+		l.indexed = false
+	}
+
+	p, err := deterministic.Marshal(e)
+	if err != nil {
+		return err
+	}
+	p = append(binary.AppendUvarint(nil, uint64(len(p))), p...)
+	if _, err := l.f.WriteAt(p, l.end); err != nil {
+		return err
+	}
+
+	l.apply(l.end, e)
+	l.end += int64(len(p))
+	return nil
+}
+
+// Put appends an entry adding the resource, replacing any resource at its
+// paths. Other paths of a replaced hardlinked resource are left to it.
+func (l *ManifestLog) Put(resource Resource) error {
+	if resource.Path() == "" {
+		return errors.New("resource has no path")
+	}
+	return l.append(&pb.LogEntry{Resource: ResourceToProto(resource)})
+}
+
+// Remove appends an entry removing the resources at the paths. Other paths
+// of a hardlinked resource are left to it.
+func (l *ManifestLog) Remove(paths ...string) error {
+	if len(paths) == 0 {
+		return nil
+	}
+	return l.append(&pb.LogEntry{Removed: paths})
+}
+
+// Lookup returns the resource at path p, reading only its latest entry. The
+// resource only has the paths that no later entry has replaced or removed.
+func (l *ManifestLog) Lookup(p string) (Resource, error) {
+	off, ok := l.index[p]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	e, _, err := l.readEntry(off)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read entry of %q: %w", p, err)
+	}
+	if e.Resource == nil {
+		return nil, fmt.Errorf("entry of %q has no resource", p)
+	}
+	return ResourceFromProto(l.current(off, e.Resource))
+}
+
+// current returns the record b of the entry at offset off with only the
+// paths for which it is the latest entry.
+func (l *ManifestLog) current(off int64, b *pb.Resource) *pb.Resource {
+	var paths []string
+	for _, p := range b.Path {
+		if l.index[p] == off {
+			paths = append(paths, p)
+		}
+	}
+	b.Path = paths
+	return b
+}
+
+// Manifest replays the log and returns the manifest it describes, sorted by
+// path.
+func (l *ManifestLog) Manifest() (*Manifest, error) {
+	var m Manifest
+	if _, err := l.scan(func(off int64, e *pb.LogEntry) error {
+		if e.Resource == nil {
+			return nil
+		}
+		b := l.current(off, e.Resource)
+		if len(b.Path) == 0 {
+			return nil
+		}
+		r, err := ResourceFromProto(b)
+		if err != nil {
+			return err
+		}
+		m.Resources = append(m.Resources, r)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	sort.Stable(ByPath(m.Resources))
+	m.Header = newHeader(m.Resources)
+	return &m, nil
+}
+
+// Close appends the index and the footer, if entries were appended since
+// the log was opened, and closes the log.
+func (l *ManifestLog) Close() error {
+	if !l.indexed {
+		if err := l.writeIndex(); err != nil {
+			l.f.Close()
+			return err
+		}
+	}
+	return l.f.Close()
+}
+
+func (l *ManifestLog) writeIndex() error {
+	paths := make([]string, 0, len(l.index))
+	for p := range l.index {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	idx := &pb.LogIndex{}
+	for _, p := range paths {
+		idx.Entry = append(idx.Entry, &pb.LogIndexEntry{Path: p, Offset: uint64(l.index[p])})
+	}
+
+	p, err := proto.Marshal(&pb.LogEntry{Index: idx})
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	buf.Write(binary.AppendUvarint(nil, uint64(len(p))))
+	buf.Write(p)
+	buf.Write(binary.BigEndian.AppendUint64(nil, uint64(l.end)))
+	buf.WriteString(logMagic)
+
+	if _, err := l.f.WriteAt(buf.Bytes(), l.end); err != nil {
+		return err
+	}
+	if err := l.f.Sync(); err != nil {
+		return err
+	}
+	l.indexed = true
+	return nil
+}
@@ -0,0 +1,147 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continuity
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestManifestLog(t *testing.T) {
+	dir, err := NewDirectory("/a", Attributes{Mode: 0o755})
+	if err != nil {
+		t.Fatal(err)
+	}
+	linked, err := NewRegularFile([]string{"/a/b", "/c"}, Attributes{Mode: 0o644}, 1, digest.FromString("b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewRegularFile([]string{"/d"}, Attributes{Mode: 0o644}, 1, digest.FromString("d"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	changed, err := NewRegularFile([]string{"/c"}, Attributes{Mode: 0o600}, 2, digest.FromString("c"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "manifest.log")
+	l, err := CreateManifestLog(path, &Manifest{Resources: []Resource{dir, linked, other}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Put(changed); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Remove("/d"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	paths := func(m *Manifest) (paths [][]string) {
+		for _, r := range m.Resources {
+			paths = append(paths, resourcePaths(r))
+		}
+		return paths
+	}
+
+	// The log is read through its index once closed, and by replaying its
+	// entries otherwise, including after a partly written entry.
+	l, err = OpenManifestLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !l.indexed {
+		t.Fatal("expected the index to be read")
+	}
+	r, err := l.Lookup("/a/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(resourcePaths(r), []string{"/a/b"}) {
+		t.Fatalf("expected the replaced path to be dropped, got %v", resourcePaths(r))
+	}
+	if r, err := l.Lookup("/c"); err != nil || r.Mode() != 0o600 {
+		t.Fatalf("expected the changed file, got %v", err)
+	}
+	if _, err := l.Lookup("/d"); err != ErrNotFound {
+		t.Fatalf("expected a removed path not to be found, got %v", err)
+	}
+	indexed, err := l.Manifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := [][]string{{"/a"}, {"/a/b"}, {"/c"}}
+	if !reflect.DeepEqual(paths(indexed), expected) {
+		t.Fatalf("expected %v, got %v", expected, paths(indexed))
+	}
+
+	if err := l.Put(other); err != nil {
+		t.Fatal(err)
+	}
+	l.f.WriteAt([]byte{0x7f, 1, 2}, l.end) // an entry of 127 bytes cut short
+	l.f.Close()
+
+	l, err = OpenManifestLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.indexed {
+		t.Fatal("expected the log to be replayed")
+	}
+	replayed, err := l.Manifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = [][]string{{"/a"}, {"/a/b"}, {"/c"}, {"/d"}}
+	if !reflect.DeepEqual(paths(replayed), expected) {
+		t.Fatalf("expected %v, got %v", expected, paths(replayed))
+	}
+	if err := l.Remove("/d"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err = OpenManifestLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	m, err := l.Manifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !proto.Equal(ToProto(indexed), ToProto(m)) {
+		t.Fatal("expected the partly written entry to be replaced")
+	}
+
+	if err := os.WriteFile(path, []byte("manifest"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenManifestLog(path); err == nil {
+		t.Fatal("expected a file other than a log to be rejected")
+	}
+}
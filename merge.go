@@ -0,0 +1,394 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continuity
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	pb "github.com/containerd/continuity/proto"
+	"google.golang.org/protobuf/proto"
+)
+
+// Component is a manifest to be combined with others into the manifest of a
+// larger bundle, at the directory Prefix of that bundle.
+type Component struct {
+	Prefix   string
+	Manifest *Manifest
+}
+
+// Combine returns the manifest of the bundle composed of the components, each
+// moved below its prefix as by Prefix, such as a root filesystem assembled
+// from independently built parts. Components are expected to be disjoint,
+// other than for paths that are the same in all of them, such as shared
+// parent directories. Other paths of more than one component are conflicts,
+// of the components added earlier, as our side, with those added later, as
+// theirs, which the options may resolve. All of the conflicts left are
+// returned as errors.
+func Combine(components []Component, opts ...MergeOpt) (*Manifest, error) {
+	o, err := newMergeOpts(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		errs   []error
+		byPath = map[string]Resource{}
+		origin = map[string]string{}
+	)
+	for _, c := range components {
+		prefixed, err := Prefix(c.Manifest, c.Prefix)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, r := range prefixed.Resources {
+			for _, p := range resourcePaths(r) {
+				existing, ok := byPath[p]
+				if !ok {
+					byPath[p], origin[p] = r, c.Prefix
+					continue
+				}
+				if sameResource(existing, r) {
+					continue
+				}
+
+				resolved, ok := o.resolve(newConflict(p, nil, existing, r))
+				if !ok {
+					errs = append(errs, fmt.Errorf("%q of the component at %q collides with the component at %q", p, c.Prefix, origin[p]))
+					continue
+				}
+				if resolved == nil {
+					delete(byPath, p)
+				} else {
+					byPath[p], origin[p] = resolved, c.Prefix
+				}
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return nil, joinErrors(errs...)
+	}
+
+	resources, err := resourcesOf(byPath)
+	if err != nil {
+		return nil, err
+	}
+	return &Manifest{Resources: resources, Header: newHeader(resources)}, nil
+}
+
+// ConflictClass classifies conflicts by how the sides of a conflict differ.
+type ConflictClass int
+
+const (
+	// ContentConflict is a conflict between resources of the same type with
+	// different content, such as files with other digests or symlinks with
+	// other targets.
+	ContentConflict ConflictClass = iota
+
+	// MetadataConflict is a conflict between resources that only differ in
+	// their metadata, such as their permissions, owners or xattrs.
+	MetadataConflict
+
+	// TypeConflict is a conflict between resources of different types, or
+	// between a resource and its removal.
+	TypeConflict
+)
+
+func (c ConflictClass) String() string {
+	switch c {
+	case ContentConflict:
+		return "content"
+	case MetadataConflict:
+		return "metadata"
+	case TypeConflict:
+		return "type"
+	}
+	return fmt.Sprintf("ConflictClass(%d)", int(c))
+}
+
+// Strategy selects how conflicts are resolved.
+type Strategy int
+
+const (
+	// StrategyReport leaves conflicts unresolved, to be reported.
+	StrategyReport Strategy = iota
+
+	// StrategyOurs resolves conflicts with our side.
+	StrategyOurs
+
+	// StrategyTheirs resolves conflicts with their side.
+	StrategyTheirs
+)
+
+// Resolver decides a conflict, returning the resource to keep at its path,
+// or nil to remove it, and true, or false to leave it unresolved.
+type Resolver func(Conflict) (Resource, bool)
+
+type mergeOpts struct {
+	strategies map[ConflictClass]Strategy
+	resolver   Resolver
+}
+
+// MergeOpt is an option for MergeManifests and Combine.
+type MergeOpt func(*mergeOpts) error
+
+// WithStrategy sets the strategy of the conflicts of the given class, which
+// are otherwise reported.
+func WithStrategy(class ConflictClass, strategy Strategy) MergeOpt {
+	return func(o *mergeOpts) error {
+		switch strategy {
+		case StrategyReport, StrategyOurs, StrategyTheirs:
+		default:
+			return fmt.Errorf("unknown merge strategy %d", strategy)
+		}
+		o.strategies[class] = strategy
+		return nil
+	}
+}
+
+// WithResolver sets a function to decide the conflicts left unresolved by
+// the strategies.
+func WithResolver(resolver Resolver) MergeOpt {
+	return func(o *mergeOpts) error {
+		o.resolver = resolver
+		return nil
+	}
+}
+
+func newMergeOpts(opts []MergeOpt) (*mergeOpts, error) {
+	o := &mergeOpts{strategies: map[ConflictClass]Strategy{}}
+	for _, opt := range opts {
+		if err := opt(o); err != nil {
+			return nil, err
+		}
+	}
+	return o, nil
+}
+
+// resolve returns the resource resolving the conflict c, and true, or false
+// if it is left unresolved.
+func (o *mergeOpts) resolve(c Conflict) (Resource, bool) {
+	switch o.strategies[c.Class] {
+	case StrategyOurs:
+		return c.Ours, true
+	case StrategyTheirs:
+		return c.Theirs, true
+	}
+	if o.resolver != nil {
+		return o.resolver(c)
+	}
+	return nil, false
+}
+
+// Conflict describes a path that both sides of a three-way merge changed
+// differently from the base. Resources are nil where the path is absent.
+type Conflict struct {
+	Path   string
+	Class  ConflictClass
+	Base   Resource
+	Ours   Resource
+	Theirs Resource
+}
+
+func newConflict(p string, base, ours, theirs Resource) Conflict {
+	return Conflict{
+		Path:   p,
+		Class:  classifyConflict(ours, theirs),
+		Base:   base,
+		Ours:   ours,
+		Theirs: theirs,
+	}
+}
+
+// classifyConflict returns the class of the conflict between the resources a
+// and b, either of which may be nil.
+func classifyConflict(a, b Resource) ConflictClass {
+	if a == nil || b == nil || a.Mode()&os.ModeType != b.Mode()&os.ModeType {
+		return TypeConflict
+	}
+
+	content := func(r Resource) *pb.Resource {
+		b := ResourceToProto(r)
+		b.Path = nil
+		b.Uid, b.Gid = 0, 0
+		b.Mode &= uint32(os.ModeType)
+		b.PosixMode = 0
+		b.Type = pb.Type_TYPE_UNSPECIFIED
+		b.Xattr = nil
+		b.ProjectId = 0
+		b.Mount = nil
+		return b
+	}
+	if proto.Equal(content(a), content(b)) {
+		return MetadataConflict
+	}
+	return ContentConflict
+}
+
+// MergeManifests merges the changes made to the manifest base by theirs
+// into ours, path by path, as when applying an update of an image on top of
+// local modifications. Paths changed on one side take that change, and those
+// changed alike on both sides are kept. Conflicts are returned for paths
+// changed differently on both sides, and for directories removed on one side
+// while the other added paths below them. Conflicts may be resolved by the
+// options, and the merged manifest keeps our side of those that are not.
+func MergeManifests(base, ours, theirs *Manifest, opts ...MergeOpt) (*Manifest, []Conflict, error) {
+	o, err := newMergeOpts(opts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var (
+		baseResources   = resourcesByPath(base)
+		ourResources    = resourcesByPath(ours)
+		theirResources  = resourcesByPath(theirs)
+		merged          = map[string]Resource{}
+		conflicts       []Conflict
+		conflictedPaths = map[string]bool{}
+	)
+	report := func(c Conflict) {
+		if !conflictedPaths[c.Path] {
+			conflicts = append(conflicts, c)
+			conflictedPaths[c.Path] = true
+		}
+	}
+
+	for _, p := range unionPaths(baseResources, ourResources, theirResources) {
+		b, ours, theirs := baseResources[p], ourResources[p], theirResources[p]
+		r := ours
+		switch {
+		case sameEntry(ours, theirs), sameEntry(b, theirs):
+		case sameEntry(b, ours):
+			r = theirs
+		default:
+			c := newConflict(p, b, ours, theirs)
+			if resolved, ok := o.resolve(c); ok {
+				r = resolved
+			} else {
+				report(c)
+			}
+		}
+		if r != nil {
+			merged[p] = r
+		}
+	}
+
+	for _, p := range unionPaths(merged) {
+		for parent := filepath.Dir(p); parent != string(os.PathSeparator); parent = filepath.Dir(parent) {
+			if _, ok := merged[parent].(Directory); ok {
+				break
+			}
+
+			// Only a directory resolves the conflict, as paths remain below.
+			c := newConflict(parent, baseResources[parent], ourResources[parent], theirResources[parent])
+			if resolved, ok := o.resolve(c); ok {
+				if dir, ok := resolved.(Directory); ok {
+					merged[parent] = dir
+					continue
+				}
+			}
+			report(c)
+
+			dir, ok := c.Ours.(Directory)
+			if !ok {
+				break
+			}
+			merged[parent] = dir
+		}
+	}
+	sort.Slice(conflicts, func(i, j int) bool { return conflicts[i].Path < conflicts[j].Path })
+
+	resources, err := resourcesOf(merged)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &Manifest{Resources: resources, Header: newHeader(resources)}, conflicts, nil
+}
+
+// resourcesByPath maps every path of the manifest m to its resource.
+func resourcesByPath(m *Manifest) map[string]Resource {
+	byPath := map[string]Resource{}
+	for _, r := range m.Resources {
+		for _, p := range resourcePaths(r) {
+			byPath[p] = r
+		}
+	}
+	return byPath
+}
+
+// unionPaths returns the paths of all of the maps, sorted.
+func unionPaths(maps ...map[string]Resource) []string {
+	seen := map[string]bool{}
+	var paths []string
+	for _, m := range maps {
+		for p := range m {
+			if !seen[p] {
+				seen[p] = true
+				paths = append(paths, p)
+			}
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// resourcesOf returns the resources of a manifest with the given paths. The
+// resources of hardlinks are only given the paths they are mapped at.
+func resourcesOf(byPath map[string]Resource) ([]Resource, error) {
+	var (
+		order []Resource
+		paths = map[Resource][]string{}
+	)
+	for _, p := range unionPaths(byPath) {
+		r := byPath[p]
+		if _, ok := paths[r]; !ok {
+			order = append(order, r)
+		}
+		paths[r] = append(paths[r], p)
+	}
+
+	resources := make([]Resource, 0, len(order))
+	for _, r := range order {
+		if len(paths[r]) != len(resourcePaths(r)) {
+			var err error
+			if r, err = withPaths(r, paths[r]); err != nil {
+				return nil, err
+			}
+		}
+		resources = append(resources, r)
+	}
+	sort.Stable(ByPath(resources))
+	return resources, nil
+}
+
+// sameEntry returns true if the resources a and b, either of which may be
+// nil, are the same.
+func sameEntry(a, b Resource) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return sameResource(a, b)
+}
+
+// sameResource returns true if the resources a and b are described by the same
+// record.
+func sameResource(a, b Resource) bool {
+	return proto.Equal(ResourceToProto(a), ResourceToProto(b))
+}
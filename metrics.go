@@ -0,0 +1,82 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continuity
+
+import (
+	"errors"
+	"io"
+	"os"
+	"time"
+)
+
+// Metrics receives measurements of the work done through a context, so that
+// they can be exported to a monitoring system such as Prometheus. The
+// methods may be called concurrently.
+type Metrics interface {
+	// Observe is called after each call to Resource, Verify or Apply, with
+	// the name of the operation ("resource", "verify" or "apply") and the
+	// time taken. Counting the calls gives the rate of files processed.
+	Observe(op string, d time.Duration)
+
+	// Hashed is called after the content of a file has been digested, with
+	// the number of bytes read and the time taken.
+	Hashed(n int64, d time.Duration)
+
+	// Error is called when an operation fails, with the name of the
+	// operation and the class of the error, which is one of "notexist",
+	// "permission", "unsupported" or "other".
+	Error(op string, class string)
+}
+
+// errorClass sorts err into one of the classes reported to Metrics.
+func errorClass(err error) string {
+	switch {
+	case errors.Is(err, os.ErrNotExist), errors.Is(err, ErrNotFound):
+		return "notexist"
+	case errors.Is(err, os.ErrPermission):
+		return "permission"
+	case errors.Is(err, ErrNotSupported):
+		return "unsupported"
+	default:
+		return "other"
+	}
+}
+
+// observe reports an operation started at start to the metrics, if any. It
+// is meant to be deferred, with errp pointing to the operation's error.
+func (c *context) observe(op string, start time.Time, errp *error) {
+	if c.metrics == nil {
+		return
+	}
+
+	c.metrics.Observe(op, time.Since(start))
+	if *errp != nil {
+		c.metrics.Error(op, errorClass(*errp))
+	}
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.n += int64(n)
+	return n, err
+}
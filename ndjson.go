@@ -0,0 +1,135 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continuity
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	pb "github.com/containerd/continuity/proto"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// ndjsonMarshal writes each resource on a single line, with the field names
+// of the proto file as for MarshalJSON.
+var ndjsonMarshal = protojson.MarshalOptions{UseProtoNames: true}
+
+// BuildNDJSON builds the manifest of the context like BuildManifest, but
+// writes each resource to w as it is walked rather than collecting them,
+// as newline-delimited JSON: one JSON mapping of a resource message per line,
+// in walk order. Files with more than one path are written in full at the
+// first path and as links to it at the others, as described by
+// CheckHardlinks. The stream has no header; it returns true if entries were
+// left out at the limits of the build.
+func BuildNDJSON(ctx Context, w io.Writer, opts ...BuildOpt) (bool, error) {
+	bw := bufio.NewWriter(w)
+	linked := map[hardlinkKey]string{}
+
+	truncated, err := walkResources(ctx, opts, func(p string, fi os.FileInfo, resource Resource) error {
+		b := ResourceToProto(resource)
+		if _, ok := resource.(Hardlinkable); ok {
+			key, err := newHardlinkKey(fi)
+			if err == nil {
+				if first, ok := linked[key]; ok {
+					b = &pb.Resource{
+						Path:      b.Path,
+						Mode:      b.Mode,
+						PosixMode: b.PosixMode,
+						Type:      pb.Type_TYPE_REGULAR,
+						Target:    first,
+					}
+				} else {
+					linked[key] = p
+				}
+			} else if err != errNotAHardLink {
+				return fmt.Errorf("adding hardlink %s: %w", p, err)
+			}
+		}
+
+		return writeNDJSONLine(bw, b)
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return truncated, bw.Flush()
+}
+
+// MarshalNDJSON writes the resources of the manifest to w as
+// newline-delimited JSON, in the format written by BuildNDJSON. The header
+// of the manifest is not written.
+func MarshalNDJSON(w io.Writer, m *Manifest) error {
+	bw := bufio.NewWriter(w)
+	for _, resource := range m.Resources {
+		if err := writeNDJSONLine(bw, ResourceToProto(resource)); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+func writeNDJSONLine(w *bufio.Writer, b *pb.Resource) error {
+	p, err := ndjsonMarshal.Marshal(b)
+	if err != nil {
+		return err
+	}
+	// Without Multiline, protojson writes the message on a single line.
+	if _, err := w.Write(p); err != nil {
+		return err
+	}
+	return w.WriteByte('\n')
+}
+
+// ReadNDJSON reads a manifest written as newline-delimited JSON by
+// BuildNDJSON or MarshalNDJSON. Blank lines are ignored and unknown fields
+// are rejected. The resources are sorted by path and the header is derived
+// from them, so a manifest that was truncated as it was built is not marked
+// as such.
+func ReadNDJSON(r io.Reader, opts ...UnmarshalOpt) (*Manifest, error) {
+	var bm pb.Manifest
+
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, 64<<20)
+	for line := 1; sc.Scan(); line++ {
+		p := bytes.TrimSpace(sc.Bytes())
+		if len(p) == 0 {
+			continue
+		}
+
+		var b pb.Resource
+		if err := protojson.Unmarshal(p, &b); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		bm.Resource = append(bm.Resource, &b)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+
+	m, err := FromProto(&bm, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Stable(ByPath(m.Resources))
+	m.Header = newHeader(m.Resources)
+	return m, nil
+}
@@ -0,0 +1,155 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package pathdriver
+
+import (
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// SlashPathDriver implements the path manipulation of PathDriver for slash
+// separated paths, whatever the local platform, as used by drivers of remote
+// and virtual filesystems. Such drivers embed it and add a Walk method, for
+// which WalkTree can be used. Abs anchors relative paths at the root.
+type SlashPathDriver struct{}
+
+func (SlashPathDriver) Join(paths ...string) string {
+	return path.Join(paths...)
+}
+
+func (SlashPathDriver) IsAbs(p string) bool {
+	return path.IsAbs(p)
+}
+
+// Rel returns a relative path that is lexically equivalent to target when
+// joined to base, like filepath.Rel.
+func (SlashPathDriver) Rel(base, target string) (string, error) {
+	base, target = path.Clean(base), path.Clean(target)
+	if base == target {
+		return ".", nil
+	}
+	if path.IsAbs(base) != path.IsAbs(target) {
+		return "", errors.New("Rel: can't make " + target + " relative to " + base)
+	}
+	if base == "." {
+		return target, nil
+	}
+
+	split := func(p string) []string {
+		p = strings.TrimPrefix(p, "/")
+		if p == "" || p == "." {
+			return nil
+		}
+		return strings.Split(p, "/")
+	}
+	bs, ts := split(base), split(target)
+
+	i := 0
+	for i < len(bs) && i < len(ts) && bs[i] == ts[i] {
+		i++
+	}
+	for _, b := range bs[i:] {
+		if b == ".." {
+			return "", errors.New("Rel: can't make " + target + " relative to " + base)
+		}
+	}
+
+	parts := make([]string, 0, len(bs)-i+len(ts)-i)
+	for range bs[i:] {
+		parts = append(parts, "..")
+	}
+	parts = append(parts, ts[i:]...)
+	return strings.Join(parts, "/"), nil
+}
+
+func (SlashPathDriver) Base(p string) string {
+	return path.Base(p)
+}
+
+func (SlashPathDriver) Dir(p string) string {
+	return path.Dir(p)
+}
+
+func (SlashPathDriver) Clean(p string) string {
+	return path.Clean(p)
+}
+
+func (SlashPathDriver) Split(p string) (dir, file string) {
+	return path.Split(p)
+}
+
+func (SlashPathDriver) Separator() byte {
+	return '/'
+}
+
+func (SlashPathDriver) Abs(p string) (string, error) {
+	return path.Join("/", p), nil
+}
+
+func (SlashPathDriver) FromSlash(p string) string {
+	return p
+}
+
+func (SlashPathDriver) ToSlash(p string) string {
+	return p
+}
+
+func (SlashPathDriver) Match(pattern, name string) (bool, error) {
+	return path.Match(pattern, name)
+}
+
+// WalkTree walks the tree at the slash separated path root like
+// filepath.Walk, describing files with lstat and listing directories with
+// readDir, which must return the entries sorted by name.
+func WalkTree(root string, lstat func(string) (os.FileInfo, error), readDir func(string) ([]os.FileInfo, error), walkFn filepath.WalkFunc) error {
+	fi, err := lstat(root)
+	if err != nil {
+		err = walkFn(root, nil, err)
+	} else {
+		err = walkTree(root, fi, readDir, walkFn)
+	}
+	if err == filepath.SkipDir {
+		return nil
+	}
+	return err
+}
+
+func walkTree(p string, fi os.FileInfo, readDir func(string) ([]os.FileInfo, error), walkFn filepath.WalkFunc) error {
+	if !fi.IsDir() {
+		return walkFn(p, fi, nil)
+	}
+
+	fis, err := readDir(p)
+	err1 := walkFn(p, fi, err)
+	if err != nil || err1 != nil {
+		// As with filepath.Walk, a directory that cannot be read is passed
+		// to walkFn with the error, and skipped if walkFn returns nil.
+		return err1
+	}
+
+	for _, cfi := range fis {
+		if err := walkTree(path.Join(p, cfi.Name()), cfi, readDir, walkFn); err != nil {
+			if !cfi.IsDir() || err != filepath.SkipDir {
+				return err
+			}
+		}
+	}
+	return nil
+}
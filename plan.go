@@ -0,0 +1,476 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continuity
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	driverpkg "github.com/containerd/continuity/driver"
+	"github.com/opencontainers/go-digest"
+)
+
+// ChangeKind is the kind of operation a Change stands for.
+type ChangeKind string
+
+const (
+	// ChangeCreate creates a directory, symlink, device or named pipe.
+	ChangeCreate ChangeKind = "create"
+	// ChangeWrite writes the content of a regular file, creating it if
+	// needed.
+	ChangeWrite ChangeKind = "write"
+	// ChangeRemove removes a file that is in the way of a resource.
+	ChangeRemove ChangeKind = "remove"
+	// ChangeLink creates a hardlink.
+	ChangeLink ChangeKind = "link"
+	// ChangeChmod changes the mode of a file.
+	ChangeChmod ChangeKind = "chmod"
+	// ChangeChown changes the owner of a file.
+	ChangeChown ChangeKind = "chown"
+	// ChangeXAttrs sets extended attributes.
+	ChangeXAttrs ChangeKind = "xattrs"
+	// ChangeReparsePoint sets the reparse data of a file.
+	ChangeReparsePoint ChangeKind = "reparse"
+	// ChangeProjectID sets the project quota id of a file.
+	ChangeProjectID ChangeKind = "projectid"
+	// ChangeFileAttributes sets the Windows file attributes of a file.
+	ChangeFileAttributes ChangeKind = "attributes"
+)
+
+// Change is an operation that applying a manifest would perform.
+type Change struct {
+	Kind ChangeKind `json:"kind"`
+
+	// Path is the path of the changed file within the context.
+	Path string `json:"path"`
+
+	// Detail describes the change, such as the new mode for ChangeChmod.
+	Detail string `json:"detail,omitempty"`
+}
+
+func (c Change) String() string {
+	if c.Detail == "" {
+		return fmt.Sprintf("%s %s", c.Kind, c.Path)
+	}
+	return fmt.Sprintf("%s %s (%s)", c.Kind, c.Path, c.Detail)
+}
+
+// Plan returns the changes that ApplyManifest would make to the context to
+// apply the manifest, in order, without making them. Like ApplyManifest,
+// it never plans the removal of files that are not in the manifest. The
+// file content provider of the context is checked for the content to write,
+// but no content is read from it.
+//
+// Only contexts returned by NewContext and NewContextWithOptions can be
+// planned against.
+func Plan(ctx Context, manifest *Manifest) ([]Change, error) {
+	c, ok := ctx.(*context)
+	if !ok {
+		return nil, fmt.Errorf("planning is not supported for %T: %w", ctx, ErrNotSupported)
+	}
+
+	var changes []Change
+	if err := c.plan(manifest, func(_ Resource, resourceChanges []Change) {
+		changes = append(changes, resourceChanges...)
+	}); err != nil {
+		return nil, err
+	}
+
+	return changes, nil
+}
+
+// Repair brings the context back in line with the manifest, only touching
+// the resources that have drifted from it, and returns the changes made.
+// Files whose metadata drifted have it fixed in place, broken hardlinks are
+// linked again, and only files whose content no longer matches their digest
+// are written, with content from the file content provider of the context.
+// As with Plan, only contexts returned by NewContext and
+// NewContextWithOptions can be repaired.
+func Repair(ctx Context, manifest *Manifest) ([]Change, error) {
+	c, ok := ctx.(*context)
+	if !ok {
+		return nil, fmt.Errorf("repair is not supported for %T: %w", ctx, ErrNotSupported)
+	}
+
+	var (
+		drifted []Resource
+		changes []Change
+	)
+	if err := c.plan(manifest, func(resource Resource, resourceChanges []Change) {
+		if len(resourceChanges) > 0 {
+			drifted = append(drifted, resource)
+			changes = append(changes, resourceChanges...)
+		}
+	}); err != nil {
+		return nil, err
+	}
+
+	for _, resource := range drifted {
+		if err := c.Apply(resource); err != nil {
+			return nil, err
+		}
+	}
+
+	return changes, nil
+}
+
+// plan plans the apply of every resource of the manifest in turn, passing
+// each to fn with the changes its apply would make.
+func (c *context) plan(manifest *Manifest, fn func(Resource, []Change)) error {
+	pc, planner := c.planner()
+	for _, resource := range manifest.Resources {
+		planner.changes = nil
+		if err := pc.Apply(resource); err != nil {
+			return err
+		}
+		fn(resource, planner.changes)
+	}
+
+	return nil
+}
+
+// planner returns a copy of the context that applies resources through a
+// planDriver, along with the driver.
+func (c *context) planner() (*context, *planDriver) {
+	planner := &planDriver{
+		Driver:  c.driver,
+		context: c,
+		created: map[string]bool{},
+	}
+
+	pc := *c
+	pc.driver = planner
+	pc.metrics = nil
+	return &pc, planner
+}
+
+// planDriver records the changes made through it instead of making them.
+// Reads are passed on to the underlying driver, and files created during the
+// plan are remembered so that later changes to them can be judged.
+type planDriver struct {
+	driverpkg.Driver
+	context *context
+	changes []Change
+	created map[string]bool
+}
+
+func (d *planDriver) record(kind ChangeKind, fp string, detail string) {
+	p := fp
+	if rel, err := d.context.pathDriver.Rel(d.context.root, fp); err == nil {
+		p = "/" + d.context.pathDriver.ToSlash(rel)
+	}
+
+	d.changes = append(d.changes, Change{Kind: kind, Path: p, Detail: detail})
+}
+
+// write records the checkout of a regular file.
+func (d *planDriver) write(fp string, rf RegularFile) {
+	d.record(ChangeWrite, fp, fmt.Sprintf("%d bytes", rf.Size()))
+	d.created[fp] = true
+}
+
+// current returns the resource as it is on disk at fp, or nil if the file
+// does not exist or is created by the plan.
+func (d *planDriver) current(fp string) (*resource, error) {
+	if d.created[fp] {
+		return nil, nil
+	}
+
+	fi, err := d.Driver.Lstat(fp)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return newBaseResource(fp, fi)
+}
+
+func (d *planDriver) Lstat(path string) (os.FileInfo, error) {
+	if d.created[path] {
+		// The plan has created the file, but a description of it is not
+		// needed to apply it.
+		return nil, &os.PathError{Op: "lstat", Path: path, Err: os.ErrNotExist}
+	}
+	return d.Driver.Lstat(path)
+}
+
+func (d *planDriver) Lstatx(path string) (os.FileInfo, *driverpkg.Statx, error) {
+	if d.created[path] {
+		return nil, nil, &os.PathError{Op: "statx", Path: path, Err: os.ErrNotExist}
+	}
+
+	statxDriver, ok := d.Driver.(driverpkg.StatxDriver)
+	if !ok {
+		fi, err := d.Driver.Lstat(path)
+		return fi, nil, err
+	}
+	return statxDriver.Lstatx(path)
+}
+
+func (d *planDriver) BirthTime(path string) (time.Time, error) {
+	birthTimeDriver, ok := d.Driver.(driverpkg.BirthTimeDriver)
+	if !ok {
+		return time.Time{}, fmt.Errorf("birth times are not supported: %w", driverpkg.ErrNotSupported)
+	}
+	return birthTimeDriver.BirthTime(path)
+}
+
+func (d *planDriver) Mkdir(path string, mode os.FileMode) error {
+	d.record(ChangeCreate, path, fmt.Sprintf("directory, %v", mode))
+	d.created[path] = true
+	return nil
+}
+
+func (d *planDriver) Mknod(path string, mode os.FileMode, major int, minor int) error {
+	d.record(ChangeCreate, path, fmt.Sprintf("device %d:%d, %v", major, minor, mode))
+	d.created[path] = true
+	return nil
+}
+
+func (d *planDriver) Mkfifo(path string, mode os.FileMode) error {
+	d.record(ChangeCreate, path, fmt.Sprintf("named pipe, %v", mode))
+	d.created[path] = true
+	return nil
+}
+
+func (d *planDriver) Symlink(oldname, newname string) error {
+	d.record(ChangeCreate, newname, fmt.Sprintf("symlink to %s", oldname))
+	d.created[newname] = true
+	return nil
+}
+
+func (d *planDriver) CreateSymlink(target, path string, dir bool) error {
+	if _, ok := d.Driver.(driverpkg.SymlinkTypeDriver); !ok {
+		return d.Symlink(target, path)
+	}
+
+	typ := "file"
+	if dir {
+		typ = "directory"
+	}
+	d.record(ChangeCreate, path, fmt.Sprintf("%s symlink to %s", typ, target))
+	d.created[path] = true
+	return nil
+}
+
+func (d *planDriver) Link(oldname, newname string) error {
+	d.record(ChangeLink, newname, fmt.Sprintf("to %s", oldname))
+	d.created[newname] = true
+	return nil
+}
+
+func (d *planDriver) Remove(path string) error {
+	if !d.created[path] {
+		if _, err := d.Driver.Lstat(path); err != nil {
+			return err
+		}
+	}
+
+	d.record(ChangeRemove, path, "")
+	delete(d.created, path)
+	return nil
+}
+
+func (d *planDriver) Lchmod(path string, mode os.FileMode) error {
+	r, err := d.current(path)
+	if err != nil {
+		return err
+	}
+
+	// Files created by the plan are created with the right mode.
+	if r != nil && r.mode != mode {
+		d.record(ChangeChmod, path, fmt.Sprintf("%v to %v", r.mode, mode))
+	}
+	return nil
+}
+
+func (d *planDriver) Lchown(path string, uid, gid int64) error {
+	r, err := d.current(path)
+	if err != nil {
+		return err
+	}
+
+	if r == nil {
+		// Created files belong to the applying user at first.
+		r = &resource{uid: int64(os.Geteuid()), gid: int64(os.Getegid())}
+	}
+	if r.uid != uid || r.gid != gid {
+		d.record(ChangeChown, path, fmt.Sprintf("%d:%d to %d:%d", r.uid, r.gid, uid, gid))
+	}
+	return nil
+}
+
+func (d *planDriver) Getxattr(path string) (map[string][]byte, error) {
+	xattrDriver, ok := d.Driver.(driverpkg.XAttrDriver)
+	if !ok {
+		return nil, fmt.Errorf("xattr extraction is not supported: %w", ErrNotSupported)
+	}
+	return xattrDriver.Getxattr(path)
+}
+
+func (d *planDriver) Setxattr(path string, attr map[string][]byte) error {
+	xattrDriver, ok := d.Driver.(driverpkg.XAttrDriver)
+	if !ok {
+		return fmt.Errorf("unsupported xattr for %q", path)
+	}
+	return d.setxattr(path, attr, xattrDriver.Getxattr)
+}
+
+func (d *planDriver) LGetxattr(path string) (map[string][]byte, error) {
+	lxattrDriver, ok := d.Driver.(driverpkg.LXAttrDriver)
+	if !ok {
+		return nil, fmt.Errorf("xattr extraction for symlinks is not supported: %w", ErrNotSupported)
+	}
+	return lxattrDriver.LGetxattr(path)
+}
+
+func (d *planDriver) LSetxattr(path string, attr map[string][]byte) error {
+	lxattrDriver, ok := d.Driver.(driverpkg.LXAttrDriver)
+	if !ok {
+		return fmt.Errorf("unsupported symlink xattr for %q", path)
+	}
+	return d.setxattr(path, attr, lxattrDriver.LGetxattr)
+}
+
+// setxattr records the attributes of attr that differ from those of the
+// file, as returned by get.
+func (d *planDriver) setxattr(path string, attr map[string][]byte, get func(string) (map[string][]byte, error)) error {
+	current := map[string][]byte{}
+	if !d.created[path] {
+		var err error
+		if current, err = get(path); err != nil {
+			return err
+		}
+	}
+
+	var changed []string
+	for k, v := range attr {
+		if cv, ok := current[k]; !ok || !bytes.Equal(cv, v) {
+			changed = append(changed, k)
+		}
+	}
+	if len(changed) > 0 {
+		sort.Strings(changed)
+		d.record(ChangeXAttrs, path, strings.Join(changed, ", "))
+	}
+	return nil
+}
+
+func (d *planDriver) GetReparsePoint(path string) ([]byte, error) {
+	rpDriver, ok := d.Driver.(driverpkg.ReparsePointDriver)
+	if !ok {
+		return nil, fmt.Errorf("reparse point extraction is not supported for %s: %w", path, ErrNotSupported)
+	}
+	return rpDriver.GetReparsePoint(path)
+}
+
+func (d *planDriver) SetReparsePoint(path string, data []byte) error {
+	if _, ok := d.Driver.(driverpkg.ReparsePointDriver); !ok {
+		return fmt.Errorf("unsupported reparse point for %q", path)
+	}
+	d.record(ChangeReparsePoint, path, fmt.Sprintf("%d bytes", len(data)))
+	return nil
+}
+
+func (d *planDriver) Junction(target, path string) error {
+	if _, ok := d.Driver.(driverpkg.ReparsePointDriver); !ok {
+		return fmt.Errorf("unsupported junction for %q", path)
+	}
+	d.record(ChangeCreate, path, fmt.Sprintf("junction to %s", target))
+	d.created[path] = true
+	return nil
+}
+
+func (d *planDriver) GetProjectID(path string) (uint32, error) {
+	projectIDDriver, ok := d.Driver.(driverpkg.ProjectIDDriver)
+	if !ok {
+		return 0, fmt.Errorf("project ids are not supported: %w", driverpkg.ErrNotSupported)
+	}
+	return projectIDDriver.GetProjectID(path)
+}
+
+func (d *planDriver) SetProjectID(path string, id uint32) error {
+	projectIDDriver, ok := d.Driver.(driverpkg.ProjectIDDriver)
+	if !ok {
+		return fmt.Errorf("unsupported project id for %q", path)
+	}
+
+	if !d.created[path] {
+		current, err := projectIDDriver.GetProjectID(path)
+		if err != nil {
+			return err
+		}
+		if current == id {
+			return nil
+		}
+	}
+
+	d.record(ChangeProjectID, path, fmt.Sprint(id))
+	return nil
+}
+
+func (d *planDriver) MeasureVerity(path string) (digest.Digest, error) {
+	verityDriver, ok := d.Driver.(driverpkg.VerityDriver)
+	if !ok {
+		return "", fmt.Errorf("fs-verity is not supported: %w", driverpkg.ErrNotSupported)
+	}
+	return verityDriver.MeasureVerity(path)
+}
+
+func (d *planDriver) StatFilesystem(path string) (string, string, error) {
+	fsDriver, ok := d.Driver.(driverpkg.FilesystemDriver)
+	if !ok {
+		return "", "", fmt.Errorf("filesystem identification is not supported: %w", driverpkg.ErrNotSupported)
+	}
+	return fsDriver.StatFilesystem(path)
+}
+
+func (d *planDriver) DeviceInfo(fi os.FileInfo) (uint64, uint64, error) {
+	deviceDriver, ok := d.Driver.(driverpkg.DeviceInfoDriver)
+	if !ok {
+		return 0, 0, fmt.Errorf("device extraction is not supported: %w", ErrNotSupported)
+	}
+	return deviceDriver.DeviceInfo(fi)
+}
+
+func (d *planDriver) SetFileAttributes(path string, attrs uint32) error {
+	if _, ok := d.Driver.(driverpkg.FileAttributeDriver); !ok {
+		// Without support in the underlying driver, applying skips the
+		// attributes.
+		return nil
+	}
+
+	r, err := d.current(path)
+	if err != nil {
+		return err
+	}
+
+	var current uint32
+	if r != nil {
+		current = r.fileAttributes
+	}
+	if current != attrs {
+		d.record(ChangeFileAttributes, path, fmt.Sprintf("%#x to %#x", current, attrs))
+	}
+	return nil
+}
@@ -0,0 +1,219 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continuity
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// Progress receives updates on the progress of building, verifying or
+// applying a manifest. Implementations can use them to render progress bars
+// and estimate the time remaining.
+type Progress interface {
+	Update(ProgressUpdate)
+}
+
+// ProgressUpdate is a snapshot of the work done through a context.
+type ProgressUpdate struct {
+	// Entries is the number of resources built, verified or applied so far.
+	Entries int64
+
+	// Bytes is the number of bytes of file content read so far, to digest
+	// or to copy it.
+	Bytes int64
+
+	// Written is the number of bytes of file content written so far, by
+	// applies.
+	Written int64
+
+	// Path is the path of the resource currently being processed.
+	Path string
+
+	// TotalEntries and TotalBytes are the number of resources to process and
+	// the size of the file content to read, where they are known in advance,
+	// such as when a manifest is applied, or zero. TotalBytes is an estimate,
+	// since files already in place are only read to compare their content,
+	// and files that differ are read again from the content provider.
+	TotalEntries int64
+	TotalBytes   int64
+
+	// Elapsed is the time since work started through the context, or since
+	// the totals were last set.
+	Elapsed time.Duration
+}
+
+// Remaining estimates the time left until the work is done, from the
+// fraction of the entries or bytes processed so far, whichever is greater,
+// and the time elapsed. It returns false if the totals are not known or no
+// progress has been made yet.
+func (u ProgressUpdate) Remaining() (time.Duration, bool) {
+	var done float64
+	if u.TotalEntries > 0 {
+		done = float64(u.Entries) / float64(u.TotalEntries)
+	}
+	if u.TotalBytes > 0 {
+		if f := float64(u.Bytes) / float64(u.TotalBytes); f > done {
+			done = f
+		}
+	}
+	if done <= 0 {
+		return 0, false
+	}
+	if done >= 1 {
+		return 0, true
+	}
+	return time.Duration(float64(u.Elapsed) * (1 - done) / done), true
+}
+
+// progressTracker accumulates progress and passes it on, at most once per
+// interval. A nil progressTracker discards progress.
+type progressTracker struct {
+	progress Progress
+	interval time.Duration
+
+	mu      sync.Mutex
+	start   time.Time
+	last    time.Time
+	update  ProgressUpdate
+	pending bool // progress was made since the last report
+}
+
+func newProgressTracker(progress Progress, interval time.Duration) *progressTracker {
+	if progress == nil {
+		return nil
+	}
+
+	return &progressTracker{
+		progress: progress,
+		interval: interval,
+	}
+}
+
+// expect starts tracking work of the given totals, resetting the progress
+// made so far.
+func (t *progressTracker) expect(entries, bytes int64) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	t.start = time.Now()
+	t.update = ProgressUpdate{TotalEntries: entries, TotalBytes: bytes}
+	t.mu.Unlock()
+}
+
+// entry records the start of work on the resource at path p.
+func (t *progressTracker) entry(p string) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	t.update.Entries++
+	t.update.Path = p
+	t.report()
+	t.mu.Unlock()
+}
+
+// read records n bytes of file content read.
+func (t *progressTracker) read(n int) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	t.update.Bytes += int64(n)
+	t.report()
+	t.mu.Unlock()
+}
+
+// wrote records n bytes of file content written.
+func (t *progressTracker) wrote(n int) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	t.update.Written += int64(n)
+	t.report()
+	t.mu.Unlock()
+}
+
+// report passes the current progress on if the interval has passed since
+// the last report. It must be called with mu held.
+func (t *progressTracker) report() {
+	now := time.Now()
+	if t.start.IsZero() {
+		t.start = now
+	}
+	if now.Sub(t.last) < t.interval {
+		t.pending = true
+		return
+	}
+
+	t.pending = false
+	t.last = now
+	t.update.Elapsed = now.Sub(t.start)
+	t.progress.Update(t.update)
+}
+
+// flush passes the progress held back by the interval on, once the work is
+// done.
+func (t *progressTracker) flush() {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	if t.pending {
+		t.last = time.Time{}
+		t.report()
+	}
+	t.mu.Unlock()
+}
+
+// reader returns r, counting the bytes read from it as progress.
+func (t *progressTracker) reader(r io.Reader) io.Reader {
+	if t == nil {
+		return r
+	}
+
+	return &progressReader{Reader: r, count: t.read}
+}
+
+// writes returns r, counting the bytes read from it as written, for content
+// copied to files.
+func (t *progressTracker) writes(r io.Reader) io.Reader {
+	if t == nil {
+		return r
+	}
+
+	return &progressReader{Reader: r, count: t.wrote}
+}
+
+type progressReader struct {
+	io.Reader
+	count func(int)
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.count(n)
+	return n, err
+}
@@ -16,6 +16,6 @@
 
 package proto
 
-//go:generate protoc --go_out=. manifest.proto
-//go:generate mv github.com/containerd/continuity/proto/manifest.pb.go .
+//go:generate protoc --go_out=. manifest.proto report.proto
+//go:generate mv github.com/containerd/continuity/proto/manifest.pb.go github.com/containerd/continuity/proto/report.pb.go .
 //go:generate rmdir -p github.com/containerd/continuity/proto
@@ -0,0 +1,144 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continuity
+
+import (
+	"os"
+	"runtime/debug"
+	"time"
+
+	pb "github.com/containerd/continuity/proto"
+)
+
+// modulePath is the path of this module, naming the builder of manifests in
+// their provenance.
+const modulePath = "github.com/containerd/continuity"
+
+// Provenance records how, where and when a manifest was built, along with
+// labels attached to the manifest as a whole. Manifests carry none unless it
+// is set, since it differs between otherwise identical builds.
+type Provenance struct {
+	// Builder names the tool that built the manifest, and its version.
+	Builder string
+
+	// Hostname is the name of the host the manifest was built on.
+	Hostname string
+
+	// BuildTime is the time the build started.
+	BuildTime time.Time
+
+	// Root is the path of the tree the manifest was built from.
+	Root string
+
+	// Labels holds metadata attached to the manifest by its builder.
+	Labels map[string]string
+
+	// unknown holds the encoded fields of the provenance that this package
+	// does not know.
+	unknown []byte
+}
+
+// NewProvenance returns the provenance of a manifest built now from root on
+// this host, by this version of the package. The build time is clamped to
+// SOURCE_DATE_EPOCH, if set.
+func NewProvenance(root string) (*Provenance, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	epoch, ok, err := SourceDateEpoch()
+	if err != nil {
+		return nil, err
+	}
+	buildTime := time.Now().UTC()
+	if ok {
+		buildTime = clampTime(buildTime, epoch)
+	}
+
+	return &Provenance{
+		Builder:   builder(),
+		Hostname:  hostname,
+		BuildTime: buildTime,
+		Root:      root,
+	}, nil
+}
+
+// builder returns the path of this module and its version, as recorded in
+// the build information of the binary.
+func builder() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return modulePath
+	}
+	mod := &info.Main
+	for _, dep := range info.Deps {
+		if dep.Path == modulePath {
+			mod = dep
+		}
+	}
+	if mod.Path != modulePath || mod.Version == "" {
+		return modulePath
+	}
+	if mod.Replace != nil && mod.Replace.Version != "" {
+		return modulePath + "@" + mod.Replace.Version
+	}
+	return modulePath + "@" + mod.Version
+}
+
+func provenanceToProto(p *Provenance) *pb.Provenance {
+	if p == nil {
+		return nil
+	}
+	bp := &pb.Provenance{
+		Builder:  p.Builder,
+		Hostname: p.Hostname,
+		Root:     p.Root,
+	}
+	if !p.BuildTime.IsZero() {
+		bp.BuildTime = p.BuildTime.UnixNano()
+	}
+	if len(p.Labels) > 0 {
+		bp.Labels = make(map[string]string, len(p.Labels))
+		for k, v := range p.Labels {
+			bp.Labels[k] = v
+		}
+	}
+	setUnknownFields(bp, p.unknown)
+	return bp
+}
+
+func provenanceFromProto(bp *pb.Provenance) *Provenance {
+	if bp == nil {
+		return nil
+	}
+	p := &Provenance{
+		Builder:  bp.Builder,
+		Hostname: bp.Hostname,
+		Root:     bp.Root,
+		unknown:  unknownFields(bp),
+	}
+	if bp.BuildTime != 0 {
+		p.BuildTime = time.Unix(0, bp.BuildTime).UTC()
+	}
+	if len(bp.Labels) > 0 {
+		p.Labels = make(map[string]string, len(bp.Labels))
+		for k, v := range bp.Labels {
+			p.Labels[k] = v
+		}
+	}
+	return p
+}
@@ -0,0 +1,92 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continuity
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// limiter is a token bucket, holding up to one second worth of tokens. Calls
+// may take more tokens than are available and then wait for the debt to be
+// paid off, so that large reads are throttled as well. A nil limiter does not
+// limit anything.
+type limiter struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+// newLimiter returns a limiter allowing rate tokens per second, or nil if
+// rate is not positive.
+func newLimiter(rate int64) *limiter {
+	if rate <= 0 {
+		return nil
+	}
+
+	return &limiter{
+		rate:   float64(rate),
+		tokens: float64(rate),
+		last:   time.Now(),
+	}
+}
+
+// wait takes n tokens, sleeping until the bucket is no longer in debt.
+func (l *limiter) wait(n int) {
+	if l == nil || n <= 0 {
+		return
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+	l.tokens -= float64(n)
+
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+
+	time.Sleep(delay)
+}
+
+// reader returns r, throttling reads from it to the rate of the limiter.
+func (l *limiter) reader(r io.Reader) io.Reader {
+	if l == nil {
+		return r
+	}
+
+	return &limitedReader{Reader: r, limiter: l}
+}
+
+type limitedReader struct {
+	io.Reader
+	limiter *limiter
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.limiter.wait(n)
+	return n, err
+}
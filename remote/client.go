@@ -0,0 +1,127 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package remote
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/containerd/continuity"
+	pb "github.com/containerd/continuity/proto"
+	remotepb "github.com/containerd/continuity/remote/proto"
+	"google.golang.org/grpc"
+)
+
+// Client calls the manifest service of a remote root.
+type Client struct {
+	client remotepb.ManifestServiceClient
+}
+
+// NewClient returns a client calling the manifest service over the
+// connection.
+func NewClient(conn grpc.ClientConnInterface) *Client {
+	return &Client{client: remotepb.NewManifestServiceClient(conn)}
+}
+
+// BuildManifest builds a manifest of the remote root.
+func (c *Client) BuildManifest(ctx context.Context) (*continuity.Manifest, error) {
+	resp, err := c.client.BuildManifest(ctx, &remotepb.BuildManifestRequest{})
+	if err != nil {
+		return nil, err
+	}
+
+	return continuity.FromProto(resp.Manifest)
+}
+
+// Verify verifies the remote root against the manifest. Differences found
+// are returned as an error, with the report filled in if not nil. Sampling
+// is as with continuity.WithSampling, and skipped if nil.
+func (c *Client) Verify(ctx context.Context, manifest *continuity.Manifest, sampling *continuity.Sampling, report *continuity.VerifyReport) error {
+	req := &remotepb.VerifyRequest{Manifest: continuity.ToProto(manifest)}
+	if sampling != nil {
+		req.SamplePercent = sampling.Percent
+		req.SampleSeed = sampling.Seed
+	}
+
+	resp, err := c.client.Verify(ctx, req)
+	if err != nil {
+		return err
+	}
+
+	if report != nil {
+		report.Resources = int(resp.Resources)
+		report.ContentVerified = int(resp.ContentVerified)
+		report.Sampling = sampling
+	}
+	if resp.Error != "" {
+		return errors.New(resp.Error)
+	}
+	return nil
+}
+
+// Diff returns the changes that applying the manifest would make to the
+// remote root.
+func (c *Client) Diff(ctx context.Context, manifest *continuity.Manifest) ([]continuity.Change, error) {
+	resp, err := c.client.Diff(ctx, &remotepb.DiffRequest{Manifest: continuity.ToProto(manifest)})
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []continuity.Change
+	for _, change := range resp.Change {
+		changes = append(changes, continuity.ChangeFromProto(change))
+	}
+
+	return changes, nil
+}
+
+// GetEntry returns the resource at the path of the remote root, writing the
+// content of regular files to w.
+func (c *Client) GetEntry(ctx context.Context, p string, w io.Writer) (continuity.Resource, error) {
+	stream, err := c.client.GetEntry(ctx, &remotepb.GetEntryRequest{Path: p})
+	if err != nil {
+		return nil, err
+	}
+
+	first, err := stream.Recv()
+	if err != nil {
+		return nil, err
+	}
+	if first.Resource == nil {
+		return nil, fmt.Errorf("no resource for %q in response", p)
+	}
+
+	m, err := continuity.FromProto(&pb.Manifest{Resource: []*pb.Resource{first.Resource}})
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		resp, err := stream.Recv()
+		if err == io.EOF {
+			return m.Resources[0], nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		if _, err := w.Write(resp.Data); err != nil {
+			return nil, err
+		}
+	}
+}
@@ -0,0 +1,178 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package remote
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/containerd/continuity"
+)
+
+// maxManifestSize limits the size of uploaded manifests.
+const maxManifestSize = 256 << 20
+
+// HTTPReport is the JSON report of the last verification started through
+// the HTTP API.
+type HTTPReport struct {
+	// State is "running" while the verification runs, then "done".
+	State string `json:"state"`
+
+	Started  time.Time  `json:"started"`
+	Finished *time.Time `json:"finished,omitempty"`
+
+	Resources       int `json:"resources"`
+	ContentVerified int `json:"contentVerified"`
+
+	// Error describes the first difference found between the root and the
+	// manifest. It is empty if the root matches.
+	Error string `json:"error,omitempty"`
+}
+
+// httpHandler serves the HTTP API of a server.
+type httpHandler struct {
+	server *Server
+
+	mu       sync.Mutex
+	manifest *continuity.Manifest
+	report   *HTTPReport
+}
+
+// HTTPHandler returns a handler serving a lightweight HTTP API for
+// environments where gRPC is inconvenient:
+//
+//	PUT  /manifest  uploads the manifest to verify against, in the binary format
+//	POST /verify    starts verifying the root against the manifest
+//	GET  /report    returns the report of the last verification as JSON
+func (s *Server) HTTPHandler() http.Handler {
+	h := &httpHandler{server: s}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/manifest", h.putManifest)
+	mux.HandleFunc("/verify", h.verify)
+	mux.HandleFunc("/report", h.getReport)
+	return mux
+}
+
+func (h *httpHandler) putManifest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		methodNotAllowed(w, http.MethodPut)
+		return
+	}
+
+	p, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxManifestSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	m, err := continuity.Unmarshal(p)
+	if err != nil {
+		http.Error(w, "error unmarshaling manifest: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	h.mu.Lock()
+	h.manifest = m
+	h.mu.Unlock()
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *httpHandler) verify(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, http.MethodPost)
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.manifest == nil {
+		http.Error(w, "no manifest uploaded", http.StatusConflict)
+		return
+	}
+	if h.report != nil && h.report.State == "running" {
+		http.Error(w, "verification already running", http.StatusConflict)
+		return
+	}
+
+	ctx, err := h.server.context()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	report := &HTTPReport{State: "running", Started: time.Now()}
+	h.report = report
+	go h.run(ctx, h.manifest, report)
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// run verifies the context against the manifest, filling in the report.
+func (h *httpHandler) run(ctx continuity.Context, manifest *continuity.Manifest, report *HTTPReport) {
+	var vr continuity.VerifyReport
+	err := continuity.VerifyManifest(ctx, manifest, continuity.WithVerifyReport(&vr))
+	finished := time.Now()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	report.State = "done"
+	report.Finished = &finished
+	report.Resources = vr.Resources
+	report.ContentVerified = vr.ContentVerified
+	if err != nil {
+		report.Error = err.Error()
+	}
+}
+
+func (h *httpHandler) getReport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	h.mu.Lock()
+	var p []byte
+	var err error
+	if h.report != nil {
+		p, err = json.Marshal(h.report)
+	}
+	h.mu.Unlock()
+
+	if p == nil && err == nil {
+		http.Error(w, "no verification started", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(p)
+}
+
+func methodNotAllowed(w http.ResponseWriter, allowed string) {
+	w.Header().Set("Allow", allowed)
+	http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+}
@@ -0,0 +1,260 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             v3.12.4
+// source: service.proto
+
+package proto
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	ManifestService_BuildManifest_FullMethodName = "/proto.ManifestService/BuildManifest"
+	ManifestService_Verify_FullMethodName        = "/proto.ManifestService/Verify"
+	ManifestService_Diff_FullMethodName          = "/proto.ManifestService/Diff"
+	ManifestService_GetEntry_FullMethodName      = "/proto.ManifestService/GetEntry"
+)
+
+// ManifestServiceClient is the client API for ManifestService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type ManifestServiceClient interface {
+	// BuildManifest builds a manifest of the root.
+	BuildManifest(ctx context.Context, in *BuildManifestRequest, opts ...grpc.CallOption) (*BuildManifestResponse, error)
+	// Verify verifies the root against a manifest.
+	Verify(ctx context.Context, in *VerifyRequest, opts ...grpc.CallOption) (*VerifyResponse, error)
+	// Diff lists the changes that applying a manifest would make to the
+	// root.
+	Diff(ctx context.Context, in *DiffRequest, opts ...grpc.CallOption) (*DiffResponse, error)
+	// GetEntry returns the resource at a path. The first response holds the
+	// resource and, for regular files, the content follows in chunks.
+	GetEntry(ctx context.Context, in *GetEntryRequest, opts ...grpc.CallOption) (ManifestService_GetEntryClient, error)
+}
+
+type manifestServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewManifestServiceClient(cc grpc.ClientConnInterface) ManifestServiceClient {
+	return &manifestServiceClient{cc}
+}
+
+func (c *manifestServiceClient) BuildManifest(ctx context.Context, in *BuildManifestRequest, opts ...grpc.CallOption) (*BuildManifestResponse, error) {
+	out := new(BuildManifestResponse)
+	err := c.cc.Invoke(ctx, ManifestService_BuildManifest_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *manifestServiceClient) Verify(ctx context.Context, in *VerifyRequest, opts ...grpc.CallOption) (*VerifyResponse, error) {
+	out := new(VerifyResponse)
+	err := c.cc.Invoke(ctx, ManifestService_Verify_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *manifestServiceClient) Diff(ctx context.Context, in *DiffRequest, opts ...grpc.CallOption) (*DiffResponse, error) {
+	out := new(DiffResponse)
+	err := c.cc.Invoke(ctx, ManifestService_Diff_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *manifestServiceClient) GetEntry(ctx context.Context, in *GetEntryRequest, opts ...grpc.CallOption) (ManifestService_GetEntryClient, error) {
+	stream, err := c.cc.NewStream(ctx, &ManifestService_ServiceDesc.Streams[0], ManifestService_GetEntry_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &manifestServiceGetEntryClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type ManifestService_GetEntryClient interface {
+	Recv() (*GetEntryResponse, error)
+	grpc.ClientStream
+}
+
+type manifestServiceGetEntryClient struct {
+	grpc.ClientStream
+}
+
+func (x *manifestServiceGetEntryClient) Recv() (*GetEntryResponse, error) {
+	m := new(GetEntryResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// ManifestServiceServer is the server API for ManifestService service.
+// All implementations must embed UnimplementedManifestServiceServer
+// for forward compatibility
+type ManifestServiceServer interface {
+	// BuildManifest builds a manifest of the root.
+	BuildManifest(context.Context, *BuildManifestRequest) (*BuildManifestResponse, error)
+	// Verify verifies the root against a manifest.
+	Verify(context.Context, *VerifyRequest) (*VerifyResponse, error)
+	// Diff lists the changes that applying a manifest would make to the
+	// root.
+	Diff(context.Context, *DiffRequest) (*DiffResponse, error)
+	// GetEntry returns the resource at a path. The first response holds the
+	// resource and, for regular files, the content follows in chunks.
+	GetEntry(*GetEntryRequest, ManifestService_GetEntryServer) error
+	mustEmbedUnimplementedManifestServiceServer()
+}
+
+// UnimplementedManifestServiceServer must be embedded to have forward compatible implementations.
+type UnimplementedManifestServiceServer struct {
+}
+
+func (UnimplementedManifestServiceServer) BuildManifest(context.Context, *BuildManifestRequest) (*BuildManifestResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method BuildManifest not implemented")
+}
+func (UnimplementedManifestServiceServer) Verify(context.Context, *VerifyRequest) (*VerifyResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Verify not implemented")
+}
+func (UnimplementedManifestServiceServer) Diff(context.Context, *DiffRequest) (*DiffResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Diff not implemented")
+}
+func (UnimplementedManifestServiceServer) GetEntry(*GetEntryRequest, ManifestService_GetEntryServer) error {
+	return status.Errorf(codes.Unimplemented, "method GetEntry not implemented")
+}
+func (UnimplementedManifestServiceServer) mustEmbedUnimplementedManifestServiceServer() {}
+
+// UnsafeManifestServiceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to ManifestServiceServer will
+// result in compilation errors.
+type UnsafeManifestServiceServer interface {
+	mustEmbedUnimplementedManifestServiceServer()
+}
+
+func RegisterManifestServiceServer(s grpc.ServiceRegistrar, srv ManifestServiceServer) {
+	s.RegisterService(&ManifestService_ServiceDesc, srv)
+}
+
+func _ManifestService_BuildManifest_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BuildManifestRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ManifestServiceServer).BuildManifest(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ManifestService_BuildManifest_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ManifestServiceServer).BuildManifest(ctx, req.(*BuildManifestRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ManifestService_Verify_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(VerifyRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ManifestServiceServer).Verify(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ManifestService_Verify_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ManifestServiceServer).Verify(ctx, req.(*VerifyRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ManifestService_Diff_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DiffRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ManifestServiceServer).Diff(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ManifestService_Diff_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ManifestServiceServer).Diff(ctx, req.(*DiffRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ManifestService_GetEntry_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(GetEntryRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(ManifestServiceServer).GetEntry(m, &manifestServiceGetEntryServer{stream})
+}
+
+type ManifestService_GetEntryServer interface {
+	Send(*GetEntryResponse) error
+	grpc.ServerStream
+}
+
+type manifestServiceGetEntryServer struct {
+	grpc.ServerStream
+}
+
+func (x *manifestServiceGetEntryServer) Send(m *GetEntryResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// ManifestService_ServiceDesc is the grpc.ServiceDesc for ManifestService service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var ManifestService_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "proto.ManifestService",
+	HandlerType: (*ManifestServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "BuildManifest",
+			Handler:    _ManifestService_BuildManifest_Handler,
+		},
+		{
+			MethodName: "Verify",
+			Handler:    _ManifestService_Verify_Handler,
+		},
+		{
+			MethodName: "Diff",
+			Handler:    _ManifestService_Diff_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "GetEntry",
+			Handler:       _ManifestService_GetEntry_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "service.proto",
+}
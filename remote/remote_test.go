@@ -0,0 +1,188 @@
+//go:build !windows
+// +build !windows
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package remote
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/containerd/continuity"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func TestRemote(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "a"), []byte("hello"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := NewServer(root, continuity.ContextOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lis := bufconn.Listen(1 << 20)
+	gs := grpc.NewServer()
+	server.Register(gs)
+	go gs.Serve(lis)
+	defer gs.Stop()
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) { return lis.Dial() }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	client := NewClient(conn)
+	ctx := context.Background()
+
+	m, err := client.BuildManifest(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Resources) != 1 || m.Resources[0].Path() != "/a" {
+		t.Fatalf("unexpected manifest: %v", m.Resources)
+	}
+
+	var report continuity.VerifyReport
+	if err := client.Verify(ctx, m, nil, &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Resources != 1 || report.ContentVerified != 1 {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+
+	var buf bytes.Buffer
+	resource, err := client.GetEntry(ctx, "/a", &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resource.Path() != "/a" || buf.String() != "hello" {
+		t.Fatalf("unexpected entry %v with content %q", resource, buf.String())
+	}
+
+	if _, err := client.GetEntry(ctx, "/missing", &buf); status.Code(err) != codes.NotFound {
+		t.Fatalf("expected not found, got %v", err)
+	}
+
+	if err := os.Chmod(filepath.Join(root, "a"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Verify(ctx, m, nil, nil); err == nil || !strings.Contains(err.Error(), "/a") {
+		t.Fatalf("expected /a to have drifted, got %v", err)
+	}
+
+	changes, err := client.Diff(ctx, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 || changes[0].Kind != continuity.ChangeChmod || changes[0].Path != "/a" {
+		t.Fatalf("unexpected changes: %v", changes)
+	}
+}
+
+func TestHTTPHandler(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "a"), []byte("hello"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, err := continuity.NewContext(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := continuity.BuildManifest(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := continuity.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := NewServer(root, continuity.ContextOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(server.HTTPHandler())
+	defer ts.Close()
+
+	do := func(method, path string, body []byte, expected int) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(method, ts.URL+path, bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != expected {
+			t.Fatalf("%s %s: expected status %d, got %s", method, path, expected, resp.Status)
+		}
+		return resp
+	}
+
+	do(http.MethodPost, "/verify", nil, http.StatusConflict).Body.Close()
+	do(http.MethodGet, "/report", nil, http.StatusNotFound).Body.Close()
+	do(http.MethodPut, "/manifest", p, http.StatusNoContent).Body.Close()
+
+	if err := os.Chmod(filepath.Join(root, "a"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	do(http.MethodPost, "/verify", nil, http.StatusAccepted).Body.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var report HTTPReport
+		resp := do(http.MethodGet, "/report", nil, http.StatusOK)
+		err := json.NewDecoder(resp.Body).Decode(&report)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if report.State == "done" {
+			if !strings.Contains(report.Error, "/a") {
+				t.Fatalf("expected /a to have drifted: %+v", report)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the verification")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,224 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package remote serves the manifest operations on a root over gRPC, so
+// that remote agents can be driven from a central controller.
+package remote
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/containerd/continuity"
+	"github.com/containerd/continuity/fs"
+	pb "github.com/containerd/continuity/proto"
+	remotepb "github.com/containerd/continuity/remote/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// chunkSize is the size of the chunks in which GetEntry streams content.
+const chunkSize = 32 * 1024
+
+// Server implements the manifest service for a single root.
+type Server struct {
+	remotepb.UnimplementedManifestServiceServer
+
+	root    string
+	options continuity.ContextOptions
+}
+
+// NewServer returns a server for the root. A context is created with the
+// options for every request.
+func NewServer(root string, options continuity.ContextOptions) (*Server, error) {
+	// Fail early if no context can be created for the root.
+	if _, err := continuity.NewContextWithOptions(root, options); err != nil {
+		return nil, err
+	}
+
+	return &Server{root: root, options: options}, nil
+}
+
+// Register registers the server with a gRPC server.
+func (s *Server) Register(gs *grpc.Server) {
+	remotepb.RegisterManifestServiceServer(gs, s)
+}
+
+func (s *Server) context() (continuity.Context, error) {
+	ctx, err := continuity.NewContextWithOptions(s.root, s.options)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return ctx, nil
+}
+
+func (s *Server) BuildManifest(_ context.Context, req *remotepb.BuildManifestRequest) (*remotepb.BuildManifestResponse, error) {
+	ctx, err := s.context()
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := continuity.BuildManifest(ctx)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+
+	return &remotepb.BuildManifestResponse{Manifest: continuity.ToProto(m)}, nil
+}
+
+func (s *Server) Verify(_ context.Context, req *remotepb.VerifyRequest) (*remotepb.VerifyResponse, error) {
+	m, err := manifestFromRequest(req.Manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, err := s.context()
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		report continuity.VerifyReport
+		opts   = []continuity.VerifyOpt{continuity.WithVerifyReport(&report)}
+	)
+	if req.SamplePercent != 0 {
+		opts = append(opts, continuity.WithSampling(req.SamplePercent, req.SampleSeed))
+	}
+
+	var resp remotepb.VerifyResponse
+	if err := continuity.VerifyManifest(ctx, m, opts...); err != nil {
+		// A root that does not match is a result, not a failed request.
+		resp.Error = err.Error()
+	}
+	resp.Resources = int64(report.Resources)
+	resp.ContentVerified = int64(report.ContentVerified)
+
+	return &resp, nil
+}
+
+func (s *Server) Diff(_ context.Context, req *remotepb.DiffRequest) (*remotepb.DiffResponse, error) {
+	m, err := manifestFromRequest(req.Manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, err := s.context()
+	if err != nil {
+		return nil, err
+	}
+
+	changes, err := continuity.Plan(ctx, m)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+
+	var resp remotepb.DiffResponse
+	for _, change := range changes {
+		resp.Change = append(resp.Change, continuity.ChangeToProto(change))
+	}
+
+	return &resp, nil
+}
+
+func (s *Server) GetEntry(req *remotepb.GetEntryRequest, stream remotepb.ManifestService_GetEntryServer) error {
+	ctx, err := s.context()
+	if err != nil {
+		return err
+	}
+
+	// Resolve the parent within the root, but not the entry itself, so that
+	// symlinks are returned rather than followed.
+	p := path.Clean("/" + req.Path)
+	if p == "/" {
+		return status.Error(codes.InvalidArgument, "the root has no entry")
+	}
+	dir, err := fs.RootPath(s.root, filepath.FromSlash(path.Dir(p)))
+	if err != nil {
+		return toStatus(err)
+	}
+	fp := filepath.Join(dir, path.Base(p))
+
+	fi, err := os.Lstat(fp)
+	if err != nil {
+		return toStatus(err)
+	}
+
+	resource, err := ctx.Resource(p, fi)
+	if err != nil {
+		return toStatus(err)
+	}
+
+	bm := continuity.ToProto(&continuity.Manifest{Resources: []continuity.Resource{resource}})
+	if err := stream.Send(&remotepb.GetEntryResponse{Resource: bm.Resource[0]}); err != nil {
+		return err
+	}
+
+	if _, ok := resource.(continuity.RegularFile); !ok {
+		return nil
+	}
+
+	f, err := os.Open(fp)
+	if err != nil {
+		return toStatus(err)
+	}
+	defer f.Close()
+
+	buf := make([]byte, chunkSize)
+	for {
+		n, err := f.Read(buf)
+		if n > 0 {
+			if err := stream.Send(&remotepb.GetEntryResponse{Data: buf[:n]}); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return toStatus(err)
+		}
+	}
+}
+
+func manifestFromRequest(bm *pb.Manifest) (*continuity.Manifest, error) {
+	if bm == nil {
+		return nil, status.Error(codes.InvalidArgument, "no manifest in request")
+	}
+
+	m, err := continuity.FromProto(bm)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	return m, nil
+}
+
+// toStatus returns a gRPC status error for the error.
+func toStatus(err error) error {
+	code := codes.Internal
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		code = codes.NotFound
+	case errors.Is(err, os.ErrPermission):
+		code = codes.PermissionDenied
+	case errors.Is(err, continuity.ErrNotSupported):
+		code = codes.Unimplemented
+	}
+	return status.Error(code, err.Error())
+}
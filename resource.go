@@ -22,6 +22,7 @@ import (
 	"os"
 	"reflect"
 	"sort"
+	"time"
 
 	pb "github.com/containerd/continuity/proto"
 	"github.com/opencontainers/go-digest"
@@ -58,6 +59,144 @@ type XAttrer interface {
 	XAttrs() map[string][]byte
 }
 
+// Windows reparse point tags recorded for symbolic links and directory
+// junctions. These are defined here, rather than taken from the system
+// headers, so that manifests built on Windows can be interpreted anywhere.
+const (
+	// ReparseTagMountPoint identifies a directory junction.
+	ReparseTagMountPoint uint32 = 0xA0000003
+
+	// ReparseTagSymlink identifies a symbolic link.
+	ReparseTagSymlink uint32 = 0xA000000C
+)
+
+// Windows file attributes recorded for resources. These are defined here,
+// rather than taken from the system headers, so that manifests built on
+// Windows can be interpreted anywhere. Only these attributes are recorded.
+const (
+	FileAttributeReadonly uint32 = 0x1
+	FileAttributeHidden   uint32 = 0x2
+	FileAttributeSystem   uint32 = 0x4
+	FileAttributeArchive  uint32 = 0x20
+
+	fileAttributesMask = FileAttributeReadonly | FileAttributeHidden | FileAttributeSystem | FileAttributeArchive
+)
+
+// Annotator is an interface that a resource type satisfies if it can carry
+// annotations, metadata attached to the resource by other tools.
+type Annotator interface {
+	// Annotations returns a copy of the annotations of the resource.
+	Annotations() map[string]string
+}
+
+// SymlinkType tells whether a symlink links to a file or to a directory,
+// which Windows requires to know when links are created.
+type SymlinkType int
+
+const (
+	// SymlinkTypeUnknown is the type of symlinks captured where links are
+	// not typed. Such links are typed by what their target is, if it
+	// exists, when they are created.
+	SymlinkTypeUnknown SymlinkType = iota
+
+	// SymlinkTypeFile is the type of links to files.
+	SymlinkTypeFile
+
+	// SymlinkTypeDirectory is the type of links to directories.
+	SymlinkTypeDirectory
+)
+
+func (t SymlinkType) String() string {
+	switch t {
+	case SymlinkTypeFile:
+		return "file"
+	case SymlinkTypeDirectory:
+		return "directory"
+	}
+	return "unknown"
+}
+
+// SymlinkTyper is an interface that a symlink resource type satisfies if it
+// can carry the type of the link.
+type SymlinkTyper interface {
+	// SymlinkType returns the type of the link.
+	SymlinkType() SymlinkType
+}
+
+// FileAttributer is an interface that a resource type satisfies if it can
+// carry the Windows file attributes of a resource.
+type FileAttributer interface {
+	// FileAttributes returns the FileAttribute flags of the resource.
+	FileAttributes() uint32
+}
+
+// ReparsePoint is an interface that a resource type satisfies if it may have
+// been captured from a Windows reparse point.
+type ReparsePoint interface {
+	// ReparseTag returns the reparse point tag of the resource, or zero if
+	// the resource is not a reparse point.
+	ReparseTag() uint32
+
+	// ReparseData returns the raw reparse data buffer for reparse points
+	// that are neither symbolic links nor directory junctions. Symbolic links
+	// and junctions are restored from their target instead.
+	ReparseData() []byte
+}
+
+// VerityFile is an interface that a resource type satisfies if it can carry
+// the fs-verity file digest of a regular file.
+type VerityFile interface {
+	// VerityDigest returns the fs-verity file digest of the resource, or an
+	// empty digest if fs-verity was not enabled on it.
+	VerityDigest() digest.Digest
+}
+
+// BirthTimer is an interface that a resource type satisfies if it can carry
+// the creation time of a resource.
+type BirthTimer interface {
+	// BirthTime returns the creation time of the resource, or the zero time
+	// if it was not captured.
+	BirthTime() time.Time
+}
+
+// Unstabler is an interface that a resource type satisfies if it can be
+// flagged as having changed while it was built.
+type Unstabler interface {
+	// Unstable returns true if the content of the resource changed while it
+	// was read, so that its digests may not describe any state of it.
+	Unstable() bool
+}
+
+// ProjectIDer is an interface that a resource type satisfies if it can carry
+// a filesystem project quota id.
+type ProjectIDer interface {
+	// ProjectID returns the project quota id of the resource, or zero if it
+	// does not belong to a project.
+	ProjectID() uint32
+}
+
+// MountPoint describes a separate filesystem mounted at a resource.
+type MountPoint struct {
+	// Type is the filesystem type, such as "tmpfs", if known.
+	Type string
+
+	// FSID is the filesystem id reported by the system, formatted in hex, if
+	// available.
+	FSID string
+
+	// Subvolume is set when the boundary is a btrfs subvolume of the parent
+	// filesystem rather than a separate mount.
+	Subvolume bool
+}
+
+// Mounted is an interface that a resource type satisfies if it may have had
+// a separate filesystem mounted over it when it was captured.
+type Mounted interface {
+	// MountPoint returns the filesystem mounted at the resource, or nil if
+	// the resource is on the same filesystem as its parent.
+	MountPoint() *MountPoint
+}
+
 // Hardlinkable is an interface that a resource type satisfies if it can be a
 // hardlink target.
 type Hardlinkable interface {
@@ -106,6 +245,10 @@ func Merge(fs ...Resource) (Resource, error) {
 		}
 	}
 
+	// Annotations of the paths of a file are combined, as long as they
+	// agree.
+	var annotations map[string]string
+
 	for _, f := range fs {
 		h, isHardlinkable := f.(Hardlinkable)
 		if !isHardlinkable {
@@ -131,6 +274,18 @@ func Merge(fs ...Resource) (Resource, error) {
 			}
 		}
 
+		if a, ok := f.(Annotator); ok {
+			for k, v := range a.Annotations() {
+				if prev, ok := annotations[k]; ok && prev != v {
+					return nil, fmt.Errorf("resource %q annotation %q does not match: %q != %q", f.Path(), k, v, prev)
+				}
+				if annotations == nil {
+					annotations = map[string]string{}
+				}
+				annotations[k] = v
+			}
+		}
+
 		for _, p := range h.Paths() {
 			pfs, ok := bypath[p]
 			if !ok {
@@ -182,11 +337,45 @@ func Merge(fs ...Resource) (Resource, error) {
 	first := bypath[paths[0]][0]
 
 	resource := resource{
-		paths:  paths,
-		mode:   first.Mode(),
-		uid:    first.UID(),
-		gid:    first.GID(),
-		xattrs: xattrs,
+		paths:       paths,
+		mode:        first.Mode(),
+		uid:         first.UID(),
+		gid:         first.GID(),
+		xattrs:      xattrs,
+		annotations: annotations,
+	}
+
+	if rp, ok := first.(ReparsePoint); ok {
+		resource.reparseTag = rp.ReparseTag()
+		resource.reparseData = rp.ReparseData()
+	}
+
+	if pr, ok := first.(ProjectIDer); ok {
+		resource.projectID = pr.ProjectID()
+	}
+
+	if fa, ok := first.(FileAttributer); ok {
+		resource.fileAttributes = fa.FileAttributes()
+	}
+
+	if vf, ok := first.(VerityFile); ok {
+		resource.verityDigest = vf.VerityDigest()
+	}
+
+	if bt, ok := first.(BirthTimer); ok {
+		resource.birthTime = bt.BirthTime()
+	}
+
+	if u, ok := first.(unknownFielder); ok {
+		resource.unknown = u.unknownFields()
+	}
+
+	// The paths of a file share its content, so it is unstable if it was
+	// found to change through any of them.
+	for _, f := range fs {
+		if u, ok := f.(Unstabler); ok && u.Unstable() {
+			resource.unstable = true
+		}
 	}
 
 	switch typedF := first.(type) {
@@ -254,13 +443,48 @@ type Device interface {
 }
 
 type resource struct {
-	paths    []string
-	mode     os.FileMode
-	uid, gid int64
-	xattrs   map[string][]byte
+	paths       []string
+	mode        os.FileMode
+	uid, gid    int64
+	xattrs      map[string][]byte
+	annotations map[string]string
+
+	reparseTag  uint32
+	reparseData []byte
+
+	mount          *MountPoint
+	projectID      uint32
+	fileAttributes uint32
+
+	verityDigest digest.Digest
+	birthTime    time.Time
+	unstable     bool
+
+	// unknown holds the encoded fields of the record of the resource that
+	// this package does not know, such as those of extensions.
+	unknown []byte
 }
 
 var _ Resource = &resource{}
+var _ ReparsePoint = &resource{}
+var _ Mounted = &resource{}
+var _ ProjectIDer = &resource{}
+var _ FileAttributer = &resource{}
+var _ Annotator = &resource{}
+var _ VerityFile = &resource{}
+var _ BirthTimer = &resource{}
+var _ Unstabler = &resource{}
+var _ unknownFielder = &resource{}
+
+// unknownFielder is satisfied by resources read from records with fields
+// this package does not know, so that they are written back unchanged.
+type unknownFielder interface {
+	unknownFields() []byte
+}
+
+func (r *resource) unknownFields() []byte {
+	return r.unknown
+}
 
 func (r *resource) Path() string {
 	if len(r.paths) < 1 {
@@ -282,6 +506,59 @@ func (r *resource) GID() int64 {
 	return r.gid
 }
 
+func (r *resource) ReparseTag() uint32 {
+	return r.reparseTag
+}
+
+func (r *resource) VerityDigest() digest.Digest {
+	return r.verityDigest
+}
+
+func (r *resource) ProjectID() uint32 {
+	return r.projectID
+}
+
+func (r *resource) Annotations() map[string]string {
+	if r.annotations == nil {
+		return nil
+	}
+
+	annotations := make(map[string]string, len(r.annotations))
+	for k, v := range r.annotations {
+		annotations[k] = v
+	}
+	return annotations
+}
+
+func (r *resource) FileAttributes() uint32 {
+	return r.fileAttributes
+}
+
+func (r *resource) BirthTime() time.Time {
+	return r.birthTime
+}
+
+func (r *resource) Unstable() bool {
+	return r.unstable
+}
+
+func (r *resource) MountPoint() *MountPoint {
+	if r.mount == nil {
+		return nil
+	}
+
+	mount := *r.mount
+	return &mount
+}
+
+func (r *resource) ReparseData() []byte {
+	if r.reparseData == nil {
+		return nil
+	}
+
+	return append([]byte(nil), r.reparseData...)
+}
+
 type regularFile struct {
 	resource
 	size    int64
@@ -368,11 +645,13 @@ func (d *directory) XAttrs() map[string][]byte {
 type symLink struct {
 	resource
 	target string
+	typ    SymlinkType
 }
 
 var _ SymLink = &symLink{}
+var _ SymlinkTyper = &symLink{}
 
-func newSymLink(base resource, target string) (SymLink, error) {
+func newSymLink(base resource, target string, typ SymlinkType) (SymLink, error) {
 	if base.Mode()&os.ModeSymlink == 0 {
 		return nil, fmt.Errorf("not a symlink")
 	}
@@ -380,6 +659,7 @@ func newSymLink(base resource, target string) (SymLink, error) {
 	return &symLink{
 		resource: base,
 		target:   target,
+		typ:      typ,
 	}, nil
 }
 
@@ -387,6 +667,10 @@ func (l *symLink) Target() string {
 	return l.target
 }
 
+func (l *symLink) SymlinkType() SymlinkType {
+	return l.typ
+}
+
 type namedPipe struct {
 	resource
 }
@@ -470,10 +754,100 @@ func (d device) Minor() uint64 {
 	return d.minor
 }
 
-// toProto converts a resource to a protobuf record. We'd like to push this
-// the individual types but we want to keep this all together during
-// prototyping.
-func toProto(resource Resource) *pb.Resource {
+// Attributes holds the attributes common to all resources, for the
+// constructors of the resource types.
+type Attributes struct {
+	// Mode holds the permission bits of the resource, along with the setuid,
+	// setgid and sticky bits. The type bits are set by the constructors.
+	Mode os.FileMode
+
+	UID, GID int64
+
+	XAttrs map[string][]byte
+
+	// BirthTime holds the creation time of the resource, if known.
+	BirthTime time.Time
+
+	// FileAttributes holds the Windows file attributes of the resource, of
+	// those recorded.
+	FileAttributes uint32
+
+	// Annotations holds metadata attached to the resource by other tools.
+	Annotations map[string]string
+}
+
+func (a Attributes) resource(paths []string, typ os.FileMode) resource {
+	const settable = os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+
+	r := resource{
+		paths: paths,
+		mode:  a.Mode&settable | typ,
+		uid:   a.UID,
+		gid:   a.GID,
+
+		birthTime:      a.BirthTime,
+		fileAttributes: a.FileAttributes & fileAttributesMask,
+	}
+	if len(a.XAttrs) > 0 {
+		r.xattrs = make(map[string][]byte, len(a.XAttrs))
+		for k, v := range a.XAttrs {
+			r.xattrs[k] = append([]byte(nil), v...)
+		}
+	}
+	if len(a.Annotations) > 0 {
+		r.annotations = make(map[string]string, len(a.Annotations))
+		for k, v := range a.Annotations {
+			r.annotations[k] = v
+		}
+	}
+	return r
+}
+
+// NewRegularFile returns a regular file with the given content. More than
+// one path describes a file with hardlinks.
+func NewRegularFile(paths []string, attrs Attributes, size int64, dgsts ...digest.Digest) (RegularFile, error) {
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("regular file without a path")
+	}
+	return newRegularFile(attrs.resource(nil, 0), paths, size, dgsts...)
+}
+
+// NewDirectory returns a directory.
+func NewDirectory(path string, attrs Attributes) (Directory, error) {
+	return newDirectory(attrs.resource([]string{path}, os.ModeDir))
+}
+
+// NewSymLink returns a symbolic link to target, of an unknown type.
+func NewSymLink(path string, attrs Attributes, target string) (SymLink, error) {
+	return newSymLink(attrs.resource([]string{path}, os.ModeSymlink), target, SymlinkTypeUnknown)
+}
+
+// NewNamedPipe returns a named pipe. More than one path describes a pipe
+// with hardlinks.
+func NewNamedPipe(paths []string, attrs Attributes) (NamedPipe, error) {
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("named pipe without a path")
+	}
+	return newNamedPipe(attrs.resource(nil, os.ModeNamedPipe), paths)
+}
+
+// NewDevice returns a character device if char is set, and a block device
+// otherwise. More than one path describes a device with hardlinks.
+func NewDevice(paths []string, attrs Attributes, char bool, major, minor uint64) (Device, error) {
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("device without a path")
+	}
+	typ := os.ModeDevice
+	if char {
+		typ |= os.ModeCharDevice
+	}
+	return newDevice(attrs.resource(nil, typ), paths, major, minor)
+}
+
+// ResourceToProto converts a resource to a protobuf record. We'd like to
+// push this the individual types but we want to keep this all together
+// during prototyping.
+func ResourceToProto(resource Resource) *pb.Resource {
 	b := &pb.Resource{
 		Path: []string{resource.Path()},
 		Mode: uint32(resource.Mode()),
@@ -481,6 +855,37 @@ func toProto(resource Resource) *pb.Resource {
 		Gid:  resource.GID(),
 	}
 
+	if rp, ok := resource.(ReparsePoint); ok {
+		b.ReparseTag = rp.ReparseTag()
+		b.ReparseData = rp.ReparseData()
+	}
+
+	if pr, ok := resource.(ProjectIDer); ok {
+		b.ProjectId = pr.ProjectID()
+	}
+
+	if fa, ok := resource.(FileAttributer); ok {
+		b.FileAttributes = fa.FileAttributes()
+	}
+
+	if a, ok := resource.(Annotator); ok {
+		b.Annotations = a.Annotations()
+	}
+
+	if bt, ok := resource.(BirthTimer); ok && !bt.BirthTime().IsZero() {
+		b.BirthTime = bt.BirthTime().UnixNano()
+	}
+
+	if u, ok := resource.(Unstabler); ok {
+		b.Unstable = u.Unstable()
+	}
+
+	if m, ok := resource.(Mounted); ok {
+		if mount := m.MountPoint(); mount != nil {
+			b.Mount = &pb.Mount{Type: mount.Type, Fsid: mount.FSID, Subvolume: mount.Subvolume}
+		}
+	}
+
 	if xattrer, ok := resource.(XAttrer); ok {
 		// Sorts the XAttrs by name for consistent ordering.
 		keys := []string{}
@@ -503,8 +908,16 @@ func toProto(resource Resource) *pb.Resource {
 		for _, dgst := range r.Digests() {
 			b.Digest = append(b.Digest, dgst.String())
 		}
+
+		if vf, ok := r.(VerityFile); ok {
+			b.VerityDigest = vf.VerityDigest().String()
+		}
 	case SymLink:
 		b.Target = r.Target()
+
+		if st, ok := r.(SymlinkTyper); ok {
+			b.SymlinkType = pb.SymlinkType(st.SymlinkType())
+		}
 	case Device:
 		b.Major, b.Minor = r.Major(), r.Minor()
 		b.Path = r.Paths()
@@ -516,16 +929,173 @@ func toProto(resource Resource) *pb.Resource {
 	// resource implementation.
 	sort.Strings(b.Path)
 
+	b.Type = protoType(resource.Mode(), b)
+	b.PosixMode = posixMode(resource.Mode())
+
+	if u, ok := resource.(unknownFielder); ok {
+		setUnknownFields(b, u.unknownFields())
+	}
+
 	return b
 }
 
-// fromProto converts from a protobuf Resource to a Resource interface.
-func fromProto(b *pb.Resource) (Resource, error) {
+// protoType returns the type of the resource record b, with the given mode.
+func protoType(mode os.FileMode, b *pb.Resource) pb.Type {
+	switch {
+	case mode.IsRegular() && len(b.Path) > 1:
+		return pb.Type_TYPE_HARDLINK
+	case mode.IsRegular():
+		return pb.Type_TYPE_REGULAR
+	case mode.IsDir():
+		return pb.Type_TYPE_DIRECTORY
+	case mode&os.ModeSymlink != 0:
+		return pb.Type_TYPE_SYMLINK
+	case mode&os.ModeCharDevice != 0 && b.Major == 0 && b.Minor == 0:
+		return pb.Type_TYPE_WHITEOUT
+	case mode&os.ModeCharDevice != 0:
+		return pb.Type_TYPE_CHAR_DEVICE
+	case mode&os.ModeDevice != 0:
+		return pb.Type_TYPE_BLOCK_DEVICE
+	case mode&os.ModeNamedPipe != 0:
+		return pb.Type_TYPE_FIFO
+	case mode&os.ModeSocket != 0:
+		return pb.Type_TYPE_SOCKET
+	}
+	return pb.Type_TYPE_UNSPECIFIED
+}
+
+// The bits of a POSIX mode_t.
+const (
+	sIFMT   = 0o170000
+	sIFSOCK = 0o140000
+	sIFLNK  = 0o120000
+	sIFREG  = 0o100000
+	sIFBLK  = 0o060000
+	sIFDIR  = 0o040000
+	sIFCHR  = 0o020000
+	sIFIFO  = 0o010000
+	sISUID  = 0o4000
+	sISGID  = 0o2000
+	sISVTX  = 0o1000
+)
+
+// posixMode returns the POSIX mode_t equivalent to mode.
+func posixMode(mode os.FileMode) uint32 {
+	m := uint32(mode.Perm())
+	switch {
+	case mode.IsRegular():
+		m |= sIFREG
+	case mode.IsDir():
+		m |= sIFDIR
+	case mode&os.ModeSymlink != 0:
+		m |= sIFLNK
+	case mode&os.ModeCharDevice != 0:
+		m |= sIFCHR
+	case mode&os.ModeDevice != 0:
+		m |= sIFBLK
+	case mode&os.ModeNamedPipe != 0:
+		m |= sIFIFO
+	case mode&os.ModeSocket != 0:
+		m |= sIFSOCK
+	}
+	if mode&os.ModeSetuid != 0 {
+		m |= sISUID
+	}
+	if mode&os.ModeSetgid != 0 {
+		m |= sISGID
+	}
+	if mode&os.ModeSticky != 0 {
+		m |= sISVTX
+	}
+	return m
+}
+
+// fileMode returns the os.FileMode equivalent to the POSIX mode_t m.
+func fileMode(m uint32) os.FileMode {
+	mode := os.FileMode(m & 0o777)
+	switch m & sIFMT {
+	case sIFREG:
+	case sIFDIR:
+		mode |= os.ModeDir
+	case sIFLNK:
+		mode |= os.ModeSymlink
+	case sIFCHR:
+		mode |= os.ModeDevice | os.ModeCharDevice
+	case sIFBLK:
+		mode |= os.ModeDevice
+	case sIFIFO:
+		mode |= os.ModeNamedPipe
+	case sIFSOCK:
+		mode |= os.ModeSocket
+	default:
+		mode |= os.ModeIrregular
+	}
+	if m&sISUID != 0 {
+		mode |= os.ModeSetuid
+	}
+	if m&sISGID != 0 {
+		mode |= os.ModeSetgid
+	}
+	if m&sISVTX != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode
+}
+
+// typeModes maps the types of resource records to the type bits of their
+// modes.
+var typeModes = map[pb.Type]os.FileMode{
+	pb.Type_TYPE_REGULAR:      0,
+	pb.Type_TYPE_HARDLINK:     0,
+	pb.Type_TYPE_DIRECTORY:    os.ModeDir,
+	pb.Type_TYPE_SYMLINK:      os.ModeSymlink,
+	pb.Type_TYPE_CHAR_DEVICE:  os.ModeDevice | os.ModeCharDevice,
+	pb.Type_TYPE_WHITEOUT:     os.ModeDevice | os.ModeCharDevice,
+	pb.Type_TYPE_BLOCK_DEVICE: os.ModeDevice,
+	pb.Type_TYPE_FIFO:         os.ModeNamedPipe,
+	pb.Type_TYPE_SOCKET:       os.ModeSocket,
+}
+
+// ResourceFromProto converts from a protobuf Resource to a Resource
+// interface, of the type given by the record, or by its mode for records
+// without a type. The POSIX mode of the record is preferred over the Go one.
+func ResourceFromProto(b *pb.Resource) (Resource, error) {
+	mode, err := recordMode(b)
+	if err != nil {
+		return nil, err
+	}
+
 	base := &resource{
 		paths: b.Path,
-		mode:  os.FileMode(b.Mode),
+		mode:  mode,
 		uid:   b.Uid,
 		gid:   b.Gid,
+
+		reparseTag:  b.ReparseTag,
+		reparseData: b.ReparseData,
+		projectID:   b.ProjectId,
+
+		fileAttributes: b.FileAttributes & fileAttributesMask,
+
+		verityDigest: digest.Digest(b.VerityDigest),
+		unstable:     b.Unstable,
+	}
+
+	base.unknown = unknownFields(b)
+
+	if b.BirthTime != 0 {
+		base.birthTime = time.Unix(0, b.BirthTime).UTC()
+	}
+
+	if len(b.Annotations) > 0 {
+		base.annotations = make(map[string]string, len(b.Annotations))
+		for k, v := range b.Annotations {
+			base.annotations[k] = v
+		}
+	}
+
+	if b.Mount != nil {
+		base.mount = &MountPoint{Type: b.Mount.Type, FSID: b.Mount.Fsid, Subvolume: b.Mount.Subvolume}
 	}
 
 	base.xattrs = make(map[string][]byte, len(b.Xattr))
@@ -546,7 +1116,11 @@ func fromProto(b *pb.Resource) (Resource, error) {
 	case base.Mode().IsDir():
 		return newDirectory(*base)
 	case base.Mode()&os.ModeSymlink != 0:
-		return newSymLink(*base, b.Target)
+		typ := SymlinkType(b.SymlinkType)
+		if typ != SymlinkTypeFile && typ != SymlinkTypeDirectory {
+			typ = SymlinkTypeUnknown
+		}
+		return newSymLink(*base, b.Target, typ)
 	case base.Mode()&os.ModeNamedPipe != 0:
 		return newNamedPipe(*base, b.Path)
 	case base.Mode()&os.ModeDevice != 0:
@@ -556,6 +1130,26 @@ func fromProto(b *pb.Resource) (Resource, error) {
 	return nil, fmt.Errorf("unknown resource record (%#v): %s", b, base.Mode())
 }
 
+// recordMode returns the mode of the resource record b, from its type, POSIX
+// mode and Go mode.
+func recordMode(b *pb.Resource) (os.FileMode, error) {
+	mode := os.FileMode(b.Mode)
+	if b.PosixMode != 0 && posixMode(mode) != b.PosixMode {
+		// The Go mode agrees with the POSIX mode unless the record was not
+		// written by this package, in which case the POSIX mode is
+		// authoritative. Otherwise, the Go mode may carry more.
+		mode = fileMode(b.PosixMode)
+	}
+	if b.Type != pb.Type_TYPE_UNSPECIFIED {
+		typ, ok := typeModes[b.Type]
+		if !ok {
+			return 0, fmt.Errorf("unknown resource type %v", b.Type)
+		}
+		mode = mode&^os.ModeType | typ
+	}
+	return mode, nil
+}
+
 // NOTE(stevvooe): An alternative model that supports inline declaration.
 // Convenient for unit testing where inline declarations may be desirable but
 // creates an awkward API for the standard use case.
@@ -17,6 +17,15 @@
 //nolint:unused,deadcode
 package continuity
 
+import (
+	"os"
+	"testing"
+
+	pb "github.com/containerd/continuity/proto"
+	"github.com/opencontainers/go-digest"
+	"google.golang.org/protobuf/proto"
+)
+
 type resourceUpdate struct {
 	Original Resource
 	Updated  Resource
@@ -171,3 +180,91 @@ func compareNamedPipe(r1, r2 NamedPipe) bool {
 func compareDevice(r1, r2 Device) bool {
 	return r1.Major() == r2.Major() && r1.Minor() == r2.Minor()
 }
+
+func TestResourceTypes(t *testing.T) {
+	attrs := Attributes{
+		Mode:   os.ModeSetuid | os.ModeDir | 0o750, // the type bit is ignored
+		UID:    1000,
+		GID:    100,
+		XAttrs: map[string][]byte{"user.a": []byte("b")},
+	}
+	dgst := digest.FromString("content")
+
+	must := mustResource(t)
+	resources := []Resource{
+		must(NewRegularFile([]string{"/a", "/b"}, attrs, 7, dgst)),
+		must(NewDirectory("/dir", attrs)),
+		must(NewSymLink("/link", attrs, "a")),
+		must(NewNamedPipe([]string{"/fifo"}, attrs)),
+		must(NewDevice([]string{"/null"}, attrs, true, 1, 3)),
+	}
+
+	if mode := resources[0].Mode(); mode != os.ModeSetuid|0o750 {
+		t.Fatalf("unexpected mode %v", mode)
+	}
+	if h, ok := resources[0].(Hardlinkable); !ok || len(h.Paths()) != 2 {
+		t.Fatal("expected a hardlinked file")
+	}
+	if mode := resources[4].Mode(); mode&os.ModeCharDevice == 0 {
+		t.Fatalf("expected a character device, got %v", mode)
+	}
+
+	types := []pb.Type{
+		pb.Type_TYPE_HARDLINK,
+		pb.Type_TYPE_DIRECTORY,
+		pb.Type_TYPE_SYMLINK,
+		pb.Type_TYPE_FIFO,
+		pb.Type_TYPE_CHAR_DEVICE,
+	}
+	for i, r := range resources {
+		b := ResourceToProto(r)
+		if b.Type != types[i] {
+			t.Fatalf("%s: expected type %v, got %v", r.Path(), types[i], b.Type)
+		}
+		decoded, err := ResourceFromProto(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !compareResource(r, decoded) {
+			t.Fatalf("%s: resources differ after conversion", r.Path())
+		}
+		if !proto.Equal(b, ResourceToProto(decoded)) {
+			t.Fatalf("%s: records differ after conversion", r.Path())
+		}
+	}
+
+	if m := ResourceToProto(resources[0]).PosixMode; m != 0o104750 {
+		t.Fatalf("unexpected POSIX mode %o", m)
+	}
+
+	// The POSIX mode takes precedence over the Go mode.
+	r, err := ResourceFromProto(&pb.Resource{
+		Path:      []string{"/null"},
+		Major:     1,
+		Minor:     3,
+		PosixMode: 0o020666,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := r.Mode(); mode != os.ModeDevice|os.ModeCharDevice|0o666 {
+		t.Fatalf("unexpected mode %v", mode)
+	}
+
+	// The type takes precedence over the type bits of the mode.
+	r, err = ResourceFromProto(&pb.Resource{
+		Path: []string{"/dir"},
+		Mode: uint32(os.ModeSymlink | 0o755),
+		Type: pb.Type_TYPE_DIRECTORY,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := r.(Directory); !ok {
+		t.Fatalf("expected a directory, got %v", r.Mode())
+	}
+
+	if _, err := NewRegularFile(nil, attrs, 0); err == nil {
+		t.Fatal("expected a file without a path to be rejected")
+	}
+}
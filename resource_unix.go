@@ -23,6 +23,8 @@ import (
 	"fmt"
 	"os"
 	"syscall"
+
+	driverpkg "github.com/containerd/continuity/driver"
 )
 
 // newBaseResource returns a *resource, populated with data from p and fi,
@@ -33,8 +35,8 @@ func newBaseResource(p string, fi os.FileInfo) (*resource, error) {
 	// this be passed in and fixed up to make these uid/gid mappings portable.
 	// Either this can be part of the driver or we can achieve it through some
 	// other mechanism.
-	sys, ok := fi.Sys().(*syscall.Stat_t)
-	if !ok {
+	st := fileStat(fi)
+	if st == nil {
 		// TODO(stevvooe): This may not be a hard error for all platforms. We
 		// may want to move this to the driver.
 		return nil, fmt.Errorf("unable to resolve syscall.Stat_t from (os.FileInfo).Sys(): %#v", fi)
@@ -44,11 +46,35 @@ func newBaseResource(p string, fi os.FileInfo) (*resource, error) {
 		paths: []string{p},
 		mode:  fi.Mode(),
 
-		uid: int64(sys.Uid),
-		gid: int64(sys.Gid),
+		uid: st.UID,
+		gid: st.GID,
 
 		// NOTE(stevvooe): Population of shared xattrs field is deferred to
 		// the resource types that populate it. Since they are a property of
 		// the context, they must set there.
 	}, nil
 }
+
+// fileStat returns the ownership of the file described by fi, or nil if fi
+// does not carry it.
+func fileStat(fi os.FileInfo) *driverpkg.FileStat {
+	switch sys := fi.Sys().(type) {
+	case *syscall.Stat_t:
+		return &driverpkg.FileStat{UID: int64(sys.Uid), GID: int64(sys.Gid)}
+	case *driverpkg.FileStat:
+		return sys
+	}
+	return nil
+}
+
+// isReparsePoint reports whether fi describes a Windows reparse point, which
+// never happens on this platform.
+func isReparsePoint(fi os.FileInfo) bool {
+	return false
+}
+
+// symlinkType returns the type of the symlink described by fi. Links are
+// not typed on this platform.
+func symlinkType(fi os.FileInfo) SymlinkType {
+	return SymlinkTypeUnknown
+}
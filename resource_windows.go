@@ -16,13 +16,61 @@
 
 package continuity
 
-import "os"
+import (
+	"os"
+	"syscall"
+
+	driverpkg "github.com/containerd/continuity/driver"
+)
 
 // newBaseResource returns a *resource, populated with data from p and fi,
 // where p will be populated directly.
 func newBaseResource(p string, fi os.FileInfo) (*resource, error) {
-	return &resource{
+	r := &resource{
 		paths: []string{p},
 		mode:  fi.Mode(),
-	}, nil
+	}
+
+	// Ownership is only recorded where a driver provides it.
+	if st := fileStat(fi); st != nil {
+		r.uid, r.gid = st.UID, st.GID
+	}
+
+	if sys, ok := fi.Sys().(*syscall.Win32FileAttributeData); ok {
+		r.fileAttributes = sys.FileAttributes & fileAttributesMask
+	}
+
+	return r, nil
+}
+
+// fileStat returns the ownership of the file described by fi, or nil if fi
+// does not carry it. Ownership is only known for files of drivers that
+// provide it.
+func fileStat(fi os.FileInfo) *driverpkg.FileStat {
+	st, _ := fi.Sys().(*driverpkg.FileStat)
+	return st
+}
+
+// symlinkType returns the type of the symlink described by fi, which is a
+// link to a directory if it has the directory attribute.
+func symlinkType(fi os.FileInfo) SymlinkType {
+	sys, ok := fi.Sys().(*syscall.Win32FileAttributeData)
+	if !ok {
+		return SymlinkTypeUnknown
+	}
+	if sys.FileAttributes&syscall.FILE_ATTRIBUTE_DIRECTORY != 0 {
+		return SymlinkTypeDirectory
+	}
+	return SymlinkTypeFile
+}
+
+// isReparsePoint reports whether fi describes a reparse point, such as a
+// symbolic link or a directory junction.
+func isReparsePoint(fi os.FileInfo) bool {
+	sys, ok := fi.Sys().(*syscall.Win32FileAttributeData)
+	if !ok {
+		return false
+	}
+
+	return sys.FileAttributes&syscall.FILE_ATTRIBUTE_REPARSE_POINT != 0
 }
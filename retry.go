@@ -0,0 +1,132 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continuity
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// errUnstable reports a regular file that changed while its content was
+// read.
+var errUnstable = errors.New("changed while it was read")
+
+// RetryPolicy selects how reads of the content of regular files are retried
+// when they fail transiently, with EBUSY or EAGAIN, or when the file changes
+// while it is read, as files of live systems do. Files are stated again once
+// they have been read, and found to change if their size or modification
+// time did. Files that still change once the retries are exhausted are
+// flagged as unstable, with the digest of their last read, while reads that
+// still fail return their error. The zero value reads files once.
+type RetryPolicy struct {
+	// Attempts is the number of times the content is read again after the
+	// first read.
+	Attempts int
+
+	// Backoff is the delay before the first retry, doubled for each of the
+	// next ones.
+	Backoff time.Duration
+
+	// MaxBackoff caps the delay between two retries. Zero means no cap.
+	MaxBackoff time.Duration
+}
+
+// retryable returns true if the error of a read of the content of a file may
+// not happen again.
+func retryable(err error) bool {
+	return errors.Is(err, syscall.EBUSY) || errors.Is(err, syscall.EAGAIN) || errors.Is(err, errUnstable)
+}
+
+// stableDigest digests the content of the regular file at path src, described
+// by fi, for the resource at path p, retrying as selected by the retry policy
+// of the context. The content is written to the sink, if any, as it is read.
+// It returns the file information of the state the digest was taken in,
+// which differs from fi if the file changed before it was read again, and
+// true if the file still changed as it was read last.
+func (c *context) stableDigest(p, src, fp string, fi os.FileInfo, sink ContentSink) (digest.Digest, os.FileInfo, bool, error) {
+	policy := c.retry
+	backoff := policy.Backoff
+	for attempt := 0; ; attempt++ {
+		var w ContentWriter
+		if sink != nil {
+			var err error
+			w, err = sink.Writer(p)
+			if err != nil {
+				return "", nil, false, fmt.Errorf("failed to store content of %s: %w", p, err)
+			}
+		}
+
+		dgst, n, err := c.digest(src, w)
+		if err == nil {
+			var after os.FileInfo
+			after, err = c.driver.Lstat(fp)
+			if err != nil {
+				discardContent(w)
+				return "", nil, false, err
+			}
+			if after.Size() == fi.Size() && after.ModTime().Equal(fi.ModTime()) {
+				return dgst, fi, false, commitContent(w, p, dgst, n)
+			}
+			if attempt >= policy.Attempts {
+				c.logger.Log(LogLevelWarn, "flagging file as unstable", "path", p)
+				return dgst, after, true, commitContent(w, p, dgst, n)
+			}
+			fi = after
+			err = fmt.Errorf("%s %w", p, errUnstable)
+		}
+		discardContent(w)
+
+		if attempt >= policy.Attempts || !retryable(err) {
+			return "", nil, false, err
+		}
+
+		c.logger.Log(LogLevelDebug, "retrying read", "path", p, "attempt", attempt+1, "error", err)
+		time.Sleep(backoff)
+		backoff *= 2
+		if policy.MaxBackoff > 0 && backoff > policy.MaxBackoff {
+			backoff = policy.MaxBackoff
+		}
+	}
+}
+
+// commitContent commits the content written to w, if any, and closes it.
+func commitContent(w ContentWriter, p string, dgst digest.Digest, size int64) error {
+	if w == nil {
+		return nil
+	}
+
+	err := w.Commit(dgst, size)
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to store content of %s: %w", p, err)
+	}
+	return nil
+}
+
+// discardContent closes w, if any, without committing the content written.
+func discardContent(w ContentWriter) {
+	if w != nil {
+		w.Close()
+	}
+}
@@ -0,0 +1,249 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continuity
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/containerd/continuity/devices"
+	driverpkg "github.com/containerd/continuity/driver"
+)
+
+// undoEntry records the state of a file before it was first touched by an
+// apply, so that it can be restored.
+type undoEntry struct {
+	fp string
+
+	// fi is the information of the file before the apply, or nil if the
+	// file did not exist.
+	fi     os.FileInfo
+	uid    int64
+	gid    int64
+	xattrs map[string][]byte
+
+	// backup is the path of a copy of the file, for files other than
+	// directories.
+	backup string
+}
+
+// undoLog records the files an apply touches, in order, so that they can
+// be restored if the apply fails.
+type undoLog struct {
+	*context
+	dir     string
+	entries []undoEntry
+	seen    map[string]bool
+}
+
+// newUndoLog creates an undo log for the context, keeping its backups in a
+// directory next to the root, created through the driver of the context.
+func newUndoLog(c *context) (*undoLog, error) {
+	var dir string
+	for i := 0; ; i++ {
+		dir = c.pathDriver.Join(c.pathDriver.Dir(c.root), fmt.Sprintf(".%s.rollback-%d%d", c.pathDriver.Base(c.root), time.Now().UnixNano(), i))
+		err := c.driver.Mkdir(dir, 0o700)
+		if err == nil {
+			break
+		}
+		if !os.IsExist(err) || i >= 10 {
+			return nil, err
+		}
+	}
+
+	return &undoLog{
+		context: c,
+		dir:     dir,
+		seen:    map[string]bool{},
+	}, nil
+}
+
+// record saves the state of the files that applying resource will change.
+func (u *undoLog) record(resource Resource) error {
+	for _, p := range u.changedPaths(resource) {
+		fp, err := u.fullpath(p)
+		if err != nil {
+			return err
+		}
+		if u.seen[fp] {
+			continue
+		}
+		u.seen[fp] = true
+
+		entry := undoEntry{fp: fp}
+		fi, err := u.driver.Lstat(fp)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				return err
+			}
+			u.entries = append(u.entries, entry)
+			continue
+		}
+
+		base, err := newBaseResource(p, fi)
+		if err != nil {
+			return err
+		}
+		entry.fi, entry.uid, entry.gid = fi, base.uid, base.gid
+
+		entry.xattrs, err = u.resolveXAttrs(fp, fi, base)
+		if err != nil && !errors.Is(err, ErrNotSupported) {
+			return err
+		}
+
+		if !fi.IsDir() {
+			entry.backup = u.pathDriver.Join(u.dir, strconv.Itoa(len(u.entries)))
+			if err := u.copy(fp, fi, entry.backup); err != nil {
+				return fmt.Errorf("failed to back up %q: %w", p, err)
+			}
+		}
+
+		u.entries = append(u.entries, entry)
+	}
+
+	return nil
+}
+
+// changedPaths returns the paths that applying resource will change, as
+// planned by Plan. Files whose content and metadata already match are left
+// out, so that they are not backed up. If planning fails, all the paths of
+// the resource are returned, as the apply may still change some of them.
+func (u *undoLog) changedPaths(resource Resource) []string {
+	pc, planner := u.context.planner()
+	if err := pc.Apply(resource); err != nil {
+		if h, ok := resource.(Hardlinkable); ok {
+			return h.Paths()
+		}
+		return []string{resource.Path()}
+	}
+
+	var paths []string
+	for _, change := range planner.changes {
+		paths = append(paths, change.Path)
+	}
+	return paths
+}
+
+// copy copies the file at fp, described by fi, to the path dst. Files are
+// copied rather than linked, as the apply may change the metadata of the
+// file in place, or the backup directory may be on another filesystem.
+func (u *undoLog) copy(fp string, fi os.FileInfo, dst string) error {
+	switch {
+	case fi.Mode().IsRegular():
+		r, err := u.driver.Open(fp)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+
+		w, err := u.driver.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, fi.Mode().Perm())
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(w, r); err != nil {
+			w.Close()
+			return err
+		}
+		return w.Close()
+	case fi.Mode()&os.ModeSymlink != 0:
+		target, err := u.driver.Readlink(fp)
+		if err != nil {
+			return err
+		}
+		return u.driver.Symlink(target, dst)
+	case fi.Mode()&os.ModeNamedPipe != 0:
+		return u.driver.Mkfifo(dst, fi.Mode())
+	case fi.Mode()&os.ModeDevice != 0:
+		major, minor, err := devices.DeviceInfo(fi)
+		if err != nil {
+			return err
+		}
+		return u.driver.Mknod(dst, fi.Mode(), int(major), int(minor))
+	}
+
+	return fmt.Errorf("%v: %w", fi.Mode(), ErrNotSupported)
+}
+
+// rollback restores the recorded files in reverse order, and removes the
+// files that did not exist.
+func (u *undoLog) rollback() error {
+	for i := len(u.entries) - 1; i >= 0; i-- {
+		entry := u.entries[i]
+		if err := u.restore(entry); err != nil {
+			return fmt.Errorf("failed to restore %s: %w", entry.fp, err)
+		}
+	}
+
+	return nil
+}
+
+func (u *undoLog) restore(entry undoEntry) error {
+	fi, err := u.driver.Lstat(entry.fp)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if entry.fi == nil {
+		if fi != nil {
+			return u.driver.Remove(entry.fp)
+		}
+		return nil
+	}
+
+	if entry.backup != "" {
+		if fi != nil {
+			if err := u.driver.Remove(entry.fp); err != nil {
+				return err
+			}
+		}
+		if renamer, ok := u.driver.(driverpkg.RenameDriver); ok {
+			if err := renamer.Rename(entry.backup, entry.fp); err != nil {
+				return err
+			}
+		} else if err := u.copy(entry.backup, entry.fi, entry.fp); err != nil {
+			return err
+		}
+	}
+
+	if err := u.driver.Lchmod(entry.fp, entry.fi.Mode()); err != nil {
+		return err
+	}
+	if err := u.driver.Lchown(entry.fp, entry.uid, entry.gid); err != nil {
+		return err
+	}
+
+	if len(entry.xattrs) > 0 {
+		if entry.fi.Mode()&os.ModeSymlink != 0 {
+			if lxattrDriver, ok := u.driver.(driverpkg.LXAttrDriver); ok {
+				return lxattrDriver.LSetxattr(entry.fp, entry.xattrs)
+			}
+		} else if xattrDriver, ok := u.driver.(driverpkg.XAttrDriver); ok {
+			return xattrDriver.Setxattr(entry.fp, entry.xattrs)
+		}
+	}
+
+	return nil
+}
+
+// Close removes the backups.
+func (u *undoLog) Close() error {
+	return u.driver.RemoveAll(u.dir)
+}
@@ -0,0 +1,97 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continuity
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Snapshotter provides a consistent view of a live tree for the duration of
+// a build, so that the manifest does not mix the states of files changed
+// while it is built. Other kinds of snapshots, such as LVM snapshots, can be
+// provided by implementing it.
+type Snapshotter interface {
+	// Snapshot returns the root of a read-only view of the tree at root,
+	// which may be root itself, and a function releasing the view.
+	Snapshot(root string) (string, func() error, error)
+}
+
+// BuildFromSnapshot builds the manifest of the tree at root from a snapshot
+// taken by s, with a context created with the options. The snapshot is
+// released once the build completes, whether or not it succeeds. The paths
+// of the manifest are relative to the root, as when building from it
+// directly.
+func BuildFromSnapshot(root string, s Snapshotter, options ContextOptions, opts ...BuildOpt) (*Manifest, error) {
+	snapshot, release, err := s.Snapshot(root)
+	if err != nil {
+		return nil, fmt.Errorf("failed to snapshot %s: %w", root, err)
+	}
+
+	m, err := buildFrom(snapshot, options, opts)
+	if rerr := release(); rerr != nil {
+		return nil, joinErrors(err, fmt.Errorf("failed to release snapshot of %s: %w", root, rerr))
+	}
+	return m, err
+}
+
+func buildFrom(root string, options ContextOptions, opts []BuildOpt) (*Manifest, error) {
+	ctx, err := NewContextWithOptions(root, options)
+	if err != nil {
+		return nil, err
+	}
+	return BuildManifest(ctx, opts...)
+}
+
+// BtrfsSnapshotter takes a read-only snapshot of a btrfs subvolume, in Dir,
+// which must be on the same filesystem, and deletes it once released. The
+// tree to build must be the root of a subvolume. It is only supported on
+// Linux and requires privileges to create and delete subvolumes.
+type BtrfsSnapshotter struct {
+	Dir string
+}
+
+// Snapshot implements Snapshotter.
+func (s BtrfsSnapshotter) Snapshot(root string) (string, func() error, error) {
+	name := fmt.Sprintf(".continuity-snapshot-%d-%d", os.Getpid(), time.Now().UnixNano())
+	if err := btrfsSnapshot(root, s.Dir, name); err != nil {
+		return "", nil, err
+	}
+
+	return filepath.Join(s.Dir, name), func() error {
+		return btrfsDeleteSubvolume(s.Dir, name)
+	}, nil
+}
+
+// FreezeSnapshotter freezes the filesystem of the tree, as fsfreeze does,
+// and thaws it once released, so that the tree is built in place while no
+// changes can be written to it. Writes to the filesystem block while it is
+// frozen, so the build must not write to it, such as to a journal, and the
+// filesystem should not be the one the caller runs from. It is only
+// supported on Linux and requires CAP_SYS_ADMIN.
+type FreezeSnapshotter struct{}
+
+// Snapshot implements Snapshotter.
+func (FreezeSnapshotter) Snapshot(root string) (string, func() error, error) {
+	thaw, err := freezeFilesystem(root)
+	if err != nil {
+		return "", nil, err
+	}
+	return root, thaw, nil
+}
@@ -0,0 +1,116 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continuity
+
+import (
+	"os"
+	"unsafe"
+
+	"github.com/containerd/continuity/internal/ioctl"
+	"golang.org/x/sys/unix"
+)
+
+// btrfsSubvolReadOnly is BTRFS_SUBVOL_RDONLY.
+const btrfsSubvolReadOnly = 1 << 1
+
+var (
+	// btrfsIocSnapCreateV2 is BTRFS_IOC_SNAP_CREATE_V2, and
+	// btrfsIocSnapDestroy is BTRFS_IOC_SNAP_DESTROY.
+	btrfsIocSnapCreateV2 = ioctl.IOW(0x94, 23, unsafe.Sizeof(btrfsVolArgsV2{}))
+	btrfsIocSnapDestroy  = ioctl.IOW(0x94, 15, unsafe.Sizeof(btrfsVolArgs{}))
+
+	// fsIocFreeze is FIFREEZE and fsIocThaw is FITHAW.
+	fsIocFreeze = ioctl.IOWR('X', 119, unsafe.Sizeof(int32(0)))
+	fsIocThaw   = ioctl.IOWR('X', 120, unsafe.Sizeof(int32(0)))
+)
+
+// btrfsVolArgsV2 is struct btrfs_ioctl_vol_args_v2.
+type btrfsVolArgsV2 struct {
+	fd      int64
+	transid uint64
+	flags   uint64
+	unused  [4]uint64
+	name    [4040]byte
+}
+
+// btrfsVolArgs is struct btrfs_ioctl_vol_args.
+type btrfsVolArgs struct {
+	fd   int64
+	name [4088]byte
+}
+
+// btrfsSnapshot creates a read-only snapshot of the subvolume at root, named
+// name in the directory dir.
+func btrfsSnapshot(root, dir, name string) error {
+	src, err := unix.Open(root, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return &os.PathError{Op: "open", Path: root, Err: err}
+	}
+	defer unix.Close(src)
+
+	dst, err := unix.Open(dir, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return &os.PathError{Op: "open", Path: dir, Err: err}
+	}
+	defer unix.Close(dst)
+
+	args := btrfsVolArgsV2{fd: int64(src), flags: btrfsSubvolReadOnly}
+	copy(args.name[:len(args.name)-1], name)
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(dst), btrfsIocSnapCreateV2, uintptr(unsafe.Pointer(&args))); errno != 0 {
+		return &os.PathError{Op: "snapshot", Path: root, Err: errno}
+	}
+	return nil
+}
+
+// btrfsDeleteSubvolume deletes the subvolume named name in the directory dir.
+func btrfsDeleteSubvolume(dir, name string) error {
+	fd, err := unix.Open(dir, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return &os.PathError{Op: "open", Path: dir, Err: err}
+	}
+	defer unix.Close(fd)
+
+	var args btrfsVolArgs
+	copy(args.name[:len(args.name)-1], name)
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), btrfsIocSnapDestroy, uintptr(unsafe.Pointer(&args))); errno != 0 {
+		return &os.PathError{Op: "delete subvolume", Path: dir, Err: errno}
+	}
+	return nil
+}
+
+// freezeFilesystem freezes the filesystem of path, returning a function
+// thawing it. The file is kept open until then.
+func freezeFilesystem(path string) (func() error, error) {
+	fd, err := unix.Open(path, unix.O_RDONLY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+
+	var arg int
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), fsIocFreeze, uintptr(unsafe.Pointer(&arg))); errno != 0 {
+		unix.Close(fd)
+		return nil, &os.PathError{Op: "freeze", Path: path, Err: errno}
+	}
+
+	return func() error {
+		defer unix.Close(fd)
+		if _, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), fsIocThaw, uintptr(unsafe.Pointer(&arg))); errno != 0 {
+			return &os.PathError{Op: "thaw", Path: path, Err: errno}
+		}
+		return nil
+	}, nil
+}
@@ -0,0 +1,38 @@
+//go:build !linux
+// +build !linux
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continuity
+
+// btrfsSnapshot creates a snapshot of a btrfs subvolume, which is not
+// supported on this platform.
+func btrfsSnapshot(root, dir, name string) error {
+	return ErrNotSupported
+}
+
+// btrfsDeleteSubvolume deletes a btrfs subvolume, which is not supported on
+// this platform.
+func btrfsDeleteSubvolume(dir, name string) error {
+	return ErrNotSupported
+}
+
+// freezeFilesystem freezes a filesystem, which is not supported on this
+// platform.
+func freezeFilesystem(path string) (func() error, error) {
+	return nil, ErrNotSupported
+}
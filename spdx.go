@@ -0,0 +1,158 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continuity
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	// SPDXVersion is the version of the SPDX specification followed by
+	// documents returned by NewSPDXDocument.
+	SPDXVersion = "SPDX-2.3"
+
+	// spdxNoAssertion marks fields the manifest carries no information for.
+	spdxNoAssertion = "NOASSERTION"
+)
+
+// spdxAlgorithms maps digest algorithms to SPDX checksum algorithms.
+var spdxAlgorithms = map[digest.Algorithm]string{
+	digest.SHA256: "SHA256",
+	digest.SHA384: "SHA384",
+	digest.SHA512: "SHA512",
+}
+
+// SPDXDocument is an SPDX document holding the file section of a manifest,
+// suitable for encoding as JSON.
+type SPDXDocument struct {
+	SPDXVersion       string           `json:"spdxVersion"`
+	DataLicense       string           `json:"dataLicense"`
+	SPDXID            string           `json:"SPDXID"`
+	Name              string           `json:"name"`
+	DocumentNamespace string           `json:"documentNamespace"`
+	CreationInfo      SPDXCreationInfo `json:"creationInfo"`
+	Files             []SPDXFile       `json:"files"`
+}
+
+// SPDXCreationInfo records when and by what an SPDX document was created.
+type SPDXCreationInfo struct {
+	Created  string   `json:"created"`
+	Creators []string `json:"creators"`
+}
+
+// SPDXFile is an entry of the file section of an SPDX document.
+type SPDXFile struct {
+	SPDXID           string         `json:"SPDXID"`
+	FileName         string         `json:"fileName"`
+	Checksums        []SPDXChecksum `json:"checksums"`
+	LicenseConcluded string         `json:"licenseConcluded"`
+	CopyrightText    string         `json:"copyrightText"`
+}
+
+// SPDXChecksum is a checksum of an SPDX file, with the algorithm named as in
+// the SPDX specification and the value hex encoded.
+type SPDXChecksum struct {
+	Algorithm string `json:"algorithm"`
+	Value     string `json:"checksumValue"`
+}
+
+// SPDXFiles returns the file section of an SPDX document for the manifest,
+// with an entry for every path of every regular file. File names are made
+// relative to the bundle root and start with "./", as SPDX expects. Digests
+// of algorithms SPDX does not name are left out, as are files without any
+// digest left. Note that SPDX asks for a SHA1 checksum of every file, which
+// manifests do not carry, so strict validators may reject the result.
+func SPDXFiles(m *Manifest) ([]SPDXFile, error) {
+	var files []SPDXFile
+	for _, resource := range m.Resources {
+		rf, ok := resource.(RegularFile)
+		if !ok {
+			continue
+		}
+
+		var checksums []SPDXChecksum
+		for _, dgst := range rf.Digests() {
+			alg, ok := spdxAlgorithms[dgst.Algorithm()]
+			if !ok {
+				continue
+			}
+			if err := dgst.Validate(); err != nil {
+				return nil, fmt.Errorf("invalid digest for resource %q: %w", rf.Path(), err)
+			}
+			checksums = append(checksums, SPDXChecksum{Algorithm: alg, Value: dgst.Encoded()})
+		}
+		if len(checksums) == 0 {
+			continue
+		}
+
+		for _, p := range rf.Paths() {
+			files = append(files, SPDXFile{
+				SPDXID:           fmt.Sprintf("SPDXRef-File-%d", len(files)+1),
+				FileName:         "./" + strings.TrimPrefix(p, "/"),
+				Checksums:        checksums,
+				LicenseConcluded: spdxNoAssertion,
+				CopyrightText:    spdxNoAssertion,
+			})
+		}
+	}
+
+	return files, nil
+}
+
+// NewSPDXDocument returns an SPDX document, under the given name, whose file
+// section lists the regular files of the manifest as SPDXFiles does. The
+// document namespace is derived from the digest of the manifest in its
+// protobuf encoding, so that documents of different manifests do not clash
+// and documents of the same manifest agree. The document is created now, or
+// at the time given by SOURCE_DATE_EPOCH if it is set, so that documents of
+// reproducible builds are identical.
+func NewSPDXDocument(m *Manifest, name string) (*SPDXDocument, error) {
+	p, err := Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+
+	created, ok, err := SourceDateEpoch()
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		created = time.Now()
+	}
+
+	files, err := SPDXFiles(m)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SPDXDocument{
+		SPDXVersion:       SPDXVersion,
+		DataLicense:       "CC0-1.0",
+		SPDXID:            "SPDXRef-DOCUMENT",
+		Name:              name,
+		DocumentNamespace: "https://github.com/containerd/continuity/spdx/" + digest.FromBytes(p).Encoded(),
+		CreationInfo: SPDXCreationInfo{
+			Created:  created.UTC().Format(time.RFC3339),
+			Creators: []string{"Tool: continuity"},
+		},
+		Files: files,
+	}, nil
+}
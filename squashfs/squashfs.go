@@ -0,0 +1,602 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package squashfs writes SquashFS images of manifests, with the content of
+// their regular files from a content provider, so that read-only images can
+// be produced without extracting the tree first. Images are in the SquashFS
+// 4.0 format, compressed with zlib, and are reproducible: the same manifest
+// and content always give the same image.
+package squashfs
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/containerd/continuity"
+	"github.com/containerd/continuity/internal/imagetree"
+)
+
+// Options controls how images are written.
+type Options struct {
+	// BlockSize is the size of the data blocks of files, a power of two
+	// between 4 KiB and 1 MiB. It defaults to 128 KiB.
+	BlockSize int
+
+	// ModTime is recorded as the modification time of the image and of all
+	// of its inodes, since manifests do not record them. It defaults to the
+	// Unix epoch.
+	ModTime time.Time
+}
+
+const (
+	magic        = 0x73717368
+	superSize    = 96
+	metadataSize = 8192
+	zlibID       = 1
+	invalidTable = 0xffffffffffffffff
+	invalidFrag  = 0xffffffff
+	noXattr      = 0xffffffff
+
+	flagNoFragments = 0x0010
+	flagNoXattrs    = 0x0200
+
+	metadataUncompressed = 0x8000
+	dataUncompressed     = 1 << 24
+
+	// idsPerBlock is the number of ids in each metadata block of the id
+	// table.
+	idsPerBlock = metadataSize / 4
+
+	// alignment is the size images are padded to, for block devices.
+	alignment = 4096
+)
+
+// Inode types. Directory entries always use the basic types.
+const (
+	typeDir = iota + 1
+	typeFile
+	typeSymlink
+	typeBlockDev
+	typeCharDev
+	typeFifo
+	typeSocket
+	typeExtDir
+	typeExtFile
+)
+
+// Write writes the SquashFS image of the manifest to w, reading the content
+// of regular files from the provider. Directories missing from the manifest
+// are added as imagetree.Build does. Extended attributes are not written.
+func Write(w io.WriteSeeker, m *continuity.Manifest, provider continuity.ContentProvider, opts Options) error {
+	if opts.BlockSize == 0 {
+		opts.BlockSize = 128 << 10
+	}
+	if opts.BlockSize < 4<<10 || opts.BlockSize > 1<<20 || opts.BlockSize&(opts.BlockSize-1) != 0 {
+		return fmt.Errorf("invalid block size %d", opts.BlockSize)
+	}
+
+	root, err := imagetree.Build[inode](m)
+	if err != nil {
+		return err
+	}
+
+	iw := &imageWriter{
+		w:         w,
+		provider:  provider,
+		blockSize: opts.BlockSize,
+		ids:       map[uint32]uint16{},
+	}
+	if !opts.ModTime.IsZero() {
+		iw.mtime = uint32(opts.ModTime.Unix())
+	}
+	iw.inodes.c = &iw.c
+	iw.dirs.c = &iw.c
+
+	if _, err := w.Write(make([]byte, superSize)); err != nil {
+		return err
+	}
+	iw.offset = superSize
+
+	// File content comes first, in the order of the paths of the files.
+	var files []*node
+	root.Walk(func(n *node) error {
+		if _, ok := n.Resource.(continuity.RegularFile); ok && n.Inode.sizes == nil {
+			n.Inode.sizes = []uint32{}
+			files = append(files, n)
+		}
+		return nil
+	})
+	for _, n := range files {
+		if err := iw.writeData(n); err != nil {
+			return fmt.Errorf("failed to write %s: %w", n.Path, err)
+		}
+	}
+
+	var count uint32
+	number(root, &count)
+	if err := iw.writeDir(root, count+1); err != nil {
+		return err
+	}
+	return iw.finish(root, count)
+}
+
+// node is a path of the image.
+type node = imagetree.Node[inode]
+
+// inode holds what is known of the inode of a node as the image is written.
+type inode struct {
+	number  uint32
+	ref     uint64 // location in the inode table, once written
+	written bool
+
+	// start and sizes locate the data blocks of regular files.
+	start uint64
+	sizes []uint32
+}
+
+// number numbers the inodes of the directory and those below it, children
+// before their directories, so that the root comes last.
+func number(n *node, count *uint32) {
+	for _, child := range n.Sorted() {
+		if child.IsDir() {
+			number(child, count)
+		} else if child.Inode.number == 0 {
+			*count++
+			child.Inode.number = *count
+		}
+	}
+	*count++
+	n.Inode.number = *count
+}
+
+// typ returns the basic inode type of the node.
+func typ(n *node) uint16 {
+	switch {
+	case n.IsDir():
+		return typeDir
+	case n.Mode&os.ModeSymlink != 0:
+		return typeSymlink
+	case n.Mode&os.ModeCharDevice != 0:
+		return typeCharDev
+	case n.Mode&os.ModeDevice != 0:
+		return typeBlockDev
+	case n.Mode&os.ModeNamedPipe != 0:
+		return typeFifo
+	case n.Mode&os.ModeSocket != 0:
+		return typeSocket
+	default:
+		return typeFile
+	}
+}
+
+// imageWriter writes the parts of an image in turn.
+type imageWriter struct {
+	w         io.WriteSeeker
+	provider  continuity.ContentProvider
+	blockSize int
+	mtime     uint32
+	offset    uint64
+
+	c      compressor
+	inodes metadataWriter
+	dirs   metadataWriter
+
+	ids    map[uint32]uint16
+	idList []uint32
+}
+
+func (iw *imageWriter) write(p []byte) error {
+	n, err := iw.w.Write(p)
+	iw.offset += uint64(n)
+	return err
+}
+
+// writeData writes the content of the regular file n in data blocks.
+func (iw *imageWriter) writeData(n *node) error {
+	rf := n.Resource.(continuity.RegularFile)
+	n.Inode.start = iw.offset
+	if rf.Size() == 0 {
+		return nil
+	}
+	r, err := imagetree.OpenContent(iw.provider, rf)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	block := make([]byte, iw.blockSize)
+	for remaining := rf.Size(); remaining > 0; {
+		size := int64(len(block))
+		if remaining < size {
+			size = remaining
+		}
+		if _, err := io.ReadFull(r, block[:size]); err != nil {
+			return err
+		}
+		remaining -= size
+
+		data, compressed := iw.c.compress(block[:size])
+		stored := uint32(len(data))
+		if !compressed {
+			stored |= dataUncompressed
+		}
+		if err := iw.write(data); err != nil {
+			return err
+		}
+		n.Inode.sizes = append(n.Inode.sizes, stored)
+	}
+	return nil
+}
+
+// id returns the index of the uid or gid in the id table.
+func (iw *imageWriter) id(v uint32) (uint16, error) {
+	if i, ok := iw.ids[v]; ok {
+		return i, nil
+	}
+	if len(iw.idList) > 0xffff {
+		return 0, fmt.Errorf("too many uids and gids")
+	}
+	i := uint16(len(iw.idList))
+	iw.ids[v] = i
+	iw.idList = append(iw.idList, v)
+	return i, nil
+}
+
+// writeDir writes the inodes below the directory n, its listing and its
+// inode, numbered parent.
+func (iw *imageWriter) writeDir(n *node, parent uint32) error {
+	children := n.Sorted()
+	for _, child := range children {
+		if child.IsDir() {
+			if err := iw.writeDir(child, n.Inode.number); err != nil {
+				return err
+			}
+		}
+	}
+	for _, child := range children {
+		if !child.IsDir() && !child.Inode.written {
+			if err := iw.writeInode(child); err != nil {
+				return fmt.Errorf("failed to write %s: %w", child.Path, err)
+			}
+		}
+	}
+
+	block, offset := iw.dirs.position()
+	listing := listing(children)
+	iw.dirs.Write(listing)
+	// The size counts the implied "." and ".." entries.
+	size := uint32(len(listing)) + 3
+
+	var b bytes.Buffer
+	if size <= 0xffff {
+		if err := iw.header(&b, n, typeDir); err != nil {
+			return err
+		}
+		binary.Write(&b, binary.LittleEndian, struct {
+			Start  uint32
+			Nlink  uint32
+			Size   uint16
+			Offset uint16
+			Parent uint32
+		}{block, n.Links(), uint16(size), offset, parent})
+	} else {
+		if err := iw.header(&b, n, typeExtDir); err != nil {
+			return err
+		}
+		binary.Write(&b, binary.LittleEndian, struct {
+			Nlink      uint32
+			Size       uint32
+			Start      uint32
+			Parent     uint32
+			IndexCount uint16
+			Offset     uint16
+			Xattr      uint32
+		}{n.Links(), size, block, parent, 0, offset, noXattr})
+	}
+	n.Inode.ref = iw.inodes.ref()
+	n.Inode.written = true
+	iw.inodes.Write(b.Bytes())
+	return nil
+}
+
+// listing returns the directory entries of the children of a directory,
+// which must have their inodes written.
+func listing(children []*node) []byte {
+	var b bytes.Buffer
+	for i := 0; i < len(children); {
+		first := children[i].Inode
+		block, base := uint32(first.ref>>16), first.number
+
+		// Entries share a header as long as their inodes are in the same
+		// metadata block and their numbers are close enough.
+		j := i
+		for ; j < len(children) && j-i < 256; j++ {
+			ino := children[j].Inode
+			diff := int64(ino.number) - int64(base)
+			if uint32(ino.ref>>16) != block || diff < -0x8000 || diff > 0x7fff {
+				break
+			}
+		}
+
+		binary.Write(&b, binary.LittleEndian, struct {
+			Count  uint32
+			Start  uint32
+			Number uint32
+		}{uint32(j - i - 1), block, base})
+		for _, child := range children[i:j] {
+			binary.Write(&b, binary.LittleEndian, struct {
+				Offset   uint16
+				Number   int16
+				Type     uint16
+				NameSize uint16
+			}{uint16(child.Inode.ref), int16(int64(child.Inode.number) - int64(base)), typ(child), uint16(len(child.Name) - 1)})
+			b.WriteString(child.Name)
+		}
+		i = j
+	}
+	return b.Bytes()
+}
+
+// header writes the header common to all inodes.
+func (iw *imageWriter) header(b *bytes.Buffer, n *node, typ uint16) error {
+	uid, err := iw.id(n.UID)
+	if err != nil {
+		return err
+	}
+	gid, err := iw.id(n.GID)
+	if err != nil {
+		return err
+	}
+
+	return binary.Write(b, binary.LittleEndian, struct {
+		Type   uint16
+		Perm   uint16
+		UID    uint16
+		GID    uint16
+		MTime  uint32
+		Number uint32
+	}{typ, uint16(n.Perm()), uid, gid, iw.mtime, n.Inode.number})
+}
+
+// writeInode writes the inode of the node n, which is not a directory.
+func (iw *imageWriter) writeInode(n *node) error {
+	var b bytes.Buffer
+	switch r := n.Resource.(type) {
+	case continuity.RegularFile:
+		size := uint64(r.Size())
+		if n.Links() > 1 || n.Inode.start > 0xffffffff || size > 0xffffffff {
+			if err := iw.header(&b, n, typeExtFile); err != nil {
+				return err
+			}
+			binary.Write(&b, binary.LittleEndian, struct {
+				Start    uint64
+				Size     uint64
+				Sparse   uint64
+				Nlink    uint32
+				Fragment uint32
+				Offset   uint32
+				Xattr    uint32
+			}{n.Inode.start, size, 0, n.Links(), invalidFrag, 0, noXattr})
+		} else {
+			if err := iw.header(&b, n, typeFile); err != nil {
+				return err
+			}
+			binary.Write(&b, binary.LittleEndian, struct {
+				Start    uint32
+				Fragment uint32
+				Offset   uint32
+				Size     uint32
+			}{uint32(n.Inode.start), invalidFrag, 0, uint32(size)})
+		}
+		binary.Write(&b, binary.LittleEndian, n.Inode.sizes)
+	case continuity.SymLink:
+		if err := iw.header(&b, n, typeSymlink); err != nil {
+			return err
+		}
+		binary.Write(&b, binary.LittleEndian, struct {
+			Nlink uint32
+			Size  uint32
+		}{n.Links(), uint32(len(r.Target()))})
+		b.WriteString(r.Target())
+	case continuity.Device:
+		if err := iw.header(&b, n, typ(n)); err != nil {
+			return err
+		}
+		major, minor := uint32(r.Major()), uint32(r.Minor())
+		binary.Write(&b, binary.LittleEndian, struct {
+			Nlink uint32
+			Rdev  uint32
+		}{n.Links(), minor&0xff | major<<8&0xfff00 | (minor&^0xff)<<12})
+	case continuity.NamedPipe:
+		if err := iw.header(&b, n, typeFifo); err != nil {
+			return err
+		}
+		binary.Write(&b, binary.LittleEndian, n.Links())
+	default:
+		return fmt.Errorf("unsupported resource of mode %v", n.Mode)
+	}
+
+	n.Inode.ref = iw.inodes.ref()
+	n.Inode.written = true
+	iw.inodes.Write(b.Bytes())
+	return nil
+}
+
+// finish writes the tables following the inodes and the superblock, once
+// the inodes, count of them, have been written.
+func (iw *imageWriter) finish(root *node, count uint32) error {
+	iw.inodes.flush()
+	iw.dirs.flush()
+
+	inodeTable := iw.offset
+	if err := iw.write(iw.inodes.out.Bytes()); err != nil {
+		return err
+	}
+	dirTable := iw.offset
+	if err := iw.write(iw.dirs.out.Bytes()); err != nil {
+		return err
+	}
+
+	// The ids are stored in metadata blocks, located by a table of their
+	// offsets.
+	ids := metadataWriter{c: &iw.c}
+	var blocks []uint64
+	for i := 0; i < len(iw.idList); i += idsPerBlock {
+		end := i + idsPerBlock
+		if end > len(iw.idList) {
+			end = len(iw.idList)
+		}
+		blocks = append(blocks, iw.offset+uint64(ids.out.Len()))
+		binary.Write(&ids, binary.LittleEndian, iw.idList[i:end])
+		ids.flush()
+	}
+	if err := iw.write(ids.out.Bytes()); err != nil {
+		return err
+	}
+	idTable := iw.offset
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, blocks)
+	if err := iw.write(b.Bytes()); err != nil {
+		return err
+	}
+
+	bytesUsed := iw.offset
+	if pad := (alignment - bytesUsed%alignment) % alignment; pad > 0 {
+		if err := iw.write(make([]byte, pad)); err != nil {
+			return err
+		}
+	}
+
+	blockLog := uint16(0)
+	for 1<<blockLog < iw.blockSize {
+		blockLog++
+	}
+	b.Reset()
+	binary.Write(&b, binary.LittleEndian, struct {
+		Magic          uint32
+		InodeCount     uint32
+		ModTime        uint32
+		BlockSize      uint32
+		FragmentCount  uint32
+		Compression    uint16
+		BlockLog       uint16
+		Flags          uint16
+		IDCount        uint16
+		Major, Minor   uint16
+		RootInode      uint64
+		BytesUsed      uint64
+		IDTable        uint64
+		XattrTable     uint64
+		InodeTable     uint64
+		DirectoryTable uint64
+		FragmentTable  uint64
+		ExportTable    uint64
+	}{
+		magic, count, iw.mtime, uint32(iw.blockSize), 0,
+		zlibID, blockLog, flagNoFragments | flagNoXattrs, uint16(len(iw.idList)), 4, 0,
+		root.Inode.ref, bytesUsed, idTable, invalidTable,
+		inodeTable, dirTable, invalidTable, invalidTable,
+	})
+	if _, err := iw.w.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := iw.w.Write(b.Bytes()); err != nil {
+		return err
+	}
+	_, err := iw.w.Seek(0, io.SeekEnd)
+	return err
+}
+
+// metadataWriter packs metadata into blocks of up to 8 KiB, each compressed
+// unless that does not make it smaller.
+type metadataWriter struct {
+	c   *compressor
+	buf []byte
+	out bytes.Buffer
+}
+
+// position returns the offset of the current block from the start of the
+// table and the offset within it.
+func (m *metadataWriter) position() (uint32, uint16) {
+	return uint32(m.out.Len()), uint16(len(m.buf))
+}
+
+// ref returns the reference to the current position, as inodes are
+// referred to.
+func (m *metadataWriter) ref() uint64 {
+	block, offset := m.position()
+	return uint64(block)<<16 | uint64(offset)
+}
+
+func (m *metadataWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		chunk := metadataSize - len(m.buf)
+		if chunk > len(p) {
+			chunk = len(p)
+		}
+		m.buf = append(m.buf, p[:chunk]...)
+		p = p[chunk:]
+		if len(m.buf) == metadataSize {
+			m.flush()
+		}
+	}
+	return n, nil
+}
+
+// flush ends the current block.
+func (m *metadataWriter) flush() {
+	if len(m.buf) == 0 {
+		return
+	}
+	data, compressed := m.c.compress(m.buf)
+	header := uint16(len(data))
+	if !compressed {
+		header |= metadataUncompressed
+	}
+	binary.Write(&m.out, binary.LittleEndian, header)
+	m.out.Write(data)
+	m.buf = m.buf[:0]
+}
+
+// compressor compresses blocks with zlib.
+type compressor struct {
+	buf bytes.Buffer
+	zw  *zlib.Writer
+}
+
+// compress returns the compressed block, or the block itself if it does not
+// compress, and whether it is compressed. The result is only valid until
+// the next call.
+func (c *compressor) compress(p []byte) ([]byte, bool) {
+	c.buf.Reset()
+	if c.zw == nil {
+		c.zw = zlib.NewWriter(&c.buf)
+	} else {
+		c.zw.Reset(&c.buf)
+	}
+	c.zw.Write(p)
+	c.zw.Close()
+	if c.buf.Len() >= len(p) {
+		return p, false
+	}
+	return c.buf.Bytes(), true
+}
@@ -0,0 +1,339 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package squashfs
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/containerd/continuity"
+	"github.com/containerd/continuity/testutil"
+	"github.com/opencontainers/go-digest"
+)
+
+func TestWrite(t *testing.T) {
+	small := []byte("hello\n")
+	// The large file spans several blocks, one of which does not compress.
+	large := bytes.Repeat([]byte("a"), 3*4096)
+	rand.New(rand.NewSource(1)).Read(large[4096 : 2*4096])
+	provider := testutil.MapProvider{digest.FromBytes(small): small, digest.FromBytes(large): large}
+
+	must := func(r continuity.Resource, err error) continuity.Resource {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+	m := &continuity.Manifest{Resources: []continuity.Resource{
+		must(continuity.NewDirectory("/a", continuity.Attributes{Mode: 0o700, UID: 1000, GID: 1000})),
+		must(continuity.NewRegularFile([]string{"/a/b", "/c"}, continuity.Attributes{Mode: 0o644}, int64(len(small)), digest.FromBytes(small))),
+		must(continuity.NewRegularFile([]string{"/d/large"}, continuity.Attributes{Mode: 0o755}, int64(len(large)), digest.FromBytes(large))),
+		must(continuity.NewRegularFile([]string{"/empty"}, continuity.Attributes{Mode: 0o600}, 0, digest.FromBytes(nil))),
+		must(continuity.NewSymLink("/link", continuity.Attributes{Mode: 0o777}, "a/b")),
+		must(continuity.NewNamedPipe([]string{"/pipe"}, continuity.Attributes{Mode: 0o600})),
+	}}
+
+	modTime := time.Unix(1700000000, 0)
+	data := writeImage(t, m, provider, Options{BlockSize: 4096, ModTime: modTime})
+	if len(data)%alignment != 0 {
+		t.Fatalf("image of %d bytes is not padded", len(data))
+	}
+	if again := writeImage(t, m, provider, Options{BlockSize: 4096, ModTime: modTime}); !bytes.Equal(data, again) {
+		t.Fatal("images of the same manifest differ")
+	}
+
+	img := readImage(t, data)
+	if img.sb.ModTime != uint32(modTime.Unix()) || img.sb.InodeCount != 8 {
+		t.Fatalf("unexpected superblock: %+v", img.sb)
+	}
+
+	root := img.inode(img.sb.RootInode)
+	if root.typ != typeDir || root.perm != 0o755 || root.uid != 0 {
+		t.Fatalf("unexpected root: %+v", root)
+	}
+	entries := img.list(root)
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.name)
+	}
+	if got := strings.Join(names, " "); got != "a c d empty link pipe" {
+		t.Fatalf("unexpected root entries: %s", got)
+	}
+
+	a := img.inode(entries[0].ref)
+	if a.typ != typeDir || a.perm != 0o700 || a.uid != 1000 || a.gid != 1000 || a.nlink != 2 || a.parent != root.number {
+		t.Fatalf("unexpected directory: %+v", a)
+	}
+	b := img.inode(img.list(a)[0].ref)
+	c := img.inode(entries[1].ref)
+	if b.typ != typeExtFile || b.number != c.number || b.nlink != 2 {
+		t.Fatalf("hardlinked files differ: %+v, %+v", b, c)
+	}
+	if got := img.content(b); !bytes.Equal(got, small) {
+		t.Fatalf("unexpected content %q", got)
+	}
+
+	d := img.inode(entries[2].ref)
+	if d.mtime != uint32(modTime.Unix()) || d.nlink != 2 {
+		t.Fatalf("unexpected implied directory: %+v", d)
+	}
+	l := img.inode(img.list(d)[0].ref)
+	if l.typ != typeFile || l.perm != 0o755 || len(l.blocks) != 3 || l.blocks[1]&dataUncompressed == 0 || l.blocks[0]&dataUncompressed != 0 {
+		t.Fatalf("unexpected large file: %+v", l)
+	}
+	if got := img.content(l); !bytes.Equal(got, large) {
+		t.Fatal("unexpected content of large file")
+	}
+	if e := img.inode(entries[3].ref); e.size != 0 || len(e.blocks) != 0 {
+		t.Fatalf("unexpected empty file: %+v", e)
+	}
+	if link := img.inode(entries[4].ref); link.typ != typeSymlink || link.target != "a/b" {
+		t.Fatalf("unexpected symlink: %+v", link)
+	}
+	if pipe := img.inode(entries[5].ref); pipe.typ != typeFifo || entries[5].typ != typeFifo {
+		t.Fatalf("unexpected pipe: %+v", pipe)
+	}
+
+	// Content not matching its digest fails the image.
+	provider[digest.FromBytes(small)] = []byte("bye\n")
+	if err := Write(tempFile(t), m, provider, Options{}); err == nil {
+		t.Fatal("expected an error for content not matching its digest")
+	}
+}
+
+func TestWriteInvalid(t *testing.T) {
+	file, err := continuity.NewRegularFile([]string{"/a"}, continuity.Attributes{Mode: 0o644}, 0, digest.FromBytes(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	under, err := continuity.NewRegularFile([]string{"/a/b"}, continuity.Attributes{Mode: 0o644}, 0, digest.FromBytes(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name      string
+		resources []continuity.Resource
+		opts      Options
+	}{
+		{"block size", nil, Options{BlockSize: 1000}},
+		{"duplicate", []continuity.Resource{file, file}, Options{}},
+		{"file parent", []continuity.Resource{file, under}, Options{}},
+	} {
+		m := &continuity.Manifest{Resources: tc.resources}
+		if err := Write(tempFile(t), m, testutil.MapProvider{}, tc.opts); err == nil {
+			t.Errorf("%s: expected an error", tc.name)
+		}
+	}
+}
+
+func tempFile(t *testing.T) *os.File {
+	f, err := os.Create(filepath.Join(t.TempDir(), "image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	return f
+}
+
+func writeImage(t *testing.T, m *continuity.Manifest, provider continuity.ContentProvider, opts Options) []byte {
+	t.Helper()
+	f := tempFile(t)
+	if err := Write(f, m, provider, opts); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+type superblock struct {
+	Magic          uint32
+	InodeCount     uint32
+	ModTime        uint32
+	BlockSize      uint32
+	FragmentCount  uint32
+	Compression    uint16
+	BlockLog       uint16
+	Flags          uint16
+	IDCount        uint16
+	Major, Minor   uint16
+	RootInode      uint64
+	BytesUsed      uint64
+	IDTable        uint64
+	XattrTable     uint64
+	InodeTable     uint64
+	DirectoryTable uint64
+	FragmentTable  uint64
+	ExportTable    uint64
+}
+
+// image reads back the parts of images the tests check.
+type image struct {
+	t    *testing.T
+	data []byte
+	sb   superblock
+	ids  []uint32
+}
+
+type testInode struct {
+	typ, perm     uint16
+	uid, gid      uint32
+	mtime, number uint32
+	nlink, parent uint32
+	start, size   uint64
+	offset        uint16
+	blocks        []uint32
+	target        string
+}
+
+type entry struct {
+	name string
+	typ  uint16
+	ref  uint64
+}
+
+func readImage(t *testing.T, data []byte) *image {
+	img := &image{t: t, data: data}
+	if err := binary.Read(bytes.NewReader(data), binary.LittleEndian, &img.sb); err != nil {
+		t.Fatal(err)
+	}
+	if img.sb.Magic != magic || img.sb.Major != 4 || img.sb.Compression != zlibID || img.sb.BytesUsed > uint64(len(data)) {
+		t.Fatalf("unexpected superblock: %+v", img.sb)
+	}
+	block := binary.LittleEndian.Uint64(data[img.sb.IDTable:])
+	ids := img.metadata(block, img.sb.IDTable, 0)
+	for i := 0; i < int(img.sb.IDCount); i++ {
+		img.ids = append(img.ids, binary.LittleEndian.Uint32(ids[i*4:]))
+	}
+	return img
+}
+
+// metadata returns the metadata from the reference ref into the table
+// starting at start, up to end.
+func (img *image) metadata(start, end, ref uint64) []byte {
+	var out []byte
+	for pos := start + ref>>16; pos < end; {
+		header := binary.LittleEndian.Uint16(img.data[pos:])
+		size := uint64(header &^ metadataUncompressed)
+		block := img.data[pos+2 : pos+2+size]
+		if header&metadataUncompressed == 0 {
+			block = img.decompress(block)
+		}
+		out = append(out, block...)
+		pos += 2 + size
+	}
+	return out[ref&0xffff:]
+}
+
+func (img *image) decompress(b []byte) []byte {
+	zr, err := zlib.NewReader(bytes.NewReader(b))
+	if err != nil {
+		img.t.Fatal(err)
+	}
+	out, err := io.ReadAll(zr)
+	if err != nil {
+		img.t.Fatal(err)
+	}
+	return out
+}
+
+func (img *image) inode(ref uint64) testInode {
+	b := img.metadata(img.sb.InodeTable, img.sb.DirectoryTable, ref)
+	le := binary.LittleEndian
+	ino := testInode{
+		typ:    le.Uint16(b),
+		perm:   le.Uint16(b[2:]),
+		uid:    img.ids[le.Uint16(b[4:])],
+		gid:    img.ids[le.Uint16(b[6:])],
+		mtime:  le.Uint32(b[8:]),
+		number: le.Uint32(b[12:]),
+	}
+	b = b[16:]
+	blocks := func(b []byte) {
+		n := (ino.size + uint64(img.sb.BlockSize) - 1) / uint64(img.sb.BlockSize)
+		for i := uint64(0); i < n; i++ {
+			ino.blocks = append(ino.blocks, le.Uint32(b[4*i:]))
+		}
+	}
+	switch ino.typ {
+	case typeDir:
+		ino.start, ino.nlink, ino.size = uint64(le.Uint32(b)), le.Uint32(b[4:]), uint64(le.Uint16(b[8:]))
+		ino.offset, ino.parent = le.Uint16(b[10:]), le.Uint32(b[12:])
+	case typeFile:
+		ino.start, ino.size, ino.nlink = uint64(le.Uint32(b)), uint64(le.Uint32(b[12:])), 1
+		blocks(b[16:])
+	case typeExtFile:
+		ino.start, ino.size, ino.nlink = le.Uint64(b), le.Uint64(b[8:]), le.Uint32(b[24:])
+		blocks(b[40:])
+	case typeSymlink:
+		ino.nlink = le.Uint32(b)
+		ino.target = string(b[8 : 8+le.Uint32(b[4:])])
+	case typeFifo:
+		ino.nlink = le.Uint32(b)
+	default:
+		img.t.Fatalf("unexpected inode type %d", ino.typ)
+	}
+	return ino
+}
+
+func (img *image) list(dir testInode) []entry {
+	end := binary.LittleEndian.Uint64(img.data[img.sb.IDTable:])
+	b := img.metadata(img.sb.DirectoryTable, end, dir.start<<16|uint64(dir.offset))
+	b = b[:dir.size-3]
+
+	le := binary.LittleEndian
+	var entries []entry
+	for len(b) > 0 {
+		count, block := le.Uint32(b)+1, le.Uint32(b[4:])
+		b = b[12:]
+		for i := uint32(0); i < count; i++ {
+			size := int(le.Uint16(b[6:])) + 1
+			entries = append(entries, entry{
+				name: string(b[8 : 8+size]),
+				typ:  le.Uint16(b[4:]),
+				ref:  uint64(block)<<16 | uint64(le.Uint16(b)),
+			})
+			b = b[8+size:]
+		}
+	}
+	return entries
+}
+
+func (img *image) content(ino testInode) []byte {
+	var out []byte
+	pos := ino.start
+	for _, size := range ino.blocks {
+		block := img.data[pos : pos+uint64(size&^dataUncompressed)]
+		if size&dataUncompressed == 0 {
+			block = img.decompress(block)
+		}
+		out = append(out, block...)
+		pos += uint64(size &^ dataUncompressed)
+	}
+	return out
+}
@@ -0,0 +1,308 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continuity
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// statsLargest is the number of largest files listed by Stats.
+const statsLargest = 10
+
+// ManifestStats summarizes the resources of a manifest. The counts by type
+// count paths, so that each path of a hardlinked resource is counted.
+type ManifestStats struct {
+	Resources int
+	Paths     int
+
+	Files       int
+	Directories int
+	SymLinks    int
+	NamedPipes  int
+	Devices     int
+
+	// TotalSize is the size of all regular files, counting hardlinked files
+	// once. UniqueSize only counts the size of each distinct content once.
+	TotalSize  int64
+	UniqueSize int64
+
+	// HardlinkGroups is the number of resources with more than one path.
+	HardlinkGroups int
+
+	// Unstable is the number of regular files flagged as having changed
+	// while they were read, counting hardlinked files once.
+	Unstable int
+
+	// Largest lists the largest regular files, largest first.
+	Largest []FileSize
+
+	// Depths counts the paths by depth: Depths[n] is the number of paths
+	// with n components.
+	Depths []int
+}
+
+// FileSize is the size of the regular file at Path.
+type FileSize struct {
+	Path string
+	Size int64
+}
+
+// Stats returns the statistics of the manifest m.
+func Stats(m *Manifest) *ManifestStats {
+	var (
+		stats ManifestStats
+		seen  = map[digest.Digest]bool{}
+	)
+	for _, r := range m.Resources {
+		paths := resourcePaths(r)
+		stats.Resources++
+		stats.Paths += len(paths)
+		if len(paths) > 1 {
+			stats.HardlinkGroups++
+		}
+
+		for _, p := range paths {
+			depth := len(strings.Split(strings.Trim(filepath.ToSlash(p), "/"), "/"))
+			for len(stats.Depths) <= depth {
+				stats.Depths = append(stats.Depths, 0)
+			}
+			stats.Depths[depth]++
+		}
+
+		switch r := r.(type) {
+		case RegularFile:
+			stats.Files += len(paths)
+			stats.TotalSize += r.Size()
+			stats.Largest = append(stats.Largest, FileSize{Path: r.Path(), Size: r.Size()})
+			if u, ok := r.(Unstabler); ok && u.Unstable() {
+				stats.Unstable++
+			}
+
+			dgsts := r.Digests()
+			if len(dgsts) == 0 || !seen[dgsts[0]] {
+				stats.UniqueSize += r.Size()
+			}
+			for _, dgst := range dgsts {
+				seen[dgst] = true
+			}
+		case Directory:
+			stats.Directories++
+		case SymLink:
+			stats.SymLinks++
+		case NamedPipe:
+			stats.NamedPipes += len(paths)
+		case Device:
+			stats.Devices += len(paths)
+		}
+	}
+
+	sort.SliceStable(stats.Largest, func(i, j int) bool {
+		return stats.Largest[i].Size > stats.Largest[j].Size
+	})
+	if len(stats.Largest) > statsLargest {
+		stats.Largest = stats.Largest[:statsLargest]
+	}
+
+	return &stats
+}
+
+// DedupReport lists the content held by more than one regular file of a
+// manifest, to find the space that hardlinking or reflinking the copies
+// would save.
+type DedupReport struct {
+	// Duplicates lists the content held by more than one regular file,
+	// those saving the most space first.
+	Duplicates []DuplicateContent
+
+	// TotalSize is the size of all regular files, counting hardlinked files
+	// once, and UniqueSize only counts the size of each distinct content
+	// once. Savings is the difference between them.
+	TotalSize  int64
+	UniqueSize int64
+	Savings    int64
+
+	// HardlinkSavings is the space already saved by hardlinks, counting the
+	// size of a hardlinked file for each of its paths but the first.
+	HardlinkSavings int64
+}
+
+// DuplicateContent is content held by several regular files.
+type DuplicateContent struct {
+	Digest digest.Digest
+	Size   int64
+
+	// Files lists the paths of each regular file holding the content, in
+	// the order of the manifest. Hardlinked paths are listed together.
+	Files [][]string
+}
+
+// Savings returns the space saved by linking the files holding the content
+// to a single copy.
+func (d DuplicateContent) Savings() int64 {
+	return d.Size * int64(len(d.Files)-1)
+}
+
+// FindDuplicates groups the regular files of the manifest m by content.
+// Files are grouped when they share any digest. Empty files and files
+// without digests are not grouped.
+func FindDuplicates(m *Manifest) *DedupReport {
+	var (
+		report DedupReport
+		groups = map[digest.Digest]*DuplicateContent{}
+		order  []*DuplicateContent
+	)
+	for _, r := range m.Resources {
+		rf, ok := r.(RegularFile)
+		if !ok {
+			continue
+		}
+		paths := rf.Paths()
+		report.TotalSize += rf.Size()
+		report.HardlinkSavings += rf.Size() * int64(len(paths)-1)
+
+		dgsts := rf.Digests()
+		if len(dgsts) == 0 || rf.Size() == 0 {
+			report.UniqueSize += rf.Size()
+			continue
+		}
+
+		var group *DuplicateContent
+		for _, dgst := range dgsts {
+			if group = groups[dgst]; group != nil {
+				break
+			}
+		}
+		if group == nil {
+			group = &DuplicateContent{Digest: dgsts[0], Size: rf.Size()}
+			order = append(order, group)
+			report.UniqueSize += rf.Size()
+		}
+		group.Files = append(group.Files, paths)
+		for _, dgst := range dgsts {
+			groups[dgst] = group
+		}
+	}
+	report.Savings = report.TotalSize - report.UniqueSize
+
+	for _, group := range order {
+		if len(group.Files) > 1 {
+			report.Duplicates = append(report.Duplicates, *group)
+		}
+	}
+	sort.SliceStable(report.Duplicates, func(i, j int) bool {
+		return report.Duplicates[i].Savings() > report.Duplicates[j].Savings()
+	})
+
+	return &report
+}
+
+// UsageBy selects how DiskUsage groups resources.
+type UsageBy int
+
+const (
+	// UsageByDirectory groups resources by their top-level directory.
+	// Resources directly under the root are grouped under "/".
+	UsageByDirectory UsageBy = iota
+
+	// UsageByOwner groups resources by their uid.
+	UsageByOwner
+
+	// UsageByType groups resources by their type: regular, directory,
+	// symlink, pipe or device.
+	UsageByType
+)
+
+// Usage is the space used by a group of resources.
+type Usage struct {
+	Key string
+
+	// Size is the size of the regular files of the group, and Resources
+	// the number of resources in it.
+	Size      int64
+	Resources int
+}
+
+// DiskUsage returns the space used by the resources of the manifest m,
+// grouped as selected by by, the largest groups first, like du(1) would
+// on the applied manifest. Hardlinked resources are only counted once,
+// grouped by their first path.
+func DiskUsage(m *Manifest, by UsageBy) ([]Usage, error) {
+	var (
+		usage []Usage
+		index = map[string]int{}
+	)
+	for _, r := range m.Resources {
+		var key string
+		switch by {
+		case UsageByDirectory:
+			key = "/"
+			if parts := strings.SplitN(strings.Trim(filepath.ToSlash(r.Path()), "/"), "/", 2); len(parts) > 1 {
+				key += parts[0]
+			} else if _, ok := r.(Directory); ok {
+				key += parts[0]
+			}
+		case UsageByOwner:
+			key = strconv.FormatInt(r.UID(), 10)
+		case UsageByType:
+			key = resourceKind(r)
+		default:
+			return nil, fmt.Errorf("unknown usage grouping %d", by)
+		}
+
+		i, ok := index[key]
+		if !ok {
+			i = len(usage)
+			index[key] = i
+			usage = append(usage, Usage{Key: key})
+		}
+		usage[i].Resources++
+		if rf, ok := r.(RegularFile); ok {
+			usage[i].Size += rf.Size()
+		}
+	}
+
+	sort.SliceStable(usage, func(i, j int) bool {
+		if usage[i].Size != usage[j].Size {
+			return usage[i].Size > usage[j].Size
+		}
+		return usage[i].Key < usage[j].Key
+	})
+	return usage, nil
+}
+
+// resourceKind returns the name of the type of the resource r.
+func resourceKind(r Resource) string {
+	switch r.(type) {
+	case RegularFile:
+		return "regular"
+	case Directory:
+		return "directory"
+	case SymLink:
+		return "symlink"
+	case NamedPipe:
+		return "pipe"
+	case Device:
+		return "device"
+	}
+	return "unknown"
+}
@@ -0,0 +1,39 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package testutil
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// MapProvider provides file content from memory, as a
+// continuity.ContentProvider.
+type MapProvider map[digest.Digest][]byte
+
+// Reader returns a reader of the content with the digest dgst.
+func (p MapProvider) Reader(dgst digest.Digest) (io.ReadCloser, error) {
+	b, ok := p[dgst]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", dgst, os.ErrNotExist)
+	}
+	return io.NopCloser(bytes.NewReader(b)), nil
+}
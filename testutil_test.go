@@ -22,6 +22,7 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"testing"
 )
 
 func tree(w io.Writer, dir string) error {
@@ -70,3 +71,15 @@ func _tree(w io.Writer, dir string, indent string) error {
 	}
 	return nil
 }
+
+// mustResource returns a function that passes on the resource returned by a
+// resource constructor, failing the test on its error.
+func mustResource(t testing.TB) func(Resource, error) Resource {
+	return func(r Resource, err error) Resource {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+}
@@ -0,0 +1,464 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continuity
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Transformer rewrites a resource of a manifest, returning the resource to
+// include in its place, or nil to leave it out.
+type Transformer func(Resource) (Resource, error)
+
+// Transform returns a new manifest with the resources of m rewritten by each
+// of the transformers in turn. Resources may be given other paths, and are
+// sorted again.
+func Transform(m *Manifest, transformers ...Transformer) (*Manifest, error) {
+	resources := make([]Resource, 0, len(m.Resources))
+	for _, r := range m.Resources {
+		for _, transform := range transformers {
+			transformed, err := transform(r)
+			if err != nil {
+				return nil, fmt.Errorf("failed to transform %q: %w", r.Path(), err)
+			}
+			if r = transformed; r == nil {
+				break
+			}
+		}
+		if r != nil {
+			resources = append(resources, r)
+		}
+	}
+
+	sort.Stable(ByPath(resources))
+	return derived(m, resources), nil
+}
+
+// MapOwnership returns a Transformer that changes the owners of resources
+// with a uid or gid in the given maps, leaving other ids as they are.
+// Manifests only record ids, not the names of users and groups.
+func MapOwnership(uids, gids map[int64]int64) Transformer {
+	return remapOwnership(func(uid, gid int64) (int64, int64, error) {
+		if mapped, ok := uids[uid]; ok {
+			uid = mapped
+		}
+		if mapped, ok := gids[gid]; ok {
+			gid = mapped
+		}
+		return uid, gid, nil
+	})
+}
+
+// ShiftOwnership returns a Transformer that adds the offsets to the uid and
+// gid of every resource, as when mapping the ids of a container to those of
+// a user namespace on the host.
+func ShiftOwnership(uidOffset, gidOffset int64) Transformer {
+	return remapOwnership(func(uid, gid int64) (int64, int64, error) {
+		uid, gid = uid+uidOffset, gid+gidOffset
+		if uid < 0 || uid > math.MaxUint32 || gid < 0 || gid > math.MaxUint32 {
+			return 0, 0, fmt.Errorf("shifted owner %d:%d is out of range", uid, gid)
+		}
+		return uid, gid, nil
+	})
+}
+
+// SquashOwnership returns a Transformer that gives every resource the same
+// uid and gid, such as 0 to have a bundle owned by root.
+func SquashOwnership(uid, gid int64) Transformer {
+	return remapOwnership(func(int64, int64) (int64, int64, error) {
+		return uid, gid, nil
+	})
+}
+
+// volatileXAttrs are the prefixes of the extended attributes that depend on
+// the host or the history of a file rather than on its content: security
+// labels and measurements, overlay filesystem metadata, and the quarantine
+// and usage markers of darwin.
+var volatileXAttrs = []string{
+	"security.selinux",
+	"security.ima",
+	"security.evm",
+	"trusted.overlay.",
+	"user.overlay.",
+	"com.apple.quarantine",
+	"com.apple.provenance",
+	"com.apple.lastuseddate#PS",
+	"com.apple.metadata:",
+}
+
+// Scrub returns a Transformer that removes the details of resources that
+// differ between builds of identical content, so that the manifests of
+// independent builds compare equal. Volatile extended attributes are dropped,
+// along with those starting with any of the given prefixes, every resource is
+// owned by root, and the filesystem ids of mount points and the birth times of
+// resources are cleared.
+func Scrub(xattrPrefixes ...string) Transformer {
+	prefixes := append(append([]string(nil), volatileXAttrs...), xattrPrefixes...)
+	return func(r Resource) (Resource, error) {
+		b := ResourceToProto(r)
+		b.Uid, b.Gid = 0, 0
+		b.BirthTime = 0
+		if b.Mount != nil {
+			b.Mount.Fsid = ""
+		}
+
+		xattrs := b.Xattr[:0]
+		for _, xattr := range b.Xattr {
+			if !hasAnyPrefix(xattr.Name, prefixes) {
+				xattrs = append(xattrs, xattr)
+			}
+		}
+		b.Xattr = xattrs
+
+		return ResourceFromProto(b)
+	}
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func remapOwnership(fn func(uid, gid int64) (int64, int64, error)) Transformer {
+	return func(r Resource) (Resource, error) {
+		uid, gid, err := fn(r.UID(), r.GID())
+		if err != nil {
+			return nil, err
+		}
+		if uid == r.UID() && gid == r.GID() {
+			return r, nil
+		}
+
+		b := ResourceToProto(r)
+		b.Uid, b.Gid = uid, gid
+		return ResourceFromProto(b)
+	}
+}
+
+// Subtree returns the manifest of the resources below the directory prefix
+// of m, with their paths made relative to that directory, so that the
+// directory can be verified or applied on its own. The directory itself
+// becomes the root and is not included. Hardlinked resources only keep
+// their paths below the directory, and symlink targets are left as they are.
+func Subtree(m *Manifest, prefix string) (*Manifest, error) {
+	prefix = filepath.Join(string(os.PathSeparator), prefix)
+	if prefix == string(os.PathSeparator) {
+		return derived(m, m.Resources), nil
+	}
+
+	var (
+		found     bool
+		resources []Resource
+	)
+	for _, r := range m.Resources {
+		if r.Path() == prefix {
+			if _, ok := r.(Directory); !ok {
+				return nil, fmt.Errorf("%q is not a directory", prefix)
+			}
+			found = true
+			continue
+		}
+
+		var paths []string
+		for _, p := range resourcePaths(r) {
+			if rel, ok := below(prefix, p); ok {
+				paths = append(paths, rel)
+			}
+		}
+		if len(paths) == 0 {
+			continue
+		}
+
+		r, err := withPaths(r, paths)
+		if err != nil {
+			return nil, err
+		}
+		resources = append(resources, r)
+	}
+
+	if !found && len(resources) == 0 {
+		return nil, fmt.Errorf("no resources below %q: %w", prefix, ErrNotFound)
+	}
+
+	sort.Stable(ByPath(resources))
+	return derived(m, resources), nil
+}
+
+// Prefix returns the manifest m with all of its paths moved below the
+// directory prefix, so that it can be embedded in a larger bundle, as the
+// inverse of Subtree. Absolute symlink targets are moved below the prefix as
+// well, and relative ones are kept, unless they climb above the root, which
+// stops them when resolved, in which case they are rewritten to lead to the
+// same resource. The directories of the prefix are not included, just as the
+// root is not.
+func Prefix(m *Manifest, prefix string) (*Manifest, error) {
+	prefix = filepath.Join(string(os.PathSeparator), prefix)
+	if prefix == string(os.PathSeparator) {
+		return derived(m, m.Resources), nil
+	}
+
+	resources := make([]Resource, 0, len(m.Resources))
+	for _, r := range m.Resources {
+		b := ResourceToProto(r)
+		for i, p := range b.Path {
+			b.Path[i] = filepath.Join(prefix, p)
+		}
+		if _, ok := r.(SymLink); ok {
+			b.Target = prefixTarget(prefix, r.Path(), b.Target)
+		}
+
+		r, err := ResourceFromProto(b)
+		if err != nil {
+			return nil, err
+		}
+		resources = append(resources, r)
+	}
+
+	return derived(m, resources), nil
+}
+
+// prefixTarget returns the target of the symlink at the path p, once moved
+// below the directory prefix.
+func prefixTarget(prefix, p, target string) string {
+	if strings.HasPrefix(target, string(os.PathSeparator)) {
+		return filepath.Join(prefix, target)
+	}
+
+	dir := filepath.Dir(p)
+	depth := len(strings.Split(dir, string(os.PathSeparator))) - 1
+	if dir == string(os.PathSeparator) {
+		depth = 0
+	}
+	for _, c := range strings.Split(target, string(os.PathSeparator)) {
+		switch c {
+		case "", ".":
+		case "..":
+			if depth--; depth < 0 {
+				// Rooted paths are resolved by Join as the root resolves
+				// them, with ".." stopping at the root.
+				rel, err := filepath.Rel(dir, filepath.Join(dir, target))
+				if err != nil {
+					return target
+				}
+				return rel
+			}
+		default:
+			depth++
+		}
+	}
+	return target
+}
+
+// Prune returns the manifest m without the resources matching any of the
+// patterns, or below a directory that does. Patterns are those of
+// filepath.Match: patterns with a separator are matched against whole paths,
+// relative to the root, and others against the last element of paths, so
+// that "*.log" matches log files anywhere. Hardlinked resources only lose
+// their matching paths.
+func Prune(m *Manifest, patterns ...string) (*Manifest, error) {
+	return prune(m, patterns, false)
+}
+
+// PruneEmptied is like Prune, but also removes the directories that only held
+// pruned resources, and their parents when left empty in turn. Directories
+// that were already empty are kept.
+func PruneEmptied(m *Manifest, patterns ...string) (*Manifest, error) {
+	return prune(m, patterns, true)
+}
+
+func prune(m *Manifest, patterns []string, emptied bool) (*Manifest, error) {
+	patterns, err := compilePatterns(patterns)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		resources []Resource
+		children  = map[string]int{}
+		remaining = map[string]int{}
+	)
+	for _, r := range m.Resources {
+		var paths []string
+		for _, p := range resourcePaths(r) {
+			children[filepath.Dir(p)]++
+			if !matchPatterns(patterns, p) {
+				remaining[filepath.Dir(p)]++
+				paths = append(paths, p)
+			}
+		}
+		if len(paths) == 0 {
+			continue
+		}
+		if len(paths) < len(resourcePaths(r)) {
+			var err error
+			if r, err = withPaths(r, paths); err != nil {
+				return nil, err
+			}
+		}
+		resources = append(resources, r)
+	}
+
+	if emptied {
+		// Resources are sorted by path, so that directories are visited after
+		// their contents in reverse.
+		kept := resources[:0:0]
+		for i := len(resources) - 1; i >= 0; i-- {
+			r := resources[i]
+			if _, ok := r.(Directory); ok && children[r.Path()] > 0 && remaining[r.Path()] == 0 {
+				remaining[filepath.Dir(r.Path())]--
+				continue
+			}
+			kept = append(kept, r)
+		}
+		for i, j := 0, len(kept)-1; i < j; i, j = i+1, j-1 {
+			kept[i], kept[j] = kept[j], kept[i]
+		}
+		resources = kept
+	}
+
+	return derived(m, resources), nil
+}
+
+// Filter returns the manifest m with only the resources matching pred,
+// such as one returned by ParseFilter. Hardlinked resources only keep
+// their matching paths.
+func Filter(m *Manifest, pred Predicate) (*Manifest, error) {
+	var resources []Resource
+	for _, r := range m.Resources {
+		var paths []string
+		for _, p := range resourcePaths(r) {
+			if pred(p, r) {
+				paths = append(paths, p)
+			}
+		}
+		if len(paths) == 0 {
+			continue
+		}
+		if len(paths) < len(resourcePaths(r)) {
+			var err error
+			if r, err = withPaths(r, paths); err != nil {
+				return nil, err
+			}
+		}
+		resources = append(resources, r)
+	}
+	return derived(m, resources), nil
+}
+
+// derived returns the manifest of the resources, derived from m, which is
+// marked as truncated if m is and keeps its provenance and unknown fields.
+func derived(m *Manifest, resources []Resource) *Manifest {
+	h := newHeader(resources)
+	h.Truncated = m.Header.Truncated
+	h.unknown = m.Header.unknown
+	return &Manifest{Resources: resources, Header: h, Provenance: m.Provenance, unknown: m.unknown}
+}
+
+// compilePatterns checks the patterns, as given to Prune, and returns them
+// with those matched against whole paths made absolute.
+func compilePatterns(patterns []string) ([]string, error) {
+	compiled := make([]string, len(patterns))
+	for i, pattern := range patterns {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+		compiled[i] = pattern
+		if strings.ContainsRune(pattern, os.PathSeparator) {
+			compiled[i] = filepath.Join(string(os.PathSeparator), pattern)
+		}
+	}
+	return compiled, nil
+}
+
+// matchPatterns returns true if the path p, or any of its parents, matches
+// any of the compiled patterns.
+func matchPatterns(patterns []string, p string) bool {
+	for ; p != string(os.PathSeparator) && p != "."; p = filepath.Dir(p) {
+		for _, pattern := range patterns {
+			name := p
+			if !strings.ContainsRune(pattern, os.PathSeparator) {
+				name = filepath.Base(p)
+			}
+			if ok, _ := filepath.Match(pattern, name); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// below returns the path p relative to the directory dir, as an absolute
+// path, if p is below dir.
+func below(dir, p string) (string, bool) {
+	if !strings.HasPrefix(p, dir+string(os.PathSeparator)) {
+		return "", false
+	}
+	return p[len(dir):], true
+}
+
+// resourcePaths returns all of the paths of the resource r.
+func resourcePaths(r Resource) []string {
+	if h, ok := r.(Hardlinkable); ok {
+		return h.Paths()
+	}
+	return []string{r.Path()}
+}
+
+// withPaths returns a copy of the resource r with the given paths.
+func withPaths(r Resource, paths []string) (Resource, error) {
+	b := ResourceToProto(r)
+	b.Path = paths
+	return ResourceFromProto(b)
+}
+
+// withMode returns a copy of the resource r with the given mode.
+func withMode(r Resource, mode os.FileMode) (Resource, error) {
+	b := ResourceToProto(r)
+	b.Mode = uint32(mode)
+	b.PosixMode = posixMode(mode)
+	return ResourceFromProto(b)
+}
+
+// Annotate returns a Transformer that adds the annotations returned by fn
+// for each resource to those it has, replacing annotations with the same
+// keys. Resources for which fn returns no annotations are left as they are.
+func Annotate(fn func(Resource) map[string]string) Transformer {
+	return func(r Resource) (Resource, error) {
+		annotations := fn(r)
+		if len(annotations) == 0 {
+			return r, nil
+		}
+
+		b := ResourceToProto(r)
+		if b.Annotations == nil {
+			b.Annotations = make(map[string]string, len(annotations))
+		}
+		for k, v := range annotations {
+			b.Annotations[k] = v
+		}
+		return ResourceFromProto(b)
+	}
+}
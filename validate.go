@@ -0,0 +1,210 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continuity
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	pb "github.com/containerd/continuity/proto"
+	"github.com/opencontainers/go-digest"
+)
+
+// Validate checks that the manifest m is well formed, as manifests built by
+// BuildManifest are, returning all of the problems found:
+//
+//   - resources are sorted by path, and no path appears twice
+//   - paths are clean and absolute, relative to the root, with no ".."
+//     components
+//   - the parent of every path is a directory of the manifest
+//   - digests parse, and sizes are not negative
+//   - symlinks have a target
+//   - devices have a device number, except for whiteouts
+//
+// Hardlinks are resources with more than one path, which the types of
+// resources only allow for files, named pipes and devices.
+func Validate(m *Manifest) error {
+	var (
+		errs []error
+		last string
+		seen = map[string]Resource{}
+	)
+	for _, r := range m.Resources {
+		if r.Path() < last {
+			errs = append(errs, fmt.Errorf("resource %q is not sorted by path after %q", r.Path(), last))
+		}
+		last = r.Path()
+
+		for _, p := range resourcePaths(r) {
+			if _, ok := seen[p]; ok {
+				errs = append(errs, fmt.Errorf("path %q appears more than once", p))
+			}
+			seen[p] = r
+
+			if err := validatePath(p); err != nil {
+				errs = append(errs, err)
+			}
+		}
+
+		switch r := r.(type) {
+		case RegularFile:
+			if r.Size() < 0 {
+				errs = append(errs, fmt.Errorf("file %q has a negative size", r.Path()))
+			}
+			for _, dgst := range r.Digests() {
+				if err := dgst.Validate(); err != nil {
+					errs = append(errs, fmt.Errorf("file %q has an invalid digest %q: %w", r.Path(), dgst, err))
+				}
+			}
+		case SymLink:
+			if r.Target() == "" {
+				errs = append(errs, fmt.Errorf("symlink %q has no target", r.Path()))
+			}
+		case Device:
+			whiteout := r.Mode()&os.ModeCharDevice != 0
+			if !whiteout && r.Major() == 0 && r.Minor() == 0 {
+				errs = append(errs, fmt.Errorf("device %q has no device number", r.Path()))
+			}
+		}
+	}
+
+	paths := make([]string, 0, len(seen))
+	for p := range seen {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		parent := filepath.Dir(p)
+		if parent == p || parent == string(os.PathSeparator) {
+			continue
+		}
+		if _, ok := seen[parent].(Directory); !ok {
+			errs = append(errs, fmt.Errorf("parent of %q is not a directory of the manifest", p))
+		}
+	}
+
+	return joinErrors(errs...)
+}
+
+// checkRecords checks the records of a manifest read in strict mode, failing
+// on the first problem found.
+func checkRecords(records []*pb.Resource, limits StrictLimits) error {
+	var (
+		entries int
+		last    string
+		seen    = map[string]bool{}
+	)
+	for _, b := range records {
+		if len(b.Path) == 0 {
+			return fmt.Errorf("resource record has no path")
+		}
+		if b.Path[0] <= last {
+			return fmt.Errorf("resource %q is not sorted by path after %q", b.Path[0], last)
+		}
+		last = b.Path[0]
+
+		for _, p := range b.Path {
+			entries++
+			if limits.MaxEntries > 0 && entries > limits.MaxEntries {
+				return fmt.Errorf("manifest has more than %d entries: %w", limits.MaxEntries, ErrLimitExceeded)
+			}
+			if limits.MaxPathLength > 0 && len(p) > limits.MaxPathLength {
+				return fmt.Errorf("path %q is longer than %d bytes: %w", p, limits.MaxPathLength, ErrLimitExceeded)
+			}
+			if seen[p] {
+				return fmt.Errorf("path %q appears more than once", p)
+			}
+			seen[p] = true
+
+			if err := checkSafePath(p); err != nil {
+				return err
+			}
+			if err := validatePath(p); err != nil {
+				return err
+			}
+		}
+
+		for _, dgst := range b.Digest {
+			if _, err := digest.Parse(dgst); err != nil {
+				return fmt.Errorf("resource %q has an invalid digest %q: %w", b.Path[0], dgst, err)
+			}
+		}
+	}
+	return nil
+}
+
+// checkSafePath returns an error if the manifest path p could lead outside
+// of the root, as described by WithSafePaths.
+func checkSafePath(p string) error {
+	if strings.IndexByte(p, 0) >= 0 {
+		return fmt.Errorf("path %q holds a NUL byte", p)
+	}
+	if filepath.VolumeName(p) != "" {
+		return fmt.Errorf("path %q names a volume", p)
+	}
+	rest := p
+	if rest != "" && os.IsPathSeparator(rest[0]) {
+		rest = rest[1:]
+	}
+	for i, c := range splitPath(rest) {
+		switch c {
+		case "":
+			if i == 0 {
+				return fmt.Errorf("path %q is empty", p)
+			}
+			return fmt.Errorf("path %q has an empty component", p)
+		case ".", "..":
+			return fmt.Errorf("path %q has a %q component", p, c)
+		}
+	}
+	return nil
+}
+
+// splitPath splits p into its components at every path separator, which
+// are both / and \ on Windows.
+func splitPath(p string) []string {
+	var components []string
+	start := 0
+	for i := 0; i < len(p); i++ {
+		if os.IsPathSeparator(p[i]) {
+			components = append(components, p[start:i])
+			start = i + 1
+		}
+	}
+	return append(components, p[start:])
+}
+
+func validatePath(p string) error {
+	switch {
+	case p == string(os.PathSeparator):
+		return fmt.Errorf("the root has a resource")
+	case !strings.HasPrefix(p, string(os.PathSeparator)):
+		return fmt.Errorf("path %q is not absolute", p)
+	}
+	for _, c := range strings.Split(p, string(os.PathSeparator)) {
+		if c == ".." {
+			return fmt.Errorf("path %q has a \"..\" component", p)
+		}
+	}
+	if filepath.Clean(p) != p {
+		return fmt.Errorf("path %q is not clean", p)
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continuity
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckSafePathSeparators(t *testing.T) {
+	for _, tc := range []struct {
+		path     string
+		expected string
+	}{
+		{path: `\a\b`},
+		{path: `\a\..\b`, expected: "\"..\" component"},
+		{path: `/a\..\b`, expected: "\"..\" component"},
+		{path: `\a/.\b`, expected: "\".\" component"},
+		{path: `\a\\b`, expected: "empty component"},
+	} {
+		err := checkSafePath(tc.path)
+		if tc.expected == "" {
+			if err != nil {
+				t.Errorf("expected %q to be accepted, got %v", tc.path, err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), tc.expected) {
+			t.Errorf("expected %q to be rejected with %q, got %v", tc.path, tc.expected, err)
+		}
+	}
+}
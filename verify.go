@@ -0,0 +1,215 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continuity
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io/fs"
+
+	pb "github.com/containerd/continuity/proto"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// VerifyReport describes how a manifest was verified by VerifyManifest.
+type VerifyReport struct {
+	// Resources is the number of resources verified.
+	Resources int
+
+	// ContentVerified is the number of regular files whose content was
+	// verified, besides their metadata.
+	ContentVerified int
+
+	// Sampling is the sampling used to pick the regular files whose content
+	// was verified, or nil if all were.
+	Sampling *Sampling
+
+	// Failures lists the resources that failed verification, in the order of
+	// the manifest. Verification stops at the first failure, unless
+	// WithAllFailures is given.
+	Failures []VerifyFailure
+
+	// Ignored lists the paths skipped with WithIgnore.
+	Ignored []string
+}
+
+// MarshalJSON encodes the report as the JSON mapping of the VerifyReport
+// protobuf message, with the field names of the message, so that tools can
+// consume it against a schema.
+func (r *VerifyReport) MarshalJSON() ([]byte, error) {
+	return protojson.MarshalOptions{UseProtoNames: true}.Marshal(VerifyReportToProto(r))
+}
+
+// VerifyReportToProto converts a report to its protobuf message.
+func VerifyReportToProto(r *VerifyReport) *pb.VerifyReport {
+	b := &pb.VerifyReport{
+		Resources:       uint64(r.Resources),
+		ContentVerified: uint64(r.ContentVerified),
+	}
+	if r.Sampling != nil {
+		b.Sampling = &pb.Sampling{Percent: r.Sampling.Percent, Seed: r.Sampling.Seed}
+	}
+	for _, f := range r.Failures {
+		bf := &pb.VerifyFailure{
+			Path:    f.Path,
+			Class:   pb.FailureClass(f.Class),
+			Message: f.Message,
+		}
+		for _, field := range f.Fields {
+			bf.Field = append(bf.Field, &pb.FieldMismatch{Name: field.Name, Expected: field.Expected, Actual: field.Actual})
+		}
+		b.Failure = append(b.Failure, bf)
+	}
+	b.Ignored = r.Ignored
+	return b
+}
+
+// FailureClass classifies verification failures.
+type FailureClass int
+
+const (
+	// FailureOther is a failure to verify a resource, such as an I/O error,
+	// rather than a mismatch.
+	FailureOther FailureClass = iota
+	// FailureMissing is a resource missing from the context.
+	FailureMissing
+	// FailureType is a resource of another type than expected.
+	FailureType
+	// FailureMetadata is a resource with other metadata than expected, such
+	// as its mode, owner or xattrs.
+	FailureMetadata
+	// FailureContent is a resource with other content than expected, such
+	// as a file with another digest or a symlink with another target.
+	FailureContent
+	// FailureHardlink is a path that is not a hardlink to its resource.
+	FailureHardlink
+	// FailureMount is a resource with another filesystem mounted at it than
+	// when the manifest was built.
+	FailureMount
+)
+
+func (c FailureClass) String() string {
+	switch c {
+	case FailureOther:
+		return "other"
+	case FailureMissing:
+		return "missing"
+	case FailureType:
+		return "type"
+	case FailureMetadata:
+		return "metadata"
+	case FailureContent:
+		return "content"
+	case FailureHardlink:
+		return "hardlink"
+	case FailureMount:
+		return "mount"
+	}
+	return fmt.Sprintf("FailureClass(%d)", int(c))
+}
+
+// FieldMismatch describes a field of a resource that differs from the
+// manifest. Values are formatted as text, with modes as octal POSIX modes and
+// lists of digests separated by commas, and are empty where absent.
+type FieldMismatch struct {
+	// Name is the name of the field, such as "mode" or "digest". Extended
+	// attributes are named "xattr." followed by the name of the attribute.
+	Name     string
+	Expected string
+	Actual   string
+}
+
+// VerifyFailure describes a resource that failed verification.
+type VerifyFailure struct {
+	Path  string
+	Class FailureClass
+
+	// Fields lists the fields that differ, where known.
+	Fields []FieldMismatch
+
+	// Message is the message of the error returned for the resource.
+	Message string
+}
+
+// VerifyError is the error returned by the verification of a resource that
+// does not match the manifest.
+type VerifyError struct {
+	Path   string
+	Class  FailureClass
+	Fields []FieldMismatch
+
+	msg string
+}
+
+func (e *VerifyError) Error() string {
+	return e.msg
+}
+
+// mismatch returns a VerifyError for the resource at path p, with the field
+// differing, if any, and a message formatted as by fmt.Sprintf.
+func mismatch(p string, class FailureClass, field *FieldMismatch, format string, args ...interface{}) error {
+	err := &VerifyError{Path: p, Class: class, msg: fmt.Sprintf(format, args...)}
+	if field != nil {
+		err.Fields = []FieldMismatch{*field}
+	}
+	return err
+}
+
+// failureOf returns the failure described by the error err of the
+// verification of the resource at path p.
+func failureOf(p string, err error) VerifyFailure {
+	f := VerifyFailure{Path: p, Message: err.Error()}
+
+	var verr *VerifyError
+	switch {
+	case errors.As(err, &verr):
+		f.Class, f.Fields = verr.Class, verr.Fields
+	case errors.Is(err, fs.ErrNotExist):
+		f.Class = FailureMissing
+	}
+	return f
+}
+
+// Sampling selects a reproducible, pseudo-random subset of the regular files
+// of a manifest. Whether a file is part of the sample depends only on the
+// seed and its path, so verifying again with the same sampling checks the
+// same files.
+type Sampling struct {
+	// Percent is the share of files to pick, from 0 to 100.
+	Percent float64
+
+	// Seed selects one of the possible samples.
+	Seed int64
+}
+
+// includes reports whether the resource at path p is part of the sample.
+func (s *Sampling) includes(p string) bool {
+	if s == nil {
+		return true
+	}
+
+	h := fnv.New64a()
+	binary.Write(h, binary.LittleEndian, s.Seed)
+	h.Write([]byte(p))
+
+	// Map the hash to [0, 100) with a resolution of a millionth of a
+	// percent.
+	const scale = 100_000_000
+	return float64(h.Sum64()%scale) < s.Percent*scale/100
+}
@@ -0,0 +1,226 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package verity builds dm-verity hash trees of images, such as filesystem
+// images assembled from continuity manifests, so that the kernel can check
+// the integrity of every block of the image as it is read. The trees are in
+// the format of veritysetup(8), version 1, with a superblock unless left
+// out.
+package verity
+
+import (
+	"bytes"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// Params describes the layout of a hash tree. The zero value describes the
+// defaults of veritysetup, except for the salt, which is empty.
+type Params struct {
+	// DataBlockSize and HashBlockSize are the sizes in bytes of the blocks
+	// of the image and of the hash tree, powers of two between 512 bytes
+	// and 64 KiB. They default to 4096.
+	DataBlockSize int
+	HashBlockSize int
+
+	// Algorithm is the hash algorithm, sha256 by default.
+	Algorithm digest.Algorithm
+
+	// Salt is hashed before every block, up to 256 bytes.
+	Salt []byte
+
+	// UUID identifies the hash tree in its superblock. Trees are only
+	// reproducible if it is set.
+	UUID [16]byte
+
+	// NoSuperblock leaves the superblock out, so that the tree starts at the
+	// beginning of the hash device. The parameters must then be given to
+	// veritysetup when the image is opened.
+	NoSuperblock bool
+}
+
+// Tree describes a hash tree written by Build.
+type Tree struct {
+	// Params are the parameters of the tree, with the defaults filled in.
+	Params Params
+
+	// DataBlocks is the number of blocks of the image.
+	DataBlocks int64
+
+	// RootHash is the hash of the top block of the tree, which is given to
+	// veritysetup or the kernel to open the image.
+	RootHash []byte
+
+	// Size is the number of bytes of the hash device written.
+	Size int64
+}
+
+// superblockSize is the size of the veritysetup superblock, which is padded
+// to a hash block.
+const superblockSize = 512
+
+// Build reads the image of size bytes from data and writes its hash tree to
+// w. The size must be a multiple of the data block size, as dm-verity only
+// protects whole blocks.
+func Build(w io.Writer, data io.Reader, size int64, p Params) (*Tree, error) {
+	if err := p.setDefaults(); err != nil {
+		return nil, err
+	}
+	if size <= 0 || size%int64(p.DataBlockSize) != 0 {
+		return nil, fmt.Errorf("image size %d is not a positive multiple of the data block size %d", size, p.DataBlockSize)
+	}
+
+	h := p.Algorithm.Hash()
+	slot := digestSlot(h.Size())
+	perBlock := int64(p.HashBlockSize / slot)
+	t := &Tree{Params: p, DataBlocks: size / int64(p.DataBlockSize)}
+
+	// The hashes of the blocks of each level, from the data up, are kept
+	// until the top is reached, since the levels are written top down.
+	var (
+		levels [][]byte
+		hashes = make([]byte, 0, t.DataBlocks*int64(slot))
+		block  = make([]byte, p.DataBlockSize)
+	)
+	for i := int64(0); i < t.DataBlocks; i++ {
+		if _, err := io.ReadFull(data, block); err != nil {
+			return nil, fmt.Errorf("failed to read block %d of the image: %w", i, err)
+		}
+		hashes = appendHash(hashes, h, p.Salt, block, slot)
+	}
+	for count := t.DataBlocks; count > 1; count = (count + perBlock - 1) / perBlock {
+		level := hashBlocks(hashes, p.HashBlockSize)
+		levels = append(levels, level)
+
+		hashes = hashes[:0:0]
+		for off := 0; off < len(level); off += p.HashBlockSize {
+			hashes = appendHash(hashes, h, p.Salt, level[off:off+p.HashBlockSize], slot)
+		}
+	}
+	t.RootHash = hashes[:h.Size()]
+
+	cw := &countingWriter{w: w}
+	if !p.NoSuperblock {
+		sb := make([]byte, p.HashBlockSize)
+		copy(sb, superblock(p, t.DataBlocks))
+		if _, err := cw.Write(sb); err != nil {
+			return nil, err
+		}
+	}
+	for i := len(levels) - 1; i >= 0; i-- {
+		if _, err := cw.Write(levels[i]); err != nil {
+			return nil, err
+		}
+	}
+	t.Size = cw.n
+	return t, nil
+}
+
+func (p *Params) setDefaults() error {
+	if p.DataBlockSize == 0 {
+		p.DataBlockSize = 4096
+	}
+	if p.HashBlockSize == 0 {
+		p.HashBlockSize = 4096
+	}
+	if p.Algorithm == "" {
+		p.Algorithm = digest.SHA256
+	}
+	for _, size := range []int{p.DataBlockSize, p.HashBlockSize} {
+		if size < 512 || size > 64<<10 || size&(size-1) != 0 {
+			return fmt.Errorf("invalid block size %d", size)
+		}
+	}
+	if !p.Algorithm.Available() {
+		return fmt.Errorf("unsupported hash algorithm %q", p.Algorithm)
+	}
+	if digestSlot(p.Algorithm.Size()) > p.HashBlockSize/2 {
+		return fmt.Errorf("hash block size %d is too small for %s", p.HashBlockSize, p.Algorithm)
+	}
+	if len(p.Salt) > 256 {
+		return errors.New("salt is longer than 256 bytes")
+	}
+	return nil
+}
+
+// digestSlot returns the space taken by a hash of size bytes in hash
+// blocks, the smallest power of two that holds it.
+func digestSlot(size int) int {
+	slot := 1
+	for slot < size {
+		slot <<= 1
+	}
+	return slot
+}
+
+// appendHash appends the hash of the salt and block to hashes, padded with
+// zeros to slot bytes.
+func appendHash(hashes []byte, h hash.Hash, salt, block []byte, slot int) []byte {
+	h.Reset()
+	h.Write(salt)
+	h.Write(block)
+	hashes = h.Sum(hashes)
+	return append(hashes, make([]byte, slot-h.Size())...)
+}
+
+// hashBlocks packs the hashes into hash blocks of the given size, padding
+// the last with zeros.
+func hashBlocks(hashes []byte, size int) []byte {
+	blocks := (len(hashes) + size - 1) / size
+	level := make([]byte, blocks*size)
+	copy(level, hashes)
+	return level
+}
+
+// superblock returns the veritysetup superblock describing the tree.
+func superblock(p Params, dataBlocks int64) []byte {
+	var sb bytes.Buffer
+	sb.WriteString("verity\x00\x00")
+	binary.Write(&sb, binary.LittleEndian, uint32(1)) // version
+	binary.Write(&sb, binary.LittleEndian, uint32(1)) // hash type
+	sb.Write(p.UUID[:])
+	algorithm := make([]byte, 32)
+	copy(algorithm, p.Algorithm)
+	sb.Write(algorithm)
+	binary.Write(&sb, binary.LittleEndian, uint32(p.DataBlockSize))
+	binary.Write(&sb, binary.LittleEndian, uint32(p.HashBlockSize))
+	binary.Write(&sb, binary.LittleEndian, uint64(dataBlocks))
+	binary.Write(&sb, binary.LittleEndian, uint16(len(p.Salt)))
+	sb.Write(make([]byte, 6))
+	salt := make([]byte, 256)
+	copy(salt, p.Salt)
+	sb.Write(salt)
+	sb.Write(make([]byte, superblockSize-sb.Len()))
+	return sb.Bytes()
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,104 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package verity
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"testing"
+)
+
+func TestBuild(t *testing.T) {
+	salt := []byte("salt")
+	hash := func(block []byte) []byte {
+		h := sha256.New()
+		h.Write(salt)
+		h.Write(block)
+		return h.Sum(nil)
+	}
+	image := func(blocks int) []byte {
+		data := make([]byte, blocks*4096)
+		for i := range data {
+			data[i] = byte(i / 4096)
+		}
+		return data
+	}
+
+	// A single block is checked against the root hash directly.
+	data := image(1)
+	var buf bytes.Buffer
+	tree, err := Build(&buf, bytes.NewReader(data), int64(len(data)), Params{Salt: salt, NoSuperblock: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != 0 || !bytes.Equal(tree.RootHash, hash(data)) {
+		t.Fatalf("unexpected tree of a block: %d bytes, root %x", buf.Len(), tree.RootHash)
+	}
+
+	// Two blocks share a hash block, under the root.
+	data = image(2)
+	buf.Reset()
+	if tree, err = Build(&buf, bytes.NewReader(data), int64(len(data)), Params{Salt: salt, NoSuperblock: true}); err != nil {
+		t.Fatal(err)
+	}
+	level := make([]byte, 4096)
+	copy(level, hash(data[:4096]))
+	copy(level[32:], hash(data[4096:]))
+	if !bytes.Equal(buf.Bytes(), level) || !bytes.Equal(tree.RootHash, hash(level)) {
+		t.Fatalf("unexpected tree of two blocks: root %x", tree.RootHash)
+	}
+
+	// More blocks than a hash block holds hashes of take two levels, written
+	// top down after the superblock.
+	data = image(129)
+	buf.Reset()
+	if tree, err = Build(&buf, bytes.NewReader(data), int64(len(data)), Params{Salt: salt}); err != nil {
+		t.Fatal(err)
+	}
+	if tree.DataBlocks != 129 || tree.Size != 4*4096 || int64(buf.Len()) != tree.Size {
+		t.Fatalf("unexpected tree of %d blocks, %d bytes", tree.DataBlocks, tree.Size)
+	}
+	out := buf.Bytes()
+	low := out[2*4096:]
+	for i := 0; i < 129; i++ {
+		if !bytes.Equal(low[i*32:i*32+32], hash(data[i*4096:(i+1)*4096])) {
+			t.Fatalf("unexpected hash of block %d", i)
+		}
+	}
+	top := make([]byte, 4096)
+	copy(top, hash(low[:4096]))
+	copy(top[32:], hash(low[4096:]))
+	if !bytes.Equal(out[4096:2*4096], top) || !bytes.Equal(tree.RootHash, hash(top)) {
+		t.Fatal("unexpected top level")
+	}
+
+	sb := out[:512]
+	if string(sb[:8]) != "verity\x00\x00" || string(sb[32:38]) != "sha256" {
+		t.Fatalf("unexpected superblock %q", sb[:64])
+	}
+	if blocks := binary.LittleEndian.Uint64(sb[72:]); blocks != 129 {
+		t.Fatalf("unexpected data block count %d", blocks)
+	}
+	if n := binary.LittleEndian.Uint16(sb[80:]); n != 4 || !bytes.Equal(sb[88:92], salt) {
+		t.Fatalf("unexpected salt %q", sb[88:88+n])
+	}
+
+	if _, err := Build(&buf, bytes.NewReader(data), 100, Params{}); err == nil {
+		t.Fatal("expected a partial block to be rejected")
+	}
+}
@@ -0,0 +1,58 @@
+//go:build !windows
+// +build !windows
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continuity
+
+import (
+	"os"
+	"syscall"
+
+	driverpkg "github.com/containerd/continuity/driver"
+)
+
+// deviceID returns the id of the device containing the resource described by
+// fi. If the device cannot be determined, false is returned.
+func deviceID(fi os.FileInfo) (uint64, bool) {
+	sys, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+
+	//nolint:unconvert
+	return uint64(sys.Dev), true
+}
+
+// changeID returns the inode number and the status change time, in
+// nanoseconds, of the file described by fi, which change when the file is
+// replaced or when its content or metadata change. Zeros are returned where
+// they are not known.
+func changeID(fi os.FileInfo) (uint64, int64) {
+	if st, ok := fi.Sys().(*driverpkg.FileStat); ok {
+		return st.Ino, 0
+	}
+
+	sys, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0
+	}
+
+	ctime := statCtime(sys)
+	//nolint:unconvert
+	return uint64(sys.Ino), ctime.Nano()
+}
@@ -0,0 +1,31 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continuity
+
+import "os"
+
+// deviceID returns the id of the device containing the resource described by
+// fi. Device ids are not available on Windows, so false is always returned.
+func deviceID(fi os.FileInfo) (uint64, bool) {
+	return 0, false
+}
+
+// changeID returns the inode number and the status change time of the file
+// described by fi. Neither is available on Windows, so zeros are returned.
+func changeID(fi os.FileInfo) (uint64, int64) {
+	return 0, 0
+}
@@ -0,0 +1,161 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continuity
+
+import (
+	stdcontext "context"
+	"time"
+)
+
+// DriftEvent reports a change in whether a resource matches its manifest.
+type DriftEvent struct {
+	// Path is the path of the resource.
+	Path string
+
+	// Err describes how the resource differs from the manifest. It is nil
+	// if Resolved is set.
+	Err error
+
+	// Resolved is set when a resource that had drifted matches the manifest
+	// again.
+	Resolved bool
+
+	// Time is when the change was detected.
+	Time time.Time
+}
+
+// Watcher verifies a context against a manifest continuously, reporting
+// resources as they drift from the manifest and as they are restored.
+//
+// All resources are verified when the watcher starts and then at every
+// interval. On Linux, the directories of the manifest are also watched with
+// inotify, so that changed resources are verified again right away.
+type Watcher struct {
+	// Context is the context to verify.
+	Context Context
+
+	// Manifest is the manifest to verify the context against.
+	Manifest *Manifest
+
+	// Interval is the time between verifications of all resources. If zero,
+	// all resources are only verified at the start, and changes are only
+	// noticed through inotify.
+	Interval time.Duration
+
+	// OnDrift is called with every drift event, from the goroutine calling
+	// Run.
+	OnDrift func(DriftEvent)
+
+	resources map[string]Resource
+	drifted   map[string]bool
+}
+
+// Run watches the context until ctx is done, returning its error. It also
+// returns if changes can no longer be watched, with the error that stopped
+// them.
+func (w *Watcher) Run(ctx stdcontext.Context) error {
+	w.resources = map[string]Resource{}
+	w.drifted = map[string]bool{}
+	for _, resource := range w.Manifest.Resources {
+		paths := []string{resource.Path()}
+		if h, ok := resource.(Hardlinkable); ok {
+			paths = h.Paths()
+		}
+		for _, p := range paths {
+			w.resources[p] = resource
+		}
+	}
+
+	var (
+		changes <-chan string
+		errs    <-chan error
+	)
+	if c, ok := w.Context.(*context); ok {
+		notifier, err := newChangeNotifier(c, w.Manifest)
+		if err != nil {
+			return err
+		}
+		if notifier != nil {
+			defer notifier.Close()
+			changes = notifier.Changes()
+			errs = notifier.Errors()
+		}
+	}
+
+	var tick <-chan time.Time
+	if w.Interval > 0 {
+		ticker := time.NewTicker(w.Interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	w.verifyAll()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-errs:
+			return err
+		case <-tick:
+			w.verifyAll()
+		case p := <-changes:
+			if p == "" {
+				// Changes were lost.
+				w.verifyAll()
+			} else if resource, ok := w.resources[p]; ok {
+				w.verify(resource)
+			}
+		}
+	}
+}
+
+// changeNotifier reports the paths of resources that may have changed.
+type changeNotifier interface {
+	// Changes returns a channel of paths of resources that may have
+	// changed. An empty path means that changes may have been missed.
+	Changes() <-chan string
+	// Errors returns a channel of the error that stops the notifier, if
+	// any.
+	Errors() <-chan error
+	Close() error
+}
+
+func (w *Watcher) verifyAll() {
+	for _, resource := range w.Manifest.Resources {
+		w.verify(resource)
+	}
+}
+
+// verify verifies the resource, reporting any change in its drift.
+func (w *Watcher) verify(resource Resource) {
+	err := w.Context.Verify(resource)
+	p := resource.Path()
+	switch {
+	case err != nil && !w.drifted[p]:
+		w.drifted[p] = true
+		w.emit(DriftEvent{Path: p, Err: err, Time: time.Now()})
+	case err == nil && w.drifted[p]:
+		delete(w.drifted, p)
+		w.emit(DriftEvent{Path: p, Resolved: true, Time: time.Now()})
+	}
+}
+
+func (w *Watcher) emit(event DriftEvent) {
+	if w.OnDrift != nil {
+		w.OnDrift(event)
+	}
+}
@@ -0,0 +1,222 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continuity
+
+import (
+	"errors"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const inotifyMask = unix.IN_ATTRIB | unix.IN_CLOSE_WRITE | unix.IN_CREATE | unix.IN_DELETE |
+	unix.IN_DELETE_SELF | unix.IN_MODIFY | unix.IN_MOVED_FROM | unix.IN_MOVED_TO | unix.IN_ONLYDIR
+
+// inotifyNotifier watches the directories of a manifest with inotify.
+// Directories of the manifest that are created while watching are watched
+// from then on.
+type inotifyNotifier struct {
+	fd      int
+	context *context
+	paths   []string         // sorted resource paths of the directories of the manifest
+	dirs    map[int32]string // resource paths of the watched directories
+	changes chan string
+	errs    chan error
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+func newChangeNotifier(c *context, manifest *Manifest) (changeNotifier, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, &os.SyscallError{Syscall: "inotify_init1", Err: err}
+	}
+
+	n := &inotifyNotifier{
+		fd:      fd,
+		context: c,
+		paths:   []string{"/"},
+		dirs:    map[int32]string{},
+		changes: make(chan string),
+		errs:    make(chan error),
+		done:    make(chan struct{}),
+	}
+
+	for _, resource := range manifest.Resources {
+		if _, ok := resource.(Directory); ok && resource.Path() != "/" {
+			n.paths = append(n.paths, resource.Path())
+		}
+	}
+	sort.Strings(n.paths)
+	if err := n.watchTree("/"); err != nil {
+		n.Close()
+		return nil, err
+	}
+
+	n.wg.Add(1)
+	go n.run()
+	return n, nil
+}
+
+// watchTree watches the directory of the manifest at dir and those below it,
+// as far as they exist.
+func (n *inotifyNotifier) watchTree(dir string) error {
+	prefix := strings.TrimSuffix(dir, "/") + "/"
+	for i := sort.SearchStrings(n.paths, dir); i < len(n.paths); i++ {
+		p := n.paths[i]
+		if p != dir && !strings.HasPrefix(p, prefix) {
+			break
+		}
+
+		fp, err := n.context.fullpath(p)
+		if err != nil {
+			return err
+		}
+
+		wd, err := unix.InotifyAddWatch(n.fd, fp, inotifyMask)
+		if err != nil {
+			if errors.Is(err, unix.ENOENT) || errors.Is(err, unix.ENOTDIR) {
+				// The drift is found by verification.
+				continue
+			}
+			return &os.PathError{Op: "inotify_add_watch", Path: fp, Err: err}
+		}
+		n.dirs[int32(wd)] = p
+	}
+	return nil
+}
+
+// isDir returns whether p is a directory of the manifest.
+func (n *inotifyNotifier) isDir(p string) bool {
+	i := sort.SearchStrings(n.paths, p)
+	return i < len(n.paths) && n.paths[i] == p
+}
+
+func (n *inotifyNotifier) Changes() <-chan string {
+	return n.changes
+}
+
+func (n *inotifyNotifier) Errors() <-chan error {
+	return n.errs
+}
+
+func (n *inotifyNotifier) run() {
+	defer n.wg.Done()
+
+	buf := make([]byte, 64*1024)
+	fds := []unix.PollFd{{Fd: int32(n.fd), Events: unix.POLLIN}}
+	for {
+		select {
+		case <-n.done:
+			return
+		default:
+		}
+
+		// Wake up regularly to notice Close.
+		if _, err := unix.Poll(fds, 500); err != nil && !errors.Is(err, unix.EINTR) {
+			n.fail(&os.SyscallError{Syscall: "poll", Err: err})
+			return
+		}
+
+		r, err := unix.Read(n.fd, buf)
+		if err != nil {
+			if errors.Is(err, unix.EAGAIN) || errors.Is(err, unix.EINTR) {
+				continue
+			}
+			n.fail(&os.SyscallError{Syscall: "read", Err: err})
+			return
+		}
+
+		for off := 0; off+unix.SizeofInotifyEvent <= r; {
+			event := (*unix.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			name := buf[off+unix.SizeofInotifyEvent : off+unix.SizeofInotifyEvent+int(event.Len)]
+			off += unix.SizeofInotifyEvent + int(event.Len)
+
+			if event.Mask&unix.IN_Q_OVERFLOW != 0 {
+				n.send("")
+				continue
+			}
+
+			dir, ok := n.dirs[event.Wd]
+			if !ok {
+				continue
+			}
+			if event.Mask&unix.IN_IGNORED != 0 {
+				// The directory is gone, and so is its watch.
+				delete(n.dirs, event.Wd)
+				continue
+			}
+			if i := indexNUL(name); i >= 0 {
+				name = name[:i]
+			}
+			if len(name) == 0 {
+				// The directory itself changed.
+				n.send(dir)
+				continue
+			}
+
+			p := path.Join(dir, string(name))
+			if event.Mask&unix.IN_ISDIR != 0 && event.Mask&(unix.IN_CREATE|unix.IN_MOVED_TO) != 0 && n.isDir(p) {
+				if err := n.watchTree(p); err != nil {
+					n.fail(err)
+					return
+				}
+				// Entries created in the directory before it was watched
+				// are not reported.
+				n.send("")
+				continue
+			}
+			n.send(p)
+		}
+	}
+}
+
+// fail passes err on, unless the notifier is closed.
+func (n *inotifyNotifier) fail(err error) {
+	select {
+	case n.errs <- err:
+	case <-n.done:
+	}
+}
+
+// send passes p on, unless the notifier is closed.
+func (n *inotifyNotifier) send(p string) {
+	select {
+	case n.changes <- p:
+	case <-n.done:
+	}
+}
+
+func (n *inotifyNotifier) Close() error {
+	close(n.done)
+	n.wg.Wait()
+	return unix.Close(n.fd)
+}
+
+func indexNUL(b []byte) int {
+	for i, c := range b {
+		if c == 0 {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,339 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package ziparchive converts between zip archives and manifests. NewFS
+// gives the file system of an archive to build manifests of it with
+// continuity.NewContextFS, and Write writes the archive of a manifest with
+// the content of its regular files from a content provider.
+//
+// Zip archives carry the paths, modes and content of files and symbolic
+// links, and ownership in the Info-ZIP Unix extra field. What else a
+// manifest may hold is reported as dropped by Write.
+package ziparchive
+
+import (
+	"archive/zip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/containerd/continuity"
+	"github.com/containerd/continuity/driver"
+	"github.com/containerd/continuity/internal/imagetree"
+)
+
+// unixExtraID is the id of the Info-ZIP extra field holding the uid and gid
+// of an entry.
+const unixExtraID = 0x7875
+
+// NewFS returns the file system of the zip archive r. Unlike r itself, it
+// reads symbolic links, stored as entries holding their targets, keeps the
+// modes of directories, and gives the ownership of entries in the Sys
+// method of their fs.FileInfo, as continuity.NewContextFS expects.
+func NewFS(r *zip.Reader) fs.FS {
+	z := &zipFS{r: r, files: map[string]*zip.File{}}
+	for _, f := range r.File {
+		z.files[strings.TrimSuffix(f.Name, "/")] = f
+	}
+	return z
+}
+
+type zipFS struct {
+	r     *zip.Reader
+	files map[string]*zip.File
+}
+
+var (
+	_ fs.ReadDirFS          = &zipFS{}
+	_ fs.StatFS             = &zipFS{}
+	_ continuity.ReadLinkFS = &zipFS{}
+)
+
+func (z *zipFS) Open(name string) (fs.File, error) {
+	return z.r.Open(name)
+}
+
+func (z *zipFS) Stat(name string) (fs.FileInfo, error) {
+	fi, err := fs.Stat(z.r, name)
+	if err != nil {
+		return nil, err
+	}
+	return z.info(name, fi), nil
+}
+
+// Lstat is Stat, since zip archives do not follow symbolic links.
+func (z *zipFS) Lstat(name string) (fs.FileInfo, error) {
+	return z.Stat(name)
+}
+
+func (z *zipFS) ReadLink(name string) (string, error) {
+	fi, err := fs.Stat(z.r, name)
+	if err != nil {
+		return "", err
+	}
+	if fi.Mode()&fs.ModeSymlink == 0 {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+	target, err := fs.ReadFile(z.r, name)
+	return string(target), err
+}
+
+func (z *zipFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	entries, err := fs.ReadDir(z.r, name)
+	if err != nil {
+		return nil, err
+	}
+	for i, entry := range entries {
+		entries[i] = dirEntry{DirEntry: entry, fsys: z, name: path.Join(name, entry.Name())}
+	}
+	return entries, nil
+}
+
+// info returns fi, with the mode and ownership recorded in the entry name,
+// if the archive holds one. Directories the archive only implies have none.
+func (z *zipFS) info(name string, fi fs.FileInfo) fs.FileInfo {
+	f, ok := z.files[name]
+	if !ok {
+		return fi
+	}
+	return fileInfo{FileInfo: fi, mode: f.Mode(), stat: parseOwner(f.Extra)}
+}
+
+type dirEntry struct {
+	fs.DirEntry
+	fsys *zipFS
+	name string
+}
+
+func (e dirEntry) Info() (fs.FileInfo, error) {
+	fi, err := e.DirEntry.Info()
+	if err != nil {
+		return nil, err
+	}
+	return e.fsys.info(e.name, fi), nil
+}
+
+type fileInfo struct {
+	fs.FileInfo
+	mode fs.FileMode
+	stat *driver.FileStat
+}
+
+func (fi fileInfo) Mode() fs.FileMode {
+	return fi.mode
+}
+
+func (fi fileInfo) Sys() interface{} {
+	if fi.stat == nil {
+		return nil
+	}
+	return fi.stat
+}
+
+// parseOwner returns the ownership held in the extra fields of an entry,
+// or nil if they hold none.
+func parseOwner(extra []byte) *driver.FileStat {
+	for len(extra) >= 4 {
+		id, size := binary.LittleEndian.Uint16(extra), int(binary.LittleEndian.Uint16(extra[2:]))
+		if len(extra) < 4+size {
+			return nil
+		}
+		field := extra[4 : 4+size]
+		extra = extra[4+size:]
+		if id != unixExtraID || len(field) < 1 || field[0] != 1 {
+			continue
+		}
+
+		// The field holds the version, then the sizes and values of the
+		// uid and the gid.
+		var ids [2]int64
+		field = field[1:]
+		for i := range ids {
+			if len(field) < 1 || len(field) < 1+int(field[0]) || field[0] > 8 {
+				return nil
+			}
+			for j := int(field[0]); j > 0; j-- {
+				ids[i] = ids[i]<<8 | int64(field[j])
+			}
+			field = field[1+int(field[0]):]
+		}
+		return &driver.FileStat{UID: ids[0], GID: ids[1]}
+	}
+	return nil
+}
+
+// ownerExtra returns the extra field holding the ownership of an entry.
+func ownerExtra(uid, gid uint32) []byte {
+	b := binary.LittleEndian.AppendUint16(nil, unixExtraID)
+	b = binary.LittleEndian.AppendUint16(b, 11)
+	b = append(b, 1, 4)
+	b = binary.LittleEndian.AppendUint32(b, uid)
+	b = append(b, 4)
+	return binary.LittleEndian.AppendUint32(b, gid)
+}
+
+// Options controls how archives are written.
+type Options struct {
+	// ModTime is recorded as the modification time of all entries, since
+	// manifests do not record them. It defaults to 1980-01-01, the earliest
+	// time zip archives can hold.
+	ModTime time.Time
+
+	// Strict fails writing archives of manifests holding metadata zip
+	// archives cannot carry, rather than dropping it.
+	Strict bool
+}
+
+// Dropped describes metadata of a path of a manifest left out of an archive.
+type Dropped struct {
+	Path string
+
+	// Metadata says what was left out, such as "extended attributes".
+	Metadata string
+}
+
+func (d Dropped) String() string {
+	return d.Path + ": " + d.Metadata
+}
+
+// node is a path of the archive.
+type node = imagetree.Node[inode]
+
+type inode struct {
+	// first is the first path of hardlinked files, written before the
+	// others.
+	first string
+}
+
+// Write writes the zip archive of the manifest to w, reading the content of
+// regular files from the provider, and returns what the archive could not
+// carry. Entries are written in the order of their paths, with parents
+// first, adding the directories missing from the manifest as
+// imagetree.Build does.
+//
+// Devices and named pipes are left out, and the paths of hardlinked files
+// after the first are written as copies of it. Extended attributes, birth
+// times, Windows file attributes and project ids are dropped. With
+// Options.Strict, any of these fails the archive instead.
+func Write(w io.Writer, m *continuity.Manifest, provider continuity.ContentProvider, opts Options) ([]Dropped, error) {
+	root, err := imagetree.Build[inode](m)
+	if err != nil {
+		return nil, err
+	}
+	if opts.ModTime.IsZero() {
+		opts.ModTime = time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)
+	}
+
+	var dropped []Dropped
+	drop := func(n *node, metadata string) error {
+		if opts.Strict {
+			return fmt.Errorf("%s: zip archives cannot carry %s", n.Path, metadata)
+		}
+		dropped = append(dropped, Dropped{Path: n.Path, Metadata: metadata})
+		return nil
+	}
+
+	zw := zip.NewWriter(w)
+	if err := root.Walk(func(n *node) error {
+		if n == root {
+			return nil
+		}
+		if err := checkDropped(n, drop); err != nil {
+			return err
+		}
+		switch n.Resource.(type) {
+		case continuity.Device:
+			return drop(n, "device")
+		case continuity.NamedPipe:
+			return drop(n, "named pipe")
+		}
+		if n.Inode.first != "" {
+			if err := drop(n, "hardlink to "+n.Inode.first+", written as a copy"); err != nil {
+				return err
+			}
+		} else {
+			n.Inode.first = n.Path
+		}
+
+		if err := writeEntry(zw, n, provider, opts.ModTime); err != nil {
+			return fmt.Errorf("failed to write %s: %w", n.Path, err)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return dropped, nil
+}
+
+// checkDropped reports the metadata of n zip archives cannot carry.
+func checkDropped(n *node, drop func(*node, string) error) error {
+	if xa, ok := n.Resource.(continuity.XAttrer); ok && len(xa.XAttrs()) > 0 {
+		if err := drop(n, "extended attributes"); err != nil {
+			return err
+		}
+	}
+	if bt, ok := n.Resource.(continuity.BirthTimer); ok && !bt.BirthTime().IsZero() {
+		if err := drop(n, "birth time"); err != nil {
+			return err
+		}
+	}
+	if fa, ok := n.Resource.(continuity.FileAttributer); ok && fa.FileAttributes() != 0 {
+		if err := drop(n, "Windows file attributes"); err != nil {
+			return err
+		}
+	}
+	if p, ok := n.Resource.(continuity.ProjectIDer); ok && p.ProjectID() != 0 {
+		if err := drop(n, "project id"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeEntry(zw *zip.Writer, n *node, provider continuity.ContentProvider, modTime time.Time) error {
+	hdr := &zip.FileHeader{
+		Name:     n.Path[1:],
+		Modified: modTime,
+		Extra:    ownerExtra(n.UID, n.GID),
+	}
+	hdr.SetMode(n.Mode)
+	if n.IsDir() {
+		hdr.Name += "/"
+	}
+	if _, ok := n.Resource.(continuity.RegularFile); ok {
+		hdr.Method = zip.Deflate
+	}
+
+	fw, err := zw.CreateHeader(hdr)
+	if err != nil {
+		return err
+	}
+	switch r := n.Resource.(type) {
+	case continuity.SymLink:
+		_, err = io.WriteString(fw, r.Target())
+		return err
+	case continuity.RegularFile:
+		return imagetree.CopyContent(fw, provider, r)
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ziparchive
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/containerd/continuity"
+	"github.com/containerd/continuity/testutil"
+	"github.com/opencontainers/go-digest"
+)
+
+func TestRoundTrip(t *testing.T) {
+	content := []byte("hello\n")
+	dgst := digest.FromBytes(content)
+	provider := testutil.MapProvider{dgst: content}
+
+	must := func(r continuity.Resource, err error) continuity.Resource {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+	m := &continuity.Manifest{Resources: []continuity.Resource{
+		must(continuity.NewDirectory("/a", continuity.Attributes{Mode: 0o700, UID: 1000, GID: 100})),
+		must(continuity.NewRegularFile([]string{"/a/b"}, continuity.Attributes{Mode: os.ModeSetuid | 0o755, XAttrs: map[string][]byte{"user.foo": []byte("bar")}}, int64(len(content)), dgst)),
+		must(continuity.NewDevice([]string{"/dev"}, continuity.Attributes{Mode: 0o600}, true, 1, 3)),
+		must(continuity.NewSymLink("/link", continuity.Attributes{Mode: 0o777}, "a/b")),
+		must(continuity.NewRegularFile([]string{"/x", "/y"}, continuity.Attributes{Mode: 0o644}, int64(len(content)), dgst)),
+	}}
+
+	var buf bytes.Buffer
+	dropped, err := Write(&buf, m, provider, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, d := range dropped {
+		got = append(got, d.String())
+	}
+	expected := []string{
+		"/a/b: extended attributes",
+		"/dev: device",
+		"/y: hardlink to /x, written as a copy",
+	}
+	if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("unexpected dropped metadata: %q", got)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, err := continuity.NewContextFS(NewFS(zr), continuity.ContextOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	built, err := continuity.BuildManifest(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var paths []string
+	for _, r := range built.Resources {
+		paths = append(paths, r.Path())
+	}
+	if strings.Join(paths, " ") != "/a /a/b /link /x /y" {
+		t.Fatalf("unexpected resources: %v", paths)
+	}
+	if a := built.Resources[0]; a.Mode() != os.ModeDir|0o700 || a.UID() != 1000 || a.GID() != 100 {
+		t.Fatalf("unexpected directory: %v %d:%d", a.Mode(), a.UID(), a.GID())
+	}
+	if b := built.Resources[1].(continuity.RegularFile); b.Mode() != os.ModeSetuid|0o755 || b.Digests()[0] != dgst {
+		t.Fatalf("unexpected file: %v %v", b.Mode(), b.Digests())
+	}
+	if target := built.Resources[2].(continuity.SymLink).Target(); target != "a/b" {
+		t.Fatalf("unexpected link target %q", target)
+	}
+	if y := built.Resources[4].(continuity.RegularFile); y.Digests()[0] != dgst {
+		t.Fatalf("unexpected copy of hardlinked file: %v", y.Digests())
+	}
+
+	// Strict archives fail rather than drop metadata.
+	if _, err := Write(io.Discard, m, provider, Options{Strict: true}); err == nil || !strings.Contains(err.Error(), "extended attributes") {
+		t.Fatalf("expected an error for extended attributes, got %v", err)
+	}
+}